@@ -82,46 +82,7 @@ func setupTestServer(t *testing.T) (*httptest.Server, *server.Server) {
 	})
 
 	// SSE endpoint
-	mux.HandleFunc("/__sse", func(w http.ResponseWriter, r *http.Request) {
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
-			return
-		}
-
-		channel := r.URL.Query().Get("channel")
-		if channel == "" {
-			http.Error(w, "missing channel", http.StatusBadRequest)
-			return
-		}
-
-		client := hub.Subscribe(channel)
-		defer hub.Unsubscribe(channel, client)
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		_, _ = w.Write([]byte(": connected\n\n"))
-		flusher.Flush()
-
-		for {
-			select {
-			case ev := <-client.Ch():
-				if ev.Event != "" {
-					_, _ = w.Write([]byte("event: " + ev.Event + "\n"))
-				}
-				_, _ = w.Write([]byte("data: "))
-				_, _ = w.Write(ev.Data)
-				_, _ = w.Write([]byte("\n\n"))
-				flusher.Flush()
-			case <-r.Context().Done():
-				return
-			case <-client.Done():
-				return
-			}
-		}
-	})
+	mux.Handle("/__sse", hub)
 
 	// SSE publish endpoint
 	mux.HandleFunc("/__sse/publish", func(w http.ResponseWriter, r *http.Request) {
@@ -370,6 +331,21 @@ func TestSSEPublishEndpoint(t *testing.T) {
 		t.Fatalf("expected 202, got %d", resp2.StatusCode)
 	}
 
+	// Test POST with a batch of events
+	batch, _ := json.Marshal(map[string]interface{}{
+		"channel": "test",
+		"event":   "test-event",
+		"batch":   []int{1, 2, 3},
+	})
+	respBatch, err := http.Post(ts.URL+"/__sse/publish", "application/json", bytes.NewReader(batch))
+	if err != nil {
+		t.Fatalf("POST /__sse/publish: %v", err)
+	}
+	defer respBatch.Body.Close()
+	if respBatch.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 for a batch, got %d", respBatch.StatusCode)
+	}
+
 	// Test POST with missing channel
 	body2 := map[string]interface{}{
 		"event": "test-event",
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultListenAddr = ":8080"
+
+// ListenConfig says where the HTTP server binds and whether it serves TLS.
+type ListenConfig struct {
+	Addr string
+
+	// CertFile and KeyFile enable HTTPS (and with it HTTP/2).
+	CertFile string
+	KeyFile  string
+
+	// SelfSigned serves HTTPS with a throwaway certificate for localhost,
+	// generated at startup. Meant for local development only.
+	SelfSigned bool
+}
+
+// TLS reports whether the server should terminate TLS itself.
+func (lc ListenConfig) TLS() bool {
+	return lc.SelfSigned || lc.CertFile != ""
+}
+
+// Options are the command-line settings of the server binary.
+type Options struct {
+	Listen ListenConfig
+
+	// ConfigFile is the JSON config to load; "" means go_appserver.json
+	// in the project root.
+	ConfigFile string
+
+	// Root is the project root holding php/worker.php; "" means the
+	// closest directory with a go.mod at or above the working directory.
+	Root string
+}
+
+// parseOptions reads the command-line flags, falling back to the
+// environment:
+//
+//	-config           GO_PHP_CONFIG
+//	-root             GO_PHP_ROOT
+//	-listen           GO_PHP_LISTEN (or the older APP_SERVER_ADDR), default :8080
+//	-tls-cert         GO_PHP_TLS_CERT
+//	-tls-key          GO_PHP_TLS_KEY
+//	-tls-self-signed  GO_PHP_TLS_SELF_SIGNED=1
+func parseOptions(args []string, getenv func(string) string) (Options, error) {
+	addr := getenv("GO_PHP_LISTEN")
+	if addr == "" {
+		addr = getenv("APP_SERVER_ADDR")
+	}
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	selfSigned, _ := strconv.ParseBool(getenv("GO_PHP_TLS_SELF_SIGNED"))
+
+	var opts Options
+	lc := &opts.Listen
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&opts.ConfigFile, "config", getenv("GO_PHP_CONFIG"), "config file")
+	fs.StringVar(&opts.Root, "root", getenv("GO_PHP_ROOT"), "project root")
+	fs.StringVar(&lc.Addr, "listen", addr, "address to listen on")
+	fs.StringVar(&lc.CertFile, "tls-cert", getenv("GO_PHP_TLS_CERT"), "TLS certificate file")
+	fs.StringVar(&lc.KeyFile, "tls-key", getenv("GO_PHP_TLS_KEY"), "TLS private key file")
+	fs.BoolVar(&lc.SelfSigned, "tls-self-signed", selfSigned, "serve TLS with a generated self-signed certificate")
+	if err := fs.Parse(args); err != nil {
+		return Options{}, err
+	}
+
+	if (lc.CertFile == "") != (lc.KeyFile == "") {
+		return Options{}, errors.New("tls-cert and tls-key must be set together")
+	}
+	if lc.SelfSigned && lc.CertFile != "" {
+		return Options{}, errors.New("tls-self-signed can't be combined with tls-cert/tls-key")
+	}
+	return opts, nil
+}
+
+// listenAndServe starts httpSrv as described by lc. It blocks like
+// http.Server.ListenAndServe.
+func listenAndServe(httpSrv *http.Server, lc ListenConfig) error {
+	httpSrv.Addr = lc.Addr
+
+	switch {
+	case lc.SelfSigned:
+		cert, err := selfSignedCert([]string{"localhost", "127.0.0.1", "::1"}, 24*time.Hour)
+		if err != nil {
+			return err
+		}
+		// net/http still adds h2 to NextProtos for us
+		httpSrv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return httpSrv.ListenAndServeTLS("", "")
+	case lc.CertFile != "":
+		return httpSrv.ListenAndServeTLS(lc.CertFile, lc.KeyFile)
+	default:
+		return httpSrv.ListenAndServe()
+	}
+}
+
+// selfSignedCert generates an ECDSA certificate for hosts (names or IPs)
+// that is valid for the given duration.
+func selfSignedCert(hosts []string, validFor time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"BareMetalPHP dev"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
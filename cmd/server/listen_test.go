@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func envMap(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestParseOptionsListen(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want ListenConfig
+	}{
+		{"default", nil, nil, ListenConfig{Addr: ":8080"}},
+		{"legacy env", nil, map[string]string{"APP_SERVER_ADDR": ":9000"}, ListenConfig{Addr: ":9000"}},
+		{"env", nil, map[string]string{"GO_PHP_LISTEN": "127.0.0.1:8443", "APP_SERVER_ADDR": ":9000"}, ListenConfig{Addr: "127.0.0.1:8443"}},
+		{"flag beats env", []string{"-listen", ":7000"}, map[string]string{"GO_PHP_LISTEN": ":8443"}, ListenConfig{Addr: ":7000"}},
+		{
+			"tls from env", nil,
+			map[string]string{"GO_PHP_TLS_CERT": "c.pem", "GO_PHP_TLS_KEY": "k.pem"},
+			ListenConfig{Addr: ":8080", CertFile: "c.pem", KeyFile: "k.pem"},
+		},
+		{"self signed", []string{"-tls-self-signed"}, nil, ListenConfig{Addr: ":8080", SelfSigned: true}},
+	}
+	for _, tt := range tests {
+		opts, err := parseOptions(tt.args, envMap(tt.env))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := opts.Listen; got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseOptionsRejectsPartialTLS(t *testing.T) {
+	if _, err := parseOptions([]string{"-tls-cert", "c.pem"}, envMap(nil)); err == nil {
+		t.Fatal("expected error for a cert without a key")
+	}
+	if _, err := parseOptions([]string{"-tls-self-signed", "-tls-cert", "c.pem", "-tls-key", "k.pem"}, envMap(nil)); err == nil {
+		t.Fatal("expected error combining self-signed with a cert")
+	}
+	if _, err := parseOptions([]string{"-bogus"}, envMap(nil)); err == nil {
+		t.Fatal("expected error for an unknown flag")
+	}
+}
+
+func TestParseOptionsRoot(t *testing.T) {
+	opts, err := parseOptions(nil, envMap(map[string]string{"GO_PHP_ROOT": "/srv/app"}))
+	if err != nil || opts.Root != "/srv/app" {
+		t.Fatalf("env: got %q, %v", opts.Root, err)
+	}
+	opts, err = parseOptions([]string{"-root", "/opt/app"}, envMap(map[string]string{"GO_PHP_ROOT": "/srv/app"}))
+	if err != nil || opts.Root != "/opt/app" {
+		t.Fatalf("flag: got %q, %v", opts.Root, err)
+	}
+}
+
+func TestParseOptionsConfigFile(t *testing.T) {
+	opts, err := parseOptions(nil, envMap(map[string]string{"GO_PHP_CONFIG": "/etc/app.json"}))
+	if err != nil || opts.ConfigFile != "/etc/app.json" {
+		t.Fatalf("env: got %q, %v", opts.ConfigFile, err)
+	}
+	opts, err = parseOptions([]string{"-config", "staging.json"}, envMap(map[string]string{"GO_PHP_CONFIG": "/etc/app.json"}))
+	if err != nil || opts.ConfigFile != "staging.json" {
+		t.Fatalf("flag: got %q, %v", opts.ConfigFile, err)
+	}
+}
+
+func TestSelfSignedCertServesHTTP2(t *testing.T) {
+	cert, err := selfSignedCert([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("selfSignedCert: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET over TLS with the generated cert: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2, got %q", body)
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
 	"log"
-	"net"
+	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,23 +22,9 @@ import (
 	"go-php/server" // IMPORTANT: change this if your module path differs
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-type RequestLog struct {
-	Time       time.Time `json:"time"`
-	ID         string    `json:"id"`
-	Method     string    `json:"method"`
-	Path       string    `json:"path"`
-	Status     int       `json:"status"`
-	DurationMs float64   `json:"duration_ms"`
-	RemoteAddr string    `json:"remote_addr,omitempty"`
-	UserAgent  string    `json:"user_agent,omitempty"`
-	Pool       string    `json:"pool,omitempty"` // "fast" or "slow" (@todo: will fill later)
-	Error      string    `json:"error,omitempty"`
-}
-
 type RouteMetrics struct {
 	Count        uint64        `json:"count"`
 	TotalLatency time.Duration `json:"total_lacency_ns"`
@@ -125,11 +114,11 @@ func (m *Metrics) EndRequest(route string, latency time.Duration, err bool) {
 	rm.TotalLatency += latency
 }
 
-func (m *Metrics) Snapshot() Metrics {
+func (m *Metrics) Snapshot() *Metrics {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	copy := Metrics{
+	copy := &Metrics{
 		TotalRequests: m.TotalRequests,
 		TotalErrors:   m.TotalErrors,
 		InFlight:      m.InFlight,
@@ -144,175 +133,51 @@ func (m *Metrics) Snapshot() Metrics {
 	return copy
 }
 
-func logRequestJSON(entry RequestLog) {
-	b, err := json.Marshal(entry)
-	if err != nil {
-		log.Printf("error marshaling log entry: %v", err)
-		return
-	}
-	log.Println(string(b))
-}
-
-//
-// -------------------------------------------------------------
-// STATIC FILE SERVING
-// -------------------------------------------------------------
-//
-
-// tryServeStatic: serves static assets based on StaticRule in config
-func tryServeStatic(w http.ResponseWriter, r *http.Request, projectRoot string, rules []StaticRule) bool {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		return false
-	}
-
-	path := r.URL.Path
+// requestMetrics records per-route metrics for every request passing through it.
+func requestMetrics(metrics *Metrics) server.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
 
-	for _, rule := range rules {
-		if !strings.HasPrefix(path, rule.Prefix) {
-			continue
-		}
-
-		relPath := strings.TrimPrefix(path, rule.Prefix)
-		relPath = filepath.Clean(relPath)
-
-		baseDir := filepath.Join(projectRoot, rule.Dir)
-		fullPath := filepath.Join(baseDir, relPath)
-
-		// Prevent ../../ escapes
-		if !strings.HasPrefix(fullPath, baseDir) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return true
-		}
-
-		info, err := os.Stat(fullPath)
-		if err != nil || info.IsDir() {
-			continue
-		}
-
-		http.ServeFile(w, r, fullPath)
-		return true
-	}
-
-	return false
-}
-
-//
-// -------------------------------------------------------------
-// REQUEST PAYLOAD TRANSFORM (HTTP → PHP Worker)
-// -------------------------------------------------------------
-//
-
-func BuildPayload(r *http.Request) *server.RequestPayload {
-	// Generate a request ID for logging + tracing
-	reqID := uuid.New().String()
-
-	// copy headers into map[string][]string with canonicalized names
-	headers := make(map[string][]string, len(r.Header)+3)
-
-	for name, values := range r.Header {
-		canonical := http.CanonicalHeaderKey(name)
-
-		// copy the slice so we don't share backing arrays with r.Header
-		copied := make([]string, len(values))
-		copy(copied, values)
-
-		headers[canonical] = copied
-	}
-
-	// ensure Host is present
-	host := r.Host
-	if host == "" && r.URL != nil {
-		host = r.URL.Host
-	}
-	if host != "" {
-		headers["Host"] = []string{host}
-	}
-
-	// add / extend X-Forwarded-For with the direct client IP
-	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && ip != "" {
-		if existing, ok := headers["X-Forwarded-For"]; ok && len(existing) > 0 {
-			headers["X-Forwarded-For"] = []string{existing[0] + ", " + ip}
-		} else {
-			headers["X-Forwarded-For"] = []string{ip}
-		}
-	}
-
-	// Attach X-Request-Id if the client didn't send one
-	if _, ok := headers["X-Request-Id"]; !ok {
-		headers["X-Request-Id"] = []string{reqID}
-	}
-
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("[request %s] error reading body: %v", reqID, err)
-	}
-	_ = r.Body.Close()
+			routeKey := r.URL.Path
+			if routeKey == "" {
+				routeKey = "/"
+			}
+			metrics.StartRequest(routeKey)
 
-	// Preserve the full RequestURI (includes query string)
-	path := r.URL.RequestURI()
-	if path == "" {
-		path = r.URL.Path
-	}
+			sw := server.NewStatusWriter(w)
+			next.ServeHTTP(sw, r)
 
-	return &server.RequestPayload{
-		ID:      reqID,
-		Method:  r.Method,
-		Path:    path,
-		Headers: headers,
-		Body:    string(bodyBytes),
+			metrics.EndRequest(routeKey, time.Since(start), sw.Status >= http.StatusInternalServerError)
+		})
 	}
 }
 
-// mapWorkerErrorToStatus converts worker-level errors into HTTP status codes.
-func mapWorkerErrorToStatus(err error) int {
-	msg := err.Error()
-
-	switch {
-	case strings.Contains(msg, "timeout"):
-		// the php worker timed out handling the request
-		return http.StatusGatewayTimeout //' 504 Gateway Timeout
-	case strings.Contains(msg, "unexpected EOF"),
-		strings.Contains(msg, "broken pipe"),
-		strings.Contains(msg, "connection reset"):
-		// Connection to the worker died mid-request
-		return http.StatusBadGateway // 502 Bad Gateway
-
+// accessLogFormat maps the access_log config value onto a server.AccessLogFormat.
+// It reports false when access logging is turned off.
+func accessLogFormat(name string) (server.AccessLogFormat, bool) {
+	switch strings.ToLower(name) {
+	case "off", "none":
+		return 0, false
+	case "text", "plain":
+		return server.AccessLogText, true
 	default:
-		// Anything else is treated as an internal server error
-		return http.StatusInternalServerError //500
+		return server.AccessLogJSON, true
 	}
 }
 
-// writeWorkerError logs and sends an appropriate HTTP error to the client.
-func writeWorkerError(w http.ResponseWriter, err error) {
-	status := mapWorkerErrorToStatus(err)
-	log.Printf("[worker] error (status=%d): %v", status, err)
-	http.Error(w, http.StatusText(status), status)
-}
-
 //
 // -------------------------------------------------------------
 // PROJECT ROOT DISCOVERY (dir containing go.mod)
 // -------------------------------------------------------------
 //
 
-func getProjectRoot() string {
+func getProjectRoot() (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
-		return "."
-	}
-
-	dir := wd
-	for {
-		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
-			return dir
-		}
-		parent := filepath.Dir(dir)
-		if parent == dir {
-			return wd
-		}
-		dir = parent
+		return "", err
 	}
+	return server.FindProjectRoot(wd)
 }
 
 //
@@ -322,25 +187,61 @@ func getProjectRoot() string {
 //
 
 func main() {
-	root := getProjectRoot()
-	cfg := loadConfig(root)
+	// Resolve listen address, TLS and the config file from flags / env
+	opts, err := parseOptions(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatalf("[server] %v", err)
+	}
+
+	root := opts.Root
+	if root == "" {
+		if root, err = getProjectRoot(); err != nil {
+			log.Fatalf("[server] can't find the project root: %v; run from the project or set -root / GO_PHP_ROOT", err)
+		}
+	}
+	cfg, err := loadConfig(opts.ConfigFile, root)
+	if err != nil {
+		log.Fatalf("[config] %v", err)
+	}
+
+	// Internal logs (worker lifecycle, hot reload, errors) go to stderr as
+	// text; log.Printf output is routed through the same handler
+	lvl, _ := server.ParseLogLevel(cfg.LogLevel)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl}))
+	slog.SetDefault(logger)
 
 	// Build server.Server instance
-	slowCfg := server.SlowRequestConfig{
-		RoutePrefixes: cfg.SlowRoutes,
-		Methods:       cfg.SlowMethods,
-		BodyThreshold: cfg.SlowBodyThreshold,
-	}
-	srv, err := server.NewServer(
-		cfg.FastWorkers,
-		cfg.SlowWorkers,
-		cfg.MaxRequestsPerWorker,
-		time.Duration(cfg.RequestTimeoutMs)*time.Millisecond,
-		slowCfg,
-	)
+	srv, err := server.NewServerWithConfig(cfg.ServerConfig(root))
 	if err != nil {
 		log.Fatalf("failed to create server: %v", err)
 	}
+	srv.SetLogger(logger)
+	srv.SetMaxBodySize(cfg.MaxBodyBytes, cfg.SlowMaxBodyBytes)
+	srv.SetBodyStreamThreshold(cfg.StreamRequestBodyBytes)
+	srv.SetMaxRequestHeaders(cfg.MaxHeaderBytes, cfg.MaxHeaderCount)
+	srv.SetCollapseRoutes(cfg.CollapseRoutes)
+	srv.SetOverflow(server.Overflow(cfg.PoolOverflow))
+	srv.SetNoWorkerRetry(cfg.NoWorkerRetries, time.Duration(cfg.NoWorkerRetryMs)*time.Millisecond)
+	srv.SetMaxHeaderTimeout(time.Duration(cfg.MaxHeaderTimeoutMs) * time.Millisecond)
+	srv.SetRouteLimits(routeLimits(cfg.RouteLimits))
+	srv.SetReloadBatch(cfg.ReloadBatch)
+	srv.SetErrorPages(loadErrorPages(root, cfg.ErrorPages))
+	srv.SetHeaderPolicy(cfg.ResponseHeaders)
+	srv.SetDebugErrors(cfg.DevMode)
+	srv.SetServerTiming(cfg.ServerTiming || cfg.DevMode)
+	srv.StartReaper(server.DefaultReaperInterval)
+
+	// streaming routes (e.g. anything under /stream/) use DispatchStream
+	srv.SetStreamConfig(server.StreamConfig{
+		RoutePrefixes:     cfg.StreamRoutes,
+		RoutePatterns:     cfg.StreamRoutePatterns,
+		AcceptEventStream: cfg.StreamEventStream,
+	})
+
+	// WebSocket upgrades on these routes get a worker of their own
+	if len(cfg.WebSocketRoutes) > 0 {
+		srv.SetWebSocketConfig(server.WebSocketConfig{RoutePrefixes: cfg.WebSocketRoutes})
+	}
 
 	metrics := NewMetrics()
 	mux := http.NewServeMux()
@@ -411,35 +312,18 @@ func main() {
 	})
 
 	hub := server.NewSSEHub()
+	hub.SetHeartbeat(time.Duration(max(cfg.SSEHeartbeatMs, 0)) * time.Millisecond)
+	srv.SetPublisher(hub)
 
-	// streaming routes: anything under /stream/ uses DispatchStream
-	mux.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
-		// tell php worker we want streaming
-		r.Header.Set("X-Go-Stream", "1")
-		payload := BuildPayload(r)
-		start := time.Now()
-
-		routeKey := r.URL.Path
-		if routeKey == "" {
-			routeKey = "/stream"
-		}
-
-		metrics.StartRequest(routeKey)
-
-		if err := srv.DispatchStream(payload, w); err != nil {
-			elapsed := time.Since(start)
-			metrics.EndRequest(routeKey, elapsed, true)
-			writeWorkerError(w, err)
-			log.Printf("[req %s] %s %s -> stream error: %v", payload.ID, payload.Method, payload.Path, err)
-			return
-		}
-
-		elapsed := time.Since(start)
-		metrics.EndRequest(routeKey, elapsed, false)
-		srv.RecordLatency(payload.Path, elapsed)
+	var accessLog server.Middleware
+	if format, ok := accessLogFormat(cfg.AccessLog); ok {
+		accessLog = server.AccessLog(server.AccessLogConfig{Writer: os.Stdout, Format: format})
+	}
 
-		log.Printf("[req %s] %s %s -> streamed (%v)", payload.ID, payload.Method, payload.Path, elapsed)
-	})
+	var compress server.Middleware
+	if cfg.Compress {
+		compress = server.Compress(server.CompressConfig{MinSize: cfg.CompressMinBytes})
+	}
 
 	mux.HandleFunc("/__ws", func(w http.ResponseWriter, r *http.Request) {
 		channel := r.URL.Query().Get("channel")
@@ -516,91 +400,31 @@ func main() {
 		w.WriteHeader(http.StatusAccepted)
 	})
 
-	// Main application handler
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// 1) Try static assets first
-		if tryServeStatic(w, r, root, cfg.Static) {
-			return
-		}
-
-		// 2) Transform request → payload for PHP worker
-		payload := BuildPayload(r)
-		start := time.Now()
-
-		// Metrics: per-route tracking
-		routeKey := r.URL.Path
-		if routeKey == "" {
-			routeKey = "/"
-		}
-		metrics.StartRequest(routeKey)
-
-		// Optional: streaming path (guarded by header)
-		if r.Header.Get("X-Go-Stream") == "1" {
-			if err := srv.DispatchStream(payload, w); err != nil {
-				elapsed := time.Since(start)
-				metrics.EndRequest(routeKey, elapsed, true)
-				writeWorkerError(w, err)
-				log.Printf("[req %s] %s %s -> stream error: %v", payload.ID, payload.Method, payload.Path, err)
-				return
-			}
-
-			elapsed := time.Since(start)
-			metrics.EndRequest(routeKey, elapsed, false)
-			srv.RecordLatency(payload.Path, elapsed)
-			log.Printf("[req %s] %s %s -> streamed (%v)", payload.ID, payload.Method, payload.Path, elapsed)
-			return
-		}
-
-		// 3) Normal non-streaming path
-		resp, err := srv.Dispatch(payload)
-		if err != nil {
-			elapsed := time.Since(start)
-			metrics.EndRequest(routeKey, elapsed, true)
-			writeWorkerError(w, err)
-			log.Printf("[req %s] %s %s -> worker error: %v", payload.ID, payload.Method, payload.Path, err)
-			return
-		}
-
-		// If PHP returns 404, give static another chance
-		if resp.Status == http.StatusNotFound {
-			if tryServeStatic(w, r, root, cfg.Static) {
-				elapsed := time.Since(start)
-				metrics.EndRequest(routeKey, elapsed, false)
-				return
-			}
-		}
+	// only believe X-Forwarded-* from configured proxies
+	trusted, err := server.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid trusted_proxies: %v", err)
+	}
 
-		// Copy headers
-		for k, v := range resp.Headers {
-			w.Header().Set(k, v)
-		}
+	// Main application handler: static assets first, then PHP workers,
+	// with a last-chance static fallback when PHP answers 404
+	app := cfg.AppConfig(root)
+	app.Middleware = []server.Middleware{
+		server.RequestID,
+		server.RealIP(trusted),
+		accessLog,
+		server.Recover,
+		corsMiddleware(cfg.CORS),
+		server.RateLimit(cfg.RateLimits),
+		compress,
+	}
+	app.DispatchMiddleware = []server.Middleware{requestMetrics(metrics)}
+	mux.Handle("/", server.NewAppHandler(srv, app))
 
-		// Write status
-		status := resp.Status
-		if status == 0 {
-			status = http.StatusOK
-		}
-		w.WriteHeader(status)
-
-		// Write body
-		_, _ = w.Write([]byte(resp.Body))
-
-		// Final metrics + structured log
-		elapsed := time.Since(start)
-		metrics.EndRequest(routeKey, elapsed, false)
-
-		entry := RequestLog{
-			Time:       time.Now(),
-			ID:         payload.ID,
-			Method:     payload.Method,
-			Path:       payload.Path,
-			Status:     status,
-			DurationMs: float64(elapsed.Milliseconds()),
-			RemoteAddr: r.RemoteAddr,
-			UserAgent:  r.UserAgent(),
-		}
-		logRequestJSON(entry)
-	})
+	// Orchestrator probes: liveness reflects live workers, readiness also
+	// startup/shutdown
+	mux.Handle("/healthz", server.HealthzHandler(srv))
+	mux.Handle("/readyz", server.ReadyzHandler(srv))
 
 	// Health summary: worker pools etc.
 	mux.HandleFunc("/__baremetal/health", func(w http.ResponseWriter, r *http.Request) {
@@ -637,50 +461,30 @@ func main() {
 		}
 	})
 
-	mux.HandleFunc("/__sse", func(w http.ResponseWriter, r *http.Request) {
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
-			return
-		}
+	// Prometheus scrape endpoint (opt-in, it reveals pool internals)
+	if cfg.PrometheusMetrics {
+		mux.Handle("/metrics", server.MetricsHandler(srv))
+	}
 
-		channel := r.URL.Query().Get("channel")
-		if channel == "" {
-			http.Error(w, "missing channel", http.StatusBadRequest)
-			return
+	// Live worker table for operators (opt-in, it reveals PIDs and load)
+	if cfg.DebugWorkers {
+		if cfg.DebugToken == "" {
+			log.Println("[config] debug_workers is on without a debug_token; don't expose /debug/workers publicly")
 		}
+		mux.Handle("/debug/workers", server.WorkersHandler(srv, cfg.DebugToken))
+	}
 
-		client := hub.Subscribe(channel)
-		defer hub.Unsubscribe(channel, client)
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		// initial comment so EventSource opens
-		_, _ = w.Write([]byte(": connected\n\n"))
-		flusher.Flush()
+	mux.Handle("/__sse", hub)
 
-		for {
-			select {
-			case ev := <-client.Ch():
-				if ev.Event != "" {
-					_, _ = w.Write([]byte("event: " + ev.Event + "\n"))
-				}
-				_, _ = w.Write([]byte("data: "))
-				_, _ = w.Write(ev.Data)
-				_, _ = w.Write([]byte("\n\n"))
-				flusher.Flush()
-			case <-r.Context().Done():
-				return
-			case <-client.Done():
-				return
-			}
-		}
+	// SSE stats: subscriber counts and dropped events
+	mux.HandleFunc("/__sse/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(hub.Stats())
 	})
 
 	// SSE publish endpoint: POST /__sse/publish
-	// Body: { "channel": "foo", "event", "update", "data": { ... } }
+	// Body: { "channel": "foo", "event", "update", "data": { ... } }, or
+	// "batch": [ ... ] instead of "data" to publish one event per item
 	mux.HandleFunc("/__sse/publish", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -688,9 +492,10 @@ func main() {
 		}
 
 		var body struct {
-			Channel string      `json:"channel"`
-			Event   string      `json:"event"`
-			Data    interface{} `json:"data"`
+			Channel string        `json:"channel"`
+			Event   string        `json:"event"`
+			Data    interface{}   `json:"data"`
+			Batch   []interface{} `json:"batch"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 			http.Error(w, "invalid JSON", http.StatusBadRequest)
@@ -702,202 +507,226 @@ func main() {
 			return
 		}
 
-		hub.Publish(body.Channel, body.Event, body.Data)
+		if body.Batch != nil {
+			hub.PublishBatch(body.Channel, body.Event, body.Batch)
+		} else {
+			hub.Publish(body.Channel, body.Event, body.Data)
+		}
 		w.WriteHeader(http.StatusAccepted)
 	})
 
 	// Hot reload (if enabled)
 	if cfg.HotReload {
-		if err := srv.EnableHotReload(root); err != nil {
+		if err := srv.EnableHotReload(root, cfg.WatchDirs...); err != nil {
 			log.Println("Hot reload disabled:", err)
 		} else {
 			log.Println("Hot reload enabled")
 		}
 	}
 
-	// Resolve listen address: APP_SERVER_ADDR env or default
-	addr := os.Getenv("APP_SERVER_ADDR")
-	if addr == "" {
-		addr = ":8080"
-	}
+	listen := opts.Listen
 
 	httpSrv := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+		Addr: listen.Addr,
+		// "OPTIONS *" is answered with an Allow header by GlobalOptions
+		Handler:                      server.GlobalOptions(nil)(mux),
+		DisableGeneralOptionsHandler: true,
 	}
 
 	// Graceful shutdown on SIGINT/SIGTERM
 	shutdownCh := make(chan os.Signal, 1)
 	signal.Notify(shutdownCh, syscall.SIGINT, syscall.SIGTERM)
 
+	// end open SSE streams so Shutdown doesn't wait on them
+	httpSrv.RegisterOnShutdown(hub.Close)
+
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-shutdownCh
-		log.Println("[shutdown] signal received, draining workers and shutting down HTTP server...")
+		log.Println("[shutdown] signal received, shutting down HTTP server, then draining workers...")
 
-		// stop taking new requests
+		// handlers finish their requests on the workers before the pools
+		// drain; see Server.Shutdown
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-
-		// tell PHP workers to drain (no new jobs, finish in-flight)
-		srv.DrainWorkers()
-
-		if err := httpSrv.Shutdown(ctx); err != nil {
+		if err := srv.Shutdown(ctx, httpSrv); err != nil {
 			log.Printf("[shutdown] http server shutdown error: %v", err)
 		} else {
-			log.Println("[shutdown] http server shut down cleanly")
+			log.Println("[shutdown] http server and workers shut down cleanly")
+		}
+	}()
+
+	// Rolling worker reload on SIGHUP, e.g. after deploying new PHP code.
+	// Signals arriving mid-reload coalesce into one follow-up reload.
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		for range reloadCh {
+			// failures are logged; workers left on the old code keep serving
+			_ = srv.ReloadWorkers(context.Background())
 		}
 	}()
 
 	// Startup banner / config summary
 	log.Println("=============================================")
-	log.Printf(" BareMetalPHP Go App Server listening on %s", addr)
+	scheme := "http"
+	if listen.TLS() {
+		scheme = "https"
+	}
+	log.Printf(" BareMetalPHP Go App Server listening on %s (%s)", listen.Addr, scheme)
 	log.Println("=============================================")
 	log.Printf(" Fast workers: %d", cfg.FastWorkers)
 	log.Printf(" Slow workers: %d", cfg.SlowWorkers)
-	log.Printf(" Timeout: %dms", cfg.RequestTimeoutMs)
-	log.Printf(" Max requests/worker: %d", cfg.MaxRequestsPerWorker)
+	if cfg.WorkerAddress != "" {
+		log.Printf(" Worker address: %s", cfg.WorkerAddress)
+	}
+	if cfg.Codec != "" {
+		log.Printf(" Frame codec: %s", cfg.Codec)
+	}
+	log.Printf(" Timeout: %dms (slow: %dms)", cfg.RequestTimeoutMs, cfg.SlowRequestTimeoutMs)
+	log.Printf(" Max requests/worker: %d (slow: %d)", cfg.MaxRequestsPerWorker, cfg.SlowMaxRequestsPerWorker)
+	if cfg.MaxWorkerLifetimeMs > 0 {
+		log.Printf(" Max worker lifetime: %s", time.Duration(cfg.MaxWorkerLifetimeMs)*time.Millisecond)
+	}
+	if cfg.MaxWorkerRSSMB > 0 {
+		log.Printf(" Max worker RSS: %dMB", cfg.MaxWorkerRSSMB)
+	}
+	if cfg.ReadIdleTimeoutMs < 0 {
+		log.Printf(" Read idle timeout: off")
+	} else if cfg.ReadIdleTimeoutMs > 0 {
+		log.Printf(" Read idle timeout: %dms", cfg.ReadIdleTimeoutMs)
+	}
+	if cfg.FrameBufferSize < 0 {
+		log.Printf(" Frame buffers: not recycled")
+	} else if cfg.FrameBufferSize > 0 {
+		log.Printf(" Frame buffer size: %d bytes", cfg.FrameBufferSize)
+	}
+	if cfg.WorkerMaxConcurrent > 1 {
+		log.Printf(" Pipelined requests per worker: %d", cfg.WorkerMaxConcurrent)
+	}
+	if cfg.WorkerIdleTTLMs > 0 {
+		log.Printf(" Idle worker TTL: %s (min workers: %d fast, %d slow)", time.Duration(cfg.WorkerIdleTTLMs)*time.Millisecond, cfg.MinFastWorkers, cfg.MinSlowWorkers)
+	}
+	if cfg.DrainTimeoutMs > 0 {
+		log.Printf(" Drain timeout: %s", time.Duration(cfg.DrainTimeoutMs)*time.Millisecond)
+	}
+	if cfg.WorkerPingIntervalMs > 0 {
+		log.Printf(" Idle worker ping: every %s", time.Duration(cfg.WorkerPingIntervalMs)*time.Millisecond)
+	}
+	if len(cfg.WarmupPaths) > 0 {
+		log.Printf(" Worker warm-up: %v x%d", cfg.WarmupPaths, max(cfg.WarmupRounds, 1))
+	}
+	if cfg.LogRequestsOverMs > 0 || cfg.SlowLogRequestsOverMs > 0 {
+		log.Printf(" Slow request log: over %dms (slow: %dms)", cfg.LogRequestsOverMs, cfg.SlowLogRequestsOverMs)
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		log.Printf(" Pool %q: %d workers", name, cfg.Pools[name].Workers)
+	}
+	if len(cfg.PoolRoutes) > 0 || cfg.DefaultPool != "" {
+		log.Printf(" Pool routes: %d (default pool: %q)", len(cfg.PoolRoutes), cfg.DefaultPool)
+	}
+	if len(cfg.CollapseRoutes) > 0 {
+		log.Printf(" Collapsed routes: %d", len(cfg.CollapseRoutes))
+	}
+	log.Printf(" Max body: %d bytes (slow routes: %d bytes)", cfg.MaxBodyBytes, cfg.SlowMaxBodyBytes)
+	log.Printf(" Max headers: %d bytes, %d lines", cfg.MaxHeaderBytes, cfg.MaxHeaderCount)
+	log.Printf(" Stream routes: %v", cfg.StreamRoutes)
+	if cfg.ServerTiming || cfg.DevMode {
+		log.Printf(" Server-Timing headers: on")
+	}
+	if rh := cfg.ResponseHeaders; len(rh.Set) > 0 || len(rh.Allow) > 0 {
+		log.Printf(" Response headers: %d forced, %d allowed from PHP", len(rh.Set), len(rh.Allow))
+	}
+	if len(cfg.WebSocketRoutes) > 0 {
+		log.Printf(" WebSocket routes: %v", cfg.WebSocketRoutes)
+	}
 	log.Println(" Static rules:")
 	for _, rule := range cfg.Static {
 		log.Printf("   %s → %s", rule.Prefix, filepath.Join(root, rule.Dir))
 	}
+	if sf := cfg.StaticFallback; sf.Disabled {
+		log.Println(" Static fallback: off")
+	} else if sf.Statuses != nil || sf.Methods != nil {
+		log.Printf(" Static fallback: statuses %v, methods %v", sf.Statuses, sf.Methods)
+	}
 	log.Println("=============================================")
 
 	// Start HTTP server (blocks until shutdown)
-	if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := listenAndServe(httpSrv, listen); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("[server] listen error: %v", err)
 	}
+	// Serve returns as soon as Shutdown starts; wait for it to finish
+	<-shutdownDone
 }
 
-type StaticRule struct {
-	Prefix string `json:"prefix"`
-	Dir    string `json:"dir"`
-}
-
-type AppServerConfig struct {
-	FastWorkers          int          `json:"fast_workers"`
-	SlowWorkers          int          `json:"slow_workers"`
-	HotReload            bool         `json:"hot_reload"`
-	RequestTimeoutMs     int          `json:"request_timeout_ms"`
-	MaxRequestsPerWorker int          `json:"max_requests_per_worker"`
-	Static               []StaticRule `json:"static"`
-
-	SlowRoutes        []string `json:"slow_routes"`
-	SlowMethods       []string `json:"slow_methods"`
-	SlowBodyThreshold int      `json:"slow_body_threshold"`
-}
-
-// defaultConfig returns sane defaults when go_appserver.json
-// is missing or invalid.
-func defaultConfig() *AppServerConfig {
-	return &AppServerConfig{
-		FastWorkers:          4,
-		SlowWorkers:          2,
-		HotReload:            false,
-		RequestTimeoutMs:     10000, // 10s
-		MaxRequestsPerWorker: 1000,
-		Static: []StaticRule{
-			{Prefix: "/assets/", Dir: "public/assets"},
-			{Prefix: "/build/", Dir: "public/build"},
-			{Prefix: "/css/", Dir: "public/css"},
-			{Prefix: "/js/", Dir: "public/js"},
-			{Prefix: "/images/", Dir: "public/images"},
-			{Prefix: "/img/", Dir: "public/img"},
-		},
-		SlowRoutes:        []string{"/reports/", "/admin/analytics"},
-		SlowMethods:       []string{"PUT", "DELETE"},
-		SlowBodyThreshold: 2_000_000,
+// loadConfig loads the config file named with -config / GO_PHP_CONFIG,
+// failing if it can't be read or parsed. With none named it tries
+// go_appserver.json in the project root and falls back to the defaults
+// (plus environment overrides) when that is missing or invalid.
+func loadConfig(named, root string) (*server.Config, error) {
+	if named != "" {
+		return server.LoadConfig(named)
 	}
-}
-
-// loadConfig tries to read go_appserver.json from projectRoot;
-// falls back to defaults on any error.
-func loadConfig(projectRoot string) *AppServerConfig {
-	cfgPath := filepath.Join(projectRoot, "go_appserver.json")
-
-	data, err := os.ReadFile(cfgPath)
+	cfg, err := server.LoadConfig(filepath.Join(root, server.DefaultConfigFile))
 	if err != nil {
-		log.Printf("[config] no go_appserver.json found at %s, using defaults: %v", cfgPath, err)
-		return defaultConfig()
-	}
-
-	var cfg AppServerConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		log.Printf("[config] invalid go_appserver.json (%s), using defaults: %v", cfgPath, err)
-		return defaultConfig()
-	}
-
-	// Pull a copy of defaults for use below
-	def := defaultConfig()
-
-	//
-	// -------------------------
-	// Core config validation
-	// -------------------------
-	//
-
-	if cfg.FastWorkers <= 0 {
-		log.Printf("[config] fast_workers=%d is invalid, falling back to %d", cfg.FastWorkers, def.FastWorkers)
-		cfg.FastWorkers = def.FastWorkers
-	}
-
-	if cfg.SlowWorkers < 0 {
-		log.Printf("[config] slow_workers=%d is invalid, falling back tp %d", cfg.SlowWorkers, def.SlowWorkers)
-		cfg.SlowWorkers = def.SlowWorkers
-	}
-
-	if cfg.RequestTimeoutMs <= 0 {
-		log.Printf("[config] request_timeout_ms=%d is invalid, falling back to %dms", cfg.RequestTimeoutMs, def.RequestTimeoutMs)
-		cfg.RequestTimeoutMs = def.RequestTimeoutMs
+		log.Printf("[config] %v, using defaults", err)
+		return server.LoadConfig("")
 	}
+	return cfg, nil
+}
 
-	if cfg.MaxRequestsPerWorker <= 0 {
-		log.Printf("[config] max_requests_per_worker=%d is invalid, falling back to %d", cfg.MaxRequestsPerWorker, def.MaxRequestsPerWorker)
-		cfg.MaxRequestsPerWorker = def.MaxRequestsPerWorker
+// routeLimits converts the configured route limits for the server.
+func routeLimits(rules []server.RouteLimitRule) []server.RouteLimit {
+	limits := make([]server.RouteLimit, 0, len(rules))
+	for _, r := range rules {
+		limits = append(limits, server.RouteLimit{
+			Prefix:       r.Prefix,
+			Max:          r.MaxConcurrent,
+			QueueTimeout: time.Duration(r.QueueTimeoutMs) * time.Millisecond,
+		})
 	}
+	return limits
+}
 
-	//
-	// -------------------------
-	// Static rules validation
-	// -------------------------
-	//
-	if len(cfg.Static) == 0 {
-		log.Printf("[config] no static rules configured, using default static rules")
-		cfg.Static = defaultConfig().Static
-	} else {
-		for i, rule := range cfg.Static {
-			if !strings.HasPrefix(rule.Prefix, "/") {
-				log.Printf("[config] static[%d].prefix=%q does not start with '/', fixing", i, rule.Prefix)
-				cfg.Static[i].Prefix = "/" + rule.Prefix
-			}
+// corsMiddleware builds the CORS middleware, or nil when it's not configured.
+func corsMiddleware(c *server.CORSSettings) server.Middleware {
+	if c == nil {
+		return nil
+	}
+	return server.CORS(server.CORSConfig{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.AllowedMethods,
+		AllowedHeaders:   c.AllowedHeaders,
+		ExposedHeaders:   c.ExposedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           time.Duration(c.MaxAgeSeconds) * time.Second,
+	})
+}
 
-			if rule.Dir == "" {
-				log.Printf("[config] static[%d].dir is empty, this rule will be ignored at runtime.", i)
-			}
+// loadErrorPages reads the configured error pages. Entries with a bad
+// status code or an unreadable file are logged and skipped, leaving the
+// plain status text for that code.
+func loadErrorPages(root string, pages map[string]string) map[int]server.ErrorPage {
+	out := make(map[int]server.ErrorPage, len(pages))
+	for code, file := range pages {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			log.Printf("[config] error_pages: %q is not an error status code, ignoring", code)
+			continue
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(root, file)
+		}
+		body, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("[config] error_pages[%q]: %v, ignoring", code, err)
+			continue
+		}
+		out[status] = server.ErrorPage{
+			ContentType: mime.TypeByExtension(filepath.Ext(file)),
+			Body:        body,
 		}
 	}
-
-	//
-	// -------------------------
-	// Slow-request config
-	// -------------------------
-	//
-
-	// Route prefixes
-	if len(cfg.SlowRoutes) == 0 {
-		cfg.SlowRoutes = def.SlowRoutes
-		log.Printf("[config] stow_routes missing, using defaults: %v", cfg.SlowRoutes)
-	}
-
-	// Methods to treat as slow
-	if len(cfg.SlowMethods) == 0 {
-		cfg.SlowMethods = def.SlowMethods
-		log.Printf("[config] slow_methods missing, using defaults: %v", cfg.SlowMethods)
-	}
-
-	// Body size threshold
-	if cfg.SlowBodyThreshold <= 0 {
-		cfg.SlowBodyThreshold = def.SlowBodyThreshold
-		log.Printf("[config] slow_body_threshold invalid, using default: %d bytes", cfg.SlowBodyThreshold)
-	}
-	return &cfg
+	return out
 }
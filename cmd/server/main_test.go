@@ -2,155 +2,18 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"io"
-	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
-	"strings"
 	"testing"
 	"time"
 
+	"go-php/server"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func TestTryServeStaticServesFile(t *testing.T) {
-	root := t.TempDir()
-	staticDir := filepath.Join(root, "public", "assets")
-	if err := os.MkdirAll(staticDir, 0o755); err != nil {
-		t.Fatalf("mkdir: %v", err)
-	}
-
-	const fileContent = "hello world"
-	if err := os.WriteFile(filepath.Join(staticDir, "test.txt"), []byte(fileContent), 0o644); err != nil {
-		t.Fatalf("write file: %v", err)
-	}
-
-	r := httptest.NewRequest(http.MethodGet, "/assets/test.txt", nil)
-	w := httptest.NewRecorder()
-
-	rules := []StaticRule{
-		{Prefix: "/assets/", Dir: "public/assets"},
-	}
-
-	served := tryServeStatic(w, r, root, rules)
-	if !served {
-		t.Fatalf("expected tryServeStatic to return true")
-	}
-
-	resp := w.Result()
-	body, _ := io.ReadAll(resp.Body)
-	if string(body) != fileContent {
-		t.Fatalf("unexpected body: %q", string(body))
-	}
-}
-
-func TestTryServeStaticWrongMethod(t *testing.T) {
-	root := t.TempDir()
-	r := httptest.NewRequest(http.MethodPost, "/assets/test.txt", nil)
-	w := httptest.NewRecorder()
-
-	served := tryServeStatic(w, r, root, []StaticRule{
-		{Prefix: "/assets/", Dir: "public/assets"},
-	})
-	if served {
-		t.Fatalf("expected tryServeStatic to return false for non-GET/HEAD")
-	}
-}
-
-func TestTryServeStaticDirectoryTraversal(t *testing.T) {
-	root := t.TempDir()
-	staticDir := filepath.Join(root, "public", "assets")
-	if err := os.MkdirAll(staticDir, 0o755); err != nil {
-		t.Fatalf("mkdir: %v", err)
-	}
-
-	r := httptest.NewRequest(http.MethodGet, "/assets/../../etc/passwd", nil)
-	w := httptest.NewRecorder()
-
-	served := tryServeStatic(w, r, root, []StaticRule{
-		{Prefix: "/assets/", Dir: "public/assets"},
-	})
-	if !served {
-		t.Fatalf("expected tryServeStatic to return true (handled with 403)")
-	}
-	if w.Code != http.StatusForbidden {
-		t.Fatalf("expected 403, got %d", w.Code)
-	}
-}
-
-func TestTryServeStaticNotFound(t *testing.T) {
-	root := t.TempDir()
-	r := httptest.NewRequest(http.MethodGet, "/assets/nonexistent.txt", nil)
-	w := httptest.NewRecorder()
-
-	served := tryServeStatic(w, r, root, []StaticRule{
-		{Prefix: "/assets/", Dir: "public/assets"},
-	})
-	if served {
-		t.Fatalf("expected tryServeStatic to return false for nonexistent file")
-	}
-}
-
-func TestBuildPayloadCopiesHeadersAndRequestURI(t *testing.T) {
-	body := bytes.NewBufferString("payload")
-	r := httptest.NewRequest(http.MethodPost, "/foo/bar?x=1", body)
-	r.RemoteAddr = net.IPv4(127, 0, 0, 1).String() + ":12345"
-	r.Header.Set("X-Custom", "val")
-
-	payload := BuildPayload(r)
-	if payload.Method != http.MethodPost {
-		t.Fatalf("expected method %s, got %s", http.MethodPost, payload.Method)
-	}
-	if payload.Path != "/foo/bar?x=1" {
-		t.Fatalf("expected full RequestURI, got %q", payload.Path)
-	}
-	if payload.Body != "payload" {
-		t.Fatalf("unexpected body: %q", payload.Body)
-	}
-	if payload.Headers["X-Custom"][0] != "val" {
-		t.Fatalf("expected X-Custom header to be copied")
-	}
-	if _, ok := payload.Headers["Host"]; !ok {
-		t.Fatalf("expected Host header to be set")
-	}
-	if xf, ok := payload.Headers["X-Forwarded-For"]; !ok || len(xf) == 0 {
-		t.Fatalf("expected X-Forwarded-For to be populated")
-	}
-	if _, ok := payload.Headers["X-Request-Id"]; !ok {
-		t.Fatalf("expected X-Request-Id to be injected")
-	}
-}
-
-func TestBuildPayloadWithExistingXForwardedFor(t *testing.T) {
-	r := httptest.NewRequest(http.MethodGet, "/test", nil)
-	r.RemoteAddr = "192.168.1.1:12345"
-	r.Header.Set("X-Forwarded-For", "10.0.0.1")
-
-	payload := BuildPayload(r)
-	xff := payload.Headers["X-Forwarded-For"]
-	if len(xff) == 0 {
-		t.Fatalf("expected X-Forwarded-For to be set")
-	}
-	if !strings.Contains(xff[0], "192.168.1.1") {
-		t.Fatalf("expected X-Forwarded-For to include client IP")
-	}
-}
-
-func TestBuildPayloadWithExistingRequestId(t *testing.T) {
-	r := httptest.NewRequest(http.MethodGet, "/test", nil)
-	r.Header.Set("X-Request-Id", "existing-id")
-
-	payload := BuildPayload(r)
-	if payload.Headers["X-Request-Id"][0] != "existing-id" {
-		t.Fatalf("expected existing X-Request-Id to be preserved")
-	}
-}
-
 func TestGetProjectRootFindsGoMod(t *testing.T) {
 	tmp := t.TempDir()
 	// fake module root
@@ -169,7 +32,10 @@ func TestGetProjectRootFindsGoMod(t *testing.T) {
 		t.Fatalf("chdir: %v", err)
 	}
 
-	root := getProjectRoot()
+	root, err := getProjectRoot()
+	if err != nil {
+		t.Fatalf("getProjectRoot: %v", err)
+	}
 
 	// macOS /var is a symlink to /private/var, which breaks the equality check.
 	resolvedRoot, err := filepath.EvalSymlinks(root)
@@ -185,111 +51,41 @@ func TestGetProjectRootFindsGoMod(t *testing.T) {
 	}
 }
 
-func TestDefaultConfigAndLoadConfigFallback(t *testing.T) {
-	tmp := t.TempDir()
-	cfg := loadConfig(tmp) // no go_appserver.json → defaults
-	def := defaultConfig()
-
-	if cfg.FastWorkers != def.FastWorkers ||
-		cfg.SlowWorkers != def.SlowWorkers ||
-		cfg.RequestTimeoutMs != def.RequestTimeoutMs {
-		t.Fatalf("loadConfig did not fall back to defaults correctly: %#v", cfg)
+func TestLoadConfigNamedFileMustLoad(t *testing.T) {
+	root := t.TempDir()
+	if _, err := loadConfig(filepath.Join(root, "staging.json"), root); err == nil {
+		t.Fatal("expected an error for a missing named config file")
 	}
-}
-
-func TestLoadConfigValidationAndDefaults(t *testing.T) {
-	tmp := t.TempDir()
-	cfgPath := filepath.Join(tmp, "go_appserver.json")
-
-	// Intentionally invalid / weird values to trigger validation logic.
-	raw := AppServerConfig{
-		FastWorkers:          -1,
-		SlowWorkers:          -5,
-		RequestTimeoutMs:     0,
-		MaxRequestsPerWorker: 0,
-		Static: []StaticRule{
-			{Prefix: "assets", Dir: ""}, // missing leading slash, empty dir
-		},
-		SlowRoutes:        nil,
-		SlowMethods:       nil,
-		SlowBodyThreshold: 0,
-	}
-	data, _ := json.Marshal(raw)
-	if err := os.WriteFile(cfgPath, data, 0o644); err != nil {
+	bad := filepath.Join(root, "bad.json")
+	if err := os.WriteFile(bad, []byte("invalid json {"), 0o644); err != nil {
 		t.Fatalf("write config: %v", err)
 	}
-
-	cfg := loadConfig(tmp)
-	if cfg.FastWorkers <= 0 {
-		t.Fatalf("FastWorkers not fixed up: %d", cfg.FastWorkers)
-	}
-	if cfg.SlowWorkers < 0 {
-		t.Fatalf("SlowWorkers not fixed up: %d", cfg.SlowWorkers)
-	}
-	if cfg.RequestTimeoutMs <= 0 {
-		t.Fatalf("RequestTimeoutMs not fixed up: %d", cfg.RequestTimeoutMs)
-	}
-	if cfg.MaxRequestsPerWorker <= 0 {
-		t.Fatalf("MaxRequestsPerWorker not fixed up: %d", cfg.MaxRequestsPerWorker)
+	if _, err := loadConfig(bad, root); err == nil {
+		t.Fatal("expected an error for an invalid named config file")
 	}
+}
 
-	if len(cfg.Static) == 0 {
-		t.Fatalf("expected static rules to be non-empty after validation")
-	}
-	for _, rule := range cfg.Static {
-		if !strings.HasPrefix(rule.Prefix, "/") {
-			t.Fatalf("static prefix still missing leading slash: %q", rule.Prefix)
-		}
-	}
-	if len(cfg.SlowRoutes) == 0 {
-		t.Fatalf("expected SlowRoutes to fall back to defaults")
-	}
-	if len(cfg.SlowMethods) == 0 {
-		t.Fatalf("expected SlowMethods to fall back to defaults")
-	}
-	if cfg.SlowBodyThreshold <= 0 {
-		t.Fatalf("expected SlowBodyThreshold to fall back to defaults")
+func TestLoadConfigDefaultFileFallsBack(t *testing.T) {
+	root := t.TempDir()
+	def := server.DefaultConfig()
+	cfg, err := loadConfig("", root) // no go_appserver.json
+	if err != nil || cfg.FastWorkers != def.FastWorkers {
+		t.Fatalf("missing default file should fall back to defaults: %v", err)
 	}
-}
 
-func TestLoadConfigInvalidJSON(t *testing.T) {
-	tmp := t.TempDir()
-	cfgPath := filepath.Join(tmp, "go_appserver.json")
-	if err := os.WriteFile(cfgPath, []byte("invalid json {"), 0o644); err != nil {
+	if err := os.WriteFile(filepath.Join(root, server.DefaultConfigFile), []byte("invalid json {"), 0o644); err != nil {
 		t.Fatalf("write config: %v", err)
 	}
-
-	cfg := loadConfig(tmp)
-	def := defaultConfig()
-	if cfg.FastWorkers != def.FastWorkers {
-		t.Fatalf("expected fallback to defaults on invalid JSON")
+	cfg, err = loadConfig("", root)
+	if err != nil || cfg.FastWorkers != def.FastWorkers {
+		t.Fatalf("invalid default file should fall back to defaults: %v", err)
 	}
-}
 
-func TestMapWorkerErrorToStatus(t *testing.T) {
-	if got := mapWorkerErrorToStatus(errors.New("timeout")); got != http.StatusGatewayTimeout {
-		t.Fatalf("timeout → %d, want %d", got, http.StatusGatewayTimeout)
-	}
-	if got := mapWorkerErrorToStatus(errors.New("broken pipe")); got != http.StatusBadGateway {
-		t.Fatalf("broken pipe → %d, want %d", got, http.StatusBadGateway)
-	}
-	if got := mapWorkerErrorToStatus(errors.New("unexpected EOF")); got != http.StatusBadGateway {
-		t.Fatalf("unexpected EOF → %d, want %d", got, http.StatusBadGateway)
-	}
-	if got := mapWorkerErrorToStatus(errors.New("connection reset")); got != http.StatusBadGateway {
-		t.Fatalf("connection reset → %d, want %d", got, http.StatusBadGateway)
-	}
-	if got := mapWorkerErrorToStatus(errors.New("something else")); got != http.StatusInternalServerError {
-		t.Fatalf("other error → %d, want %d", got, http.StatusInternalServerError)
+	if err := os.WriteFile(filepath.Join(root, server.DefaultConfigFile), []byte(`{"fast_workers": 3}`), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
 	}
-}
-
-func TestWriteWorkerErrorWritesStatus(t *testing.T) {
-	rr := httptest.NewRecorder()
-	writeWorkerError(rr, errors.New("timeout"))
-	resp := rr.Result()
-	if resp.StatusCode != http.StatusGatewayTimeout {
-		t.Fatalf("expected 504, got %d", resp.StatusCode)
+	if cfg, err = loadConfig("", root); err != nil || cfg.FastWorkers != 3 {
+		t.Fatalf("default file not loaded: %v", err)
 	}
 }
 
@@ -344,13 +140,16 @@ func TestMetricsEndRequestDecrementsInFlight(t *testing.T) {
 	}
 }
 
-func TestLogRequestJSONError(t *testing.T) {
-	// This test just ensures the error path is covered
-	// We can't easily test log output, but we can ensure it doesn't panic
-	entry := RequestLog{
-		Time: time.Now(),
+func TestAccessLogFormat(t *testing.T) {
+	if _, ok := accessLogFormat("off"); ok {
+		t.Fatalf("expected access_log=off to disable logging")
+	}
+	if f, ok := accessLogFormat("text"); !ok || f != server.AccessLogText {
+		t.Fatalf("expected text format, got %v (enabled=%v)", f, ok)
+	}
+	if f, ok := accessLogFormat(""); !ok || f != server.AccessLogJSON {
+		t.Fatalf("expected JSON to be the default, got %v (enabled=%v)", f, ok)
 	}
-	logRequestJSON(entry)
 }
 
 func TestAuthenticateWSWithJWT(t *testing.T) {
@@ -487,3 +286,27 @@ func TestAuthenticateWSWithJWTButEmptyUserID(t *testing.T) {
 		t.Fatalf("expected error for empty user ID")
 	}
 }
+
+func TestLoadErrorPages(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "errors"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "errors", "503.json"), []byte(`{"error":"busy"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := loadErrorPages(root, map[string]string{
+		"503": "errors/503.json",
+		"502": "errors/missing.html",
+		"200": "errors/503.json",
+		"abc": "errors/503.json",
+	})
+	if len(pages) != 1 {
+		t.Fatalf("expected only the 503 page, got %v", pages)
+	}
+	p := pages[http.StatusServiceUnavailable]
+	if string(p.Body) != `{"error":"busy"}` || p.ContentType != "application/json" {
+		t.Fatalf("503 page: %q (%s)", p.Body, p.ContentType)
+	}
+}
@@ -16,12 +16,42 @@ function build_server_array(array $payload): array
 
     $method = $payload['method'] ?? 'GET';
     $path = $payload['path'] ?? '/';
+    // the URI as the client sent it; the decoded query is only rebuilt
+    // for payloads without it (older Go, warm-up requests)
+    $rawPath = (string) ($payload['raw_path'] ?? '');
+    $uriPath = $rawPath !== '' ? $rawPath : $path;
+    $queryString = array_key_exists('raw_query', $payload)
+        ? (string) $payload['raw_query']
+        : encode_form_pairs($payload['query'] ?? []);
 
     $server['REQUEST_METHOD'] = $method;
-    $server['REQUEST_URI'] = $path;
+    $server['REQUEST_URI'] = $queryString !== '' ? $uriPath . '?' . $queryString : $uriPath;
+    $server['QUERY_STRING'] = $queryString;
     $server['SCRIPT_NAME'] = $path;
     $server['PHP_SELF'] = $path;
 
+    // ---- Client connection details ----
+    $scheme = ($payload['scheme'] ?? 'http') === 'https' ? 'https' : 'http';
+    $server['REQUEST_SCHEME'] = $scheme;
+    $server['SERVER_PORT'] = $scheme === 'https' ? '443' : '80';
+    if ($scheme === 'https') {
+        $server['HTTPS'] = 'on';
+    }
+
+    if (!empty($payload['remote_addr'])) {
+        $server['REMOTE_ADDR'] = (string) $payload['remote_addr'];
+    }
+
+    if (!empty($payload['host'])) {
+        $host = (string) $payload['host'];
+        $server['HTTP_HOST'] = $host;
+        $server['SERVER_NAME'] = preg_replace('/:\d+$/', '', $host);
+
+        if (preg_match('/:(\d+)$/', $host, $m)) {
+            $server['SERVER_PORT'] = $m[1];
+        }
+    }
+
     $headers = $payload['headers'] ?? [];
 
     // Map headers to PHP-style SERVER keys
@@ -38,8 +68,8 @@ function build_server_array(array $payload): array
 
         // Host -> SERVER_NAME / HTTP_HOST
         if ($normalized === 'host') {
-            $server['HTTP_HOST'] = $valueString;
-            $server['SERVER_NAME'] = $valueString;
+            $server['HTTP_HOST'] ??= $valueString;
+            $server['SERVER_NAME'] ??= $valueString;
             continue;
         }
 
@@ -62,6 +92,89 @@ function build_server_array(array $payload): array
     return $server;
 }
 
+/**
+ * Re-encode Go's map[string][]string (query or form fields) as a
+ * urlencoded string, keeping repeated keys.
+ */
+function encode_form_pairs(array $fields): string
+{
+    $pairs = [];
+    foreach ($fields as $name => $values) {
+        foreach ((array) $values as $value) {
+            $pairs[] = urlencode((string) $name) . '=' . urlencode((string) $value);
+        }
+    }
+
+    return implode('&', $pairs);
+}
+
+/**
+ * Build a $_POST style array from Go's map[string][]string form fields.
+ * Fields named like "tags[]" are passed through parse_str so PHP array
+ * syntax keeps working. Also used for the query ($_GET).
+ */
+function build_post_array(array $form): array
+{
+    $post = [];
+    parse_str(encode_form_pairs($form), $post);
+
+    return $post;
+}
+
+/**
+ * Build $_FILES from the upload descriptors sent by Go, in the shape PHP
+ * itself gives it: a field named with brackets ("photos[]", "doc[a][b]")
+ * nests below each of name, type, tmp_name, error and size, so several
+ * files can share a field, e.g. $_FILES['photos']['name'][0]. As with
+ * parse_str, a repeated field without brackets keeps the last file.
+ */
+function build_files_array(array $uploads): array
+{
+    $files = [];
+    foreach ($uploads as $upload) {
+        $field = (string) ($upload['field'] ?? '');
+        $bracket = strpos($field, '[');
+        $base = $bracket === false ? $field : substr($field, 0, $bracket);
+        if ($base === '') {
+            continue;
+        }
+
+        $info = [
+            'name'     => (string) ($upload['name'] ?? ''),
+            'type'     => (string) ($upload['type'] ?? ''),
+            'tmp_name' => (string) ($upload['tmp_name'] ?? ''),
+            'error'    => UPLOAD_ERR_OK,
+            'size'     => (int) ($upload['size'] ?? 0),
+        ];
+        if ($bracket === false) {
+            $files[$base] = $info;
+            continue;
+        }
+
+        preg_match_all('/\[([^\]]*)\]/', substr($field, $bracket), $matches);
+        foreach ($info as $attr => $value) {
+            if (!is_array($files[$base] ?? null)) {
+                $files[$base] = [];
+            }
+            $node = &$files[$base][$attr];
+            foreach ($matches[1] as $key) {
+                if (!is_array($node)) {
+                    $node = [];
+                }
+                if ($key === '') {
+                    $node[] = null;
+                    $key = array_key_last($node);
+                }
+                $node = &$node[$key];
+            }
+            $node = $value;
+            unset($node);
+        }
+    }
+
+    return $files;
+}
+
 /**
  * Convert Go → BareMetalPHP Request
  */
@@ -70,18 +183,17 @@ function make_baremetal_request(array $payload): Request
     // Build SERVER-style array first (REQUEST_METHOD, REQUEST_URI, HTTP_*, etc.)
     $server = build_server_array($payload);
 
-    // Raw body from Go payload
+    // Raw body from Go payload. A streamed body is left for the app to
+    // read with request_body_chunks(), except form posts, which need it
+    // parsed up front.
     $body = $payload['body'] ?? '';
-    $uri = $payload['uri'] ?? '/';
-
-
+    if (!empty($payload['body_stream'])
+        && str_starts_with($server['CONTENT_TYPE'] ?? '', 'application/x-www-form-urlencoded')) {
+        $body = implode('', iterator_to_array(request_body_chunks(), false));
+    }
 
     // ---- Initialize everything so we never pass null ----
-    $get     = [];
-    $parts = parse_url($uri);
-    if (!empty($parts['query'])) {
-        parse_str($parts['query'], $get);
-    }
+    $get     = build_post_array($payload['query'] ?? []);
     $post    = [];
     $files   = [];
 
@@ -91,16 +203,20 @@ function make_baremetal_request(array $payload): Request
     if (str_starts_with($contentType, 'application/x-www-form-urlencoded')) {
         parse_str($body, $post);
     } else if (str_starts_with($contentType, 'multipart/form-data')) {
-        // Real multipart parsing is non-trivial here.
-        // for now we leave $post / $files empty in Go mode.
-        $post = [];
-        $files = [];
+        // Go parses multipart bodies itself: fields arrive in 'form' and
+        // file parts are spooled to temp files described by 'files'.
+        // Note: the temp files were not created by PHP's upload handling,
+        // so move them with rename()/copy() rather than move_uploaded_file().
+        $post = build_post_array($payload['form'] ?? []);
+        $files = build_files_array($payload['files'] ?? []);
     }
 
-    // ---- Cookies: parse from HTTP_COOKIE header ----
+    // ---- Cookies: Go sends them parsed; fall back to HTTP_COOKIE ----
     $cookies = [];
     $cookieHeader = $server['HTTP_COOKIE'] ?? '';
-    if ($cookieHeader !== '') {
+    if (isset($payload['cookies']) && is_array($payload['cookies'])) {
+        $cookies = $payload['cookies'];
+    } else if ($cookieHeader !== '') {
         foreach (explode(';', $cookieHeader) as $cookiePart) {
             $cookiePart = trim($cookiePart);
 
@@ -175,22 +291,172 @@ function handle_bridge_request(array $payload, $kernel = null): array
 }
 
 
+/**
+ * ---- Frame codec (negotiated with Go at worker startup) ---
+ *
+ * Go sets GO_PHP_CODEC when it wants something other than JSON. We use
+ * MessagePack only if the msgpack extension is available; worker.php
+ * reports the final choice to Go in its ready frame.
+ */
+
+ function bridge_codec(): string
+ {
+    static $codec = null;
+
+    if ($codec === null) {
+        $codec = 'json';
+        $requested = strtolower((string) getenv('GO_PHP_CODEC'));
+
+        if ($requested === 'msgpack') {
+            if (function_exists('msgpack_pack')) {
+                $codec = 'msgpack';
+            } else {
+                fwrite(STDERR, "worker: msgpack extension not loaded, falling back to json\n");
+            }
+        }
+    }
+
+    return $codec;
+ }
+
+ /**
+  * The frame protocol version Go speaks, from GO_PHP_PROTOCOL (see
+  * ProtocolVersion in server/protocol.go). Go that predates versions
+  * doesn't set it and speaks 1.
+  */
+ function bridge_go_protocol(): int
+ {
+    return max((int) getenv('GO_PHP_PROTOCOL'), 1);
+ }
+
+ function bridge_encode(mixed $value): string|false
+ {
+    if (bridge_codec() === 'msgpack') {
+        return msgpack_pack($value);
+    }
+
+    return json_encode($value, JSON_UNESCAPED_SLASHES);
+ }
+
+ function bridge_decode(string $data): mixed
+ {
+    if (bridge_codec() === 'msgpack') {
+        return msgpack_unpack($data);
+    }
+
+    return json_decode($data, true);
+ }
+
+
+/**
+ * ---- Streamed request bodies ---
+ *
+ * When Go sets 'body_stream' on a request, the body follows the request
+ * frame as 'chunk' frames and a final 'end' frame on stdin. worker.php
+ * calls bridge_begin_body() before handling such a request and
+ * bridge_finish_body() after, so whatever the app leaves unread is
+ * skipped before the next request frame.
+ */
+
+ /**
+  * The stdin handle of a request whose body is still being streamed, or
+  * null, by reference.
+  */
+ function &bridge_body_source()
+ {
+    static $source = null;
+
+    return $source;
+ }
+
+ function bridge_begin_body($stdin): void
+ {
+    $source = &bridge_body_source();
+    $source = $stdin;
+ }
+
+ /**
+  * Yield the streamed request body chunk by chunk. Yields nothing when the
+  * body was sent inline (use the request's body then) or was already read.
+  */
+ function request_body_chunks(): \Generator
+ {
+    $source = &bridge_body_source();
+
+    while ($source !== null) {
+        $frame = bridge_read_frame($source);
+        if (!is_array($frame) || ($frame['type'] ?? '') !== 'chunk') {
+            // 'end', or the pipe broke; either way the body is over
+            $source = null;
+            break;
+        }
+
+        yield (string) ($frame['data'] ?? '');
+    }
+ }
+
+ function bridge_finish_body(): void
+ {
+    foreach (request_body_chunks() as $_) {
+        // skip what the app did not read
+    }
+ }
+
+ function bridge_read_frame($stream): mixed
+ {
+    $hdr = fread($stream, 4);
+    if ($hdr === false || strlen($hdr) < 4) {
+        return null;
+    }
+
+    $len = unpack('Nlen', $hdr)['len'];
+    $data = '';
+    while (strlen($data) < $len) {
+        $part = fread($stream, $len - strlen($data));
+        if ($part === '' || $part === false) {
+            return null;
+        }
+        $data .= $part;
+    }
+
+    return bridge_decode($data);
+ }
+
+
 /**
  * ---- Streaming helpers (length-prefixed frames) ---
  */
 
+ /**
+  * The stream frames to Go go out on, by reference: null for STDOUT, or
+  * the connection when worker.php listens on a socket (GO_PHP_LISTEN).
+  */
+ function &bridge_output()
+ {
+    static $output = null;
+
+    return $output;
+ }
+
+ function bridge_set_output($stream): void
+ {
+    $output = &bridge_output();
+    $output = $stream;
+ }
+
  function send_stream_frame(array $frame): void
  {
-    $json = json_encode($frame, JSON_UNESCAPED_SLASHES);
-    if ($json === false) {
+    $encoded = bridge_encode($frame);
+    if ($encoded === false) {
         return;
     }
 
-    $len = strlen($json);
+    $len = strlen($encoded);
     $hdr = pack('N', $len); // 4-byte big-endian length
 
-    fwrite(STDOUT, $hdr . $json);
-    fflush(STDOUT);
+    $output = bridge_output() ?? STDOUT;
+    fwrite($output, $hdr . $encoded);
+    fflush($output);
  }
 
  function stream_response_headers(int $status, array $headers = [], ?string $data = null): void
@@ -217,9 +483,80 @@ function handle_bridge_request(array $payload, $kernel = null): array
     send_stream_frame($frame);
  }
 
- function stream_response_end(): void
+ /**
+  * End a streamed response. $trailers (name => value or list of values)
+  * are sent to the client as HTTP trailers after the body, e.g. a checksum
+  * or a status that was only known at the end.
+  */
+ function stream_response_end(array $trailers = []): void
+ {
+    $frame = ['type' => 'end'];
+    if ($trailers !== []) {
+        $frame['trailers'] = array_map(fn ($v) => array_values((array) $v), $trailers);
+    }
+
+    send_stream_frame($frame);
+ }
+
+
+ /**
+  * Bodies over this size are streamed to Go in chunks when it allows it
+  * (the stream_response field of the request), rather than held in one
+  * response frame.
+  */
+ const BRIDGE_STREAM_BODY_OVER = 1 << 20;
+ const BRIDGE_STREAM_CHUNK = 256 << 10;
+
+ /**
+  * Send a unary response as a streamed one: headers with its
+  * Content-Length, the body in chunks, then the end frame. worker.php uses
+  * it for large bodies when Go set stream_response.
+  */
+ function stream_response_body(int $status, array $headers, string $body, array $trailers = []): void
+ {
+    $headers = array_map(fn ($v) => array_values((array) $v), $headers);
+    if ($trailers === []) {
+        $headers['Content-Length'] = [(string) strlen($body)];
+    }
+    stream_response_headers($status, $headers);
+    for ($off = 0, $len = strlen($body); $off < $len; $off += BRIDGE_STREAM_CHUNK) {
+        stream_response_chunk(substr($body, $off, BRIDGE_STREAM_CHUNK));
+    }
+    stream_response_end($trailers);
+ }
+
+ /**
+  * Thrown by retry_elsewhere(); worker.php turns it into a retry frame.
+  */
+ final class BridgeRetryElsewhere extends \RuntimeException
  {
-    send_stream_frame(['type' => 'end']);
+ }
+
+ /**
+  * Give the current request back to Go instead of answering it, when the
+  * worker finds itself in a bad state (a stale database connection, say)
+  * before acting on the request. Go recycles this worker and, for a
+  * request that is safe to repeat, runs it once more on another; anything
+  * else gets a 503. Call it before sending any streamed output.
+  */
+ function retry_elsewhere(string $reason = ''): never
+ {
+    throw new BridgeRetryElsewhere($reason);
+ }
+
+ /**
+  * Publish an event to the Go SSE hub. Works in both unary and streaming
+  * mode and may be called any number of times while handling a request;
+  * subscribers of $channel receive $data JSON-encoded.
+  */
+ function publish_event(string $channel, string $event, mixed $data = null): void
+ {
+    send_stream_frame([
+        'type' => 'publish',
+        'channel' => $channel,
+        'event' => $event,
+        'payload' => $data,
+    ]);
  }
 
 
@@ -237,4 +574,203 @@ function handle_bridge_request(array $payload, $kernel = null): array
 
     stream_response_headers($status, $headers, $body);
     stream_response_end();
- }
\ No newline at end of file
+ }
+
+
+/**
+ * ---- WebSocket sessions ---
+ *
+ * Go hands WebSocket upgrades on its websocket_routes to the handler
+ * registered with on_websocket(), which gets the request payload. It
+ * either refuses with ws_refuse(), or calls ws_accept() and then talks to
+ * the client with ws_receive() and ws_send() until ws_receive() returns
+ * null (the client left) or it calls ws_close(). Go's 'close' frame is always the last one of a session, so
+ * ws_close() reads up to it before the worker takes the next request.
+ */
+
+ /**
+  * The session state, by reference: the stdin handle while a session is
+  * open, and whether it was accepted and has ended.
+  */
+ function &bridge_ws_state(): array
+ {
+    static $state = ['stdin' => null, 'accepted' => false, 'ended' => false, 'closed' => false];
+
+    return $state;
+ }
+
+ /**
+  * The WebSocket handler set with on_websocket(), by reference.
+  */
+ function &bridge_ws_handler()
+ {
+    static $handler = null;
+
+    return $handler;
+ }
+
+ /**
+  * Handle WebSocket upgrades with $handler(array $payload).
+  */
+ function on_websocket(callable $handler): void
+ {
+    $h = &bridge_ws_handler();
+    $h = $handler;
+ }
+
+ /**
+  * Accept the upgrade. $headers (e.g. Sec-WebSocket-Protocol, Set-Cookie)
+  * go out with the handshake.
+  */
+ function ws_accept(array $headers = []): void
+ {
+    $state = &bridge_ws_state();
+    if ($state['accepted'] || $state['ended']) {
+        return;
+    }
+
+    $state['accepted'] = true;
+    send_stream_frame(['type' => 'headers', 'status' => 101, 'headers' => bridge_ws_headers($headers)]);
+ }
+
+ /**
+  * Refuse the upgrade with a plain HTTP response.
+  */
+ function ws_refuse(int $status, array $headers = [], string $body = ''): void
+ {
+    $state = &bridge_ws_state();
+    if ($state['accepted'] || $state['ended']) {
+        return;
+    }
+
+    $state['ended'] = true;
+    send_stream_frame(['type' => 'headers', 'status' => $status, 'headers' => bridge_ws_headers($headers), 'data' => $body]);
+    stream_response_end();
+ }
+
+ /**
+  * Headers as Go reads them: name => list of values, an object in JSON.
+  */
+ function bridge_ws_headers(array $headers): array|object
+ {
+    $headers = array_map(fn ($v) => array_values((array) $v), $headers);
+
+    return bridge_codec() === 'json' ? (object) $headers : $headers;
+ }
+
+ /**
+  * Wait for the next client message: ['data' => string, 'binary' => bool],
+  * or null once the session is closing ($code and $reason then say why).
+  */
+ function ws_receive(?int &$code = null, ?string &$reason = null): ?array
+ {
+    $state = &bridge_ws_state();
+
+    while ($state['stdin'] !== null && !$state['closed']) {
+        $frame = bridge_read_frame($state['stdin']);
+        if (!is_array($frame)) {
+            // the pipe broke; nothing more will come
+            $state['closed'] = true;
+            break;
+        }
+
+        if (($frame['type'] ?? '') === 'close') {
+            $state['closed'] = true;
+            $code = (int) ($frame['status'] ?? 1005);
+            $reason = (string) ($frame['data'] ?? '');
+            break;
+        }
+
+        if ($state['ended'] || ($frame['type'] ?? '') !== 'message') {
+            continue;
+        }
+
+        $binary = !empty($frame['binary']);
+        $data = (string) ($frame['data'] ?? '');
+
+        return [
+            'data' => $binary ? (string) base64_decode($data) : $data,
+            'binary' => $binary,
+        ];
+    }
+
+    return null;
+ }
+
+ /**
+  * Send a message to the client.
+  */
+ function ws_send(string $data, bool $binary = false): void
+ {
+    $state = &bridge_ws_state();
+    if ($state['ended']) {
+        return;
+    }
+
+    $frame = ['type' => 'message', 'data' => $binary ? base64_encode($data) : $data];
+    if ($binary) {
+        $frame['binary'] = true;
+    }
+
+    send_stream_frame($frame);
+ }
+
+ /**
+  * End the session, closing the client connection with $code and $reason.
+  */
+ function ws_close(int $code = 1000, string $reason = ''): void
+ {
+    bridge_ws_end(['type' => 'end', 'status' => $code, 'data' => $reason]);
+ }
+
+ /**
+  * End the session with an error: the client sees 1011, or the error
+  * status if the upgrade was not accepted yet.
+  */
+ function ws_fail(string $message): void
+ {
+    bridge_ws_end(['type' => 'error', 'error' => $message]);
+ }
+
+ function bridge_ws_end(array $frame): void
+ {
+    $state = &bridge_ws_state();
+    if ($state['stdin'] === null || $state['ended']) {
+        return;
+    }
+
+    $state['ended'] = true;
+    send_stream_frame($frame);
+
+    if ($state['accepted']) {
+        // skip what the client sent meanwhile, up to Go's close frame
+        while (ws_receive() !== null) {
+        }
+    }
+ }
+
+ function handle_bridge_websocket(array $payload, $stdin): void
+ {
+    $state = &bridge_ws_state();
+    $state = ['stdin' => $stdin, 'accepted' => false, 'ended' => false, 'closed' => false];
+
+    try {
+        $handler = bridge_ws_handler();
+        if ($handler === null) {
+            ws_refuse(404, ['Content-Type' => 'text/plain; charset=UTF-8'], 'Not Found');
+            return;
+        }
+
+        $handler($payload);
+
+        if ($state['accepted']) {
+            ws_close();
+        }
+    } finally {
+        // an exception, or a handler that never answered the upgrade;
+        // a no-op once the session ended
+        ws_fail('WebSocket handler failed');
+        $state['stdin'] = null;
+    }
+ }
+
@@ -35,6 +35,33 @@ try {
 // HELPERS
 // -------------------------------------------------------------
 
+// The frame protocol version this worker speaks; see ProtocolVersion in
+// server/protocol.go.
+const WORKER_PROTOCOL = 3;
+
+/**
+ * Give a request back to Go (see retry_elsewhere() in bridge.php) with a
+ * retry frame, or answer 503 to Go too old to know one.
+ */
+function worker_retry_elsewhere(array $payload, BridgeRetryElsewhere $e, $stderr): void
+{
+    fwrite($stderr, "worker: giving request back: " . $e->getMessage() . "\n");
+    if (bridge_go_protocol() >= 3) {
+        send_stream_frame(['type' => 'retry', 'id' => $payload['id'] ?? '', 'error' => $e->getMessage()]);
+        return;
+    }
+    if (worker_wants_streaming($payload)) {
+        send_stream_frame(['type' => 'error', 'status' => 503, 'error' => 'Service Unavailable']);
+        return;
+    }
+    send_stream_frame([
+        'id'      => $payload['id'] ?? null,
+        'status'  => 503,
+        'headers' => ['Content-Type' => 'text/plain; charset=UTF-8'],
+        'body'    => 'Service Unavailable',
+    ]);
+}
+
 /**
  * Read exactly $length bytes from a stream or return null on failure.
  */
@@ -74,12 +101,85 @@ function worker_wants_streaming(array $payload): bool
     return false;
 }
 
+/**
+ * Listen on $address ("unix:///path" or "tcp://host:port") and fork a
+ * child for each connection from Go. Only the child returns, with the
+ * connection; the parent keeps accepting until it is killed.
+ */
+function worker_listen(string $address, $stderr)
+{
+    if (!function_exists('pcntl_fork')) {
+        fwrite($stderr, "worker: GO_PHP_LISTEN needs the pcntl extension\n");
+        exit(1);
+    }
+
+    if (str_starts_with($address, 'unix://')) {
+        // a socket left behind by an earlier run
+        @unlink(substr($address, strlen('unix://')));
+    }
+    $server = stream_socket_server($address, $errno, $errstr);
+    if ($server === false) {
+        fwrite($stderr, "worker: listening on {$address} failed: {$errstr}\n");
+        exit(1);
+    }
+    fwrite($stderr, "worker: listening on {$address}\n");
+
+    while (true) {
+        $conn = @stream_socket_accept($server, -1);
+
+        // reap children whose connection ended
+        while (pcntl_waitpid(-1, $status, WNOHANG) > 0) {
+        }
+
+        if ($conn === false) {
+            continue;
+        }
+
+        $pid = pcntl_fork();
+        if ($pid === -1) {
+            fwrite($stderr, "worker: fork failed\n");
+            fclose($conn);
+            continue;
+        }
+        if ($pid === 0) {
+            fclose($server);
+            return $conn;
+        }
+        fclose($conn);
+    }
+}
+
 // -------------------------------------------------------------
 // WORKER LOOP
 // -------------------------------------------------------------
 $stdin  = fopen("php://stdin",  "rb");
 $stdout = fopen("php://stdout", "wb");
 
+// Serve Go over a socket instead of stdin/stdout, one process per
+// connection (see WorkerConfig.Address). Go doesn't handshake over a
+// socket, so these workers always speak JSON and send no ready frame.
+$listen = (string) getenv('GO_PHP_LISTEN');
+if ($listen !== '') {
+    if ((string) getenv('GO_PHP_CODEC') !== '') {
+        fwrite($stderr, "worker: GO_PHP_CODEC is ignored with GO_PHP_LISTEN, using json\n");
+        putenv('GO_PHP_CODEC');
+    }
+    // nor does it say which protocol version it speaks: assume ours
+    putenv('GO_PHP_PROTOCOL=' . WORKER_PROTOCOL);
+    $stdin = $stdout = worker_listen($listen, $stderr);
+    bridge_set_output($stdout);
+}
+
+// Tell Go which codec and protocol version we'll speak (see
+// ProtocolVersion in server/protocol.go). The ready frame itself is
+// always JSON. Go that predates protocol versions only expects it when
+// it asked for a non-default codec.
+if ($listen === '' && ((string) getenv('GO_PHP_PROTOCOL') !== '' || (string) getenv('GO_PHP_CODEC') !== '')) {
+    $ready = json_encode(['type' => 'ready', 'codec' => bridge_codec(), 'protocol' => WORKER_PROTOCOL]);
+    fwrite($stdout, pack("N", strlen($ready)) . $ready);
+    fflush($stdout);
+}
+
 while (true) {
     // ----- 1. Read 4-byte length header -----
     $lenData = fread($stdin, 4);
@@ -102,16 +202,42 @@ while (true) {
         continue;
     }
 
-    // ----- 2. Read JSON payload of given length -----
-    $json = worker_read_exact($stdin, $length);
-    if ($json === null) {
+    // ----- 2. Read the encoded payload of given length -----
+    $raw = worker_read_exact($stdin, $length);
+    if ($raw === null) {
         fwrite($stderr, "worker: failed to read full request payload\n");
         break;
     }
 
-    $payload = json_decode($json, true);
+    $payload = bridge_decode($raw);
     if (!is_array($payload)) {
-        fwrite($stderr, "worker: invalid JSON payload: " . json_last_error_msg() . "\n");
+        fwrite($stderr, "worker: invalid " . bridge_codec() . " payload\n");
+        continue;
+    }
+
+    // Go checks that an idle worker still answers; see SetPing.
+    if (($payload['type'] ?? null) === 'ping') {
+        $pong = bridge_encode(['type' => 'pong']);
+        fwrite($stdout, pack("N", strlen($pong)) . $pong);
+        fflush($stdout);
+        continue;
+    }
+
+    // The body follows as chunk frames; the app reads them through
+    // request_body_chunks() and we skip the rest once it is done.
+    if (!empty($payload['body_stream'])) {
+        bridge_begin_body($stdin);
+    }
+
+    // WebSocket upgrades run a message session on the pipe until Go's
+    // close frame; see bridge.php.
+    if (!empty($payload['websocket'])) {
+        try {
+            handle_bridge_websocket($payload, $stdin);
+        } catch (\Throwable $e) {
+            // the bridge already ended the session with an error
+            fwrite($stderr, "worker: websocket exception " . $e->getMessage() . "\n");
+        }
         continue;
     }
 
@@ -123,6 +249,8 @@ while (true) {
         // - bridge.php will emit length-prefixed frames using send_stream_frame()
         try {
             handle_bridge_request_streaming($payload);
+        } catch (BridgeRetryElsewhere $e) {
+            worker_retry_elsewhere($payload, $e, $stderr);
         } catch (\Throwable $e) {
             fwrite($stderr, "worker: streaming exception " . $e->getMessage() . "\n");
             // Best-effort error frame
@@ -133,12 +261,17 @@ while (true) {
                 ]);
             }
         }
+        bridge_finish_body();
         continue;
     }
 
     // ----- 4. Non-streaming mode: single response -----
     try {
         $result = handle_bridge_request($payload);
+    } catch (BridgeRetryElsewhere $e) {
+        bridge_finish_body();
+        worker_retry_elsewhere($payload, $e, $stderr);
+        continue;
     } catch (\Throwable $e) {
         fwrite($stderr, "worker: unhandled exception " . $e->getMessage() . "\n");
 
@@ -148,6 +281,7 @@ while (true) {
             'body'    => "Internal Server Error",
         ];
     }
+    bridge_finish_body();
 
     // ----- Normalize headers so JSON always encodes an object -----
     $headersArray = $result['headers'] ?? [];
@@ -156,9 +290,20 @@ while (true) {
         $headersArray = [];
     }
 
+    // A large body goes out in chunks when Go takes it that way, so
+    // neither side holds it in one frame.
+    $body = (string) ($result['body'] ?? '');
+    if (!empty($payload['stream_response']) && strlen($body) > BRIDGE_STREAM_BODY_OVER) {
+        $trailers = is_array($result['trailers'] ?? null) ? $result['trailers'] : [];
+        stream_response_body((int) ($result['status'] ?? 200), $headersArray, $body, $trailers);
+        continue;
+    }
+
     // If it's an empty array, we want {} in JSON, not [].
     // json_encode((object)[]) => "{}"
-    $headersObject = (object) $headersArray;
+    // (Go accepts an empty msgpack array as an empty map, so only JSON
+    // needs the object cast.)
+    $headersObject = bridge_codec() === 'json' ? (object) $headersArray : $headersArray;
 
     // ----- 5. Package response for Go -----
     $response = [
@@ -168,15 +313,20 @@ while (true) {
         'body'    => $result['body'] ?? '',
     ];
 
-    $outJson = json_encode($response);
-    if ($outJson === false) {
-        fwrite($stderr, "worker: json_encode failed: " . json_last_error_msg() . "\n");
+    // Optional HTTP trailers, sent after the body
+    if (!empty($result['trailers']) && is_array($result['trailers'])) {
+        $response['trailers'] = bridge_codec() === 'json' ? (object) $result['trailers'] : $result['trailers'];
+    }
+
+    $out = bridge_encode($response);
+    if ($out === false) {
+        fwrite($stderr, "worker: encoding response failed: " . json_last_error_msg() . "\n");
         continue;
     }
 
-    $outLen = pack("N", strlen($outJson));
+    $outLen = pack("N", strlen($out));
 
     fwrite($stdout, $outLen);
-    fwrite($stdout, $outJson);
+    fwrite($stdout, $out);
     fflush($stdout);
 }
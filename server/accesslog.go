@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects how AccessLog renders entries written to an io.Writer.
+type AccessLogFormat int
+
+const (
+	// AccessLogText writes one human-readable line per request.
+	AccessLogText AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON
+)
+
+// AccessLogEntry is a single access log record.
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	ID         string        `json:"id,omitempty"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	DurationMs float64       `json:"duration_ms"`
+	Pool       string        `json:"pool,omitempty"` // "fast" or "slow"; empty when PHP wasn't involved
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	ClientIP   string        `json:"client_ip,omitempty"` // resolved through trusted proxies
+	UserAgent  string        `json:"user_agent,omitempty"`
+}
+
+// AccessLogConfig configures the AccessLog middleware.
+type AccessLogConfig struct {
+	// Logger, if set, receives every entry as an Info record and takes
+	// precedence over Writer/Format.
+	Logger *slog.Logger
+
+	// Writer receives entries rendered in Format. Defaults to os.Stdout.
+	Writer io.Writer
+	Format AccessLogFormat
+}
+
+type requestInfoKey struct{}
+
+// requestInfo carries details discovered while handling a request (such as
+// the pool that served it) back out to the access log.
+type requestInfo struct {
+	mu   sync.Mutex
+	pool string
+}
+
+// withRequestInfo attaches a fresh requestInfo to the request context.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// setRequestPool records which pool served the request, if anyone is listening.
+func setRequestPool(ctx context.Context, pool string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.pool = pool
+		info.mu.Unlock()
+	}
+}
+
+func (i *requestInfo) Pool() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.pool
+}
+
+// AccessLog returns a middleware that records one entry per request with
+// the final status and body size, the duration, the pool that handled the
+// request and its X-Request-Id.
+func AccessLog(cfg AccessLogConfig) Middleware {
+	if cfg.Writer == nil {
+		cfg.Writer = os.Stdout
+	}
+	var mu sync.Mutex // serializes writes to cfg.Writer
+
+	emit := func(ctx context.Context, e AccessLogEntry) {
+		if cfg.Logger != nil {
+			cfg.Logger.LogAttrs(ctx, slog.LevelInfo, "request",
+				slog.String("id", e.ID),
+				slog.String("method", e.Method),
+				slog.String("path", e.Path),
+				slog.Int("status", e.Status),
+				slog.Int64("bytes", e.Bytes),
+				slog.Duration("duration", e.Duration),
+				slog.String("pool", e.Pool),
+				slog.String("remote_addr", e.RemoteAddr),
+				slog.String("client_ip", e.ClientIP),
+				slog.String("user_agent", e.UserAgent),
+			)
+			return
+		}
+
+		var line []byte
+		if cfg.Format == AccessLogJSON {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			line = append(b, '\n')
+		} else {
+			line = []byte(formatAccessLogText(e))
+		}
+
+		mu.Lock()
+		_, _ = cfg.Writer.Write(line)
+		mu.Unlock()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, info := withRequestInfo(r)
+
+			sw := NewStatusWriter(w)
+			next.ServeHTTP(sw, r)
+
+			status := sw.Status
+			if status == 0 {
+				// handler wrote nothing at all; net/http sends 200
+				status = http.StatusOK
+			}
+
+			elapsed := time.Since(start)
+			emit(r.Context(), AccessLogEntry{
+				Time:       start,
+				ID:         r.Header.Get("X-Request-Id"),
+				Method:     r.Method,
+				Path:       r.URL.RequestURI(),
+				Status:     status,
+				Bytes:      sw.Bytes,
+				Duration:   elapsed,
+				DurationMs: float64(elapsed.Microseconds()) / 1000,
+				Pool:       info.Pool(),
+				RemoteAddr: r.RemoteAddr,
+				ClientIP:   ClientIP(r),
+				UserAgent:  r.UserAgent(),
+			})
+		})
+	}
+}
+
+func formatAccessLogText(e AccessLogEntry) string {
+	pool := e.Pool
+	if pool == "" {
+		pool = "-"
+	}
+	id := e.ID
+	if id == "" {
+		id = "-"
+	}
+	client := e.ClientIP
+	if client == "" {
+		client = e.RemoteAddr
+	}
+	return fmt.Sprintf("%s %s %q %d %d %s pool=%s id=%s\n",
+		e.Time.Format(time.RFC3339),
+		client,
+		e.Method+" "+e.Path,
+		e.Status,
+		e.Bytes,
+		e.Duration.Round(time.Microsecond),
+		pool,
+		id,
+	)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogJSONRecordsPoolAndStatus(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+
+	buf := new(bytes.Buffer)
+	h := Chain(NewHandler(s),
+		RequestID,
+		AccessLog(AccessLogConfig{Writer: buf, Format: AccessLogJSON}),
+	)
+
+	r := httptest.NewRequest(http.MethodGet, "/hello?x=1", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unmarshal access log %q: %v", buf.String(), err)
+	}
+
+	if entry.Method != http.MethodGet || entry.Path != "/hello?x=1" {
+		t.Fatalf("unexpected method/path: %#v", entry)
+	}
+	if entry.Status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", entry.Status)
+	}
+	if entry.Bytes != int64(len("w0:/hello")) { // fake worker echoes the payload path
+		t.Fatalf("unexpected byte count %d", entry.Bytes)
+	}
+	if entry.Pool != "fast" {
+		t.Fatalf("expected pool=fast, got %q", entry.Pool)
+	}
+	if entry.ID != "req-1" {
+		t.Fatalf("expected request id req-1, got %q", entry.ID)
+	}
+}
+
+func TestAccessLogTextCapturesHandlerStatus(t *testing.T) {
+	buf := new(bytes.Buffer)
+	h := AccessLog(AccessLogConfig{Writer: buf})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/brew", nil))
+
+	line := buf.String()
+	if !strings.Contains(line, `"POST /brew" 418`) {
+		t.Fatalf("unexpected text access log line: %q", line)
+	}
+	if !strings.Contains(line, "pool=-") {
+		t.Fatalf("expected empty pool to be rendered as '-': %q", line)
+	}
+}
+
+func TestAccessLogSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(buf, nil))
+
+	h := AccessLog(AccessLogConfig{Logger: logger})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("unmarshal slog record %q: %v", buf.String(), err)
+	}
+	if rec["msg"] != "request" || rec["status"] != float64(200) || rec["bytes"] != float64(2) {
+		t.Fatalf("unexpected slog record: %v", rec)
+	}
+}
+
+func TestAccessLogRecordsResolvedClientIP(t *testing.T) {
+	tp, _ := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	buf := new(bytes.Buffer)
+	h := Chain(http.NotFoundHandler(),
+		RealIP(tp),
+		AccessLog(AccessLogConfig{Writer: buf, Format: AccessLogJSON}),
+	)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry AccessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unmarshal access log %q: %v", buf.String(), err)
+	}
+	if entry.ClientIP != "198.51.100.7" || entry.RemoteAddr != "10.0.0.1:5555" {
+		t.Fatalf("unexpected addresses: client=%q remote=%q", entry.ClientIP, entry.RemoteAddr)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import "net/http"
+
+// AppConfig configures NewAppHandler.
+type AppConfig struct {
+	// Root is the project root the Static rule directories are relative to.
+	Root string
+	// Static rules serve files before PHP sees a request, and again when
+	// PHP answers 404; StaticFallback narrows or turns off the latter.
+	Static         []StaticRule
+	StaticFallback StaticFallback
+
+	// Middleware wraps the whole handler, static files included; the
+	// first one is the outermost.
+	Middleware []Middleware
+	// DispatchMiddleware wraps only the requests that go to PHP.
+	DispatchMiddleware []Middleware
+}
+
+// NewAppHandler returns the handler cmd/server serves at "/": static
+// files for the configured rules, then the PHP workers of s, with the
+// static rules as a fallback when PHP answers 404 for a path under one of
+// their prefixes (see StaticFallback). It can be mounted in
+// any mux next to other Go routes:
+//
+//	mux.Handle("/php/", http.StripPrefix("/php", server.NewAppHandler(srv, cfg)))
+//
+// The handler doesn't own s: build it with NewServerWithConfig, and call
+// s.Shutdown when shutting down, as cmd/server does.
+func NewAppHandler(s *Server, cfg AppConfig) http.Handler {
+	dispatch := NewHandler(s)
+	var static Middleware
+	if len(cfg.Static) > 0 {
+		serveStatic := ServeStatic(cfg.Root, cfg.Static)
+		if !cfg.StaticFallback.Disabled {
+			dispatch.Fallback = cfg.StaticFallback.wrap(cfg.Static, serveStatic)
+			dispatch.FallbackStatuses = cfg.StaticFallback.Statuses
+		}
+		static = TryFirst(serveStatic)
+	}
+
+	h := Chain(dispatch, cfg.DispatchMiddleware...)
+	h = Chain(h, static)
+	return Chain(h, cfg.Middleware...)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppHandlerServesStaticThenPHP(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "public"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "public", "robots.txt"), []byte("User-agent: *"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	var dispatched []string
+	app := NewAppHandler(s, AppConfig{
+		Root:   root,
+		Static: []StaticRule{{Prefix: "/", Dir: "public"}},
+		Middleware: []Middleware{func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Outer", "1")
+				next.ServeHTTP(w, r)
+			})
+		}},
+		DispatchMiddleware: []Middleware{func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				dispatched = append(dispatched, r.URL.Path)
+				next.ServeHTTP(w, r)
+			})
+		}},
+	})
+
+	// mounted under a prefix of another mux
+	mux := http.NewServeMux()
+	mux.Handle("/php/", http.StripPrefix("/php", app))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/php/robots.txt", nil))
+	if rr.Body.String() != "User-agent: *" || rr.Header().Get("X-Outer") != "1" {
+		t.Fatalf("static file: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/php/hello", nil))
+	if rr.Body.String() != "w0:/hello" || rr.Header().Get("X-Outer") != "1" {
+		t.Fatalf("PHP route: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	if len(dispatched) != 1 || dispatched[0] != "/hello" {
+		t.Fatalf("dispatch middleware should only see PHP requests, saw %v", dispatched)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// Strategy is how a pool picks the worker for a request.
+type Strategy string
+
+const (
+	// RoundRobin cycles through the live workers. It is the default.
+	RoundRobin Strategy = "round_robin"
+
+	// LeastConnections picks the live worker with the fewest requests in
+	// flight, so a worker stuck on a long request is skipped.
+	LeastConnections Strategy = "least_connections"
+
+	// Sticky hashes a session cookie to a fixed worker, so a session keeps
+	// hitting the same warm worker. Requests without the cookie, or whose
+	// worker is dead, draining, busy or running a long request, fall back
+	// to round-robin.
+	Sticky Strategy = "sticky"
+)
+
+// DefaultStickyCookie is the cookie Sticky uses when none is configured.
+const DefaultStickyCookie = "PHPSESSID"
+
+// DefaultLongRequestThreshold is how long a worker must have been busy
+// before it counts as running a long request, unless
+// SetLongRequestThreshold says otherwise.
+const DefaultLongRequestThreshold = time.Second
+
+// ParseStrategy validates a strategy name from configuration. "" means
+// RoundRobin.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConnections, Sticky:
+		return Strategy(s), nil
+	}
+	return "", fmt.Errorf("unknown worker selection strategy %q", s)
+}
+
+// SetStrategy sets how the pool picks workers. cookie names the session
+// cookie for Sticky ("" uses DefaultStickyCookie) and is ignored otherwise.
+func (p *WorkerPool) SetStrategy(s Strategy, cookie string) {
+	if cookie == "" {
+		cookie = DefaultStickyCookie
+	}
+	p.mu.Lock()
+	p.strategy = s
+	p.stickyCookie = cookie
+	p.mu.Unlock()
+}
+
+// SetLongRequestThreshold sets how long a worker must have had requests in
+// flight before it counts as running a long request. Whatever the
+// strategy, a worker running a long request is only picked when every
+// other live worker is too, so a short request doesn't queue behind a
+// report on a worker's pipe while another worker could take it; see
+// WorkerStat.Long. 0 means DefaultLongRequestThreshold and a negative d
+// turns this off.
+func (p *WorkerPool) SetLongRequestThreshold(d time.Duration) {
+	p.mu.Lock()
+	p.longRequest = d
+	p.mu.Unlock()
+}
+
+// longRequestLocked returns the long request threshold, 0 when it is off;
+// p.mu must be held.
+func (p *WorkerPool) longRequestLocked() time.Duration {
+	switch {
+	case p.longRequest == 0:
+		return DefaultLongRequestThreshold
+	case p.longRequest < 0:
+		return 0
+	}
+	return p.longRequest
+}
+
+// isLongLocked reports whether w is running a long request as of now;
+// p.mu must be held.
+func (p *WorkerPool) isLongLocked(w *Worker, now time.Time) bool {
+	long := p.longRequestLocked()
+	return long > 0 && w.busyFor(now) >= long
+}
+
+// pickWorker returns the worker req should go to under the pool's
+// strategy, or nil if none is available.
+func (p *WorkerPool) pickWorker(req *RequestPayload) *Worker {
+	p.mu.Lock()
+	strategy, cookie := p.strategy, p.stickyCookie
+	p.mu.Unlock()
+
+	switch strategy {
+	case LeastConnections:
+		return p.leastConnections()
+	case Sticky:
+		if w := p.stickyWorker(req, cookie); w != nil {
+			return w
+		}
+	}
+	return p.NextWorker()
+}
+
+// leastConnections returns the live worker with the fewest in-flight
+// requests, scanning from the round-robin cursor so ties rotate. Workers
+// running a long request come last whatever their load.
+func (p *WorkerPool) leastConnections() *Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.workers)
+	now := time.Now()
+	var best *Worker
+	bestLoad, bestIdx, bestLong := 0, 0, false
+	for i := 0; i < n; i++ {
+		idx := (p.next + i) % n
+		w := p.workers[idx]
+		if w == nil || w.isDead() || w.isDraining() || w.isPinned() {
+			continue
+		}
+		load, long := w.getInFlight(), p.isLongLocked(w, now) || w.isWarming()
+		if best == nil || (bestLong && !long) || (long == bestLong && load < bestLoad) {
+			best, bestLoad, bestIdx, bestLong = w, load, idx, long
+		}
+	}
+	if best != nil {
+		p.next = (bestIdx + 1) % n
+	}
+	return best
+}
+
+// stickyWorker returns the worker the session cookie hashes to, or nil
+// if the request has no such cookie or that worker can't take it now.
+func (p *WorkerPool) stickyWorker(req *RequestPayload, cookie string) *Worker {
+	if req == nil {
+		return nil
+	}
+	session := req.Cookies[cookie]
+	if session == "" {
+		return nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(session))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.workers) == 0 {
+		return nil
+	}
+	w := p.workers[h.Sum32()%uint32(len(p.workers))]
+	if w == nil || w.isDead() || w.isDraining() || w.isPinned() || w.getInFlight() >= w.capacity() || p.isLongLocked(w, time.Now()) || w.isWarming() {
+		return nil
+	}
+	return w
+}
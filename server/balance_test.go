@@ -0,0 +1,140 @@
+package server
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStrategy(t *testing.T) {
+	for in, want := range map[string]Strategy{
+		"":                  RoundRobin,
+		"round_robin":       RoundRobin,
+		"least_connections": LeastConnections,
+		"sticky":            Sticky,
+	} {
+		got, err := ParseStrategy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseStrategy(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestLeastConnectionsPicksIdlestLiveWorker(t *testing.T) {
+	busy, idle, dead := &Worker{}, &Worker{}, &Worker{}
+	busy.incrInFlight()
+	busy.incrInFlight()
+	dead.markDead()
+
+	pool := &WorkerPool{workers: []*Worker{busy, dead, idle}}
+	pool.SetStrategy(LeastConnections, "")
+
+	for i := 0; i < 3; i++ {
+		if w := pool.pickWorker(&RequestPayload{}); w != idle {
+			t.Fatalf("pick %d: expected the idle worker, got %p", i, w)
+		}
+	}
+
+	idle.incrInFlight()
+	idle.incrInFlight()
+	idle.incrInFlight()
+	if w := pool.pickWorker(&RequestPayload{}); w != busy {
+		t.Fatalf("expected the less loaded worker once idle filled up, got %p", w)
+	}
+}
+
+func TestStickyRoutesSessionToSameWorker(t *testing.T) {
+	workers := []*Worker{{}, {}, {}, {}}
+	pool := &WorkerPool{workers: workers}
+	pool.SetStrategy(Sticky, "sid")
+
+	req := &RequestPayload{Cookies: map[string]string{"sid": "abc123"}}
+	first := pool.pickWorker(req)
+	if first == nil {
+		t.Fatal("no worker picked")
+	}
+	for i := 0; i < 5; i++ {
+		if w := pool.pickWorker(req); w != first {
+			t.Fatalf("pick %d: session moved to another worker", i)
+		}
+	}
+
+	// an unusable home worker falls back to round-robin
+	for _, unusable := range []func(){first.incrInFlight, first.startDraining} {
+		unusable()
+		if w := pool.pickWorker(req); w == first || w == nil {
+			t.Fatalf("expected fallback away from the home worker, got %p", w)
+		}
+	}
+}
+
+func TestStickyWithoutCookieRoundRobins(t *testing.T) {
+	a, b := &Worker{}, &Worker{}
+	pool := &WorkerPool{workers: []*Worker{a, b}}
+	pool.SetStrategy(Sticky, "")
+
+	req := &RequestPayload{Cookies: map[string]string{"other": "x"}}
+	if pool.pickWorker(req) != a || pool.pickWorker(req) != b {
+		t.Fatal("expected round-robin for requests without the session cookie")
+	}
+}
+
+// busyWith marks w as having had a request in flight for d.
+func busyWith(w *Worker, d time.Duration) {
+	w.stateMu.Lock()
+	w.incrInFlightLocked()
+	w.busySince = time.Now().Add(-d)
+	w.stateMu.Unlock()
+}
+
+func TestLongRequestWorkerIsPassedOver(t *testing.T) {
+	long, short, free := &Worker{}, &Worker{}, &Worker{}
+	busyWith(long, 5*time.Second)
+	busyWith(short, time.Millisecond)
+
+	pool := &WorkerPool{workers: []*Worker{long, short, free}}
+	for _, s := range []Strategy{RoundRobin, LeastConnections, Sticky} {
+		pool.SetStrategy(s, "")
+		for i := 0; i < 6; i++ {
+			req := &RequestPayload{Cookies: map[string]string{DefaultStickyCookie: strconv.Itoa(i)}}
+			if w := pool.pickWorker(req); w == long || w == nil {
+				t.Fatalf("%s pick %d: got the worker running a long request", s, i)
+			}
+		}
+	}
+	if !slices.ContainsFunc(pool.WorkerStats(), func(st WorkerStat) bool { return st.Index == 0 && st.Long && st.BusySeconds >= 5 }) {
+		t.Fatalf("the long request isn't in the stats: %+v", pool.WorkerStats())
+	}
+
+	// with every other worker gone it still gets requests
+	short.markDead()
+	free.startDraining()
+	if w := pool.NextWorker(); w != long {
+		t.Fatalf("expected the only live worker, got %p", w)
+	}
+
+	// and with the threshold off it is just busy
+	pool.SetLongRequestThreshold(-1)
+	short.state, free.state = WorkerIdle, WorkerIdle
+	pool.SetStrategy(RoundRobin, "")
+	if got := []*Worker{pool.NextWorker(), pool.NextWorker(), pool.NextWorker()}; !slices.Contains(got, long) {
+		t.Fatal("round-robin should reach every worker with the threshold off")
+	}
+}
+
+func TestLongRequestWorkerIsNotIdleForOverflow(t *testing.T) {
+	w := &Worker{maxConcurrent: 4}
+	busyWith(w, 2*time.Second)
+	pool := &WorkerPool{workers: []*Worker{w}}
+	if pool.hasIdleWorker() {
+		t.Fatal("a worker running a long request has a free slot but isn't idle")
+	}
+	pool.SetLongRequestThreshold(time.Minute)
+	if !pool.hasIdleWorker() {
+		t.Fatal("under the threshold the free slot counts")
+	}
+}
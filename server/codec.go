@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxFrameBytes caps a single length-prefixed frame read from a worker.
+const maxFrameBytes = 10 * 1024 * 1024
+
+// Codec encodes the bodies of the length-prefixed frames exchanged with
+// PHP workers. Struct fields are named after their json tags whatever the
+// codec, so PHP sees the same keys either way.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec is the default codec: slower and bigger than MessagePack but
+// readable when debugging the pipe.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                       { return "json" }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// MsgpackCodec encodes frames as MessagePack. Strings travel as raw bytes,
+// so binary bodies survive without escaping. The PHP side needs the
+// msgpack extension.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string                       { return "msgpack" }
+func (MsgpackCodec) Marshal(v any) ([]byte, error)      { return msgpackMarshal(v) }
+func (MsgpackCodec) Unmarshal(data []byte, v any) error { return msgpackUnmarshal(data, v) }
+
+// CodecByName returns the codec called name ("json" or "msgpack").
+func CodecByName(name string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "json":
+		return JSONCodec{}, nil
+	case "msgpack", "messagepack":
+		return MsgpackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// requestedCodec is the codec new workers should negotiate: the one
+// called name, or when name is "" the one GO_PHP_CODEC names. An unknown
+// name is an error; falling back to JSON would hide a typo.
+func requestedCodec(name string) (Codec, error) {
+	source := "codec"
+	if name == "" {
+		name, source = os.Getenv("GO_PHP_CODEC"), "GO_PHP_CODEC"
+	}
+	c, err := CodecByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return c, nil
+}
+
+// writeFrame encodes v with codec and writes it as one length-prefixed frame.
+func writeFrame(w io.Writer, codec Codec, v any) error {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	header := headerBufs.Get().(*[4]byte)
+	defer headerBufs.Put(header)
+	binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// bodyChunkSize is the most request body data sent in one chunk frame.
+const bodyChunkSize = 64 << 10
+
+// writeBodyFrames sends body to a worker as chunk frames followed by an
+// end frame.
+func writeBodyFrames(w io.Writer, codec Codec, body io.Reader) error {
+	buf := make([]byte, bodyChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := writeFrame(w, codec, StreamFrame{Type: "chunk", Data: string(buf[:n])}); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return writeFrame(w, codec, StreamFrame{Type: "end"})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maxLoggedFrame caps how much of a rejected frame is logged.
+const maxLoggedFrame = 256
+
+// frameSnippet returns frame for logging, cut to maxLoggedFrame bytes.
+func frameSnippet(frame []byte) string {
+	if len(frame) <= maxLoggedFrame {
+		return string(frame)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", frame[:maxLoggedFrame], len(frame))
+}
+
+// readFrame reads one length-prefixed frame body.
+//
+// The length covers the whole encoded envelope, never just the response
+// body, so a frame is never empty: a 204 with no body is still
+// {"status":204}. A zero length is a protocol error, as is one over
+// maxFrameBytes.
+func readFrame(r io.Reader) ([]byte, error) {
+	return readFrameInto(r, nil)
+}
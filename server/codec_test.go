@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecByName(t *testing.T) {
+	for name, want := range map[string]string{"": "json", "JSON": "json", "msgpack": "msgpack"} {
+		c, err := CodecByName(name)
+		if err != nil || c.Name() != want {
+			t.Errorf("CodecByName(%q) = %v, %v; want %s", name, c, err, want)
+		}
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
+
+func TestRequestedCodec(t *testing.T) {
+	t.Setenv("GO_PHP_CODEC", "msgpack")
+	if c, err := requestedCodec(""); err != nil || c.Name() != "msgpack" {
+		t.Fatalf("requestedCodec(\"\") = %v, %v; want GO_PHP_CODEC's msgpack", c, err)
+	}
+	if c, err := requestedCodec("json"); err != nil || c.Name() != "json" {
+		t.Fatalf("requestedCodec(\"json\") = %v, %v; want the name over GO_PHP_CODEC", c, err)
+	}
+	if _, err := requestedCodec("msgpak"); err == nil || !strings.Contains(err.Error(), "msgpak") {
+		t.Fatalf("expected an error naming the unknown codec, got %v", err)
+	}
+
+	t.Setenv("GO_PHP_CODEC", "xml")
+	if _, err := requestedCodec(""); err == nil || !strings.Contains(err.Error(), "GO_PHP_CODEC") {
+		t.Fatalf("expected an error naming GO_PHP_CODEC, got %v", err)
+	}
+	pool, err := NewPoolWithConfig(2, WorkerConfig{PHPBinary: "/bin/sh", Codec: "xml"})
+	if err == nil || pool != nil {
+		t.Fatalf("expected an unknown codec to fail the pool, got %v, %v", pool, err)
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, JSONCodec{}, readyFrame{Type: "ready", Codec: "msgpack"}); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	c, protocol, err := handshake(slog.Default(), &buf, MsgpackCodec{}, time.Second)
+	if err != nil || c.Name() != "msgpack" || protocol != 1 {
+		t.Fatalf("expected msgpack and protocol 1, got %v, %d, %v", c, protocol, err)
+	}
+
+	buf.Reset()
+	_ = writeFrame(&buf, JSONCodec{}, StreamFrame{Type: "chunk"})
+	if _, _, err := handshake(slog.Default(), &buf, MsgpackCodec{}, time.Second); err == nil {
+		t.Fatal("expected error for a non-ready handshake frame")
+	}
+}
+
+func TestHandleRequestWithMsgpackCodec(t *testing.T) {
+	var resp bytes.Buffer
+	if err := writeFrame(&resp, MsgpackCodec{}, ResponsePayload{Status: 200, Headers: map[string]string{"X-A": "1"}, Body: "\x00\xffok"}); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	var sent bytes.Buffer
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: &sent},
+		stdout: io.NopCloser(&resp),
+		codec:  MsgpackCodec{},
+	}
+
+	got, err := w.handleRequest(&RequestPayload{ID: "1", Method: "GET", Path: "/"})
+	if err != nil {
+		t.Fatalf("handleRequest: %v", err)
+	}
+	if got.Body != "\x00\xffok" || got.Headers["X-A"] != "1" {
+		t.Fatalf("unexpected response: %+v", got)
+	}
+
+	body, err := readFrame(&sent)
+	if err != nil {
+		t.Fatalf("reading sent frame: %v", err)
+	}
+	var req RequestPayload
+	if err := msgpackUnmarshal(body, &req); err != nil || req.Method != "GET" {
+		t.Fatalf("request not sent as msgpack: %+v, %v", req, err)
+	}
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	resp := ResponsePayload{
+		ID:      "bench",
+		Status:  200,
+		Headers: map[string]string{"Content-Type": "text/csv", "Content-Disposition": "attachment"},
+		Body:    strings.Repeat("2024-01-01,widget,42,19.99\n", 40000),
+	}
+	raw, err := codec.Marshal(resp)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		raw, _ := codec.Marshal(resp)
+		var out ResponsePayload
+		if err := codec.Unmarshal(raw, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecJSON(b *testing.B)    { benchmarkCodec(b, JSONCodec{}) }
+func BenchmarkCodecMsgpack(b *testing.B) { benchmarkCodec(b, MsgpackCodec{}) }
+
+func TestWriteBodyFramesChunksAndEnds(t *testing.T) {
+	body := strings.Repeat("a", bodyChunkSize+10)
+	var buf bytes.Buffer
+	if err := writeBodyFrames(&buf, JSONCodec{}, strings.NewReader(body)); err != nil {
+		t.Fatalf("writeBodyFrames: %v", err)
+	}
+
+	var types []string
+	var got strings.Builder
+	for {
+		raw, err := readFrame(&buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		var f StreamFrame
+		if err := json.Unmarshal(raw, &f); err != nil {
+			t.Fatalf("decode frame: %v", err)
+		}
+		types = append(types, f.Type)
+		got.WriteString(f.Data)
+	}
+
+	if !reflect.DeepEqual(types, []string{"chunk", "chunk", "end"}) {
+		t.Fatalf("frames = %v", types)
+	}
+	if got.String() != body {
+		t.Fatalf("reassembled %d bytes, want %d", got.Len(), len(body))
+	}
+}
+
+func TestReadFrameRejectsEmptyAndOversizedFrames(t *testing.T) {
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 0})); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("zero-length frame: expected ErrBadFrame, got %v", err)
+	}
+	huge := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := readFrame(bytes.NewReader(huge)); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("oversized frame: expected ErrBadFrame, got %v", err)
+	}
+}
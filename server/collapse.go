@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// CollapseRoute opts GET requests matching Prefix or Pattern (path.Match
+// syntax) into request collapsing; see SetCollapseRoutes. A route with
+// both matches either.
+type CollapseRoute struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+func (rt CollapseRoute) matches(p string) bool {
+	if rt.Prefix != "" && strings.HasPrefix(p, rt.Prefix) {
+		return true
+	}
+	if rt.Pattern != "" {
+		if ok, _ := path.Match(rt.Pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCollapseRoutes turns on request collapsing for GETs matching routes:
+// while one request for a host, path and query is with a worker, identical
+// requests arriving meanwhile don't take a worker of their own but wait
+// for it and get a copy of its response, or its error. Only responses that
+// are the same for every client may be collapsed, so it is opt-in by
+// route; Set-Cookie is never copied to the waiting requests. Requests with
+// a body and streamed requests are never collapsed. nil turns it off.
+func (s *Server) SetCollapseRoutes(routes []CollapseRoute) {
+	s.collapseRoutes = routes
+}
+
+// flight is a request in progress that identical ones wait for.
+type flight struct {
+	done chan struct{}
+	resp *ResponsePayload
+	err  error
+}
+
+// collapser tracks the requests in flight by key.
+type collapser struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// collapseKey returns the key identical requests share, or "" if req
+// can't be collapsed.
+func (s *Server) collapseKey(req *RequestPayload) string {
+	if req.Method != http.MethodGet || req.Body != "" || req.BodyStream || len(s.collapseRoutes) == 0 {
+		return ""
+	}
+	for _, rt := range s.collapseRoutes {
+		if rt.matches(req.Path) {
+			return req.Host + req.Path + "?" + url.Values(req.Query).Encode()
+		}
+	}
+	return ""
+}
+
+// do runs dispatch for the first request with key and has the requests
+// that arrive while it runs wait for its result instead.
+func (c *collapser) do(req *RequestPayload, key string, dispatch func() (*ResponsePayload, error)) (*ResponsePayload, error) {
+	c.mu.Lock()
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		req.traceAttr("php.collapsed", true)
+		return f.resp.copyFor(req), f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	resp, err := dispatch()
+	// the waiting requests copy from a copy: the caller may still change
+	// resp as it writes it out
+	f.resp, f.err = resp.copyFor(req), err
+	return resp, err
+}
+
+// copyFor returns a copy of resp for a collapsed request, without
+// Set-Cookie: a cookie set for one client must not reach the others.
+func (resp *ResponsePayload) copyFor(req *RequestPayload) *ResponsePayload {
+	if resp == nil {
+		return nil
+	}
+	cp := *resp
+	cp.ID = req.ID
+	cp.Headers = make(map[string]string, len(resp.Headers))
+	for k, v := range resp.Headers {
+		if !strings.EqualFold(k, "Set-Cookie") {
+			cp.Headers[k] = v
+		}
+	}
+	if resp.Trailers != nil {
+		cp.Trailers = make(map[string]string, len(resp.Trailers))
+		for k, v := range resp.Trailers {
+			cp.Trailers[k] = v
+		}
+	}
+	return &cp
+}
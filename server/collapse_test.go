@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollapserSharesOneDispatch(t *testing.T) {
+	var c collapser
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	dispatch := func() (*ResponsePayload, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return &ResponsePayload{ID: "leader", Status: 200, Body: "report",
+			Headers: map[string]string{"Content-Type": "text/html", "Set-Cookie": "sid=1"}}, nil
+	}
+
+	var wg sync.WaitGroup
+	resps := make([]*ResponsePayload, 5)
+	run := func(i int) {
+		defer wg.Done()
+		resp, err := c.do(&RequestPayload{ID: string(rune('a' + i))}, "/report?", dispatch)
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+		resps[i] = resp
+	}
+	wg.Add(1)
+	go run(0)
+	<-started
+	for i := 1; i < len(resps); i++ {
+		wg.Add(1)
+		go run(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("dispatched %d times, want once", n)
+	}
+	if resps[0].Headers["Set-Cookie"] != "sid=1" {
+		t.Fatal("the first request should keep its cookie")
+	}
+	for i, resp := range resps[1:] {
+		if resp.Body != "report" || resp.ID != string(rune('b'+i)) || resp.Headers["Content-Type"] != "text/html" {
+			t.Fatalf("collapsed response %d = %+v", i, resp)
+		}
+		if _, ok := resp.Headers["Set-Cookie"]; ok {
+			t.Fatalf("collapsed response %d got the cookie", i)
+		}
+	}
+
+	// the next request after it finished goes to a worker again
+	c.do(&RequestPayload{ID: "z"}, "/report?", func() (*ResponsePayload, error) { calls.Add(1); return nil, errors.New("x") })
+	if calls.Load() != 2 {
+		t.Fatal("a finished request should not be shared")
+	}
+}
+
+func TestCollapseKey(t *testing.T) {
+	s := &Server{}
+	get := &RequestPayload{Method: "GET", Host: "example.com", Path: "/report", Query: map[string][]string{"b": {"2"}, "a": {"1"}}}
+	if s.collapseKey(get) != "" {
+		t.Fatal("nothing is collapsed without routes")
+	}
+
+	s.SetCollapseRoutes([]CollapseRoute{{Prefix: "/report"}, {Pattern: "/pages/*"}})
+	if got := s.collapseKey(get); got != "example.com/report?a=1&b=2" {
+		t.Fatalf("key = %q", got)
+	}
+	for _, req := range []*RequestPayload{
+		{Method: "POST", Path: "/report"},
+		{Method: "GET", Path: "/report", Body: "x"},
+		{Method: "GET", Path: "/report", BodyStream: true},
+		{Method: "GET", Path: "/account"},
+	} {
+		if key := s.collapseKey(req); key != "" {
+			t.Errorf("%s %s should not be collapsed, key %q", req.Method, req.Path, key)
+		}
+	}
+	if s.collapseKey(&RequestPayload{Method: "GET", Path: "/pages/home"}) == "" {
+		t.Fatal("pattern routes should collapse too")
+	}
+}
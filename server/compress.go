@@ -0,0 +1,312 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressMinSize is the smallest response body Compress bothers
+// compressing when CompressConfig.MinSize is zero.
+const DefaultCompressMinSize = 1024
+
+// CompressConfig configures the Compress middleware.
+type CompressConfig struct {
+	// MinSize is the body size below which unary responses are sent
+	// uncompressed. Zero uses DefaultCompressMinSize. Responses that are
+	// flushed before reaching it (streams) are compressed regardless.
+	MinSize int
+
+	// Level is the gzip/zlib compression level; zero means the default.
+	Level int
+
+	// SkipTypes lists media types, or prefixes ending in "/", that are
+	// already compressed. Nil uses a default list of images, audio,
+	// video, fonts and archives.
+	SkipTypes []string
+}
+
+var defaultCompressSkipTypes = []string{
+	"image/", "audio/", "video/", "font/",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-7z-compressed", "application/x-rar-compressed",
+	"application/zstd", "application/wasm", "application/pdf", "application/octet-stream",
+}
+
+// Compress returns a middleware that gzip- or deflate-encodes responses
+// for clients that accept it. It works for both unary and streamed
+// responses: each Flush pushes the compressed bytes written so far to
+// the client, so stream chunks still arrive promptly.
+func Compress(cfg CompressConfig) Middleware {
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = DefaultCompressMinSize
+	}
+	if cfg.Level == 0 {
+		cfg.Level = gzip.DefaultCompression
+	}
+	if cfg.SkipTypes == nil {
+		cfg.SkipTypes = defaultCompressSkipTypes
+	}
+
+	c := &compressor{cfg: cfg}
+	c.gzip.New = func() any {
+		zw, err := gzip.NewWriterLevel(nil, cfg.Level)
+		if err != nil {
+			zw = gzip.NewWriter(nil)
+		}
+		return zw
+	}
+	c.zlib.New = func() any {
+		zw, err := zlib.NewWriterLevel(nil, cfg.Level)
+		if err != nil {
+			zw = zlib.NewWriter(nil)
+		}
+		return zw
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cw := &compressWriter{
+				ResponseWriter: w,
+				c:              c,
+				encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+				head:           r.Method == http.MethodHead,
+			}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+type compressor struct {
+	cfg  CompressConfig
+	gzip sync.Pool
+	zlib sync.Pool
+}
+
+// compressible reports whether a response with header h and status may be
+// encoded at all.
+func (c *compressor) compressible(status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	if mt == "image/svg+xml" {
+		return true
+	}
+	if mt == "text/event-stream" {
+		// EventSource clients and proxies in between expect each event
+		// as it comes, not a deflate stream
+		return false
+	}
+	for _, skip := range c.cfg.SkipTypes {
+		if mt == skip || (strings.HasSuffix(skip, "/") && strings.HasPrefix(mt, skip)) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip. It returns "" when neither is acceptable.
+func negotiateEncoding(accept string) string {
+	var gzipQ, deflateQ, anyQ float64 = -1, -1, -1
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	}
+	return ""
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter holds back the status line and the first MinSize bytes
+// of the body until it knows whether the response is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string // negotiated with the client, "" for none
+	head     bool
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         flushWriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	if code < http.StatusOK {
+		// informational responses go straight through
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	cw.wroteHeader = true
+	if cw.head || code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.c.cfg.MinSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush commits to compressing (if the response qualifies) and pushes
+// everything written so far to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide writes the real status line, compressing the body from here on
+// when allowed and the response qualifies, then releases the buffer.
+func (cw *compressWriter) decide(allowed bool) error {
+	cw.decided = true
+
+	h := cw.ResponseWriter.Header()
+	if cw.c.compressible(cw.status, h) {
+		h.Add("Vary", "Accept-Encoding")
+		if allowed && cw.encoding != "" && !cw.head {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", cw.encoding)
+			// the encoded bytes differ, so a strong validator no longer holds
+			if tag := h.Get("ETag"); tag != "" && !strings.HasPrefix(tag, "W/") {
+				h.Set("ETag", "W/"+tag)
+			}
+			cw.enc = cw.c.acquire(cw.encoding, cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close finishes the response once the handler returns. Bodies that
+// never reached MinSize are sent as is.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			// nothing written; let net/http send its default 200
+			return
+		}
+		_ = cw.decide(false)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+		cw.c.release(cw.encoding, cw.enc)
+		cw.enc = nil
+	}
+}
+
+func (c *compressor) acquire(encoding string, w io.Writer) flushWriteCloser {
+	if encoding == "gzip" {
+		zw := c.gzip.Get().(*gzip.Writer)
+		zw.Reset(w)
+		return zw
+	}
+	zw := c.zlib.Get().(*zlib.Writer)
+	zw.Reset(w)
+	return zw
+}
+
+func (c *compressor) release(encoding string, enc flushWriteCloser) {
+	if encoding == "gzip" {
+		c.gzip.Put(enc)
+		return
+	}
+	c.zlib.Put(enc)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serveCompressed(t *testing.T, h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rr := httptest.NewRecorder()
+	Compress(CompressConfig{MinSize: 64})(h).ServeHTTP(rr, r)
+	return rr
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gunzip: %v", err)
+	}
+	return string(out)
+}
+
+func TestCompressGzipsLargeResponses(t *testing.T) {
+	body := strings.Repeat(`{"id":1,"name":"widget"},`, 20)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "999")
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, body[:10])
+		_, _ = io.WriteString(w, body[10:])
+	})
+
+	rr := serveCompressed(t, h, "br, gzip;q=0.8, deflate;q=0.5")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rr.Code)
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected headers: %v", rr.Header())
+	}
+	if rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("stale Content-Length left on compressed response")
+	}
+	if rr.Header().Get("ETag") != `W/"abc"` {
+		t.Fatalf("expected ETag to be weakened, got %q", rr.Header().Get("ETag"))
+	}
+	if got := gunzip(t, rr.Body.Bytes()); got != body {
+		t.Fatalf("round trip mismatch: %q", got)
+	}
+}
+
+func TestCompressDeflate(t *testing.T) {
+	body := strings.Repeat("deflate me ", 20)
+	rr := serveCompressed(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}), "deflate")
+
+	if rr.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatalf("expected deflate, got %v", rr.Header())
+	}
+	zr, err := zlib.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("zlib reader: %v", err)
+	}
+	got, _ := io.ReadAll(zr)
+	if string(got) != body {
+		t.Fatalf("round trip mismatch: %q", got)
+	}
+}
+
+func TestCompressSkips(t *testing.T) {
+	big := strings.Repeat("x", 200)
+	tests := []struct {
+		name   string
+		accept string
+		ct     string
+		body   string
+	}{
+		{"no accept-encoding", "", "text/plain", big},
+		{"gzip refused", "gzip;q=0", "text/plain", big},
+		{"below threshold", "gzip", "text/plain", "small"},
+		{"already compressed type", "gzip", "image/png", big},
+		{"event stream", "gzip", "text/event-stream", big},
+	}
+	for _, tt := range tests {
+		rr := serveCompressed(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.ct)
+			_, _ = io.WriteString(w, tt.body)
+		}), tt.accept)
+
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: unexpected Content-Encoding %q", tt.name, rr.Header().Get("Content-Encoding"))
+		}
+		if rr.Body.String() != tt.body {
+			t.Errorf("%s: body altered: %q", tt.name, rr.Body.String())
+		}
+	}
+}
+
+func TestCompressLeavesEncodedResponsesAlone(t *testing.T) {
+	rr := serveCompressed(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = io.WriteString(w, strings.Repeat("z", 200))
+	}), "gzip")
+	if rr.Header().Get("Content-Encoding") != "br" || rr.Body.Len() != 200 {
+		t.Fatalf("pre-encoded response was touched: %v %d", rr.Header(), rr.Body.Len())
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                      "",
+		"gzip":                  "gzip",
+		"deflate, gzip":         "gzip",
+		"gzip;q=0.2, deflate":   "deflate",
+		"*":                     "gzip",
+		"*;q=0, identity":       "",
+		"br":                    "",
+		"GZIP;q=1.0":            "gzip",
+		"gzip;q=0, deflate;q=0": "",
+	} {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressStreamFlushesChunks(t *testing.T) {
+	next := make(chan struct{})
+	h := Compress(CompressConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-next
+		_, _ = io.WriteString(w, "second\n")
+	}))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip") // disables the transport's transparent gunzip
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip stream, got %v", resp.Header)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	got := make([]byte, len("first\n"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(zr, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || string(got) != "first\n" {
+			t.Fatalf("first chunk: %q, %v", got, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("flushed chunk did not arrive before the handler finished")
+	}
+
+	close(next)
+	rest, err := io.ReadAll(zr)
+	if err != nil || string(rest) != "second\n" {
+		t.Fatalf("rest of stream: %q, %v", rest, err)
+	}
+}
@@ -0,0 +1,768 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteLimitRule caps concurrent requests under a path prefix.
+type RouteLimitRule struct {
+	Prefix         string `json:"prefix"`
+	MaxConcurrent  int    `json:"max_concurrent"`
+	QueueTimeoutMs int    `json:"queue_timeout_ms"` // 0 = reject with 503 straight away
+}
+
+// PoolSettings configures a named pool. Unset fields take the fast
+// pool's values.
+type PoolSettings struct {
+	Workers              int    `json:"workers"`
+	MinWorkers           int    `json:"min_workers"`
+	RequestTimeoutMs     int    `json:"request_timeout_ms"`
+	MaxRequestsPerWorker int    `json:"max_requests_per_worker"`
+	LogRequestsOverMs    int    `json:"log_requests_over_ms"`
+	Codec                string `json:"codec"`
+}
+
+// CORSSettings enables CORS handling at the Go layer; see CORSConfig.
+type CORSSettings struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"`
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"`
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAgeSeconds    int      `json:"max_age_seconds"`
+}
+
+// Config is the app server's configuration file, go_appjson by
+// default, as read by LoadConfig. ServerConfig and AppConfig turn it into
+// the settings NewServerWithConfig and NewAppHandler take.
+type Config struct {
+	FastWorkers          int          `json:"fast_workers"`
+	SlowWorkers          int          `json:"slow_workers"`
+	HotReload            bool         `json:"hot_reload"`
+	WatchDirs            []string     `json:"watch_dirs"`   // relative to the project root
+	ReloadBatch          int          `json:"reload_batch"` // workers restarted at a time on reload; 0 = a quarter of each pool
+	RequestTimeoutMs     int          `json:"request_timeout_ms"`
+	MaxRequestsPerWorker int          `json:"max_requests_per_worker"`
+	MaxWorkerLifetimeMs  int          `json:"max_worker_lifetime_ms"`  // 0 = no time-based recycling
+	MaxWorkerRSSMB       int          `json:"max_worker_rss_mb"`       // 0 = no memory-based recycling
+	WorkerMaxConcurrent  int          `json:"worker_max_concurrent"`   // requests pipelined per worker; 1 = one at a time
+	WorkerIdleTTLMs      int          `json:"worker_idle_ttl_ms"`      // 0 = pools never shrink
+	MinFastWorkers       int          `json:"min_fast_workers"`        // kept when shrinking; default 1
+	MinSlowWorkers       int          `json:"min_slow_workers"`        // kept when shrinking; default 1
+	DrainTimeoutMs       int          `json:"drain_timeout_ms"`        // kill draining workers after this; 0 = wait for them
+	WorkerPingIntervalMs int          `json:"worker_ping_interval_ms"` // ping workers idle this long; 0 = never
+	WorkerPingTimeoutMs  int          `json:"worker_ping_timeout_ms"`  // 0 = DefaultPingTimeout
+	WarmupPaths          []string     `json:"warmup_paths"`            // GET these on every new worker before it takes requests
+	WarmupRounds         int          `json:"warmup_rounds"`           // times warmup_paths are requested; 0 = once
+	Static               []StaticRule `json:"static"`
+
+	// When the static rules get a second chance at a request PHP answered
+	// (by default: any 404 under a static prefix).
+	StaticFallback StaticFallback `json:"static_fallback"`
+
+	// Slow pool overrides; 0 means same as the fast pool.
+	SlowRequestTimeoutMs     int `json:"slow_request_timeout_ms"`
+	SlowMaxRequestsPerWorker int `json:"slow_max_requests_per_worker"`
+	SlowLogRequestsOverMs    int `json:"slow_log_requests_over_ms"`
+
+	// Log requests a worker takes at least this many ms over at WARN,
+	// like a slow query log; 0 (default) logs none.
+	LogRequestsOverMs int `json:"log_requests_over_ms"`
+
+	// Honor a client's X-Request-Timeout / Timeout header in place of the
+	// pool timeout, up to this many ms. 0 (default) ignores the headers.
+	MaxHeaderTimeoutMs int `json:"max_header_timeout_ms"`
+
+	// Once a response frame starts arriving, a worker that goes this many
+	// ms without sending more of it is killed. 0 uses the default (10s),
+	// a negative value waits forever.
+	ReadIdleTimeoutMs int `json:"read_idle_timeout_ms"`
+
+	// Typical response size in bytes; responses up to it are read into
+	// recycled buffers. 0 uses the default (32KB), a negative value
+	// allocates every response.
+	FrameBufferSize int `json:"frame_buffer_size"`
+
+	// php executable used for workers; "" means "php" from PATH.
+	PHPBinary string `json:"php_binary"`
+
+	// Frame codec workers ask PHP for: "json" or "msgpack". "" uses
+	// GO_PHP_CODEC, or json; an unknown name stops the
+	Codec string `json:"codec"`
+
+	// Connect to workers listening on "unix:///path" or "tcp://host:port"
+	// (php/worker.php with GO_PHP_LISTEN) instead of launching them; ""
+	// launches php_binary on pipes.
+	WorkerAddress string `json:"worker_address"`
+
+	// How pools pick a worker: "round_robin" (default), "least_connections"
+	// or "sticky", which keeps a session on one worker by hashing the
+	// sticky_cookie (default PHPSESSID).
+	WorkerSelection string `json:"worker_selection"`
+	StickyCookie    string `json:"sticky_cookie"`
+
+	// A worker busy for this many ms counts as running a long request,
+	// and requests go to any other live worker before it. 0 uses the
+	// default (1s), a negative value turns this off.
+	LongRequestThresholdMs int `json:"long_request_threshold_ms"`
+
+	// When a request may run on the other pool because every worker in
+	// its own is busy: "off" (default), "fast" (fast requests may borrow
+	// slow workers) or "both".
+	PoolOverflow string `json:"pool_overflow"`
+
+	// Named pools next to fast and slow, and the routes that send
+	// requests to a pool by name; the first matching route wins.
+	// Unrouted requests go to default_pool, or when that is empty to
+	// fast or slow as the slow_* settings decide.
+	Pools       map[string]PoolSettings `json:"pools"`
+	PoolRoutes  []PoolRoute             `json:"pool_routes"`
+	DefaultPool string                  `json:"default_pool"`
+
+	// GETs matching these routes are collapsed: identical requests that
+	// arrive while one is with a worker share its response. Only for
+	// responses that are the same for every client.
+	CollapseRoutes []CollapseRoute `json:"collapse_routes"`
+
+	// How often an idempotent request that finds no live worker (say,
+	// mid-reload) is tried again, the first retry after NoWorkerRetryMs
+	// and each later one after twice as long. 0 uses the defaults, a
+	// negative count fails at once.
+	NoWorkerRetries int `json:"no_worker_retries"`
+	NoWorkerRetryMs int `json:"no_worker_retry_ms"`
+
+	// Serve pool and worker stats for Prometheus at /metrics.
+	PrometheusMetrics bool `json:"prometheus_metrics"`
+
+	// Serve a live view of every worker at /debug/workers. Requests must
+	// send "Authorization: Bearer <debug_token>" when a token is set
+	// (also settable with GO_PHP_DEBUG_TOKEN).
+	DebugWorkers bool   `json:"debug_workers"`
+	DebugToken   string `json:"debug_token"`
+
+	SlowRoutes        []string `json:"slow_routes"`
+	SlowMethods       []string `json:"slow_methods"`
+	SlowBodyThreshold int      `json:"slow_body_threshold"`
+	SlowContentTypes  []string `json:"slow_content_types"` // e.g. "video/*"
+
+	// Per-route concurrency caps, checked before a worker is picked.
+	RouteLimits []RouteLimitRule `json:"route_limits"`
+
+	// Per-client-IP rate limits; the longest matching prefix applies.
+	RateLimits []RateLimitRule `json:"rate_limits"`
+
+	// CORS headers and preflight answers; nil leaves CORS to the app.
+	CORS *CORSSettings `json:"cors,omitempty"`
+
+	// Security headers forced onto PHP responses, and optionally the
+	// only headers PHP may set; see HeaderPolicy.
+	ResponseHeaders HeaderPolicy `json:"response_headers"`
+
+	// Error pages by status code ("502": "errors/502.html"), relative to
+	// the project root. The content type follows the file extension.
+	ErrorPages map[string]string `json:"error_pages"`
+
+	// DevMode shows the underlying error on error responses. Never turn
+	// it on in production.
+	DevMode bool `json:"dev_mode"`
+
+	// Add Server-Timing headers (queue, php, total) to PHP responses.
+	// Always on in dev_mode.
+	ServerTiming bool `json:"server_timing"`
+
+	// Request body limits in bytes (fast routes / slow routes).
+	MaxBodyBytes     int64 `json:"max_body_bytes"`
+	SlowMaxBodyBytes int64 `json:"slow_max_body_bytes"`
+
+	// Request header limits: bytes of names and values, and header
+	// lines. Requests over either get 431. 0 uses the default (64KB and
+	// 100), a negative value turns the limit off.
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	MaxHeaderCount int `json:"max_header_count"`
+
+	// Request bodies larger than this many bytes (or of unknown length)
+	// are streamed to PHP in chunks instead of being read into memory.
+	// 0 (default) turns streaming off.
+	StreamRequestBodyBytes int64 `json:"stream_request_body_bytes"`
+
+	// Access log format: "json" (default), "text" or "off".
+	AccessLog string `json:"access_log"`
+
+	// Level of the server's own logs: "debug", "info" (default), "warn"
+	// or "error".
+	LogLevel string `json:"log_level"`
+
+	// Requests streamed through the worker frame protocol: by path prefix
+	// or path.Match pattern, and/or whenever the client sends
+	// Accept: text/event-stream.
+	StreamRoutes        []string `json:"stream_routes"`
+	StreamRoutePatterns []string `json:"stream_route_patterns"`
+	StreamEventStream   bool     `json:"stream_event_stream"`
+
+	// WebSocket upgrades under these path prefixes are relayed to a PHP
+	// worker, which stays with the connection until it closes.
+	WebSocketRoutes []string `json:"websocket_routes"`
+
+	// Keepalive interval for idle SSE streams. 0 uses the default, a
+	// negative value disables heartbeats.
+	SSEHeartbeatMs int `json:"sse_heartbeat_ms"`
+
+	// Proxies (CIDRs or IPs) whose X-Forwarded-For / X-Forwarded-Proto
+	// headers are trusted when resolving the client IP and scheme.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Gzip/deflate response compression for clients that accept it.
+	// Bodies smaller than compress_min_bytes are sent as is.
+	Compress         bool `json:"compress"`
+	CompressMinBytes int  `json:"compress_min_bytes"`
+}
+
+// DefaultConfig returns the settings used when there is no config file.
+func DefaultConfig() *Config {
+	return &Config{
+		FastWorkers:              4,
+		SlowWorkers:              2,
+		HotReload:                false,
+		WatchDirs:                []string{"php", "routes"},
+		RequestTimeoutMs:         10000, // 10s
+		MaxRequestsPerWorker:     1000,
+		SlowRequestTimeoutMs:     10000,
+		SlowMaxRequestsPerWorker: 1000,
+		Static: []StaticRule{
+			{Prefix: "/assets/", Dir: "public/assets"},
+			{Prefix: "/build/", Dir: "public/build"},
+			{Prefix: "/css/", Dir: "public/css"},
+			{Prefix: "/js/", Dir: "public/js"},
+			{Prefix: "/images/", Dir: "public/images"},
+			{Prefix: "/img/", Dir: "public/img"},
+		},
+		SlowRoutes:        []string{"/reports/", "/admin/analytics"},
+		SlowMethods:       []string{"PUT", "DELETE"},
+		SlowBodyThreshold: 2_000_000,
+		MaxBodyBytes:      DefaultMaxBodyBytes,
+		SlowMaxBodyBytes:  DefaultMaxBodyBytes,
+		MaxHeaderBytes:    DefaultMaxHeaderBytes,
+		MaxHeaderCount:    DefaultMaxHeaderCount,
+		AccessLog:         "json",
+		LogLevel:          "info",
+		StreamRoutes:      []string{"/stream/"},
+		SSEHeartbeatMs:    int(DefaultSSEHeartbeat / time.Millisecond),
+		NoWorkerRetries:   DefaultNoWorkerRetries,
+		NoWorkerRetryMs:   int(DefaultNoWorkerRetryInterval / time.Millisecond),
+		CompressMinBytes:  DefaultCompressMinSize,
+	}
+}
+
+// DefaultConfigFile is the config file cmd/server reads from the project
+// root unless -config or GO_PHP_CONFIG names another one.
+const DefaultConfigFile = "go_appserver.json"
+
+// LoadConfig reads the JSON config file at path, applies the GO_PHP_*
+// environment overrides (GO_PHP_FAST_WORKERS, GO_PHP_SLOW_ROUTES, ...)
+// and validates the result: invalid values are logged and replaced by
+// their defaults. An empty path reads no file, leaving the defaults with
+// the overrides. A file that can't be read or parsed is an error; it
+// wraps fs.ErrNotExist when the file is missing.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, os.Getenv)
+}
+
+// loadConfig is LoadConfig with the environment read through getenv.
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		cfg = &Config{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	applyEnvOverrides(cfg, getenv)
+	cfg.validate()
+	return cfg, nil
+}
+
+// validate replaces invalid settings, logging each, and fills in those
+// that default to another setting.
+func (cfg *Config) validate() {
+
+	// Pull a copy of defaults for use below
+	def := DefaultConfig()
+
+	//
+	// -------------------------
+	// Core config validation
+	// -------------------------
+	//
+
+	if cfg.FastWorkers <= 0 {
+		log.Printf("[config] fast_workers=%d is invalid, falling back to %d", cfg.FastWorkers, def.FastWorkers)
+		cfg.FastWorkers = def.FastWorkers
+	}
+
+	if cfg.SlowWorkers < 0 {
+		log.Printf("[config] slow_workers=%d is invalid, falling back tp %d", cfg.SlowWorkers, def.SlowWorkers)
+		cfg.SlowWorkers = def.SlowWorkers
+	}
+
+	if cfg.RequestTimeoutMs <= 0 {
+		log.Printf("[config] request_timeout_ms=%d is invalid, falling back to %dms", cfg.RequestTimeoutMs, def.RequestTimeoutMs)
+		cfg.RequestTimeoutMs = def.RequestTimeoutMs
+	}
+
+	if cfg.MaxRequestsPerWorker <= 0 {
+		log.Printf("[config] max_requests_per_worker=%d is invalid, falling back to %d", cfg.MaxRequestsPerWorker, def.MaxRequestsPerWorker)
+		cfg.MaxRequestsPerWorker = def.MaxRequestsPerWorker
+	}
+
+	if cfg.LogRequestsOverMs < 0 {
+		log.Printf("[config] log_requests_over_ms=%d is invalid, no requests will be logged as slow", cfg.LogRequestsOverMs)
+		cfg.LogRequestsOverMs = 0
+	}
+
+	if cfg.SlowLogRequestsOverMs <= 0 {
+		cfg.SlowLogRequestsOverMs = cfg.LogRequestsOverMs
+	}
+
+	if cfg.SlowRequestTimeoutMs <= 0 {
+		cfg.SlowRequestTimeoutMs = cfg.RequestTimeoutMs
+	}
+
+	if cfg.SlowMaxRequestsPerWorker <= 0 {
+		cfg.SlowMaxRequestsPerWorker = cfg.MaxRequestsPerWorker
+	}
+
+	if cfg.MaxHeaderTimeoutMs < 0 {
+		log.Printf("[config] max_header_timeout_ms=%d is invalid, ignoring timeout headers", cfg.MaxHeaderTimeoutMs)
+		cfg.MaxHeaderTimeoutMs = 0
+	}
+
+	if cfg.MaxWorkerLifetimeMs < 0 {
+		log.Printf("[config] max_worker_lifetime_ms=%d is invalid, disabling time-based recycling", cfg.MaxWorkerLifetimeMs)
+		cfg.MaxWorkerLifetimeMs = 0
+	}
+
+	if cfg.MaxWorkerRSSMB < 0 {
+		log.Printf("[config] max_worker_rss_mb=%d is invalid, disabling memory-based recycling", cfg.MaxWorkerRSSMB)
+		cfg.MaxWorkerRSSMB = 0
+	}
+
+	if cfg.WorkerMaxConcurrent < 0 {
+		log.Printf("[config] worker_max_concurrent=%d is invalid, sending one request per worker at a time", cfg.WorkerMaxConcurrent)
+		cfg.WorkerMaxConcurrent = 0
+	}
+
+	if cfg.WorkerIdleTTLMs < 0 {
+		log.Printf("[config] worker_idle_ttl_ms=%d is invalid, pools will not shrink", cfg.WorkerIdleTTLMs)
+		cfg.WorkerIdleTTLMs = 0
+	}
+
+	if cfg.DrainTimeoutMs < 0 {
+		log.Printf("[config] drain_timeout_ms=%d is invalid, draining workers will finish their requests", cfg.DrainTimeoutMs)
+		cfg.DrainTimeoutMs = 0
+	}
+
+	if cfg.WorkerPingIntervalMs < 0 {
+		log.Printf("[config] worker_ping_interval_ms=%d is invalid, workers will not be pinged", cfg.WorkerPingIntervalMs)
+		cfg.WorkerPingIntervalMs = 0
+	}
+
+	for i, p := range cfg.WarmupPaths {
+		if !strings.HasPrefix(p, "/") {
+			log.Printf("[config] warmup_paths[%d]=%q does not start with '/', fixing", i, p)
+			cfg.WarmupPaths[i] = "/" + p
+		}
+	}
+	if cfg.WarmupRounds < 0 {
+		log.Printf("[config] warmup_rounds=%d is invalid, warming up once", cfg.WarmupRounds)
+		cfg.WarmupRounds = 0
+	}
+
+	if cfg.MinFastWorkers <= 0 || cfg.MinFastWorkers > cfg.FastWorkers {
+		cfg.MinFastWorkers = min(1, cfg.FastWorkers)
+	}
+
+	if cfg.MinSlowWorkers <= 0 || cfg.MinSlowWorkers > cfg.SlowWorkers {
+		cfg.MinSlowWorkers = min(1, cfg.SlowWorkers)
+	}
+
+	if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+		log.Printf("[config] log_level=%q is invalid, falling back to %q", cfg.LogLevel, def.LogLevel)
+		cfg.LogLevel = def.LogLevel
+	}
+
+	if _, err := ParseStrategy(cfg.WorkerSelection); err != nil {
+		log.Printf("[config] worker_selection: %v, falling back to round_robin", err)
+		cfg.WorkerSelection = string(RoundRobin)
+	}
+
+	if _, err := ParseOverflow(cfg.PoolOverflow); err != nil {
+		log.Printf("[config] pool_overflow: %v, falling back to off", err)
+		cfg.PoolOverflow = string(OverflowOff)
+	}
+
+	// Named pools and their routes
+	for name, pool := range cfg.Pools {
+		if name == "" || name == "fast" || name == "slow" {
+			log.Printf("[config] pools: the name %q is reserved, ignoring this pool", name)
+			delete(cfg.Pools, name)
+		} else if pool.Workers <= 0 {
+			log.Printf("[config] pools[%q].workers=%d is invalid, ignoring this pool", name, pool.Workers)
+			delete(cfg.Pools, name)
+		}
+	}
+	knownPool := func(name string) bool {
+		_, ok := cfg.Pools[name]
+		return ok || name == "fast" || name == "slow"
+	}
+	routes := cfg.PoolRoutes[:0]
+	for i, rule := range cfg.PoolRoutes {
+		if !knownPool(rule.Pool) {
+			log.Printf("[config] pool_routes[%d]: unknown pool %q, this rule will be ignored", i, rule.Pool)
+			continue
+		}
+		if _, err := path.Match(rule.Pattern, "/"); err != nil {
+			log.Printf("[config] pool_routes[%d]: bad pattern %q: %v, this rule will be ignored", i, rule.Pattern, err)
+			continue
+		}
+		routes = append(routes, rule)
+	}
+	cfg.PoolRoutes = routes
+	collapse := cfg.CollapseRoutes[:0]
+	for i, rule := range cfg.CollapseRoutes {
+		if rule.Prefix == "" && rule.Pattern == "" {
+			log.Printf("[config] collapse_routes[%d]: no prefix or pattern, this rule will be ignored", i)
+			continue
+		}
+		if _, err := path.Match(rule.Pattern, "/"); err != nil {
+			log.Printf("[config] collapse_routes[%d]: bad pattern %q: %v, this rule will be ignored", i, rule.Pattern, err)
+			continue
+		}
+		collapse = append(collapse, rule)
+	}
+	cfg.CollapseRoutes = collapse
+	if cfg.DefaultPool != "" && !knownPool(cfg.DefaultPool) {
+		log.Printf("[config] default_pool: unknown pool %q, using the fast/slow heuristics", cfg.DefaultPool)
+		cfg.DefaultPool = ""
+	}
+
+	if cfg.NoWorkerRetries == 0 {
+		cfg.NoWorkerRetries = def.NoWorkerRetries
+	}
+	if cfg.NoWorkerRetryMs <= 0 {
+		cfg.NoWorkerRetryMs = def.NoWorkerRetryMs
+	}
+
+	//
+	// -------------------------
+	// Static rules validation
+	// -------------------------
+	//
+	if len(cfg.Static) == 0 {
+		log.Printf("[config] no static rules configured, using default static rules")
+		cfg.Static = DefaultConfig().Static
+	} else {
+		for i, rule := range cfg.Static {
+			if !strings.HasPrefix(rule.Prefix, "/") {
+				log.Printf("[config] static[%d].prefix=%q does not start with '/', fixing", i, rule.Prefix)
+				cfg.Static[i].Prefix = "/" + rule.Prefix
+			}
+
+			if rule.Dir == "" {
+				log.Printf("[config] static[%d].dir is empty, this rule will be ignored at runtime.", i)
+			}
+		}
+	}
+
+	sf := &cfg.StaticFallback
+	for _, status := range sf.Statuses {
+		if status < 100 || status > 599 {
+			log.Printf("[config] static_fallback.statuses has invalid status %d, ignoring it", status)
+		}
+	}
+	if sf.Statuses != nil {
+		sf.Statuses = slices.DeleteFunc(sf.Statuses, func(status int) bool { return status < 100 || status > 599 })
+	}
+	for i, m := range sf.Methods {
+		sf.Methods[i] = strings.ToUpper(m)
+	}
+
+	//
+	// -------------------------
+	// Slow-request config
+	// -------------------------
+	//
+
+	// Route prefixes
+	if len(cfg.SlowRoutes) == 0 {
+		cfg.SlowRoutes = def.SlowRoutes
+		log.Printf("[config] stow_routes missing, using defaults: %v", cfg.SlowRoutes)
+	}
+
+	// Methods to treat as slow
+	if len(cfg.SlowMethods) == 0 {
+		cfg.SlowMethods = def.SlowMethods
+		log.Printf("[config] slow_methods missing, using defaults: %v", cfg.SlowMethods)
+	}
+
+	// Body size threshold
+	if cfg.SlowBodyThreshold <= 0 {
+		cfg.SlowBodyThreshold = def.SlowBodyThreshold
+		log.Printf("[config] slow_body_threshold invalid, using default: %d bytes", cfg.SlowBodyThreshold)
+	}
+
+	// Route concurrency limits
+	for i, rule := range cfg.RouteLimits {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			log.Printf("[config] route_limits[%d].prefix=%q does not start with '/', fixing", i, rule.Prefix)
+			cfg.RouteLimits[i].Prefix = "/" + rule.Prefix
+		}
+		if rule.MaxConcurrent <= 0 {
+			log.Printf("[config] route_limits[%d].max_concurrent=%d is invalid, this rule will be ignored", i, rule.MaxConcurrent)
+		}
+	}
+
+	// Rate limits
+	for i, rule := range cfg.RateLimits {
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			log.Printf("[config] rate_limits[%d] needs a positive rate and burst, this rule will be ignored", i)
+		}
+	}
+
+	// Hot reload watch dirs
+	if cfg.WatchDirs == nil {
+		cfg.WatchDirs = def.WatchDirs
+	}
+
+	// Streaming routes
+	if cfg.StreamRoutes == nil {
+		cfg.StreamRoutes = def.StreamRoutes
+	}
+	patterns := cfg.StreamRoutePatterns[:0]
+	for _, pattern := range cfg.StreamRoutePatterns {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			log.Printf("[config] ignoring stream route pattern %q: %v", pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	cfg.StreamRoutePatterns = patterns
+
+	// Trusted proxies: drop entries that don't parse
+	if len(cfg.TrustedProxies) > 0 {
+		valid := cfg.TrustedProxies[:0]
+		for _, p := range cfg.TrustedProxies {
+			if _, err := ParseTrustedProxies([]string{p}); err != nil {
+				log.Printf("[config] trusted_proxies: %v, ignoring", err)
+				continue
+			}
+			valid = append(valid, p)
+		}
+		cfg.TrustedProxies = valid
+	}
+
+	// SSE heartbeat
+	if cfg.SSEHeartbeatMs == 0 {
+		cfg.SSEHeartbeatMs = def.SSEHeartbeatMs
+	}
+
+	// Compression threshold
+	if cfg.CompressMinBytes <= 0 {
+		cfg.CompressMinBytes = def.CompressMinBytes
+	}
+
+	// Body size limits
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = def.MaxBodyBytes
+		log.Printf("[config] max_body_bytes missing, using default: %d bytes", cfg.MaxBodyBytes)
+	}
+	if cfg.SlowMaxBodyBytes <= 0 {
+		cfg.SlowMaxBodyBytes = cfg.MaxBodyBytes
+		log.Printf("[config] slow_max_body_bytes missing, using max_body_bytes: %d bytes", cfg.SlowMaxBodyBytes)
+	}
+
+	// Header limits; negative turns them off
+	if cfg.MaxHeaderBytes == 0 {
+		cfg.MaxHeaderBytes = def.MaxHeaderBytes
+	}
+	if cfg.MaxHeaderCount == 0 {
+		cfg.MaxHeaderCount = def.MaxHeaderCount
+	}
+}
+
+// applyEnvOverrides lets GO_PHP_* environment variables override the
+// config file, so one file can be shared across environments. List
+// values are comma-separated.
+func applyEnvOverrides(cfg *Config, getenv func(string) string) {
+	ints := map[string]*int{
+		"GO_PHP_FAST_WORKERS":                 &cfg.FastWorkers,
+		"GO_PHP_SLOW_WORKERS":                 &cfg.SlowWorkers,
+		"GO_PHP_REQUEST_TIMEOUT_MS":           &cfg.RequestTimeoutMs,
+		"GO_PHP_SLOW_REQUEST_TIMEOUT_MS":      &cfg.SlowRequestTimeoutMs,
+		"GO_PHP_MAX_REQUESTS_PER_WORKER":      &cfg.MaxRequestsPerWorker,
+		"GO_PHP_SLOW_MAX_REQUESTS_PER_WORKER": &cfg.SlowMaxRequestsPerWorker,
+	}
+	for name, field := range ints {
+		v := getenv(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("[config] %s=%q is not a number, ignoring", name, v)
+			continue
+		}
+		*field = n
+	}
+
+	if v := getenv("GO_PHP_HOT_RELOAD"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("[config] GO_PHP_HOT_RELOAD=%q is not a boolean, ignoring", v)
+		} else {
+			cfg.HotReload = b
+		}
+	}
+	if v := getenv("GO_PHP_BINARY"); v != "" {
+		cfg.PHPBinary = v
+	}
+	if v := getenv("GO_PHP_WORKER_ADDRESS"); v != "" {
+		cfg.WorkerAddress = v
+	}
+	if v := getenv("GO_PHP_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := getenv("GO_PHP_DEBUG_TOKEN"); v != "" {
+		cfg.DebugToken = v
+	}
+
+	lists := map[string]*[]string{
+		"GO_PHP_SLOW_ROUTES": &cfg.SlowRoutes,
+		"GO_PHP_WATCH_DIRS":  &cfg.WatchDirs,
+	}
+	for name, field := range lists {
+		v := getenv(name)
+		if v == "" {
+			continue
+		}
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field = items
+	}
+}
+
+// ParseLogLevel maps a log_level setting to a slog level; "" is info.
+func ParseLogLevel(name string) (slog.Level, error) {
+	var lvl slog.Level
+	if name == "" {
+		return lvl, nil // slog.LevelInfo
+	}
+	err := lvl.UnmarshalText([]byte(name))
+	return lvl, err
+}
+
+// ServerConfig returns the NewServerWithConfig settings for cfg: the
+// fast and slow pools, the named pools on top of the fast pool's
+// settings, and the pool routes. root is the project root.
+func (cfg *Config) ServerConfig(root string) ServerConfig {
+	// workers are recycled by request count, age or memory, whichever
+	// comes first; the reaper brings recycled workers back up
+	fastPool := PoolConfig{
+		Workers:              cfg.FastWorkers,
+		MaxRequests:          cfg.MaxRequestsPerWorker,
+		RequestTimeout:       time.Duration(cfg.RequestTimeoutMs) * time.Millisecond,
+		MaxLifetime:          time.Duration(cfg.MaxWorkerLifetimeMs) * time.Millisecond,
+		MaxRSS:               int64(cfg.MaxWorkerRSSMB) << 20,
+		MaxConcurrent:        cfg.WorkerMaxConcurrent,
+		ReadIdleTimeout:      time.Duration(cfg.ReadIdleTimeoutMs) * time.Millisecond,
+		FrameBufferSize:      cfg.FrameBufferSize,
+		Address:              cfg.WorkerAddress,
+		Strategy:             Strategy(cfg.WorkerSelection),
+		StickyCookie:         cfg.StickyCookie,
+		LongRequestThreshold: time.Duration(cfg.LongRequestThresholdMs) * time.Millisecond,
+		IdleTTL:              time.Duration(cfg.WorkerIdleTTLMs) * time.Millisecond,
+		MinWorkers:           cfg.MinFastWorkers,
+		DrainTimeout:         time.Duration(cfg.DrainTimeoutMs) * time.Millisecond,
+		PingInterval:         time.Duration(cfg.WorkerPingIntervalMs) * time.Millisecond,
+		PingTimeout:          time.Duration(cfg.WorkerPingTimeoutMs) * time.Millisecond,
+		Warmup:               WarmupConfig{Paths: cfg.WarmupPaths, Rounds: cfg.WarmupRounds},
+	}
+	slowPool := fastPool
+	slowPool.Workers = cfg.SlowWorkers
+	slowPool.MinWorkers = cfg.MinSlowWorkers
+	slowPool.MaxRequests = cfg.SlowMaxRequestsPerWorker
+	slowPool.RequestTimeout = time.Duration(cfg.SlowRequestTimeoutMs) * time.Millisecond
+	slowPool.SlowRequestLog = time.Duration(cfg.SlowLogRequestsOverMs) * time.Millisecond
+
+	return ServerConfig{
+		Fast: fastPool,
+		Slow: slowPool,
+		SlowRequests: SlowRequestConfig{
+			RoutePrefixes: cfg.SlowRoutes,
+			Methods:       cfg.SlowMethods,
+			BodyThreshold: cfg.SlowBodyThreshold,
+			ContentTypes:  cfg.SlowContentTypes,
+		},
+		Pools:       namedPools(cfg.Pools, fastPool),
+		PoolRoutes:  cfg.PoolRoutes,
+		DefaultPool: cfg.DefaultPool,
+		PHPBinary:   cfg.PHPBinary,
+		Codec:       cfg.Codec,
+		ProjectRoot: root,
+	}
+}
+
+// AppConfig returns the NewAppHandler settings for cfg's static rules,
+// which are relative to root. Middleware is left to the caller.
+func (cfg *Config) AppConfig(root string) AppConfig {
+	return AppConfig{
+		Root:           root,
+		Static:         cfg.Static,
+		StaticFallback: cfg.StaticFallback,
+	}
+}
+
+// namedPools builds the configured named pools on top of the fast pool's
+// settings.
+func namedPools(pools map[string]PoolSettings, base PoolConfig) map[string]PoolConfig {
+	out := make(map[string]PoolConfig, len(pools))
+	for name, ps := range pools {
+		pc := base
+		pc.Workers = ps.Workers
+		pc.MinWorkers = min(1, ps.Workers)
+		if ps.MinWorkers > 0 && ps.MinWorkers <= ps.Workers {
+			pc.MinWorkers = ps.MinWorkers
+		}
+		if ps.RequestTimeoutMs > 0 {
+			pc.RequestTimeout = time.Duration(ps.RequestTimeoutMs) * time.Millisecond
+		}
+		if ps.MaxRequestsPerWorker > 0 {
+			pc.MaxRequests = ps.MaxRequestsPerWorker
+		}
+		if ps.LogRequestsOverMs > 0 {
+			pc.SlowRequestLog = time.Duration(ps.LogRequestsOverMs) * time.Millisecond
+		}
+		if ps.Codec != "" {
+			pc.Codec = ps.Codec
+		}
+		out[name] = pc
+	}
+	return out
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes data as a config file in a fresh temp dir.
+func writeConfig(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), DefaultConfigFile)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+// noEnv is a getenv with nothing set.
+func noEnv(string) string { return "" }
+
+func TestLoadConfigWithoutFileUsesDefaults(t *testing.T) {
+	cfg, err := loadConfig("", noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	def := DefaultConfig()
+
+	if cfg.FastWorkers != def.FastWorkers ||
+		cfg.SlowWorkers != def.SlowWorkers ||
+		cfg.RequestTimeoutMs != def.RequestTimeoutMs {
+		t.Fatalf("loadConfig did not fall back to defaults correctly: %#v", cfg)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	_, err := loadConfig(filepath.Join(t.TempDir(), "nope.json"), noEnv)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a not-exist error, got %v", err)
+	}
+}
+
+func TestLoadConfigValidationAndDefaults(t *testing.T) {
+	// Intentionally invalid / weird values to trigger validation logic.
+	raw := Config{
+		FastWorkers:          -1,
+		SlowWorkers:          -5,
+		RequestTimeoutMs:     0,
+		MaxRequestsPerWorker: 0,
+		Static: []StaticRule{
+			{Prefix: "assets", Dir: ""}, // missing leading slash, empty dir
+		},
+		SlowRoutes:        nil,
+		SlowMethods:       nil,
+		SlowBodyThreshold: 0,
+		LogLevel:          "loud",
+	}
+	data, _ := json.Marshal(raw)
+
+	cfg, err := loadConfig(writeConfig(t, data), noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.FastWorkers <= 0 {
+		t.Fatalf("FastWorkers not fixed up: %d", cfg.FastWorkers)
+	}
+	if cfg.SlowWorkers < 0 {
+		t.Fatalf("SlowWorkers not fixed up: %d", cfg.SlowWorkers)
+	}
+	if cfg.RequestTimeoutMs <= 0 {
+		t.Fatalf("RequestTimeoutMs not fixed up: %d", cfg.RequestTimeoutMs)
+	}
+	if cfg.MaxRequestsPerWorker <= 0 {
+		t.Fatalf("MaxRequestsPerWorker not fixed up: %d", cfg.MaxRequestsPerWorker)
+	}
+
+	if len(cfg.Static) == 0 {
+		t.Fatalf("expected static rules to be non-empty after validation")
+	}
+	for _, rule := range cfg.Static {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			t.Fatalf("static prefix still missing leading slash: %q", rule.Prefix)
+		}
+	}
+	if len(cfg.SlowRoutes) == 0 {
+		t.Fatalf("expected SlowRoutes to fall back to defaults")
+	}
+	if len(cfg.SlowMethods) == 0 {
+		t.Fatalf("expected SlowMethods to fall back to defaults")
+	}
+	if cfg.SlowBodyThreshold <= 0 {
+		t.Fatalf("expected SlowBodyThreshold to fall back to defaults")
+	}
+	if cfg.MaxBodyBytes <= 0 || cfg.SlowMaxBodyBytes <= 0 {
+		t.Fatalf("expected body limits to fall back to defaults: %d / %d", cfg.MaxBodyBytes, cfg.SlowMaxBodyBytes)
+	}
+	if cfg.LogLevel != "info" {
+		t.Fatalf("expected an invalid log_level to fall back to info, got %q", cfg.LogLevel)
+	}
+}
+
+func TestLoadConfigInvalidJSON(t *testing.T) {
+	if _, err := loadConfig(writeConfig(t, []byte("invalid json {")), noEnv); err == nil {
+		t.Fatal("expected an error for invalid JSON")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{"": slog.LevelInfo, "debug": slog.LevelDebug, "WARN": slog.LevelWarn, "error": slog.LevelError} {
+		if got, err := ParseLogLevel(name); err != nil || got != want {
+			t.Fatalf("ParseLogLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+}
+
+func TestLoadConfigDropsInvalidTrustedProxies(t *testing.T) {
+	data := []byte(`{"trusted_proxies": ["10.0.0.0/8", "not-an-ip", "192.168.1.1", "10.0.0.0/99"]}`)
+	cfg, err := loadConfig(writeConfig(t, data), noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if want := []string{"10.0.0.0/8", "192.168.1.1"}; !reflect.DeepEqual(cfg.TrustedProxies, want) {
+		t.Fatalf("TrustedProxies = %v, want %v", cfg.TrustedProxies, want)
+	}
+}
+
+func TestLoadConfigSlowPoolOverrides(t *testing.T) {
+	data := []byte(`{"request_timeout_ms": 2000, "max_requests_per_worker": 50, "slow_request_timeout_ms": 60000}`)
+	cfg, err := loadConfig(writeConfig(t, data), noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.SlowRequestTimeoutMs != 60000 {
+		t.Fatalf("expected slow timeout override, got %d", cfg.SlowRequestTimeoutMs)
+	}
+	if cfg.SlowMaxRequestsPerWorker != 50 {
+		t.Fatalf("expected slow max requests to inherit the fast value, got %d", cfg.SlowMaxRequestsPerWorker)
+	}
+}
+
+func TestLoadConfigNamedPools(t *testing.T) {
+	data := []byte(`{
+		"pools": {"export": {"workers": 2, "request_timeout_ms": 120000, "codec": "msgpack"}, "slow": {"workers": 1}, "empty": {}},
+		"pool_routes": [
+			{"pool": "export", "prefix": "/exports/"},
+			{"pool": "missing", "prefix": "/x/"},
+			{"pool": "export", "pattern": "/reports/[/csv"}
+		],
+		"default_pool": "nope"
+	}`)
+	cfg, err := loadConfig(writeConfig(t, data), noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cfg.Pools) != 1 || cfg.Pools["export"].Workers != 2 {
+		t.Fatalf("reserved and empty pools should be dropped: %v", cfg.Pools)
+	}
+	if want := []PoolRoute{{Pool: "export", Prefix: "/exports/"}}; !reflect.DeepEqual(cfg.PoolRoutes, want) {
+		t.Fatalf("PoolRoutes = %+v, want %+v", cfg.PoolRoutes, want)
+	}
+	if cfg.DefaultPool != "" {
+		t.Fatalf("unknown default pool kept: %q", cfg.DefaultPool)
+	}
+
+	base := PoolConfig{Workers: 4, MinWorkers: 1, MaxRequests: 500, RequestTimeout: time.Second, Codec: "json"}
+	pc := namedPools(cfg.Pools, base)["export"]
+	if pc.Workers != 2 || pc.RequestTimeout != 2*time.Minute || pc.MaxRequests != 500 || pc.Codec != "msgpack" {
+		t.Fatalf("named pool should override the fast pool's settings: %+v", pc)
+	}
+}
+
+func TestLoadConfigAppliesEnvOverrides(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "staging.json")
+	raw := `{"fast_workers": 2, "slow_workers": 1, "hot_reload": false, "slow_routes": ["/reports/"]}`
+	if err := os.WriteFile(cfgPath, []byte(raw), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	env := map[string]string{
+		"GO_PHP_FAST_WORKERS":       "8",
+		"GO_PHP_REQUEST_TIMEOUT_MS": "not-a-number",
+		"GO_PHP_HOT_RELOAD":         "true",
+		"GO_PHP_SLOW_ROUTES":        "/export/, /admin/ ",
+		"GO_PHP_WATCH_DIRS":         "app,config",
+		"GO_PHP_LOG_LEVEL":          "debug",
+	}
+	cfg, err := loadConfig(cfgPath, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	if cfg.FastWorkers != 8 || cfg.SlowWorkers != 1 {
+		t.Fatalf("workers: fast=%d slow=%d", cfg.FastWorkers, cfg.SlowWorkers)
+	}
+	if cfg.RequestTimeoutMs != DefaultConfig().RequestTimeoutMs {
+		t.Fatalf("invalid override should be ignored, got timeout %d", cfg.RequestTimeoutMs)
+	}
+	if !cfg.HotReload {
+		t.Fatal("GO_PHP_HOT_RELOAD not applied")
+	}
+	if !reflect.DeepEqual(cfg.SlowRoutes, []string{"/export/", "/admin/"}) {
+		t.Fatalf("slow routes: %v", cfg.SlowRoutes)
+	}
+	if !reflect.DeepEqual(cfg.WatchDirs, []string{"app", "config"}) {
+		t.Fatalf("watch dirs: %v", cfg.WatchDirs)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Fatalf("log level: %q", cfg.LogLevel)
+	}
+}
+
+func TestLoadConfigDefaultsWithOverrides(t *testing.T) {
+	cfg, err := loadConfig("", func(k string) string {
+		if k == "GO_PHP_SLOW_WORKERS" {
+			return "0"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.SlowWorkers != 0 || cfg.FastWorkers != DefaultConfig().FastWorkers {
+		t.Fatalf("unexpected workers: fast=%d slow=%d", cfg.FastWorkers, cfg.SlowWorkers)
+	}
+	if !reflect.DeepEqual(cfg.WatchDirs, []string{"php", "routes"}) {
+		t.Fatalf("expected default watch dirs, got %v", cfg.WatchDirs)
+	}
+}
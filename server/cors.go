@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the CORS middleware.
+type CORSConfig struct {
+	// AllowedOrigins lists origins allowed to make cross-origin requests,
+	// e.g. "https://app.example.com". "*" allows any origin, and a single
+	// "*" inside an entry matches a subdomain: "https://*.example.com".
+	AllowedOrigins []string
+
+	// AllowedMethods defaults to GET, HEAD, POST, PUT, PATCH and DELETE.
+	AllowedMethods []string
+
+	// AllowedHeaders lists request headers a preflight may ask for; "*"
+	// allows any. It defaults to Accept, Authorization, Content-Type and
+	// X-Requested-With.
+	AllowedHeaders []string
+
+	// ExposedHeaders are response headers scripts may read.
+	ExposedHeaders []string
+
+	// AllowCredentials lets requests carry cookies and HTTP auth. The
+	// request origin is then echoed back instead of "*".
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight result.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"}
+)
+
+// CORS returns a middleware that adds Access-Control-Allow-* headers for
+// allowed origins and answers preflight OPTIONS requests itself, so they
+// never reach a PHP worker. Requests without an Origin header pass
+// through untouched.
+func CORS(cfg CORSConfig) Middleware {
+	if cfg.AllowedMethods == nil {
+		cfg.AllowedMethods = defaultCORSMethods
+	}
+	if cfg.AllowedHeaders == nil {
+		cfg.AllowedHeaders = defaultCORSHeaders
+	}
+	anyOrigin := slices.Contains(cfg.AllowedOrigins, "*")
+	anyHeader := slices.Contains(cfg.AllowedHeaders, "*")
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+
+	originAllowed := func(origin string) bool {
+		if anyOrigin {
+			return true
+		}
+		for _, o := range cfg.AllowedOrigins {
+			if prefix, suffix, ok := strings.Cut(o, "*"); ok {
+				if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+					return true
+				}
+			} else if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the spec forbids "*" on credentialed responses
+	echoOrigin := !anyOrigin || cfg.AllowCredentials
+	setOrigin := func(h http.Header, origin string) {
+		if echoOrigin {
+			h.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+
+			reqMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method != http.MethodOptions || reqMethod == "" {
+				// actual request
+				if echoOrigin {
+					h.Add("Vary", "Origin")
+				}
+				if originAllowed(origin) {
+					setOrigin(h, origin)
+					if exposed != "" {
+						h.Set("Access-Control-Expose-Headers", exposed)
+					}
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// preflight: answered here whatever the outcome; without the
+			// allow headers the browser blocks the actual request
+			h.Add("Vary", "Origin")
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			reqHeaders := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+			if !originAllowed(origin) || !containsFold(cfg.AllowedMethods, reqMethod) ||
+				(!anyHeader && slices.ContainsFunc(reqHeaders, func(h string) bool { return !containsFold(cfg.AllowedHeaders, h) })) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			setOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", methods)
+			if len(reqHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(reqHeaders, ", "))
+			}
+			if cfg.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func splitHeaderList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// containsFold reports whether list has s, ignoring case.
+func containsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(v string) bool { return strings.EqualFold(v, s) })
+}
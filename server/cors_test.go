@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRequest(h http.Handler, method, origin string, hdr map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/items", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	for k, v := range hdr {
+		r.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestCORSPreflightSkipsWorker(t *testing.T) {
+	reached := false
+	h := CORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+	rr := corsRequest(h, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "content-type, authorization",
+	})
+	if reached {
+		t.Fatal("preflight reached the next handler")
+	}
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Headers":     "content-type, authorization",
+		"Access-Control-Max-Age":           "600",
+	}
+	for k, v := range want {
+		if got := rr.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if rr.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Error("missing Access-Control-Allow-Methods")
+	}
+}
+
+func TestCORSPreflightRejections(t *testing.T) {
+	h := CORS(CORSConfig{AllowedOrigins: []string{"https://*.example.com"}})(http.NotFoundHandler())
+
+	for name, tc := range map[string]struct {
+		origin string
+		hdr    map[string]string
+	}{
+		"unknown origin":     {"https://evil.test", map[string]string{"Access-Control-Request-Method": "GET"}},
+		"disallowed method":  {"https://a.example.com", map[string]string{"Access-Control-Request-Method": "CONNECT"}},
+		"disallowed header":  {"https://a.example.com", map[string]string{"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Secret"}},
+		"bare wildcard host": {"https://.example.com", map[string]string{"Access-Control-Request-Method": "GET"}},
+	} {
+		rr := corsRequest(h, http.MethodOptions, tc.origin, tc.hdr)
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: expected a 204 without allow headers, got %d %v", name, rr.Code, rr.Header())
+		}
+	}
+
+	rr := corsRequest(h, http.MethodOptions, "https://a.example.com", map[string]string{"Access-Control-Request-Method": "GET"})
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://a.example.com" {
+		t.Fatalf("subdomain wildcard not matched: %v", rr.Header())
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	h := CORS(CORSConfig{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X-Total"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	rr := corsRequest(h, http.MethodGet, "https://anywhere.test", nil)
+	if rr.Body.String() != "ok" {
+		t.Fatalf("request not served: %q", rr.Body.String())
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "*" || rr.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+		t.Fatalf("unexpected CORS headers: %v", rr.Header())
+	}
+
+	// plain OPTIONS without a preflight method goes to the app
+	rr = corsRequest(h, http.MethodOptions, "https://anywhere.test", nil)
+	if rr.Body.String() != "ok" {
+		t.Fatal("non-preflight OPTIONS should reach the handler")
+	}
+
+	// same-origin / non-browser requests are left alone
+	rr = corsRequest(h, http.MethodGet, "", nil)
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("CORS headers added without an Origin: %v", rr.Header())
+	}
+}
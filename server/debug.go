@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WorkersHandler serves a live view of every worker for operators: per
+// pool, each worker's index, PID, state, requests in flight and for how
+// long, request counts, restarts, uptime and memory. Browsers get an HTML
+// table; "?format=json" or an Accept header asking for JSON gets
+// {"fast": [WorkerStat...], "slow": [...]}, plus any named pools.
+//
+// The page reveals process details, so don't mount it publicly. With a
+// non-empty token, requests must send "Authorization: Bearer <token>".
+func WorkersHandler(s *Server, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !bearerMatches(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="debug"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+
+		type poolWorkers struct {
+			Name    string
+			Workers []WorkerStat
+		}
+		var page []poolWorkers
+		pools := make(map[string][]WorkerStat)
+		for _, np := range s.pools() {
+			stats := np.pool.WorkerStats()
+			page = append(page, poolWorkers{np.name, stats})
+			pools[np.name] = stats
+		}
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(pools)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = workersPage.Execute(w, page)
+	})
+}
+
+// bearerMatches reports whether r carries token as a bearer token.
+func bearerMatches(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) == 1
+}
+
+var workersPage = template.Must(template.New("workers").Funcs(template.FuncMap{
+	"seconds": func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(time.Second).String()
+	},
+	"mb": func(b int64) string {
+		if b == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f MB", float64(b)/(1<<20))
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Workers</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;margin-bottom:2em}td,th{border:1px solid #ccc;padding:.2em .6em;text-align:right}.busy{background:#ffe9b3}.draining{background:#dde8ff}.dead{background:#ffd1d1}</style>
+</head><body>
+{{range .}}<h2>{{.Name}} pool</h2>
+{{if .Workers}}<table>
+<tr><th>#</th><th>PID</th><th>State</th><th>In flight</th><th>Busy for</th><th>Requests</th><th>Total requests</th><th>Restarts</th><th>Uptime</th><th>RSS</th></tr>
+{{range .Workers}}<tr class="{{.State}}"><td>{{.Index}}</td><td>{{.PID}}</td><td>{{.State}}</td><td>{{.InFlight}}</td><td>{{if .BusySeconds}}{{seconds .BusySeconds}}{{if .Long}} (long){{end}}{{end}}</td><td>{{.Requests}}{{if .MaxRequests}} / {{.MaxRequests}}{{end}}</td><td>{{.TotalRequests}}</td><td>{{.Restarts}}</td><td>{{seconds .UptimeSeconds}}</td><td>{{mb .RSS}}</td></tr>
+{{end}}</table>{{else}}<p>No workers.</p>{{end}}
+{{end}}</body></html>
+`))
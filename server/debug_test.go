@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkersHandler(t *testing.T) {
+	s := &Server{
+		fastPool: newFakePool(t, 2, time.Second),
+		slowPool: newFakePool(t, 1, time.Second),
+	}
+	stuck := s.fastPool.workers[1]
+	stuck.setState(WorkerBusy)
+	stuck.incrInFlight()
+	stuck.busySince = time.Now().Add(-90 * time.Second)
+	defer stuck.decrInFlight()
+
+	h := WorkersHandler(s, "")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/workers?format=json", nil))
+	var pools map[string][]WorkerStat
+	if err := json.NewDecoder(rr.Body).Decode(&pools); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(pools["fast"]) != 2 || len(pools["slow"]) != 1 {
+		t.Fatalf("unexpected pools: %+v", pools)
+	}
+	got := pools["fast"][1]
+	if got.State != "busy" || got.InFlight != 1 || got.BusySeconds < 90 {
+		t.Fatalf("stuck worker not reported: %+v", got)
+	}
+	if pools["fast"][0].BusySeconds != 0 {
+		t.Fatalf("idle worker reported busy: %+v", pools["fast"][0])
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/workers", nil))
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("expected an HTML page, got %q", ct)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, `<tr class="busy">`) || !strings.Contains(body, "1m30s") {
+		t.Fatalf("page does not show the stuck worker:\n%s", body)
+	}
+}
+
+func TestWorkersHandlerRequiresToken(t *testing.T) {
+	s := &Server{fastPool: newFakePool(t, 1, time.Second), slowPool: &WorkerPool{}}
+	h := WorkersHandler(s, "s3cret")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/workers", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", rr.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/workers", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a wrong token, got %d", rr.Code)
+	}
+
+	r.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the token, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrBadRequestEncoding is wrapped by errors for request bodies that don't
+// decode under their Content-Encoding. The client gets 400.
+var ErrBadRequestEncoding = errors.New("malformed request body encoding")
+
+// decodeRequestBody replaces a gzip or deflate encoded r.Body with the
+// decoded bytes and drops Content-Encoding and Content-Length, so PHP sees
+// the body as if it had been sent plain. limit (> 0) caps the encoded
+// body; the caller caps the decoded one, which is what stops a small
+// compressed body from expanding without bound. Other encodings are
+// passed through untouched.
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, limit int64) error {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if enc != "gzip" && enc != "x-gzip" && enc != "deflate" {
+		return nil
+	}
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil
+	}
+
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, body, limit)
+	}
+	var zr io.ReadCloser
+	var err error
+	if enc == "deflate" {
+		// RFC 9110: "deflate" is the zlib format, not a raw deflate stream
+		zr, err = zlib.NewReader(body)
+	} else {
+		zr, err = gzip.NewReader(body)
+	}
+	if err != nil {
+		return decodeError(err)
+	}
+
+	r.Body = &decodedBody{zr: zr, body: body}
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return nil
+}
+
+// decodeError marks err as ErrBadRequestEncoding unless it is the end of
+// the body or the size limit.
+func decodeError(err error) error {
+	var maxErr *http.MaxBytesError
+	if err == io.EOF || errors.As(err, &maxErr) {
+		return err
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = errors.New("truncated body")
+	}
+	return fmt.Errorf("%w: %v", ErrBadRequestEncoding, err)
+}
+
+type decodedBody struct {
+	zr   io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	if err != nil {
+		err = decodeError(err)
+	}
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	_ = b.zr.Close()
+	return b.body.Close()
+}
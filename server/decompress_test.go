@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeRequestBodyGzipAndDeflate(t *testing.T) {
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(`{"a":1}`))
+	zw.Close()
+
+	for enc, body := range map[string][]byte{"gzip": gzipped(t, `{"a":1}`), "deflate": deflated.Bytes()} {
+		r := httptest.NewRequest(http.MethodPost, "/api", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", enc)
+		if err := decodeRequestBody(httptest.NewRecorder(), r, 0); err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		payload, err := BuildPayload(r)
+		if err != nil {
+			t.Fatalf("%s: BuildPayload: %v", enc, err)
+		}
+		if payload.Body != `{"a":1}` {
+			t.Fatalf("%s: PHP should see the decoded body, got %q", enc, payload.Body)
+		}
+		if _, ok := payload.Headers["Content-Encoding"]; ok {
+			t.Fatalf("%s: Content-Encoding should be dropped: %v", enc, payload.Headers)
+		}
+	}
+
+	// other encodings pass through as they are
+	r := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader("raw"))
+	r.Header.Set("Content-Encoding", "br")
+	if err := decodeRequestBody(httptest.NewRecorder(), r, 0); err != nil || r.Header.Get("Content-Encoding") != "br" {
+		t.Fatalf("unknown encoding touched: %v", err)
+	}
+}
+
+func TestHandlerDecompressesRequestBodies(t *testing.T) {
+	post := func(body []byte) *httptest.ResponseRecorder {
+		// a body failing mid-stream kills the worker, so each gets its own
+		s := &Server{
+			fastPool:   newFakePool(t, 1, time.Second),
+			slowPool:   newFakePool(t, 1, time.Second),
+			routeStats: make(map[string]*routeStats),
+		}
+		// decoded bodies have no known length, so they stream, and the
+		// fake worker echoes streamed bodies
+		s.SetBodyStreamThreshold(1 << 20)
+		s.SetMaxBodySize(64, 64)
+
+		r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		NewHandler(s).ServeHTTP(rr, r)
+		return rr
+	}
+
+	if rr := post(gzipped(t, "hello")); rr.Code != http.StatusOK || rr.Body.String() != "w0:/upload:hello" {
+		t.Fatalf("decoded body: %d %q", rr.Code, rr.Body)
+	}
+
+	if rr := post([]byte("not gzip at all")); rr.Code != http.StatusBadRequest {
+		t.Fatalf("malformed gzip: got %d, want 400", rr.Code)
+	}
+
+	// a small body that inflates past the limit
+	bomb := gzipped(t, strings.Repeat("0", 4096))
+	if len(bomb) > 64 {
+		t.Fatalf("test body compresses to %d bytes", len(bomb))
+	}
+	if rr := post(bomb); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("decoded body over the limit: got %d, want 413", rr.Code)
+	}
+
+	truncated := gzipped(t, strings.Repeat("abc", 10))
+	if rr := post(truncated[:len(truncated)-6]); rr.Code != http.StatusBadRequest {
+		t.Fatalf("truncated gzip: got %d, want 400", rr.Code)
+	}
+}
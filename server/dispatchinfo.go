@@ -0,0 +1,72 @@
+package server
+
+import "time"
+
+// DispatchInfo describes how DispatchWithInfo served a request.
+type DispatchInfo struct {
+	Pool   string // pool that ran the request, after any overflow
+	Worker int    // index of the worker in Pool; -1 if none was picked
+
+	// Queue is the time from dispatch until the request went onto the
+	// worker's pipe, PHP the time until the worker answered, and Total
+	// the whole dispatch. Queue and PHP are 0 if the request never
+	// reached a worker.
+	Queue time.Duration
+	PHP   time.Duration
+	Total time.Duration
+
+	Overflow         bool // the request borrowed a worker of the other pool; see SetOverflow
+	Restarted        bool // a dead worker was restarted to take it
+	Retried          bool // it was sent again after the pipe broke
+	RetriedElsewhere bool // the worker gave it back and another took it; see ErrRetryElsewhere
+	NoWorkerRetries  int  // times it waited for a live worker; see SetNoWorkerRetry
+	Collapsed        bool // it got the response of an identical request; see SetCollapseRoutes
+}
+
+// note records a dispatch span attribute.
+func (i *DispatchInfo) note(key string, value any) {
+	switch key {
+	case "php.worker":
+		i.Worker, _ = value.(int)
+	case "php.pool_overflow":
+		i.Pool, _ = value.(string)
+		i.Overflow = true
+	case "php.worker_restarted":
+		i.Restarted = true
+	case "php.retried":
+		i.Retried = true
+	case "php.retried_elsewhere":
+		i.RetriedElsewhere = true
+	case "php.collapsed":
+		i.Collapsed = true
+	case "php.no_worker_retries":
+		i.NoWorkerRetries, _ = value.(int)
+	}
+}
+
+// DispatchWithInfo is Dispatch, also reporting which pool and worker
+// served req, how its time was spent and whether it was restarted or
+// retried on the way, for callers that log or act on it.
+func (s *Server) DispatchWithInfo(req *RequestPayload) (*ResponsePayload, DispatchInfo, error) {
+	info := DispatchInfo{Worker: -1}
+	info.Pool, _ = s.selectPool(req)
+	req.info = &info
+	defer func() { req.info = nil }()
+
+	timing := req.timing
+	if timing == nil {
+		// Server-Timing is off; time this dispatch only
+		timing = &requestTiming{start: time.Now()}
+		req.timing = timing
+		defer func() { req.timing = nil }()
+	}
+
+	start := time.Now()
+	resp, err := s.dispatch(req)
+	info.Total = time.Since(start)
+	if !timing.sent.IsZero() {
+		info.Queue = timing.sent.Sub(start)
+		info.PHP = timing.php
+	}
+	return resp, info, err
+}
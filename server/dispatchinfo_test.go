@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDispatchWithInfo(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 2, time.Second),
+		routeStats: make(map[string]*routeStats),
+		slowCfg:    SlowRequestConfig{RoutePrefixes: []string{"/reports/"}},
+	}
+
+	resp, info, err := s.DispatchWithInfo(&RequestPayload{ID: "1", Method: "GET", Path: "/reports/x"})
+	if err != nil || resp.Body != "w0:/reports/x" {
+		t.Fatalf("DispatchWithInfo: %+v, %v", resp, err)
+	}
+	if info.Pool != "slow" || info.Worker != 0 || info.Overflow || info.Restarted || info.Retried {
+		t.Fatalf("info = %+v", info)
+	}
+	if info.PHP <= 0 || info.Queue < 0 || info.Total < info.Queue+info.PHP {
+		t.Fatalf("timings don't add up: %+v", info)
+	}
+
+	req := &RequestPayload{ID: "2", Method: "GET", Path: "/reports/y"}
+	if _, info, _ = s.DispatchWithInfo(req); info.Worker != 1 {
+		t.Fatalf("second request should go to the next worker: %+v", info)
+	}
+	if req.timing != nil || req.info != nil {
+		t.Fatal("DispatchWithInfo must not leave timing behind: Server-Timing is off")
+	}
+}
+
+func TestDispatchWithInfoWithoutWorker(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetNoWorkerRetry(2, time.Millisecond)
+
+	_, info, err := s.DispatchWithInfo(&RequestPayload{ID: "1", Method: "GET", Path: "/"})
+	if !errors.Is(err, ErrNoWorkers) {
+		t.Fatalf("expected ErrNoWorkers, got %v", err)
+	}
+	if info.Pool != "fast" || info.Worker != -1 || info.NoWorkerRetries != 2 || info.Queue != 0 || info.PHP != 0 {
+		t.Fatalf("info = %+v", info)
+	}
+}
@@ -1,9 +1,163 @@
 package server
 
-import "errors"
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+)
 
 var (
 	ErrWorkerDead = errors.New("worker is dead")
 
 	ErrWorkerDraining = errors.New("worker is draining")
+
+	// ErrWorkerTimeout is wrapped by errors for requests a worker did not
+	// answer within its request timeout.
+	ErrWorkerTimeout = errors.New("worker timeout")
+
+	// ErrBadFrame is wrapped by errors for frames from a worker that could
+	// not be decoded or made no sense, such as an invalid status code.
+	ErrBadFrame = errors.New("malformed frame from worker")
 )
+
+// WorkerError is an error the PHP worker reported itself with an "error"
+// stream frame, as opposed to a failure to talk to the worker.
+type WorkerError struct {
+	Status  int // status PHP asked for; 0 means 500
+	Message string
+}
+
+func (e *WorkerError) Error() string {
+	return "stream error from worker: " + e.Message
+}
+
+// mapWorkerErrorToStatus converts worker-level errors into HTTP status
+// codes, so both pools and both dispatch paths report failures alike:
+// 503 when no worker could take the request, 502 when talking to the
+// worker failed, 504 on timeouts, 501 for what the worker's protocol
+// version can't carry and PHP's own status for errors it reported.
+// Typed errors decide first; only an untyped error is classified by its
+// text, and then by the root cause's text alone, so the stderr tail
+// withStderr appends can't turn a crash into a timeout.
+func mapWorkerErrorToStatus(err error) int {
+	msg := rootCause(err).Error()
+
+	var workerErr *WorkerError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		// a streamed request body went over the limit mid-request
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadRequestEncoding):
+		// a streamed request body turned out not to decode
+		return http.StatusBadRequest
+	case errors.Is(err, ErrProtocolTooOld):
+		// the worker predates what the request needs
+		return http.StatusNotImplemented
+	case errors.As(err, &workerErr):
+		if workerErr.Status >= 400 && workerErr.Status <= 599 {
+			return workerErr.Status
+		}
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrNoWorkers),
+		errors.Is(err, ErrWorkerDraining),
+		errors.Is(err, ErrRetryElsewhere),
+		errors.Is(err, ErrConcurrencyLimit):
+		// nothing could take the request right now; the client may retry
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrWorkerTimeout):
+		// the php worker timed out handling the request
+		return http.StatusGatewayTimeout //' 504 Gateway Timeout
+	case errors.Is(err, ErrWorkerDead),
+		errors.Is(err, ErrBadFrame),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, syscall.ECONNRESET):
+		// Connection to the worker died mid-request
+		return http.StatusBadGateway // 502 Bad Gateway
+	case strings.Contains(msg, "timeout"):
+		return http.StatusGatewayTimeout
+	case strings.Contains(msg, "unexpected EOF"),
+		strings.Contains(msg, "broken pipe"),
+		strings.Contains(msg, "connection reset"):
+		return http.StatusBadGateway
+
+	default:
+		// Anything else is treated as an internal server error
+		return http.StatusInternalServerError //500
+	}
+}
+
+// rootCause unwraps err down to the error it started as. Joined errors
+// are left as they are.
+func rootCause(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
+
+// ErrorPage is a canned body sent for an error status.
+type ErrorPage struct {
+	ContentType string // defaults to text/html; charset=utf-8
+	Body        []byte
+}
+
+// SetErrorPages registers pages sent instead of the plain status text when
+// the server itself answers with an error status: worker failures, route
+// limits, bad or oversized request bodies. Responses produced by PHP are
+// never replaced.
+func (s *Server) SetErrorPages(pages map[int]ErrorPage) {
+	s.errorPages = pages
+}
+
+// SetDebugErrors makes error responses include the underlying error text
+// instead of an error page. It is meant for development only: the text
+// can reveal paths and other internals.
+func (s *Server) SetDebugErrors(on bool) {
+	s.debugErrors = on
+}
+
+// writeWorkerError sends an appropriate HTTP error to the client and
+// returns the status it chose, for the caller to log. 503s carry a
+// Retry-After, as the condition is expected to clear shortly.
+func (s *Server) writeWorkerError(w http.ResponseWriter, err error) int {
+	status := mapWorkerErrorToStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	s.writeError(w, status, err)
+	return status
+}
+
+// writeError answers with status and its error page, or the status text
+// when none is registered. err is only shown in debug mode.
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	if s.debugErrors && err != nil {
+		http.Error(w, http.StatusText(status)+": "+err.Error(), status)
+		return
+	}
+	page, ok := s.errorPages[status]
+	if !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	ct := page.ContentType
+	if ct == "" {
+		ct = "text/html; charset=utf-8"
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ct)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(page.Body)
+}
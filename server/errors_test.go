@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMapWorkerErrorToStatus(t *testing.T) {
+	if got := mapWorkerErrorToStatus(errors.New("timeout")); got != http.StatusGatewayTimeout {
+		t.Fatalf("timeout → %d, want %d", got, http.StatusGatewayTimeout)
+	}
+	if got := mapWorkerErrorToStatus(errors.New("broken pipe")); got != http.StatusBadGateway {
+		t.Fatalf("broken pipe → %d, want %d", got, http.StatusBadGateway)
+	}
+	if got := mapWorkerErrorToStatus(errors.New("unexpected EOF")); got != http.StatusBadGateway {
+		t.Fatalf("unexpected EOF → %d, want %d", got, http.StatusBadGateway)
+	}
+	if got := mapWorkerErrorToStatus(errors.New("connection reset")); got != http.StatusBadGateway {
+		t.Fatalf("connection reset → %d, want %d", got, http.StatusBadGateway)
+	}
+	if got := mapWorkerErrorToStatus(errors.New("something else")); got != http.StatusInternalServerError {
+		t.Fatalf("other error → %d, want %d", got, http.StatusInternalServerError)
+	}
+}
+
+func TestMapTypedWorkerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{ErrNoWorkers, http.StatusServiceUnavailable},
+		{ErrWorkerDraining, http.StatusServiceUnavailable},
+		{ErrWorkerDead, http.StatusBadGateway},
+		{fmt.Errorf("write frame: %w", syscall.EPIPE), http.StatusBadGateway},
+		{io.ErrUnexpectedEOF, http.StatusBadGateway},
+		{fmt.Errorf("%w: no response after 1s", ErrWorkerTimeout), http.StatusGatewayTimeout},
+		{&WorkerError{Status: http.StatusUnprocessableEntity, Message: "bad input"}, http.StatusUnprocessableEntity},
+		{&WorkerError{Message: "no status"}, http.StatusInternalServerError},
+	} {
+		if got := mapWorkerErrorToStatus(tc.err); got != tc.want {
+			t.Errorf("%v → %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestWriteWorkerErrorSetsRetryAfterOn503(t *testing.T) {
+	rr := httptest.NewRecorder()
+	(&Server{}).writeWorkerError(rr, ErrNoWorkers)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got %d with Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+	}
+
+	rr = httptest.NewRecorder()
+	(&Server{}).writeWorkerError(rr, ErrWorkerDead)
+	if rr.Header().Get("Retry-After") != "" {
+		t.Fatal("502 should not carry Retry-After")
+	}
+}
+
+func TestWriteWorkerErrorWritesStatus(t *testing.T) {
+	rr := httptest.NewRecorder()
+	(&Server{}).writeWorkerError(rr, errors.New("timeout"))
+	resp := rr.Result()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", resp.StatusCode)
+	}
+}
+
+func TestWriteErrorUsesRegisteredPage(t *testing.T) {
+	s := &Server{}
+	s.SetErrorPages(map[int]ErrorPage{
+		http.StatusBadGateway: {Body: []byte("<h1>Back soon</h1>")},
+		http.StatusServiceUnavailable: {
+			ContentType: "application/json",
+			Body:        []byte(`{"error":"busy"}`),
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	s.writeWorkerError(rr, errors.New("write |1: broken pipe"))
+	if rr.Code != http.StatusBadGateway || rr.Body.String() != "<h1>Back soon</h1>" {
+		t.Fatalf("got %d %q", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	rr = httptest.NewRecorder()
+	s.writeWorkerError(rr, ErrConcurrencyLimit)
+	if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != `{"error":"busy"}` ||
+		rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q (%s)", rr.Code, rr.Body.String(), rr.Header().Get("Content-Type"))
+	}
+
+	// no page registered: plain status text, never the error itself
+	rr = httptest.NewRecorder()
+	s.writeWorkerError(rr, errors.New("timeout reading /srv/app/worker.php"))
+	if rr.Code != http.StatusGatewayTimeout || strings.Contains(rr.Body.String(), "worker.php") {
+		t.Fatalf("got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWriteErrorShowsDetailInDebugMode(t *testing.T) {
+	s := &Server{}
+	s.SetErrorPages(map[int]ErrorPage{http.StatusInternalServerError: {Body: []byte("oops")}})
+	s.SetDebugErrors(true)
+
+	rr := httptest.NewRecorder()
+	s.writeWorkerError(rr, errors.New("worker exploded"))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "worker exploded") {
+		t.Fatalf("got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMapWorkerErrorIgnoresStderrText(t *testing.T) {
+	w := &Worker{stderr: newStderrTail(nil)}
+	_, _ = w.stderr.Write([]byte("PHP Warning: upstream timeout talking to redis\n"))
+
+	err := w.withStderr(fmt.Errorf("read frame: %w", ErrWorkerDead))
+	if !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected the stderr tail in the error, got %v", err)
+	}
+	if got := mapWorkerErrorToStatus(err); got != http.StatusBadGateway {
+		t.Fatalf("dead worker with timeout on stderr → %d, want %d", got, http.StatusBadGateway)
+	}
+}
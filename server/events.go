@@ -0,0 +1,253 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WorkerEventKind says what happened to a worker.
+type WorkerEventKind int
+
+const (
+	// WorkerSpawned: a PHP process was started for the worker.
+	WorkerSpawned WorkerEventKind = iota
+	// WorkerReady: the process answered its handshake and takes
+	// requests. Duration is how long starting it took.
+	WorkerReady
+	// WorkerRequestStarted: the worker was handed a request.
+	WorkerRequestStarted
+	// WorkerRequestFinished: the request is done. Duration is how long it
+	// took and Err how it failed, if it did.
+	WorkerRequestFinished
+	// WorkerRecycled: the worker was taken out of service on purpose, to
+	// be restarted or stopped once its in-flight requests are done. Reason
+	// is one of the Recycle constants; Duration is the process's uptime.
+	WorkerRecycled
+	// WorkerDied: the process exited or stopped answering without being
+	// asked to. Reason or Err says how; Duration is its uptime.
+	WorkerDied
+)
+
+func (k WorkerEventKind) String() string {
+	switch k {
+	case WorkerSpawned:
+		return "spawned"
+	case WorkerReady:
+		return "ready"
+	case WorkerRequestStarted:
+		return "request_started"
+	case WorkerRequestFinished:
+		return "request_finished"
+	case WorkerRecycled:
+		return "recycled"
+	case WorkerDied:
+		return "died"
+	}
+	return "unknown"
+}
+
+// Reasons a worker is recycled, in WorkerEvent.Reason.
+const (
+	RecycleMaxRequests = "max_requests" // served WorkerConfig.MaxRequests
+	RecycleMaxLifetime = "max_lifetime" // see SetMaxLifetime
+	RecycleMemory      = "memory"       // over its RSS limit; see SetMaxRSS
+	RecycleReload      = "reload"       // hot reload or Server.ReloadWorkers
+	RecycleTimeout     = "timeout"      // a request or frame timed out and the process was killed
+	RecycleRetry       = "retry"        // it gave a request back; see ErrRetryElsewhere
+	RecycleIdle        = "idle"         // idle past the pool's idle TTL; see SetIdleTTL
+	RecycleScaleDown   = "scale_down"   // removed by ScaleTo
+)
+
+// WorkerEvent is one worker lifecycle transition, as passed to a
+// WorkerObserver.
+type WorkerEvent struct {
+	Kind WorkerEventKind
+	Time time.Time
+
+	Pool   string // "fast", "slow" or a named pool; "" for a pool outside a Server
+	Worker int    // index of the worker in Pool; -1 outside a pool
+	PID    int    // 0 for workers on a WorkerConfig.Start pipe or a socket
+
+	Request  string        // ID of the request, for the request events
+	Reason   string        // see Kind
+	Duration time.Duration // see Kind
+	Err      error         // see Kind
+}
+
+// WorkerObserver is told about worker lifecycle events, for metrics or
+// alerting the package doesn't provide. Events are delivered one at a
+// time, in order, on a goroutine of their own, so a slow observer never
+// holds up a request; if it falls more than WorkerEventBuffer events
+// behind, further events are dropped until it catches up.
+type WorkerObserver interface {
+	WorkerEvent(WorkerEvent)
+}
+
+// WorkerObserverFunc adapts a function to a WorkerObserver.
+type WorkerObserverFunc func(WorkerEvent)
+
+func (f WorkerObserverFunc) WorkerEvent(e WorkerEvent) { f(e) }
+
+// WorkerEventBuffer is how many events wait for a WorkerObserver before
+// new ones are dropped.
+const WorkerEventBuffer = 1024
+
+// eventQueue hands events to an observer on its own goroutine.
+type eventQueue struct {
+	obs      WorkerObserver
+	ch       chan WorkerEvent
+	warnOnce sync.Once
+}
+
+// newEventQueue starts delivering to obs; it returns nil for a nil obs.
+func newEventQueue(obs WorkerObserver) *eventQueue {
+	if obs == nil {
+		return nil
+	}
+	q := &eventQueue{obs: obs, ch: make(chan WorkerEvent, WorkerEventBuffer)}
+	go q.run()
+	return q
+}
+
+func (q *eventQueue) run() {
+	for e := range q.ch {
+		q.deliver(e)
+	}
+}
+
+// deliver calls the observer, which must not take the process down.
+func (q *eventQueue) deliver(e WorkerEvent) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Default().Error("worker observer panicked", "event", e.Kind.String(), "panic", p)
+		}
+	}()
+	q.obs.WorkerEvent(e)
+}
+
+// send queues e without blocking.
+func (q *eventQueue) send(e WorkerEvent) {
+	select {
+	case q.ch <- e:
+	default:
+		q.warnOnce.Do(func() {
+			slog.Default().Warn("worker observer falling behind, dropping events", "buffer", WorkerEventBuffer)
+		})
+	}
+}
+
+// workerEvents is where a worker reports its events: the observer's queue
+// and the worker's place in its pool.
+type workerEvents struct {
+	q      *eventQueue
+	pool   string
+	worker int
+}
+
+// emit reports e, filling in when and where it happened. It is a no-op
+// without an observer. Callers must not hold w.stateMu.
+func (w *Worker) emit(e WorkerEvent) {
+	ev := w.events.Load()
+	if ev == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Pool, e.Worker = ev.pool, ev.worker
+	w.stateMu.RLock()
+	e.PID = w.pid
+	spawnedAt := w.spawnedAt
+	w.stateMu.RUnlock()
+	if (e.Kind == WorkerRecycled || e.Kind == WorkerDied) && e.Duration == 0 && !spawnedAt.IsZero() {
+		e.Duration = e.Time.Sub(spawnedAt)
+	}
+	ev.q.send(e)
+}
+
+// recycled reports that the worker is being taken out of service.
+func (w *Worker) recycled(reason string) {
+	w.emit(WorkerEvent{Kind: WorkerRecycled, Reason: reason})
+}
+
+// died reports that the worker's process failed without being asked to.
+func (w *Worker) died(reason string, err error) {
+	w.emit(WorkerEvent{Kind: WorkerDied, Reason: reason, Err: err})
+}
+
+// emitStarted reports the worker's current process as spawned and ready,
+// at the times it was.
+func (w *Worker) emitStarted() {
+	ev := w.events.Load()
+	if ev == nil {
+		return
+	}
+	w.stateMu.RLock()
+	pid, startedAt, spawnedAt := w.pid, w.startedAt, w.spawnedAt
+	w.stateMu.RUnlock()
+	if startedAt.IsZero() {
+		startedAt = spawnedAt
+	}
+	e := WorkerEvent{Pool: ev.pool, Worker: ev.worker, PID: pid}
+	e.Kind, e.Time = WorkerSpawned, startedAt
+	ev.q.send(e)
+	e.Kind, e.Time, e.Duration = WorkerReady, spawnedAt, spawnedAt.Sub(startedAt)
+	ev.q.send(e)
+}
+
+// SetObserver reports the lifecycle events of every worker in the pool,
+// including ones added later, to obs; nil stops reporting. Workers
+// already running are reported as spawned and ready, at the times they
+// were, so obs starts from the whole pool.
+func (p *WorkerPool) SetObserver(obs WorkerObserver) {
+	p.setObserver(newEventQueue(obs), "")
+}
+
+// setObserver points the pool's workers at q, naming the pool name.
+func (p *WorkerPool) setObserver(q *eventQueue, name string) {
+	p.mu.Lock()
+	p.events, p.name = q, name
+	workers := append([]*Worker(nil), p.workers...)
+	for i, w := range workers {
+		if w != nil {
+			w.events.Store(p.workerEvents(i))
+		}
+	}
+	p.mu.Unlock()
+
+	for _, w := range workers {
+		if w != nil && !w.isDead() {
+			w.emitStarted()
+		}
+	}
+}
+
+// workerEvents returns where the worker at index i reports events, or nil
+// without an observer; p.mu must be held.
+func (p *WorkerPool) workerEvents(i int) *workerEvents {
+	if p.events == nil {
+		return nil
+	}
+	return &workerEvents{q: p.events, pool: p.name, worker: i}
+}
+
+// serve runs one attempt at req on w, recording it in the pool's metrics
+// and slow request log and reporting it to the observer.
+func (p *WorkerPool) serve(w *Worker, req *RequestPayload, handle func() error) error {
+	w.emit(WorkerEvent{Kind: WorkerRequestStarted, Request: req.ID})
+	start := time.Now()
+	err := handle()
+	d := time.Since(start)
+	p.requestMetrics().record(d, err)
+	p.logSlow(w, req, d, err)
+	w.emit(WorkerEvent{Kind: WorkerRequestFinished, Request: req.ID, Duration: d, Err: err})
+	return err
+}
+
+// SetWorkerObserver reports the lifecycle events of the workers of every
+// pool to obs; see WorkerPool.SetObserver. nil stops reporting.
+func (s *Server) SetWorkerObserver(obs WorkerObserver) {
+	q := newEventQueue(obs)
+	for _, np := range s.pools() {
+		np.pool.setObserver(q, np.name)
+	}
+}
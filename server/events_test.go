@@ -0,0 +1,135 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventLog is a WorkerObserver that keeps what it is told.
+type eventLog struct {
+	mu     sync.Mutex
+	events []WorkerEvent
+}
+
+func (l *eventLog) WorkerEvent(e WorkerEvent) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+// wait returns the events once there are at least n, failing if they
+// don't arrive in time.
+func (l *eventLog) wait(t *testing.T, n int) []WorkerEvent {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		l.mu.Lock()
+		got := append([]WorkerEvent(nil), l.events...)
+		l.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events, want %d: %+v", len(got), n, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func kinds(events []WorkerEvent) []string {
+	var out []string
+	for _, e := range events {
+		out = append(out, e.Kind.String()+":"+e.Reason)
+	}
+	return out
+}
+
+func TestObserverSeesWorkerLifecycle(t *testing.T) {
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 2, RequestTimeout: time.Second, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.stopAll()
+
+	var log eventLog
+	pool.SetObserver(&log)
+	for i := range 2 {
+		if _, err := pool.Dispatch(&RequestPayload{ID: string(rune('a' + i)), Method: "GET", Path: "/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.workers[0].restartIfDead(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := log.wait(t, 9)
+	want := []string{
+		"spawned:", "ready:",
+		"request_started:", "request_finished:",
+		"request_started:", "recycled:max_requests", "request_finished:",
+		"spawned:", "ready:",
+	}
+	if g := kinds(got); !slices.Equal(g, want) {
+		t.Fatalf("events = %v, want %v", g, want)
+	}
+	for _, e := range got {
+		if e.Worker != 0 || e.Time.IsZero() {
+			t.Fatalf("event without its worker or time: %+v", e)
+		}
+	}
+	if got[3].Request != "a" || got[3].Duration <= 0 {
+		t.Fatalf("request finished = %+v", got[3])
+	}
+	if got[5].Duration <= 0 {
+		t.Fatalf("recycled without the uptime: %+v", got[5])
+	}
+}
+
+func TestObserverSeesWorkerDie(t *testing.T) {
+	// the fake PHP side exits after one request
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 1000, RequestTimeout: time.Second, Start: fakeStart(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.stopAll()
+
+	var log eventLog
+	pool.SetObserver(&log)
+	pool.Dispatch(&RequestPayload{ID: "1", Method: "POST", Path: "/"})
+	if _, err := pool.Dispatch(&RequestPayload{ID: "2", Method: "POST", Path: "/"}); err == nil {
+		t.Fatal("the second request should find the worker gone")
+	}
+
+	got := log.wait(t, 7)
+	if e := got[5]; e.Kind != WorkerDied || e.Reason != "broken pipe" || e.Err == nil {
+		t.Fatalf("events = %v", kinds(got))
+	}
+	if e := got[6]; e.Kind != WorkerRequestFinished || e.Err == nil {
+		t.Fatalf("events = %v", kinds(got))
+	}
+}
+
+func TestSlowObserverDoesNotStallRequests(t *testing.T) {
+	w := newFakeWorker(t, "php0", time.Second)
+	pool := &WorkerPool{workers: []*Worker{w}}
+	defer w.stop()
+
+	block := make(chan struct{})
+	defer close(block)
+	pool.SetObserver(WorkerObserverFunc(func(WorkerEvent) { <-block }))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range WorkerEventBuffer {
+			pool.Dispatch(&RequestPayload{ID: string(rune(i)), Method: "GET", Path: "/"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests waited for the observer")
+	}
+}
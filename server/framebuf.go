@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultFrameBufferSize is the typical frame size NewWorkerWithConfig
+// recycles read buffers for when WorkerConfig.FrameBufferSize is 0.
+const DefaultFrameBufferSize = 32 << 10
+
+// framePools holds one framePool per buffer size, shared by every worker
+// configured with that size.
+var framePools sync.Map // int -> *framePool
+
+// framePoolFor returns the shared pool for size, applying the
+// WorkerConfig.FrameBufferSize defaults. It returns nil, allocating every
+// frame, when size is negative.
+func framePoolFor(size int) *framePool {
+	if size == 0 {
+		size = DefaultFrameBufferSize
+	}
+	if size < 0 {
+		return nil
+	}
+	size = max(size, 4)
+	if p, ok := framePools.Load(size); ok {
+		return p.(*framePool)
+	}
+	p, _ := framePools.LoadOrStore(size, newFramePool(size))
+	return p.(*framePool)
+}
+
+// framePool recycles the buffers frames from workers are read into. Every
+// buffer has the same capacity; a frame too big for it gets a buffer of
+// its own, which is left to the garbage collector, so one huge response
+// doesn't pin its memory in the pool.
+type framePool struct {
+	size int
+	pool sync.Pool // of *[]byte
+}
+
+func newFramePool(size int) *framePool {
+	p := &framePool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// get returns a buffer, or nil from a nil pool.
+func (p *framePool) get() *[]byte {
+	if p == nil {
+		return nil
+	}
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns buf to the pool. Nothing may use the frame read into it
+// afterwards. A nil buf is ignored.
+func (p *framePool) put(buf *[]byte) {
+	if p == nil || buf == nil {
+		return
+	}
+	p.pool.Put(buf)
+}
+
+// readFrameInto is readFrame reading into buf, length prefix included,
+// when the frame fits its capacity; otherwise it allocates the body.
+func readFrameInto(r io.Reader, buf []byte) ([]byte, error) {
+	if cap(buf) < 4 {
+		buf = make([]byte, 4)
+	}
+	hdr := buf[:4]
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr)
+	if n == 0 {
+		return nil, fmt.Errorf("%w: zero-length frame", ErrBadFrame)
+	}
+	if n > maxFrameBytes {
+		return nil, fmt.Errorf("%w: %d byte frame exceeds the %d byte limit", ErrBadFrame, n, maxFrameBytes)
+	}
+
+	var body []byte
+	if int(n) <= cap(buf) {
+		body = buf[:n]
+	} else {
+		body = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// headerBufs recycles the length prefixes writeFrame sends.
+var headerBufs = sync.Pool{New: func() any { return new([4]byte) }}
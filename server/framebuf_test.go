@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadFrameIntoUsesBufferWhenFrameFits(t *testing.T) {
+	var sent bytes.Buffer
+	writeFrame(&sent, JSONCodec{}, StreamFrame{Type: "chunk", Data: "hi"})
+	writeFrame(&sent, JSONCodec{}, StreamFrame{Type: "chunk", Data: strings.Repeat("x", 100)})
+
+	buf := make([]byte, 64)
+	small, err := readFrameInto(&sent, buf)
+	if err != nil || &small[0] != &buf[0] {
+		t.Fatalf("a frame that fits should be read into the buffer: %v", err)
+	}
+	if string(small) != `{"type":"chunk","data":"hi"}` {
+		t.Fatalf("small frame = %q", small)
+	}
+
+	big, err := readFrameInto(&sent, buf)
+	if err != nil || &big[0] == &buf[0] || len(big) <= len(buf) {
+		t.Fatalf("a frame bigger than the buffer needs its own: %d bytes, %v", len(big), err)
+	}
+
+	if _, err := readFrameInto(bytes.NewReader([]byte{0, 0, 0, 0}), buf); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("zero-length frame: %v", err)
+	}
+}
+
+func TestFramePoolForDefaults(t *testing.T) {
+	if p := framePoolFor(0); p == nil || p.size != DefaultFrameBufferSize {
+		t.Fatalf("0 should use the default size, got %+v", p)
+	}
+	if p := framePoolFor(-1); p != nil {
+		t.Fatal("a negative size should disable recycling")
+	}
+	if framePoolFor(4096) != framePoolFor(4096) {
+		t.Fatal("workers with the same size should share a pool")
+	}
+
+	// a nil pool hands out nothing and takes anything
+	var none *framePool
+	if none.get() != nil {
+		t.Fatal("nil pool returned a buffer")
+	}
+	none.put(new([]byte))
+}
+
+func TestWorkerReadFrameRecyclesOnlyFittingFrames(t *testing.T) {
+	var sent bytes.Buffer
+	writeFrame(&sent, JSONCodec{}, StreamFrame{Type: "chunk", Data: "hi"})
+	writeFrame(&sent, JSONCodec{}, StreamFrame{Type: "chunk", Data: strings.Repeat("x", 100)})
+
+	w := &Worker{frames: newFramePool(64)}
+	r := io.NopCloser(&sent)
+
+	body, buf, err := w.readFrame(r)
+	if err != nil || buf == nil || &body[0] != &(*buf)[0] {
+		t.Fatalf("small frame: buf %v, %v", buf, err)
+	}
+	w.frames.put(buf)
+
+	body, buf, err = w.readFrame(r)
+	if err != nil || buf != nil || len(body) <= 64 {
+		t.Fatalf("big frame: %d bytes, buf %v, %v", len(body), buf, err)
+	}
+
+	if _, buf, err = w.readFrame(r); err != io.EOF || buf != nil {
+		t.Fatalf("at EOF: buf %v, %v", buf, err)
+	}
+}
+
+// With buffers recycled, every response must still arrive intact whether
+// or not it fit, and pipelined responses must not overwrite each other.
+func TestRecycledFramesKeepResponsesIntact(t *testing.T) {
+	for _, maxConcurrent := range []int{1, 4} {
+		w, err := NewWorkerWithConfig(WorkerConfig{MaxRequests: 1000, FrameBufferSize: 128, Start: fakeStart(0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetMaxConcurrent(maxConcurrent)
+
+		done := make(chan error)
+		for i := range 20 {
+			path := "/" + strings.Repeat("p", i*10) // some frames outgrow the buffer
+			go func() {
+				resp, err := w.Handle(&RequestPayload{ID: path, Method: "GET", Path: path})
+				if err == nil && resp.Body != "php0:"+path {
+					err = errors.New("got " + resp.Body + " for " + path)
+				}
+				done <- err
+			}()
+		}
+		for range 20 {
+			if err := <-done; err != nil {
+				t.Fatalf("max concurrent %d: %v", maxConcurrent, err)
+			}
+		}
+		w.stop()
+	}
+}
+
+func TestRecycledFramesOnStreams(t *testing.T) {
+	chunks := []string{"a", strings.Repeat("b", 200), "c"}
+	w := newFakeStreamWorker(t, http.StatusOK, nil, chunks)
+	w.frames = newFramePool(64)
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/logs", nil))
+	if !strings.HasSuffix(rr.Body.String(), strings.Join(chunks, "")) {
+		t.Fatalf("streamed body = %q", rr.Body)
+	}
+}
+
+// benchmarkReadFrame reads a typical response frame through a worker
+// with the given pool; compare allocs/op with and without recycling.
+func benchmarkReadFrame(b *testing.B, frames *framePool) {
+	raw, _ := json.Marshal(ResponsePayload{ID: "bench", Status: 200, Body: strings.Repeat("<li>item</li>", 600)})
+	var one bytes.Buffer
+	writeFrame(&one, JSONCodec{}, json.RawMessage(raw))
+	frame := one.Bytes()
+
+	w := &Worker{frames: frames}
+	r := bytes.NewReader(frame)
+	rc := io.NopCloser(r)
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(frame)
+		_, buf, err := w.readFrame(rc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.frames.put(buf)
+	}
+}
+
+func BenchmarkReadFrameAlloc(b *testing.B) { benchmarkReadFrame(b, nil) }
+func BenchmarkReadFrameRecycled(b *testing.B) {
+	benchmarkReadFrame(b, newFramePool(DefaultFrameBufferSize))
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeFrame(io.Discard, JSONCodec{}, StreamFrame{Type: "chunk", Data: "x"})
+	}
+}
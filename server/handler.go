@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler is the PHP-dispatch step of the request pipeline: it turns the
+// HTTP request into a RequestPayload, hands it to the Server's worker
+// pools and writes the worker's response back to the client.
+//
+// It is a plain http.Handler, so it can be mounted in any mux and wrapped
+// with any Middleware.
+type Handler struct {
+	srv *Server
+
+	// Fallback, if set, gets a chance to serve the request when the worker
+	// answers with one of FallbackStatuses. When it reports true the worker
+	// response is discarded. It is only consulted for unary responses, and
+	// only while nothing has been written to the client.
+	Fallback TryServeFunc
+	// FallbackStatuses are the worker statuses the Fallback is consulted
+	// for; nil means just 404.
+	FallbackStatuses []int
+}
+
+// fallsBack reports whether a worker response with status goes to the
+// Fallback.
+func (h *Handler) fallsBack(status int) bool {
+	if h.Fallback == nil {
+		return false
+	}
+	if h.FallbackStatuses == nil {
+		return status == http.StatusNotFound
+	}
+	return slices.Contains(h.FallbackStatuses, status)
+}
+
+// NewHandler returns the dispatch handler for s.
+func NewHandler(s *Server) *Handler {
+	return &Handler{srv: s}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.srv.checkRequestHeaders(r); err != nil {
+		h.srv.log().Info("request headers too large", "method", r.Method, "path", r.URL.Path, "err", err)
+		h.srv.writeError(w, http.StatusRequestHeaderFieldsTooLarge, err)
+		return
+	}
+	// gzip/deflate bodies reach PHP decoded; the body limit applies to
+	// the decoded bytes
+	limit := h.srv.MaxBodySize(r)
+	// classify while Content-Length still describes the body as sent
+	slow := h.srv.IsSlowHTTPRequest(r)
+	if limit > 0 && r.ContentLength > limit {
+		// refuse before reading any of it: net/http only sends the 100
+		// Continue a client with Expect: 100-continue waits for on the
+		// first read, so the body is never sent
+		h.srv.log().Info("request body too large", "method", r.Method, "path", r.URL.Path, "limit", limit, "content_length", r.ContentLength)
+		h.srv.writeError(w, http.StatusRequestEntityTooLarge, &http.MaxBytesError{Limit: limit})
+		return
+	}
+	var payload *RequestPayload
+	err := decodeRequestBody(w, r, limit)
+	if err == nil {
+		if limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		build := BuildPayload
+		if h.srv.streamsBody(r) {
+			build = BuildStreamingPayload
+		}
+		payload, err = build(r)
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			h.srv.log().Info("request body too large", "method", r.Method, "path", r.URL.Path, "limit", maxErr.Limit)
+			h.srv.writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		h.srv.log().Info("bad request", "method", r.Method, "path", r.URL.Path, "err", err)
+		h.srv.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer payload.RemoveUploads()
+	payload.slow = slow
+	payload.Timeout = h.srv.headerTimeout(r)
+	start := time.Now()
+
+	poolName, _ := h.srv.selectPool(payload)
+	setRequestPool(r.Context(), poolName)
+	// log under the id the access log and PHP see, not the internal one
+	logger := h.srv.log().With("request_id", payload.Headers["X-Request-Id"][0], "method", payload.Method, "path", payload.Path, "pool", poolName)
+
+	_, span := startSpan(r.Context(), "php.dispatch")
+	defer span.End()
+	span.SetAttribute("php.pool", poolName)
+	payload.span = span
+	if tp := span.TraceParent(); tp != "" {
+		// let PHP continue the trace under the dispatch span
+		payload.Headers["Traceparent"] = []string{tp}
+	}
+
+	if h.srv.serverTiming {
+		payload.timing = &requestTiming{start: start}
+	}
+
+	payload.headerPolicy = h.srv.headerPolicy
+	payload.streamHook = h.srv.streamHook
+
+	sw := NewStatusWriter(w)
+	h.srv.headerPolicy.apply(sw.Header())
+	if h.srv.IsWebSocketRequest(r) {
+		h.serveWebSocket(sw, r, payload, logger, start)
+		return
+	}
+	if h.srv.IsStreamRequest(r) {
+		h.serveStream(sw, payload, logger, start)
+		return
+	}
+	h.serveUnary(sw, r, payload, logger, start)
+}
+
+// serveStream writes frames to the client as the worker emits them. A
+// streamed response is never handed to the Fallback: by the time the
+// worker's status is known the headers are already on the wire.
+func (h *Handler) serveStream(sw *StatusWriter, payload *RequestPayload, logger *slog.Logger, start time.Time) {
+	// tell php worker we want streaming
+	payload.Headers["X-Go-Stream"] = []string{"1"}
+
+	if err := h.srv.DispatchStream(payload, sw); err != nil {
+		payload.span.RecordError(err)
+		if sw.WroteHeader() {
+			// an error page now would be appended to the streamed body;
+			// the client just sees the response end early
+			logger.Error("stream aborted", "status", sw.Status, "bytes", sw.Bytes, "err", err)
+			return
+		}
+		status := h.srv.writeWorkerError(sw, err)
+		logger.Error("stream failed", "status", status, "err", err)
+		return
+	}
+
+	elapsed := time.Since(start)
+	h.srv.RecordLatency(payload.Path, elapsed)
+	logger.Debug("streamed", "duration", elapsed)
+}
+
+// serveWebSocket lets a worker accept the upgrade and then relays the
+// session's messages until either side closes it.
+func (h *Handler) serveWebSocket(sw *StatusWriter, r *http.Request, payload *RequestPayload, logger *slog.Logger, start time.Time) {
+	if err := h.srv.DispatchWebSocket(payload, sw, r); err != nil {
+		payload.span.RecordError(err)
+		if sw.WroteHeader() {
+			logger.Error("websocket aborted", "status", sw.Status, "duration", time.Since(start), "err", err)
+			return
+		}
+		status := h.srv.writeWorkerError(sw, err)
+		logger.Error("websocket failed", "status", status, "err", err)
+		return
+	}
+	// left out of RecordLatency: how long a session lasts is up to the client
+	logger.Debug("websocket closed", "status", sw.Status, "duration", time.Since(start))
+}
+
+// serveUnary waits for the worker's complete response and writes it, or
+// lets the Fallback serve the request instead when PHP answered with one
+// of FallbackStatuses (by default 404). A response PHP chose to stream is
+// written as it arrives instead, and never handed to the Fallback.
+func (h *Handler) serveUnary(sw *StatusWriter, r *http.Request, payload *RequestPayload, logger *slog.Logger, start time.Time) {
+	// PHP may stream a large body instead; see RequestPayload.StreamResponse
+	payload.rw = sw
+	resp, info, err := h.srv.DispatchWithInfo(payload)
+	payload.timing.setHeader(sw.Header())
+	// the access log shows where the request ran, overflow included
+	setRequestPool(r.Context(), info.Pool)
+	if err != nil {
+		payload.span.RecordError(err)
+		if sw.WroteHeader() {
+			// PHP was streaming the response; the client sees it end early
+			logger.Error("response aborted", "status", sw.Status, "bytes", sw.Bytes, "worker", info.Worker, "err", err)
+			return
+		}
+		status := h.srv.writeWorkerError(sw, err)
+		logger.Error("worker error", "status", status, "worker", info.Worker, "err", err)
+		return
+	}
+	h.srv.RecordLatency(payload.Path, time.Since(start))
+	payload.span.SetAttribute("php.status", resp.Status)
+	if resp.streamed {
+		// already relayed to the client, too late for the Fallback
+		return
+	}
+
+	// If PHP returns 404 (or another FallbackStatuses), give the fallback
+	// another chance, as long as nothing has gone out to the client yet
+	if h.fallsBack(resp.Status) && !sw.WroteHeader() {
+		if h.Fallback(sw, r) {
+			return
+		}
+	}
+
+	resp.Headers = guardHeaders(payload.headerPolicy, resp.Headers)
+	resp.Trailers = guardHeaders(payload.headerPolicy, resp.Trailers)
+	if h.srv.responseHook != nil {
+		h.srv.responseHook(payload, resp)
+	}
+	writeResponse(sw, resp, r.Method == http.MethodHead)
+}
+
+// writeResponse copies a unary worker response to the client. The body
+// is complete, so it goes out with a Content-Length rather than chunked
+// (Compress drops it again if it encodes the body), unless the worker
+// sent trailers, which need a chunked body on HTTP/1.1. For HEAD requests
+// only the headers are sent, with the length the body would have had.
+// Responses that can't have a body (204, 304) go out with neither a body
+// nor a Content-Length, even if the worker sent one.
+func writeResponse(w http.ResponseWriter, resp *ResponsePayload, head bool) {
+	var connection []string
+	for k, v := range resp.Headers {
+		if strings.EqualFold(k, "Connection") {
+			connection = append(connection, v)
+		}
+	}
+	hop := hopByHop(connection)
+	for k, v := range resp.Headers {
+		if hop[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		w.Header().Set(k, v)
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var trailers []string
+	if !head && bodyAllowed(status) {
+		trailers = trailerNames(resp.Trailers)
+	}
+	switch {
+	case !bodyAllowed(status):
+		// whatever length PHP declared, nothing follows a 204 or 304
+		w.Header().Del("Content-Length")
+		w.Header().Del("Transfer-Encoding")
+	case len(trailers) > 0:
+		w.Header()["Trailer"] = trailers
+		w.Header().Del("Content-Length")
+	case w.Header().Get("Content-Length") == "":
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	}
+	w.WriteHeader(status)
+
+	if !head && bodyAllowed(status) {
+		_, _ = w.Write([]byte(resp.Body))
+	}
+	for _, name := range trailers {
+		for k, v := range resp.Trailers {
+			if http.CanonicalHeaderKey(k) == name {
+				w.Header().Set(name, v)
+			}
+		}
+	}
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
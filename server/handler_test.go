@@ -0,0 +1,495 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerDispatchesToWorker(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+
+	fallbackCalled := false
+	h := NewHandler(s)
+	h.Fallback = func(w http.ResponseWriter, r *http.Request) bool {
+		fallbackCalled = true
+		return true
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/hello", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if rr.Body.String() != "w0:/hello" {
+		t.Fatalf("unexpected body: %q", rr.Body.String())
+	}
+	if rr.Header().Get("X-Worker") != "w0" {
+		t.Fatalf("expected worker headers to be copied, got %q", rr.Header().Get("X-Worker"))
+	}
+	if fallbackCalled {
+		t.Fatalf("fallback must only run when the worker answers 404")
+	}
+}
+
+func TestHandlerNoWorkersReturnsError(t *testing.T) {
+	s := &Server{
+		fastPool: &WorkerPool{},
+		slowPool: &WorkerPool{},
+	}
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code < http.StatusInternalServerError {
+		t.Fatalf("expected a 5xx status without workers, got %d", rr.Code)
+	}
+}
+
+func TestHandlerRejectsOversizedBody(t *testing.T) {
+	s := &Server{
+		fastPool: newFakePool(t, 1, time.Second),
+		slowPool: newFakePool(t, 1, time.Second),
+		slowCfg: SlowRequestConfig{
+			RoutePrefixes: []string{"/upload"},
+		},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetMaxBodySize(4, 64)
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("0123456789")))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 on fast route, got %d", rr.Code)
+	}
+
+	// slow routes get the higher cap
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload/file", strings.NewReader("0123456789")))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on slow route under its limit, got %d", rr.Code)
+	}
+}
+
+func TestHandlerStreamsLargeRequestBodies(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetBodyStreamThreshold(16)
+
+	// spans several chunk frames
+	big := strings.Repeat("0123456789", 3*bodyChunkSize/10+7)
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(big)))
+	if rr.Code != http.StatusOK || rr.Body.String() != "w0:/upload:"+big {
+		t.Fatalf("streamed body not delivered intact: %d, %d bytes", rr.Code, rr.Body.Len())
+	}
+
+	// small bodies still go inline
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("tiny")))
+	if rr.Body.String() != "w0:/upload" {
+		t.Fatalf("small body should not be streamed: %q", rr.Body.String())
+	}
+}
+
+func TestHandlerStreamedBodyOverLimit(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetBodyStreamThreshold(4)
+	s.SetMaxBodySize(10, 10)
+
+	// no Content-Length, so the limit is only hit while streaming
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 64)))
+	r.ContentLength = -1
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+	if !s.fastPool.workers[0].isDead() {
+		t.Fatal("worker left mid-request should be marked dead")
+	}
+}
+
+func TestHandlerStreamsDesignatedRoutes(t *testing.T) {
+	w := newFakeStreamWorker(t, http.StatusOK, map[string][]string{"Content-Type": {"text/plain"}}, []string{" world"})
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/logs", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if rr.Body.String() != "hello world" {
+		t.Fatalf("expected streamed body, got %q", rr.Body.String())
+	}
+	if !rr.Flushed {
+		t.Fatalf("expected streamed frames to be flushed")
+	}
+}
+
+func TestHandlerStreamSkipsFallbackAndErrorPage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: http.StatusNotFound, Data: "not here"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "error", Status: http.StatusInternalServerError, Error: "boom"}))
+	w := &Worker{
+		stdin:       nopWriteCloser{Writer: io.Discard},
+		stdout:      io.NopCloser(bytes.NewReader(buf.Bytes())),
+		maxRequests: 100,
+	}
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+
+	h := NewHandler(s)
+	h.Fallback = func(w http.ResponseWriter, r *http.Request) bool {
+		t.Fatal("fallback must not run for streamed responses")
+		return true
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/missing", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the worker's 404, got %d", rr.Code)
+	}
+	// the error came after the headers: no error page tacked onto the body
+	if rr.Body.String() != "not here" {
+		t.Fatalf("streamed body was corrupted: %q", rr.Body.String())
+	}
+}
+
+func TestHandlerFallbackOnlyBeforeWrite(t *testing.T) {
+	notFound := rawFrame(`{"status":404,"body":"missing"}`)
+	w := &Worker{
+		stdin:       nopWriteCloser{Writer: io.Discard},
+		stdout:      io.NopCloser(bytes.NewReader(append(notFound, notFound...))),
+		maxRequests: 100,
+	}
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	h := NewHandler(s)
+	h.Fallback = func(w http.ResponseWriter, r *http.Request) bool {
+		_, _ = io.WriteString(w, "static")
+		return true
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+	if rr.Body.String() != "static" {
+		t.Fatalf("expected the fallback to serve the 404, got %q", rr.Body.String())
+	}
+
+	// an outer middleware already started the response
+	rr = httptest.NewRecorder()
+	sw := NewStatusWriter(rr)
+	_, _ = io.WriteString(sw, "early:")
+	h.ServeHTTP(sw, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+	if strings.Contains(rr.Body.String(), "static") {
+		t.Fatalf("fallback ran after the response was started: %q", rr.Body.String())
+	}
+}
+
+func TestHandlerFallbackStatuses(t *testing.T) {
+	gone, notFound := rawFrame(`{"status":410,"body":"gone"}`), rawFrame(`{"status":404,"body":"no such user"}`)
+	w := &Worker{
+		stdin:       nopWriteCloser{Writer: io.Discard},
+		stdout:      io.NopCloser(bytes.NewReader(append(gone, notFound...))),
+		maxRequests: 100,
+	}
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	h := NewHandler(s)
+	h.FallbackStatuses = []int{http.StatusGone}
+	h.Fallback = func(w http.ResponseWriter, r *http.Request) bool {
+		_, _ = io.WriteString(w, "static")
+		return true
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/old.js", nil))
+	if rr.Body.String() != "static" {
+		t.Fatalf("a 410 should go to the fallback, got %d %q", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	if rr.Code != http.StatusNotFound || rr.Body.String() != "no such user" {
+		t.Fatalf("a 404 is no longer a fallback status: %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandlerHeadOmitsBody(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/hello", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("HEAD response carried a body: %q", rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Length"); got != "9" { // len("w0:/hello")
+		t.Fatalf("expected the would-be Content-Length 9, got %q", got)
+	}
+}
+
+func TestWriteResponseSetsContentLength(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeResponse(rr, &ResponsePayload{Status: 200, Body: "hello"}, false)
+	if got := rr.Header().Get("Content-Length"); got != "5" {
+		t.Fatalf("expected Content-Length 5, got %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	writeResponse(rr, &ResponsePayload{Status: 200, Headers: map[string]string{"Content-Length": "3"}, Body: "abc"}, false)
+	if got := rr.Header().Get("Content-Length"); got != "3" {
+		t.Fatalf("worker Content-Length overridden: %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	writeResponse(rr, &ResponsePayload{Status: http.StatusNoContent}, false)
+	if got := rr.Header().Get("Content-Length"); got != "" {
+		t.Fatalf("204 must not get a Content-Length, got %q", got)
+	}
+}
+
+func TestWriteResponseBodylessStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		rr := httptest.NewRecorder()
+		writeResponse(rr, &ResponsePayload{
+			Status:  status,
+			Headers: map[string]string{"Content-Length": "12", "ETag": `"v1"`},
+			Body:    "stray output",
+		}, false)
+
+		if rr.Code != status {
+			t.Fatalf("expected %d, got %d", status, rr.Code)
+		}
+		if got := rr.Header().Get("Content-Length"); got != "" {
+			t.Fatalf("%d must not carry a Content-Length, got %q", status, got)
+		}
+		if rr.Body.Len() != 0 {
+			t.Fatalf("%d must not carry a body, got %q", status, rr.Body.String())
+		}
+		if rr.Header().Get("ETag") != `"v1"` {
+			t.Fatalf("%d lost its other headers: %v", status, rr.Header())
+		}
+	}
+}
+
+func TestWorkerHandlesEmptyResponseBody(t *testing.T) {
+	w := &Worker{
+		stdin:       nopWriteCloser{Writer: io.Discard},
+		stdout:      io.NopCloser(bytes.NewReader(rawFrame(`{"status":204}`))),
+		maxRequests: 100,
+	}
+	resp, err := w.Handle(&RequestPayload{ID: "1", Method: "DELETE", Path: "/items/1"})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if resp.Status != http.StatusNoContent || resp.Body != "" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if w.isDead() {
+		t.Fatal("an empty body is not a protocol error")
+	}
+}
+
+func TestWorkerStreamDropsBodyForNoContent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{
+		Type:    "headers",
+		Status:  http.StatusNoContent,
+		Headers: map[string][]string{"Content-Length": {"5"}},
+		Data:    "stray",
+	}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "more"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(bytes.NewReader(buf.Bytes())),
+	}
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{Method: "GET"}, rr); err != nil {
+		t.Fatalf("streamInternal: %v", err)
+	}
+	if rr.Code != http.StatusNoContent || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("204 stream leaked a body or length: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+}
+
+func TestWriteResponseSendsTrailers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, &ResponsePayload{
+			Status:   200,
+			Headers:  map[string]string{"Content-Length": "5"},
+			Body:     "hello",
+			Trailers: map[string]string{"x-checksum": "abc123", "Set-Cookie": "a=b"},
+		}, false)
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if got := res.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Fatalf("trailer not received: %q (trailers %v)", got, res.Trailer)
+	}
+	if _, ok := res.Trailer["Set-Cookie"]; ok {
+		t.Fatal("Set-Cookie must not be sent as a trailer")
+	}
+}
+
+func TestCompressReplacesContentLength(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+	h := Compress(CompressConfig{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, &ResponsePayload{Status: 200, Body: body}, false)
+	}))
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %v", resp.Header)
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != int64(len(raw)) {
+		t.Fatalf("Content-Length %d does not match the %d encoded bytes", resp.ContentLength, len(raw))
+	}
+	if gunzip(t, raw) != body {
+		t.Fatal("round trip mismatch")
+	}
+}
+
+func TestHandlerExpectContinue(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetMaxBodySize(16, 16)
+	ts := httptest.NewServer(NewHandler(s))
+	defer ts.Close()
+
+	send := func(length int) (*bufio.Reader, net.Conn) {
+		t.Helper()
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST /import HTTP/1.1\r\nHost: x\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", length)
+		return bufio.NewReader(conn), conn
+	}
+
+	// over the limit: the final status comes without a 100 Continue
+	br, conn := send(1 << 30)
+	resp, err := http.ReadResponse(br, nil)
+	conn.Close()
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413 before the body, got %v, %v", resp, err)
+	}
+
+	// accepted: 100 Continue, then the response once the body is sent
+	br, conn = send(4)
+	defer conn.Close()
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 100 Continue") {
+		t.Fatalf("expected 100 Continue, got %q, %v", line, err)
+	}
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "abcd")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after the body, got %v, %v", resp, err)
+	}
+}
+
+func TestHandlerRejectsTooManyHeaders(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetMaxRequestHeaders(64, 3)
+	s.SetBodyStreamThreshold(1)
+
+	for name, hdr := range map[string]http.Header{
+		"count": {"A": {"1", "2"}, "B": {"3"}, "C": {"4"}},
+		"bytes": {"Cookie": {strings.Repeat("x", 100)}},
+	} {
+		for _, body := range []string{"", "streamed"} {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			r.Header = hdr
+			rr := httptest.NewRecorder()
+			NewHandler(s).ServeHTTP(rr, r)
+			if rr.Code != http.StatusRequestHeaderFieldsTooLarge {
+				t.Fatalf("%s with body %q: expected 431, got %d", name, body, rr.Code)
+			}
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("streamed"))
+	r.Header = http.Header{"A": {"1"}, "B": {"2"}}
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 under the limits, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Request header limits applied by NewServer; see SetMaxRequestHeaders.
+const (
+	DefaultMaxHeaderBytes = 64 << 10
+	DefaultMaxHeaderCount = 100
+)
+
+// ErrRequestHeadersTooLarge is wrapped by errors for requests whose
+// headers are over the limits set with SetMaxRequestHeaders. The client
+// gets 431.
+var ErrRequestHeadersTooLarge = errors.New("request headers too large")
+
+// SetMaxRequestHeaders caps the headers of a request the Handler passes to
+// PHP: maxBytes on the names and values together and maxCount on the
+// header lines, a header sent twice counting twice. A request over either
+// gets 431 Request Header Fields Too Large before its payload is built, so
+// thousands of huge headers never reach a frame. A value <= 0 disables
+// that limit.
+func (s *Server) SetMaxRequestHeaders(maxBytes, maxCount int) {
+	s.maxHeaderBytes = maxBytes
+	s.maxHeaderCount = maxCount
+}
+
+// checkRequestHeaders returns an error wrapping ErrRequestHeadersTooLarge
+// if r's headers are over the Server's limits.
+func (s *Server) checkRequestHeaders(r *http.Request) error {
+	if s.maxHeaderBytes <= 0 && s.maxHeaderCount <= 0 {
+		return nil
+	}
+	size, count := 0, 0
+	for name, values := range r.Header {
+		for _, v := range values {
+			size += len(name) + len(v)
+			count++
+		}
+	}
+	if s.maxHeaderCount > 0 && count > s.maxHeaderCount {
+		return fmt.Errorf("%w: %d headers, limit %d", ErrRequestHeadersTooLarge, count, s.maxHeaderCount)
+	}
+	if s.maxHeaderBytes > 0 && size > s.maxHeaderBytes {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrRequestHeadersTooLarge, size, s.maxHeaderBytes)
+	}
+	return nil
+}
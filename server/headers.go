@@ -0,0 +1,218 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1. They
+// describe the worker's side of the exchange, not the client connection,
+// so they are never copied from a worker response.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// hopByHop returns the canonical names of the headers to drop from a
+// response: the standard hop-by-hop headers plus any named in its
+// Connection header values.
+func hopByHop(connection []string) map[string]bool {
+	hop := make(map[string]bool, len(hopHeaders))
+	for _, h := range hopHeaders {
+		hop[h] = true
+	}
+	for _, v := range connection {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hop[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return hop
+}
+
+// copyFrameHeaders copies the headers of a worker's headers frame into
+// dst, leaving out hop-by-hop fields.
+func copyFrameHeaders(dst http.Header, src map[string][]string) {
+	var connection []string
+	for k, vs := range src {
+		if strings.EqualFold(k, "Connection") {
+			connection = append(connection, vs...)
+		}
+	}
+	hop := hopByHop(connection)
+
+	for k, vs := range src {
+		if len(vs) == 0 || hop[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+
+		if strings.ToLower(k) == "set-cookie" {
+			// can't join, must be dealt with separately
+			for _, v := range vs {
+				dst.Add(k, v)
+			}
+		} else {
+			// RFC-compliant: join
+			dst.Set(k, strings.Join(vs, ", "))
+		}
+	}
+}
+
+// HeaderPolicy limits which response headers PHP controls; see
+// Server.SetHeaderPolicy.
+type HeaderPolicy struct {
+	// Set headers go on every response the Handler writes, e.g.
+	// Strict-Transport-Security or a Content-Security-Policy. Whatever the
+	// worker sends under the same names is dropped, so an empty value
+	// just keeps PHP from sending the header (X-Powered-By, say).
+	Set map[string]string `json:"set,omitempty"`
+	// Allow, when not empty, names the only headers and trailers a worker
+	// may send; the rest are dropped. Content-Type and Content-Length,
+	// which describe the body, are always allowed.
+	Allow []string `json:"allow,omitempty"`
+}
+
+// headerPolicy is a HeaderPolicy with canonical header names.
+type headerPolicy struct {
+	set   http.Header
+	allow map[string]bool // nil allows every header
+}
+
+func newHeaderPolicy(p HeaderPolicy) *headerPolicy {
+	if len(p.Set) == 0 && len(p.Allow) == 0 {
+		return nil
+	}
+	hp := &headerPolicy{set: make(http.Header, len(p.Set))}
+	for k, v := range p.Set {
+		hp.set[http.CanonicalHeaderKey(k)] = []string{v}
+	}
+	if len(p.Allow) > 0 {
+		hp.allow = map[string]bool{"Content-Type": true, "Content-Length": true}
+		for _, k := range p.Allow {
+			hp.allow[http.CanonicalHeaderKey(k)] = true
+		}
+	}
+	return hp
+}
+
+// SetHeaderPolicy guards the headers of responses from PHP, so a buggy or
+// compromised script can't switch off the site's security headers. The
+// zero HeaderPolicy turns it off.
+func (s *Server) SetHeaderPolicy(p HeaderPolicy) {
+	s.headerPolicy = newHeaderPolicy(p)
+}
+
+// allows reports whether a worker may send the header name.
+func (p *headerPolicy) allows(name string) bool {
+	if p == nil {
+		return true
+	}
+	name = http.CanonicalHeaderKey(name)
+	if _, ok := p.set[name]; ok {
+		return false
+	}
+	return p.allow == nil || p.allow[name]
+}
+
+// apply sets p's headers on h, ahead of the worker's.
+func (p *headerPolicy) apply(h http.Header) {
+	if p == nil {
+		return
+	}
+	for k, vs := range p.set {
+		if vs[0] != "" {
+			h[k] = []string{vs[0]}
+		}
+	}
+}
+
+// guardHeaders returns the worker headers or trailers in h that p allows.
+func guardHeaders[V any](p *headerPolicy, h map[string]V) map[string]V {
+	if p == nil || len(h) == 0 {
+		return h
+	}
+	out := make(map[string]V, len(h))
+	for k, v := range h {
+		if p.allows(k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// forbiddenTrailers are fields a worker may not send as trailers (RFC 9110
+// section 6.5.1): they frame or route the message, or must be known before
+// the body to be of any use.
+var forbiddenTrailers = map[string]bool{
+	"Authorization":     true,
+	"Cache-Control":     true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Range":     true,
+	"Content-Type":      true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Location":          true,
+	"Proxy-Connection":  true,
+	"Retry-After":       true,
+	"Set-Cookie":        true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Vary":              true,
+	"Www-Authenticate":  true,
+}
+
+// trailerNames returns the canonical names in trailers that may be sent,
+// sorted.
+func trailerNames[V any](trailers map[string]V) []string {
+	names := make([]string, 0, len(trailers))
+	for k := range trailers {
+		if name := http.CanonicalHeaderKey(k); !forbiddenTrailers[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// addTrailers sets trailers on h through http.TrailerPrefix, which works
+// after the headers have gone out. Forbidden fields are dropped.
+func addTrailers(h http.Header, trailers map[string][]string) {
+	for k, vs := range trailers {
+		if name := http.CanonicalHeaderKey(k); !forbiddenTrailers[name] {
+			for _, v := range vs {
+				h.Add(http.TrailerPrefix+name, v)
+			}
+		}
+	}
+}
+
+// isEventStream reports whether h describes a text/event-stream response.
+func isEventStream(h http.Header) bool {
+	mt, _, _ := strings.Cut(h.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mt), "text/event-stream")
+}
+
+// prepareEventStream adjusts the headers of an event stream a worker
+// produces so nothing between PHP and the browser holds events back:
+// no length, no caching, and no buffering in an nginx in front of us.
+// Compress already leaves event streams alone.
+func prepareEventStream(h http.Header) {
+	h.Del("Content-Length")
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "no-cache")
+	}
+	h.Set("X-Accel-Buffering", "no")
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteResponseDropsHopByHopHeaders(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeResponse(rr, &ResponsePayload{
+		Status: 200,
+		Headers: map[string]string{
+			"connection":        "close, X-Internal",
+			"Transfer-Encoding": "chunked",
+			"Keep-Alive":        "timeout=5",
+			"X-Internal":        "secret",
+			"X-App":             "ok",
+		},
+		Body: "hi",
+	}, false)
+
+	for _, h := range []string{"Connection", "Transfer-Encoding", "Keep-Alive", "X-Internal"} {
+		if v := rr.Header().Get(h); v != "" {
+			t.Errorf("hop-by-hop header %s leaked: %q", h, v)
+		}
+	}
+	if rr.Header().Get("X-App") != "ok" {
+		t.Fatalf("end-to-end header dropped: %v", rr.Header())
+	}
+}
+
+func TestWorkerStreamDropsHopByHopHeaders(t *testing.T) {
+	w := &Worker{
+		requestTimeout: 500 * time.Millisecond,
+		stdin:          nopWriteCloser{Writer: io.Discard},
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{
+		Type:   "headers",
+		Status: 200,
+		Headers: map[string][]string{
+			"Connection": {"close"},
+			"Upgrade":    {"websocket"},
+			"X-App":      {"ok"},
+		},
+	}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	w.stdout = io.NopCloser(bytes.NewReader(buf.Bytes()))
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{}, rr); err != nil {
+		t.Fatalf("streamInternal error: %v", err)
+	}
+	if rr.Header().Get("Connection") != "" || rr.Header().Get("Upgrade") != "" {
+		t.Fatalf("hop-by-hop headers leaked: %v", rr.Header())
+	}
+	if rr.Header().Get("X-App") != "ok" {
+		t.Fatalf("end-to-end header dropped: %v", rr.Header())
+	}
+}
+
+func TestWorkerStreamPreparesEventStream(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{
+		Type:    "headers",
+		Status:  200,
+		Headers: map[string][]string{"Content-Type": {"text/event-stream; charset=utf-8"}, "Content-Length": {"0"}},
+	}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "data: 10%\n\n"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(bytes.NewReader(buf.Bytes())),
+	}
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{Method: "GET"}, rr); err != nil {
+		t.Fatalf("streamInternal error: %v", err)
+	}
+	h := rr.Header()
+	if h.Get("Content-Length") != "" || h.Get("Cache-Control") != "no-cache" || h.Get("X-Accel-Buffering") != "no" {
+		t.Fatalf("event stream headers not prepared: %v", h)
+	}
+	if rr.Body.String() != "data: 10%\n\n" || !rr.Flushed {
+		t.Fatalf("event not flushed: %q", rr.Body.String())
+	}
+}
+
+type failingWriter struct{ *httptest.ResponseRecorder }
+
+func (failingWriter) Write([]byte) (int, error) { return 0, syscall.EPIPE }
+
+func TestWorkerStreamClientGoneKillsWorker(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: 200, Data: "tick"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "tick"}))
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(bytes.NewReader(buf.Bytes())),
+	}
+
+	if err := w.streamInternal(&RequestPayload{Method: "GET"}, failingWriter{httptest.NewRecorder()}); err == nil {
+		t.Fatal("expected the write error")
+	}
+	if !w.isDead() {
+		t.Fatal("worker with an abandoned response on its pipe must be restarted")
+	}
+}
+
+func TestHeaderPolicyGuardsWorkerHeaders(t *testing.T) {
+	policy := HeaderPolicy{
+		Set:   map[string]string{"x-frame-options": "DENY", "X-Powered-By": ""},
+		Allow: []string{"cache-control"},
+	}
+	workerHeaders := map[string]string{
+		"X-Frame-Options": "ALLOWALL",
+		"X-Powered-By":    "PHP/8.3",
+		"X-Debug-Token":   "abc",
+		"Cache-Control":   "no-store",
+		"Content-Type":    "application/json",
+	}
+	check := func(name string, h http.Header) {
+		t.Helper()
+		if got := h.Get("X-Frame-Options"); got != "DENY" {
+			t.Errorf("%s: X-Frame-Options = %q, want the forced value", name, got)
+		}
+		for _, k := range []string{"X-Powered-By", "X-Debug-Token"} {
+			if v, ok := h[k]; ok {
+				t.Errorf("%s: %s should be dropped, got %q", name, k, v)
+			}
+		}
+		if h.Get("Cache-Control") != "no-store" || h.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: allowed headers should pass: %v", name, h)
+		}
+	}
+
+	w := newStallWorker(t, -1, func(stdout io.Writer) {
+		body, _ := json.Marshal(ResponsePayload{Status: 200, Headers: workerHeaders, Body: "{}"})
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(body)))
+		stdout.Write(hdr[:])
+		stdout.Write(body)
+	})
+	s := &Server{fastPool: &WorkerPool{workers: []*Worker{w}}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetHeaderPolicy(policy)
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	check("unary", rr.Header())
+
+	frameHeaders := make(map[string][]string)
+	for k, v := range workerHeaders {
+		frameHeaders[k] = []string{v}
+	}
+	sw := newFakeStreamWorker(t, http.StatusOK, frameHeaders, []string{"{}"})
+	s = &Server{fastPool: &WorkerPool{workers: []*Worker{sw}}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+	s.SetHeaderPolicy(policy)
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/x", nil))
+	check("stream", rr.Header())
+
+	// error responses get the forced headers too
+	s = &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetHeaderPolicy(policy)
+	s.SetNoWorkerRetry(-1, 0)
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("error response: %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestHeaderPolicyWithoutAllowListKeepsOtherHeaders(t *testing.T) {
+	p := newHeaderPolicy(HeaderPolicy{Set: map[string]string{"Content-Security-Policy": "default-src 'self'"}})
+	got := guardHeaders(p, map[string]string{"content-security-policy": "*", "X-Custom": "1"})
+	if _, ok := got["content-security-policy"]; ok || got["X-Custom"] != "1" {
+		t.Fatalf("guardHeaders = %v", got)
+	}
+	if newHeaderPolicy(HeaderPolicy{}) != nil {
+		t.Fatal("an empty policy should turn the guard off")
+	}
+}
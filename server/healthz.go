@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// hasLiveWorker reports whether the pool has a worker that can take a
+// request right now (not dead, not draining), without moving the
+// round-robin cursor like NextWorker does.
+func (p *WorkerPool) hasLiveWorker() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		if w != nil && !w.isDead() && !w.isDraining() {
+			return true
+		}
+	}
+	return false
+}
+
+// poolAvailable treats a pool configured with no workers as not in use
+// rather than down.
+func poolAvailable(p *WorkerPool) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	empty := len(p.workers) == 0
+	p.mu.Unlock()
+	return empty || p.hasLiveWorker()
+}
+
+// Available reports whether every pool in use has at least one live worker.
+func (s *Server) Available() bool {
+	for _, np := range s.pools() {
+		if !poolAvailable(np.pool) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetReady flips the readiness reported by ReadyzHandler. NewServer marks
+// the server ready once every worker has completed its startup handshake;
+// clear it at shutdown so load balancers stop routing here while
+// in-flight requests drain.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// Ready reports whether the server finished starting up and hasn't been
+// taken out of rotation with SetReady(false).
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+type probeStatus struct {
+	Status string `json:"status"`
+	Fast   bool   `json:"fast_pool"`
+	Slow   bool   `json:"slow_pool"`
+	Ready  bool   `json:"ready"`
+
+	Pools map[string]bool `json:"pools,omitempty"` // the named pools
+}
+
+// HealthzHandler is a liveness probe: 200 while each pool in use has a
+// worker that isn't dead or draining, 503 otherwise.
+func HealthzHandler(s *Server) http.Handler {
+	return probeHandler(s, false)
+}
+
+// ReadyzHandler is a readiness probe: like HealthzHandler, but also 503
+// until startup has finished and once SetReady(false) was called.
+func ReadyzHandler(s *Server) http.Handler {
+	return probeHandler(s, true)
+}
+
+func probeHandler(s *Server, needReady bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := probeStatus{
+			Fast:  poolAvailable(s.fastPool),
+			Slow:  poolAvailable(s.slowPool),
+			Ready: s.Ready(),
+		}
+
+		available := st.Fast && st.Slow
+		for name, p := range s.named {
+			if st.Pools == nil {
+				st.Pools = make(map[string]bool, len(s.named))
+			}
+			st.Pools[name] = poolAvailable(p)
+			available = available && st.Pools[name]
+		}
+
+		code := http.StatusOK
+		st.Status = "ok"
+		if !available || (needReady && !st.Ready) {
+			code = http.StatusServiceUnavailable
+			st.Status = "unavailable"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(st)
+	})
+}
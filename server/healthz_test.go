@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func probe(t *testing.T, h http.Handler) (int, probeStatus) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	var st probeStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatalf("decode probe body %q: %v", rr.Body.String(), err)
+	}
+	return rr.Code, st
+}
+
+func TestHealthzReflectsLiveWorkers(t *testing.T) {
+	fast1, fast2 := &Worker{}, &Worker{}
+	s := &Server{
+		fastPool: &WorkerPool{workers: []*Worker{fast1, fast2}},
+		slowPool: &WorkerPool{}, // no slow workers configured
+	}
+
+	if code, st := probe(t, HealthzHandler(s)); code != http.StatusOK || st.Status != "ok" {
+		t.Fatalf("expected 200 with live workers, got %d %+v", code, st)
+	}
+
+	fast1.markDead()
+	fast2.startDraining()
+	code, st := probe(t, HealthzHandler(s))
+	if code != http.StatusServiceUnavailable || st.Fast {
+		t.Fatalf("expected 503 once no fast worker is live, got %d %+v", code, st)
+	}
+}
+
+func TestReadyzRequiresStartupAndHonorsSetReady(t *testing.T) {
+	s := &Server{
+		fastPool: &WorkerPool{workers: []*Worker{{}}},
+		slowPool: &WorkerPool{workers: []*Worker{{}}},
+	}
+
+	if code, _ := probe(t, ReadyzHandler(s)); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before startup finished, got %d", code)
+	}
+	if code, _ := probe(t, HealthzHandler(s)); code != http.StatusOK {
+		t.Fatalf("liveness must not depend on readiness, got %d", code)
+	}
+
+	s.SetReady(true)
+	if code, st := probe(t, ReadyzHandler(s)); code != http.StatusOK || !st.Ready {
+		t.Fatalf("expected 200 once ready, got %d %+v", code, st)
+	}
+
+	s.SetReady(false)
+	if code, _ := probe(t, ReadyzHandler(s)); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after SetReady(false), got %d", code)
+	}
+}
+
+func TestNewServerIsReady(t *testing.T) {
+	php, dir := newStandInPHP(t)
+	s, err := NewServerWithConfig(ServerConfig{
+		Fast:        PoolConfig{Workers: 1, MaxRequests: 10},
+		Slow:        PoolConfig{Workers: 1, MaxRequests: 10},
+		PHPBinary:   php,
+		ProjectRoot: dir,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithConfig: %v", err)
+	}
+	defer s.Shutdown(context.Background(), nil)
+	if !s.Ready() || !s.Available() {
+		t.Fatalf("expected a freshly started server to be ready and available")
+	}
+}
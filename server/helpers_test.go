@@ -5,6 +5,10 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -12,6 +16,7 @@ import (
 // newFakeWorker returns a Worker whose stdin/stdout are in-memory pipes.
 // The goroutine reads RequestPayload, writes a ResponsePayload whose
 // Body is a label + ":" + req.Path, so you can tell which worker handled it.
+// A streamed request body is appended as ":" + body.
 func newFakeWorker(t *testing.T, label string, timeout time.Duration) *Worker {
 	t.Helper()
 
@@ -25,75 +30,113 @@ func newFakeWorker(t *testing.T, label string, timeout time.Duration) *Worker {
 		requestTimeout: timeout,
 	}
 
-	// Fake PHP worker loop.
-	go func() {
-		defer func(stdinR *io.PipeReader) {
-			err := stdinR.Close()
-			if err != nil {
-				log.Fatalf("stdin pipe close error: %v", err)
-			}
-		}(stdinR)
-		defer func(stdoutW *io.PipeWriter) {
-			err := stdoutW.Close()
-			if err != nil {
-				log.Fatalf("stdout pipe close error: %v", err)
-			}
-		}(stdoutW)
+	go runFakePHP(stdinR, stdoutW, label, 0)
 
-		for {
-			// 1) Read request length header (4 bytes big-endian)
-			hdr := make([]byte, 4)
-			if _, err := io.ReadFull(stdinR, hdr); err != nil {
-				return // client closed or error
-			}
+	return w
+}
 
-			length := (uint32(hdr[0]) << 24) |
-				(uint32(hdr[1]) << 16) |
-				(uint32(hdr[2]) << 8) |
-				uint32(hdr[3])
+// runFakePHP is the fake PHP side of newFakeWorker and fakeStart. It
+// exits, closing its pipes, after serving exitAfter requests if that is
+// positive.
+func runFakePHP(stdinR *io.PipeReader, stdoutW *io.PipeWriter, label string, exitAfter int) {
+	defer func(stdinR *io.PipeReader) {
+		err := stdinR.Close()
+		if err != nil {
+			log.Fatalf("stdin pipe close error: %v", err)
+		}
+	}(stdinR)
+	defer func(stdoutW *io.PipeWriter) {
+		err := stdoutW.Close()
+		if err != nil {
+			log.Fatalf("stdout pipe close error: %v", err)
+		}
+	}(stdoutW)
 
-			if length == 0 {
-				return
-			}
+	for served := 0; exitAfter <= 0 || served < exitAfter; served++ {
+		// 1) Read request length header (4 bytes big-endian)
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(stdinR, hdr); err != nil {
+			return // client closed or error
+		}
 
-			body := make([]byte, length)
-			if _, err := io.ReadFull(stdinR, body); err != nil {
-				return
-			}
+		length := (uint32(hdr[0]) << 24) |
+			(uint32(hdr[1]) << 16) |
+			(uint32(hdr[2]) << 8) |
+			uint32(hdr[3])
 
-			var req RequestPayload
-			if err := json.Unmarshal(body, &req); err != nil {
-				return
-			}
+		if length == 0 {
+			return
+		}
 
-			resp := ResponsePayload{
-				ID:     req.ID,
-				Status: 200,
-				Headers: map[string]string{
-					"X-Worker": label,
-				},
-				Body: label + ":" + req.Path,
-			}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(stdinR, body); err != nil {
+			return
+		}
+
+		var req RequestPayload
+		if err := json.Unmarshal(body, &req); err != nil {
+			return
+		}
 
-			respJSON, err := json.Marshal(&resp)
+		// a streamed body follows as chunk frames; echo it back
+		var streamed string
+		for req.BodyStream {
+			raw, err := readFrame(stdinR)
 			if err != nil {
 				return
 			}
-
-			respLen := uint32(len(respJSON))
-			outHdr := make([]byte, 4)
-			binary.BigEndian.PutUint32(outHdr, respLen)
-
-			if _, err := stdoutW.Write(outHdr); err != nil {
+			var frame StreamFrame
+			if err := json.Unmarshal(raw, &frame); err != nil {
 				return
 			}
-			if _, err := stdoutW.Write(respJSON); err != nil {
-				return
+			if frame.Type == "end" {
+				break
 			}
+			streamed += frame.Data
 		}
-	}()
 
-	return w
+		resp := ResponsePayload{
+			ID:     req.ID,
+			Status: 200,
+			Headers: map[string]string{
+				"X-Worker": label,
+			},
+			Body: label + ":" + req.Path,
+		}
+		if req.BodyStream {
+			resp.Body += ":" + streamed
+		}
+
+		respJSON, err := json.Marshal(&resp)
+		if err != nil {
+			return
+		}
+
+		respLen := uint32(len(respJSON))
+		outHdr := make([]byte, 4)
+		binary.BigEndian.PutUint32(outHdr, respLen)
+
+		if _, err := stdoutW.Write(outHdr); err != nil {
+			return
+		}
+		if _, err := stdoutW.Write(respJSON); err != nil {
+			return
+		}
+	}
+}
+
+// fakeStart returns a WorkerConfig.Start for fake PHP sides labeled php0,
+// php1, ... in start order, each answering like newFakeWorker's and
+// exiting after exitAfter requests if that is positive.
+func fakeStart(exitAfter int) func() (io.WriteCloser, io.ReadCloser, error) {
+	var starts atomic.Int32
+	return func() (io.WriteCloser, io.ReadCloser, error) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		label := "php" + strconv.Itoa(int(starts.Add(1)-1))
+		go runFakePHP(stdinR, stdoutW, label, exitAfter)
+		return stdinW, stdoutR, nil
+	}
 }
 
 // newFakePool builds a WorkerPool with N fake workers labeled w0, w1, ...
@@ -112,3 +155,31 @@ type nopWriteCloser struct {
 }
 
 func (nopWriteCloser) Close() error { return nil }
+
+// newProjectDir returns a project root with a placeholder php/worker.php,
+// for tests that start a php stand-in which never reads the script.
+func newProjectDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "php"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "php", "worker.php"), []byte("<?php\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newStandInPHP returns a project root and a php stand-in that answers
+// the handshake and then swallows requests, for tests that need a real
+// worker process (a PID, RSS, an exit to watch) but not PHP itself.
+func newStandInPHP(t *testing.T) (php, dir string) {
+	t.Helper()
+	dir = newProjectDir(t)
+	php = filepath.Join(dir, "standinphp")
+	script := "#!/bin/sh\nprintf '\\000\\000\\000\\037{\"type\":\"ready\",\"codec\":\"json\"}'\nexec cat >/dev/null\n"
+	if err := os.WriteFile(php, []byte(script), 0o755); err != nil {
+		t.Fatalf("write php stand-in: %v", err)
+	}
+	return php, dir
+}
@@ -0,0 +1,31 @@
+package server
+
+// ResponseHook rewrites a worker's unary response before the Handler
+// writes it: it may change the status, headers, body or trailers, e.g.
+// to add a nonce to a Content-Security-Policy or inject a debug toolbar
+// in development. It runs after the HeaderPolicy has filtered what PHP
+// sent, so headers it adds are kept, and never for responses the Fallback
+// serves instead.
+type ResponseHook func(req *RequestPayload, resp *ResponsePayload)
+
+// StreamHeadersHook is ResponseHook for streamed responses, which are
+// written as they arrive: it only gets the "headers" frame, and may
+// change its status, headers and the data it starts the body with. A
+// response whose first frame is a chunk gets an empty headers frame with
+// status 200. Large unary responses PHP chose to stream (see
+// RequestPayload.StreamResponse) go to this hook rather than the
+// ResponseHook.
+type StreamHeadersHook func(req *RequestPayload, frame *StreamFrame)
+
+// SetResponseHook runs hook on every unary response the Handler writes;
+// nil removes it. Set it before serving requests.
+func (s *Server) SetResponseHook(hook ResponseHook) {
+	s.responseHook = hook
+}
+
+// SetStreamHeadersHook runs hook on the headers of every streamed
+// response the Handler relays; nil removes it. Set it before serving
+// requests.
+func (s *Server) SetStreamHeadersHook(hook StreamHeadersHook) {
+	s.streamHook = hook
+}
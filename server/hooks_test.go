@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseHookRewritesUnaryResponse(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetHeaderPolicy(HeaderPolicy{Allow: []string{"X-Allowed"}})
+	s.SetResponseHook(func(req *RequestPayload, resp *ResponsePayload) {
+		resp.Headers["Content-Security-Policy"] = "script-src 'nonce-" + req.Path + "'"
+		resp.Body = strings.ToUpper(resp.Body) + "<!-- toolbar -->"
+	})
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/page", nil))
+	if got := rr.Body.String(); got != "W0:/PAGE<!-- toolbar -->" {
+		t.Fatalf("body = %q", got)
+	}
+	if rr.Header().Get("Content-Length") != "24" {
+		t.Fatalf("Content-Length = %q, want the rewritten body's", rr.Header().Get("Content-Length"))
+	}
+	// the hook's headers are not subject to the policy PHP's are
+	if rr.Header().Get("Content-Security-Policy") != "script-src 'nonce-/page'" || rr.Header().Get("X-Worker") != "" {
+		t.Fatalf("headers = %v", rr.Header())
+	}
+}
+
+func TestStreamHeadersHook(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: http.StatusOK, Headers: map[string][]string{"X-From-PHP": {"1"}}}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "body"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	// no headers frame at all
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "only a chunk"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	w := &Worker{
+		stdin:       nopWriteCloser{Writer: io.Discard},
+		stdout:      io.NopCloser(bytes.NewReader(buf.Bytes())),
+		maxRequests: 100,
+	}
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+	var seen []string
+	s.SetStreamHeadersHook(func(req *RequestPayload, frame *StreamFrame) {
+		seen = append(seen, req.Path)
+		if frame.Headers == nil {
+			frame.Headers = map[string][]string{}
+		}
+		frame.Headers["X-Hooked"] = []string{"yes"}
+		frame.Status = http.StatusAccepted
+		frame.Data = "hooked:"
+	})
+	h := NewHandler(s)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/a", nil))
+	if rr.Code != http.StatusAccepted || rr.Body.String() != "hooked:body" ||
+		rr.Header().Get("X-Hooked") != "yes" || rr.Header().Get("X-From-PHP") != "1" {
+		t.Fatalf("got %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/b", nil))
+	if rr.Code != http.StatusAccepted || rr.Body.String() != "hooked:only a chunk" || rr.Header().Get("X-Hooked") != "yes" {
+		t.Fatalf("got %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if len(seen) != 2 {
+		t.Fatalf("hook ran for %v", seen)
+	}
+}
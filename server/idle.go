@@ -0,0 +1,118 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+)
+
+// SetIdleTTL right-sizes the pool to demand: the reaper (see StartReaper)
+// stops workers that have been idle for ttl, keeping at least min. When
+// every remaining worker is busy, Dispatch starts another one in the
+// background, up to the pool's original size (or the last ScaleTo). A
+// ttl of zero disables it.
+func (p *WorkerPool) SetIdleTTL(ttl time.Duration, min int) {
+	p.mu.Lock()
+	p.idleTTL = ttl
+	p.minWorkers = max(min, 0)
+	p.mu.Unlock()
+}
+
+// shrinkIdle removes workers idle for longer than the idle TTL, down to
+// the minimum, and stops removed workers once their last request is done.
+func (p *WorkerPool) shrinkIdle(now time.Time) {
+	// a reload in progress still holds the old worker list
+	if !p.reloadMu.TryLock() {
+		return
+	}
+	defer p.reloadMu.Unlock()
+
+	var stop []*Worker
+	p.mu.Lock()
+	var retiring []*Worker
+	for _, w := range p.retiring {
+		if w.getInFlight() == 0 {
+			stop = append(stop, w)
+		} else {
+			retiring = append(retiring, w)
+		}
+	}
+	p.retiring = retiring
+
+	if p.idleTTL > 0 {
+		live := 0
+		for _, w := range p.workers {
+			if w != nil && !w.isDead() && !w.isDraining() {
+				live++
+			}
+		}
+
+		kept := make([]*Worker, 0, len(p.workers))
+		for _, w := range p.workers {
+			if w == nil || live <= p.minWorkers || w.idleFor(now) < p.idleTTL {
+				kept = append(kept, w)
+				continue
+			}
+			live--
+			w.log().Info("worker idle, removing it", "idle_ttl", p.idleTTL)
+			w.recycled(RecycleIdle)
+			// a request may have picked it just now
+			w.startDraining()
+			if w.getInFlight() == 0 {
+				stop = append(stop, w)
+			} else {
+				p.retire(w)
+			}
+		}
+		if len(kept) < len(p.workers) {
+			p.workers = kept
+			if p.next >= len(kept) {
+				p.next = 0
+			}
+			for i, w := range kept {
+				if w != nil {
+					w.SetLogger(p.workerLogger(i))
+					w.events.Store(p.workerEvents(i))
+				}
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, w := range stop {
+		w.stop()
+	}
+}
+
+// growIfSaturated starts a worker in the background when the pool has
+// shrunk under SetIdleTTL and no worker is idle. The request that noticed
+// still queues on a busy worker; the new one helps those after it.
+func (p *WorkerPool) growIfSaturated() {
+	p.mu.Lock()
+	grow := p.idleTTL > 0 && p.spawn != nil && len(p.workers) < p.maxWorkers
+	spawn, logger := p.spawn, p.logger
+	p.mu.Unlock()
+	if !grow || p.hasIdleWorker() || !p.growing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer p.growing.Store(false)
+		w, err := spawn()
+		if err != nil {
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Error("starting worker failed", "err", err)
+			return
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if len(p.workers) >= p.maxWorkers {
+			// scaled down meanwhile
+			go w.stop()
+			return
+		}
+		p.addWorker(w)
+	}()
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShrinkIdleKeepsMinimum(t *testing.T) {
+	p := newFakePool(t, 3, time.Second)
+	p.SetIdleTTL(time.Minute, 2)
+
+	now := time.Now()
+	for _, w := range p.workers {
+		w.lastActive = now.Add(-2 * time.Minute)
+	}
+	// busy workers are never idle, however long ago they last finished
+	busy := p.workers[2]
+	busy.incrInFlight()
+	defer busy.decrInFlight()
+
+	removed := []*Worker{p.workers[0]}
+	p.shrinkIdle(now)
+
+	if len(p.workers) != 2 || p.workers[1] != busy {
+		t.Fatalf("expected one idle worker removed, %d left", len(p.workers))
+	}
+	for _, w := range removed {
+		if !w.isDead() {
+			t.Fatal("removed worker should be stopped")
+		}
+	}
+
+	// the minimum counts live workers, so nothing more goes
+	p.shrinkIdle(now)
+	if len(p.workers) != 2 {
+		t.Fatalf("pool shrank below its minimum: %d workers", len(p.workers))
+	}
+}
+
+func TestShrinkIdleLeavesRecentWorkers(t *testing.T) {
+	p := newFakePool(t, 2, time.Second)
+	p.SetIdleTTL(time.Minute, 0)
+
+	now := time.Now()
+	p.workers[0].lastActive = now.Add(-30 * time.Second)
+	p.workers[1].lastActive = now.Add(-30 * time.Second)
+	p.shrinkIdle(now)
+
+	if len(p.workers) != 2 {
+		t.Fatalf("workers idle for less than the TTL were removed: %d left", len(p.workers))
+	}
+}
+
+func TestDispatchGrowsShrunkPool(t *testing.T) {
+	p := newFakePool(t, 1, time.Second)
+	p.maxWorkers = 2
+	p.spawn = func() (*Worker, error) { return newFakeWorker(t, "new", time.Second), nil }
+	p.SetIdleTTL(time.Minute, 1)
+
+	// with an idle worker there is no need to grow
+	if _, err := p.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if n := len(p.workers); n != 1 {
+		t.Fatalf("pool grew without being saturated: %d workers", n)
+	}
+
+	p.workers[0].incrInFlight()
+	defer p.workers[0].decrInFlight()
+	if _, err := p.Dispatch(&RequestPayload{ID: "2", Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.workers)
+		p.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saturated pool did not grow back: %d workers", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
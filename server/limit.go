@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrConcurrencyLimit is returned by Dispatch when a route is already
+// running its maximum number of requests and no slot freed up in time.
+var ErrConcurrencyLimit = errors.New("route concurrency limit reached")
+
+// RouteLimit caps how many requests for a route run at once, independent
+// of pool size. Use it to protect a dependency behind an expensive route,
+// e.g. one report export at a time.
+type RouteLimit struct {
+	// Prefix matches request paths; the first matching limit applies.
+	Prefix string
+	// Max is the number of concurrent requests allowed.
+	Max int
+	// QueueTimeout is how long a request waits for a free slot before it
+	// fails with ErrConcurrencyLimit. Zero rejects it immediately.
+	QueueTimeout time.Duration
+}
+
+type routeLimiter struct {
+	RouteLimit
+	slots chan struct{}
+}
+
+// SetRouteLimits replaces the per-route concurrency limits. Limits are
+// enforced before a worker is picked, so waiting requests don't hold one.
+// Limits with Max <= 0 are ignored.
+func (s *Server) SetRouteLimits(limits []RouteLimit) {
+	var ls []*routeLimiter
+	for _, l := range limits {
+		if l.Max <= 0 {
+			continue
+		}
+		ls = append(ls, &routeLimiter{RouteLimit: l, slots: make(chan struct{}, l.Max)})
+	}
+	s.routeLimits = ls
+}
+
+// acquireRouteSlot takes a concurrency slot for req's route, if it has a
+// limit. The returned func releases it and must always be called.
+func (s *Server) acquireRouteSlot(req *RequestPayload) (func(), error) {
+	var l *routeLimiter
+	for _, rl := range s.routeLimits {
+		if strings.HasPrefix(req.Path, rl.Prefix) {
+			l = rl
+			break
+		}
+	}
+	if l == nil {
+		return func() {}, nil
+	}
+
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.QueueTimeout <= 0 {
+		return func() {}, ErrConcurrencyLimit
+	}
+
+	timer := time.NewTimer(l.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return func() {}, ErrConcurrencyLimit
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRouteLimitRejectsOverLimit(t *testing.T) {
+	s := &Server{fastPool: newFakePool(t, 2, time.Second), slowPool: &WorkerPool{}}
+	s.SetRouteLimits([]RouteLimit{{Prefix: "/reports/export", Max: 1}})
+
+	req := &RequestPayload{Method: "GET", Path: "/reports/export/1"}
+	release, err := s.acquireRouteSlot(req)
+	if err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+
+	if _, err := s.Dispatch(req); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatalf("expected ErrConcurrencyLimit while the slot is held, got %v", err)
+	}
+	if got := mapWorkerErrorToStatus(ErrConcurrencyLimit); got != http.StatusServiceUnavailable {
+		t.Fatalf("limit error maps to %d, want 503", got)
+	}
+
+	// other routes are not affected
+	if _, err := s.Dispatch(&RequestPayload{Method: "GET", Path: "/home"}); err != nil {
+		t.Fatalf("unlimited route: %v", err)
+	}
+
+	release()
+	if _, err := s.Dispatch(req); err != nil {
+		t.Fatalf("dispatch after release: %v", err)
+	}
+}
+
+func TestRouteLimitQueuesUntilSlotFrees(t *testing.T) {
+	s := &Server{}
+	s.SetRouteLimits([]RouteLimit{{Prefix: "/export", Max: 1, QueueTimeout: 2 * time.Second}})
+	req := &RequestPayload{Path: "/export"}
+
+	release, err := s.acquireRouteSlot(req)
+	if err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, release)
+
+	start := time.Now()
+	release2, err := s.acquireRouteSlot(req)
+	if err != nil {
+		t.Fatalf("queued request should get the freed slot: %v", err)
+	}
+	defer release2()
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Fatalf("expected the request to wait for the slot, waited %s", waited)
+	}
+}
+
+func TestRouteLimitQueueTimesOut(t *testing.T) {
+	s := &Server{}
+	s.SetRouteLimits([]RouteLimit{{Prefix: "/export", Max: 1, QueueTimeout: 30 * time.Millisecond}})
+	req := &RequestPayload{Path: "/export"}
+
+	release, _ := s.acquireRouteSlot(req)
+	defer release()
+	if _, err := s.acquireRouteSlot(req); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatalf("expected ErrConcurrencyLimit after the queue timeout, got %v", err)
+	}
+}
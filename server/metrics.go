@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the request
+// duration histogram (the Prometheus client defaults).
+var DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative Prometheus-style histogram.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64 // counts[i] observations <= bounds[i]; last is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+	h.sum += v
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram. Counts are
+// cumulative, one per bound plus a final +Inf bucket.
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: append([]uint64(nil), h.counts...),
+		Sum:    h.sum,
+	}
+}
+
+// poolMetrics counts the requests a pool dispatches and how long they take.
+type poolMetrics struct {
+	mu       sync.Mutex
+	requests uint64
+	errors   uint64
+	duration *histogram
+}
+
+func newPoolMetrics() *poolMetrics {
+	return &poolMetrics{duration: newHistogram(DefaultDurationBuckets)}
+}
+
+func (m *poolMetrics) record(d time.Duration, err error) {
+	m.mu.Lock()
+	m.requests++
+	if err != nil {
+		m.errors++
+	}
+	m.mu.Unlock()
+	m.duration.observe(d.Seconds())
+}
+
+// MetricsHandler serves pool and worker statistics for s in the
+// Prometheus text exposition format, labelled by pool="fast"/"slow" or
+// the name of a named pool.
+func MetricsHandler(s *Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		var names []string
+		pools := make(map[string]PoolStats)
+		workers := make(map[string][]WorkerStat)
+		for _, np := range s.pools() {
+			names = append(names, np.name)
+			pools[np.name] = np.pool.Stats()
+			workers[np.name] = np.pool.WorkerStats()
+		}
+		writeMetrics(w, names, pools, workers)
+	})
+}
+
+func writeMetrics(w io.Writer, names []string, pools map[string]PoolStats, workers map[string][]WorkerStat) {
+
+	family := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	family("baremetal_workers", "gauge", "Workers by state.")
+	for _, pool := range names {
+		st := pools[pool]
+		for _, v := range []struct {
+			state string
+			n     int
+		}{{"idle", st.Idle}, {"busy", st.Busy}, {"draining", st.Draining}, {"warming", st.Warming}, {"dead", st.DeadWorkers}} {
+			fmt.Fprintf(w, "baremetal_workers{pool=%q,state=%q} %d\n", pool, v.state, v.n)
+		}
+	}
+
+	family("baremetal_requests_total", "counter", "Requests dispatched to PHP workers.")
+	for _, pool := range names {
+		fmt.Fprintf(w, "baremetal_requests_total{pool=%q} %d\n", pool, pools[pool].Requests)
+	}
+
+	family("baremetal_request_errors_total", "counter", "Dispatched requests that failed at the worker layer.")
+	for _, pool := range names {
+		fmt.Fprintf(w, "baremetal_request_errors_total{pool=%q} %d\n", pool, pools[pool].Errors)
+	}
+
+	family("baremetal_in_flight_requests", "gauge", "Requests currently being handled by workers.")
+	for _, pool := range names {
+		fmt.Fprintf(w, "baremetal_in_flight_requests{pool=%q} %d\n", pool, pools[pool].InFlight)
+	}
+
+	family("baremetal_queue_depth", "gauge", "Requests waiting for a busy worker.")
+	for _, pool := range names {
+		fmt.Fprintf(w, "baremetal_queue_depth{pool=%q} %d\n", pool, pools[pool].Queued)
+	}
+
+	family("baremetal_request_duration_seconds", "histogram", "Time spent in the worker per request.")
+	for _, pool := range names {
+		h := pools[pool].Duration
+		if len(h.Counts) == 0 {
+			continue
+		}
+		for i, b := range h.Bounds {
+			fmt.Fprintf(w, "baremetal_request_duration_seconds_bucket{pool=%q,le=%q} %d\n", pool, strconv.FormatFloat(b, 'g', -1, 64), h.Counts[i])
+		}
+		total := h.Counts[len(h.Counts)-1]
+		fmt.Fprintf(w, "baremetal_request_duration_seconds_bucket{pool=%q,le=\"+Inf\"} %d\n", pool, total)
+		fmt.Fprintf(w, "baremetal_request_duration_seconds_sum{pool=%q} %g\n", pool, h.Sum)
+		fmt.Fprintf(w, "baremetal_request_duration_seconds_count{pool=%q} %d\n", pool, total)
+	}
+
+	family("baremetal_worker_rss_bytes", "gauge", "Resident memory of each worker as last sampled.")
+	for _, pool := range names {
+		for i, rss := range pools[pool].WorkerRSS {
+			fmt.Fprintf(w, "baremetal_worker_rss_bytes{pool=%q,worker=\"%d\"} %d\n", pool, i, rss)
+		}
+	}
+
+	family("baremetal_worker_requests_total", "counter", "Requests served by each worker across its processes.")
+	for _, pool := range names {
+		for _, st := range workers[pool] {
+			fmt.Fprintf(w, "baremetal_worker_requests_total{pool=%q,worker=\"%d\"} %d\n", pool, st.Index, st.TotalRequests)
+		}
+	}
+
+	family("baremetal_worker_restarts_total", "counter", "PHP processes each worker has started after its first.")
+	for _, pool := range names {
+		for _, st := range workers[pool] {
+			fmt.Fprintf(w, "baremetal_worker_restarts_total{pool=%q,worker=\"%d\"} %d\n", pool, st.Index, st.Restarts)
+		}
+	}
+
+	family("baremetal_worker_uptime_seconds", "gauge", "Age of each worker's current PHP process.")
+	for _, pool := range names {
+		for _, st := range workers[pool] {
+			fmt.Fprintf(w, "baremetal_worker_uptime_seconds{pool=%q,worker=\"%d\"} %g\n", pool, st.Index, st.UptimeSeconds)
+		}
+	}
+}
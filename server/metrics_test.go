@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandlerExposesPoolStats(t *testing.T) {
+	s := &Server{
+		fastPool: newFakePool(t, 2, time.Second),
+		slowPool: &WorkerPool{},
+	}
+	s.fastPool.workers[1].markDead()
+
+	if _, err := s.fastPool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	MetricsHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE baremetal_workers gauge",
+		`baremetal_workers{pool="fast",state="idle"} 1`,
+		`baremetal_workers{pool="fast",state="dead"} 1`,
+		`baremetal_workers{pool="slow",state="idle"} 0`,
+		`baremetal_requests_total{pool="fast"} 1`,
+		`baremetal_requests_total{pool="slow"} 0`,
+		`baremetal_request_errors_total{pool="fast"} 0`,
+		`baremetal_queue_depth{pool="fast"} 0`,
+		"# TYPE baremetal_request_duration_seconds histogram",
+		`baremetal_request_duration_seconds_bucket{pool="fast",le="10"} 1`,
+		`baremetal_request_duration_seconds_bucket{pool="fast",le="+Inf"} 1`,
+		`baremetal_request_duration_seconds_count{pool="fast"} 1`,
+		`baremetal_worker_requests_total{pool="fast",worker="0"} 1`,
+		`baremetal_worker_requests_total{pool="fast",worker="1"} 0`,
+		`baremetal_worker_restarts_total{pool="fast",worker="0"} 0`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestHistogramIsCumulative(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 0.5, 5} {
+		h.observe(v)
+	}
+	snap := h.snapshot()
+	want := []uint64{1, 3, 4}
+	for i := range want {
+		if snap.Counts[i] != want[i] {
+			t.Fatalf("counts = %v, want %v", snap.Counts, want)
+		}
+	}
+	if snap.Sum != 6.05 {
+		t.Fatalf("sum = %v", snap.Sum)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+)
+
+// Middleware wraps an http.Handler with cross-cutting behavior
+// (logging, auth, compression, ...).
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with the given middleware. The first middleware is the
+// outermost one, so Chain(h, a, b) serves a request as a(b(h)).
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i] != nil {
+			h = mws[i](h)
+		}
+	}
+	return h
+}
+
+// TryServeFunc attempts to serve a request and reports whether it did.
+type TryServeFunc func(w http.ResponseWriter, r *http.Request) bool
+
+// TryFirst returns a middleware that gives try the first chance at a
+// request and only calls the next handler when try declines it.
+func TryFirst(try TryServeFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if try(w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestID makes sure every request carries an X-Request-Id header,
+// generating one when the client didn't send it, and echoes it back
+// on the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = uuid.New().String()
+			r.Header.Set("X-Request-Id", id)
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recover turns a panic in the wrapped handler into a 500 response and
+// logs it with the request ID and stack, instead of letting net/http drop
+// the connection. http.ErrAbortHandler is re-panicked as net/http expects.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := NewStatusWriter(w)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			slog.Error("panic serving request",
+				"request_id", r.Header.Get("X-Request-Id"), "method", r.Method, "path", r.URL.Path,
+				"panic", p, "stack", string(debug.Stack()))
+			if !sw.WroteHeader() {
+				http.Error(sw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// StatusWriter wraps an http.ResponseWriter and records the status code
+// and number of body bytes written through it.
+type StatusWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+
+	wroteHeader bool
+}
+
+// NewStatusWriter wraps w. If w is already a *StatusWriter it is returned as is.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	if sw, ok := w.(*StatusWriter); ok {
+		return sw
+	}
+	return &StatusWriter{ResponseWriter: w}
+}
+
+func (sw *StatusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.Status = code
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *StatusWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.Bytes += int64(n)
+	return n, err
+}
+
+// WroteHeader reports whether the status line has been written.
+func (sw *StatusWriter) WroteHeader() bool {
+	return sw.wroteHeader
+}
+
+// Flush forwards to the underlying writer when it supports flushing.
+func (sw *StatusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *StatusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
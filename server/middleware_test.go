@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChainOrdersMiddlewareOutermostFirst(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("a"), nil, mw("b"))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := []string{"a", "b", "handler"}
+	if len(order) != len(want) {
+		t.Fatalf("unexpected call order: %v", order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("unexpected call order: %v, want %v", order, want)
+		}
+	}
+}
+
+func TestTryFirstShortCircuits(t *testing.T) {
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+	})
+
+	served := Chain(next, TryFirst(func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusTeapot)
+		return true
+	}))
+
+	rr := httptest.NewRecorder()
+	served.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if nextCalled {
+		t.Fatalf("expected next handler to be skipped when try serves the request")
+	}
+	if rr.Code != http.StatusTeapot {
+		t.Fatalf("expected 418, got %d", rr.Code)
+	}
+
+	declined := Chain(next, TryFirst(func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}))
+	declined.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !nextCalled {
+		t.Fatalf("expected next handler to run when try declines")
+	}
+}
+
+func TestRequestIDGeneratesAndPreserves(t *testing.T) {
+	var seen string
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Request-Id")
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if seen == "" {
+		t.Fatalf("expected a generated X-Request-Id")
+	}
+	if rr.Header().Get("X-Request-Id") != seen {
+		t.Fatalf("expected response X-Request-Id %q, got %q", seen, rr.Header().Get("X-Request-Id"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-Id", "client-id")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if seen != "client-id" {
+		t.Fatalf("expected client X-Request-Id to be preserved, got %q", seen)
+	}
+}
+
+func TestStatusWriterRecordsStatusAndBytes(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewStatusWriter(rr)
+
+	if sw.WroteHeader() {
+		t.Fatalf("expected WroteHeader to be false before writing")
+	}
+
+	_, _ = sw.Write([]byte("hello"))
+
+	if sw.Status != http.StatusOK {
+		t.Fatalf("expected implicit 200, got %d", sw.Status)
+	}
+	if sw.Bytes != 5 {
+		t.Fatalf("expected 5 bytes, got %d", sw.Bytes)
+	}
+	if !sw.WroteHeader() {
+		t.Fatalf("expected WroteHeader to be true after writing")
+	}
+
+	if NewStatusWriter(sw) != sw {
+		t.Fatalf("expected NewStatusWriter to reuse an existing StatusWriter")
+	}
+}
+
+func TestRecoverTurnsPanicInto500(t *testing.T) {
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp *ResponsePayload
+		_ = resp.Body // nil dereference
+	}), RequestID, Recover)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rr.Code)
+	}
+	if rr.Header().Get("X-Request-Id") == "" {
+		t.Fatalf("expected the request id to survive the panic")
+	}
+}
+
+func TestRecoverKeepsStatusAlreadyWritten(t *testing.T) {
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late")
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected the written 202 to stand, got %d", rr.Code)
+	}
+}
+
+func TestRecoverRepanicsAbortHandler(t *testing.T) {
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("expected http.ErrAbortHandler to propagate, got %v", p)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
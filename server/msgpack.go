@@ -0,0 +1,731 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small MessagePack implementation covering what the bridge protocol
+// needs: nil, bools, numbers, strings, binary, arrays, string-keyed maps
+// and structs (keyed by json tag). Extension types are not supported.
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	jsonNumberType = reflect.TypeOf(json.Number(""))
+	errMsgpackEOF  = errors.New("msgpack: unexpected end of data")
+)
+
+func msgpackMarshal(v any) ([]byte, error) {
+	e := &msgpackEncoder{buf: make([]byte, 0, 256)}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func msgpackUnmarshal(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal needs a non-nil pointer")
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+// ---- struct field metadata ----
+
+type msgpackField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var msgpackFieldCache sync.Map // reflect.Type -> []msgpackField
+
+func msgpackFields(t reflect.Type) []msgpackField {
+	if cached, ok := msgpackFieldCache.Load(t); ok {
+		return cached.([]msgpackField)
+	}
+
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name := sf.Name
+		omitEmpty := false
+		if tag, ok := sf.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, msgpackField{name: name, index: i, omitEmpty: omitEmpty})
+	}
+
+	msgpackFieldCache.Store(t, fields)
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// ---- encoding ----
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) byte1(b byte) { e.buf = append(e.buf, b) }
+
+func (e *msgpackEncoder) uint16(tag byte, n uint16) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.BigEndian.AppendUint16(e.buf, n)
+}
+
+func (e *msgpackEncoder) uint32(tag byte, n uint32) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, n)
+}
+
+func (e *msgpackEncoder) uint64(tag byte, n uint64) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.byte1(0xc0)
+		return nil
+	}
+
+	switch v.Type() {
+	case rawMessageType:
+		return e.encodeRawJSON(v.Bytes())
+	case jsonNumberType:
+		n := json.Number(v.String())
+		if i, err := n.Int64(); err == nil {
+			e.encodeInt(i)
+		} else if f, err := n.Float64(); err == nil {
+			e.uint64(0xcb, math.Float64bits(f))
+		} else {
+			return fmt.Errorf("msgpack: invalid json.Number %q", n)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.byte1(0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			e.byte1(0xc3)
+		} else {
+			e.byte1(0xc2)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+
+	case reflect.Float32:
+		e.uint32(0xca, math.Float32bits(float32(v.Float())))
+
+	case reflect.Float64:
+		e.uint64(0xcb, math.Float64bits(v.Float()))
+
+	case reflect.String:
+		e.encodeString(v.String())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			e.byte1(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBin(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+
+	case reflect.Array:
+		return e.encodeArray(v)
+
+	case reflect.Map:
+		if v.IsNil() {
+			e.byte1(0xc0)
+			return nil
+		}
+		e.mapHeader(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encodeMapKey(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !isEmptyValue(v.Field(f.index)) {
+				n++
+			}
+		}
+		e.mapHeader(n)
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			e.encodeString(f.name)
+			if err := e.encode(fv); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// encodeRawJSON re-encodes an embedded JSON document as native MessagePack.
+func (e *msgpackEncoder) encodeRawJSON(raw []byte) error {
+	if len(raw) == 0 {
+		e.byte1(0xc0)
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // keep integers integers
+	var x any
+	if err := dec.Decode(&x); err != nil {
+		return fmt.Errorf("msgpack: invalid json.RawMessage: %w", err)
+	}
+	return e.encode(reflect.ValueOf(x))
+}
+
+func (e *msgpackEncoder) encodeMapKey(k reflect.Value) error {
+	switch k.Kind() {
+	case reflect.String:
+		e.encodeString(k.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeString(strconv.FormatInt(k.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.encodeString(strconv.FormatUint(k.Uint(), 10))
+	default:
+		return fmt.Errorf("msgpack: unsupported map key type %s", k.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.byte1(byte(int8(n)))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(int8(n)))
+	case n >= math.MinInt16:
+		e.uint16(0xd1, uint16(int16(n)))
+	case n >= math.MinInt32:
+		e.uint32(0xd2, uint32(int32(n)))
+	default:
+		e.uint64(0xd3, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.byte1(byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(0xcd, uint16(n))
+	case n <= math.MaxUint32:
+		e.uint32(0xce, uint32(n))
+	default:
+		e.uint64(0xcf, n)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n <= 31:
+		e.byte1(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(0xda, uint16(n))
+	default:
+		e.uint32(0xdb, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBin(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(0xc5, uint16(n))
+	default:
+		e.uint32(0xc6, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	n := v.Len()
+	switch {
+	case n <= 15:
+		e.byte1(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(0xdc, uint16(n))
+	default:
+		e.uint32(0xdd, uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) mapHeader(n int) {
+	switch {
+	case n <= 15:
+		e.byte1(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.uint16(0xde, uint16(n))
+	default:
+		e.uint32(0xdf, uint32(n))
+	}
+}
+
+// ---- decoding ----
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errMsgpackEOF
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// decodeAny decodes the next value into its natural Go representation:
+// nil, bool, int64, uint64, float64, string, []byte, []any or
+// map[string]any.
+func (d *msgpackDecoder) decodeAny() (any, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	tag := b[0]
+
+	switch {
+	case tag <= 0x7f:
+		return int64(tag), nil
+	case tag >= 0xe0:
+		return int64(int8(tag)), nil
+	case tag&0xe0 == 0xa0:
+		return d.readString(int(tag & 0x1f))
+	case tag&0xf0 == 0x90:
+		return d.readArray(int(tag & 0x0f))
+	case tag&0xf0 == 0x80:
+		return d.readMap(int(tag & 0x0f))
+	}
+
+	switch tag {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (tag - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (tag - 0xd0)
+		u, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 1:
+			return int64(int8(u)), nil
+		case 2:
+			return int64(int16(u)), nil
+		case 4:
+			return int64(int32(u)), nil
+		default:
+			return int64(u), nil
+		}
+	case 0xca:
+		u, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		u, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (tag - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (tag - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), raw...), nil
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (tag - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (tag - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", tag)
+}
+
+func (d *msgpackDecoder) readString(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) readArray(n int) ([]any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackEOF
+	}
+	out := make([]any, n)
+	for i := range out {
+		x, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = x
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) readMap(n int) (map[string]any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackEOF
+	}
+	out := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		key, err := msgpackKeyString(k)
+		if err != nil {
+			return nil, err
+		}
+		x, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		out[key] = x
+	}
+	return out, nil
+}
+
+// msgpackKeyString normalizes a map key. PHP turns numeric string keys into
+// integers, so those are accepted and formatted back.
+func msgpackKeyString(k any) (string, error) {
+	switch k := k.(type) {
+	case string:
+		return k, nil
+	case []byte:
+		return string(k), nil
+	case int64:
+		return strconv.FormatInt(k, 10), nil
+	case uint64:
+		return strconv.FormatUint(k, 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key %T", k)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	x, err := d.decodeAny()
+	if err != nil {
+		return err
+	}
+	return msgpackAssign(v, x)
+}
+
+// msgpackAssign stores a decoded value into v, converting between the
+// generic representation and v's type.
+func msgpackAssign(v reflect.Value, x any) error {
+	if v.Type() == rawMessageType {
+		if x == nil {
+			v.SetBytes(nil)
+			return nil
+		}
+		raw, err := json.Marshal(msgpackJSONSafe(x))
+		if err != nil {
+			return err
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(x))
+		return nil
+
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return msgpackAssign(v.Elem(), x)
+
+	case reflect.Bool:
+		if b, ok := x.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := x.(type) {
+		case int64:
+			v.SetInt(n)
+			return nil
+		case uint64:
+			v.SetInt(int64(n))
+			return nil
+		case float64:
+			v.SetInt(int64(n))
+			return nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch n := x.(type) {
+		case int64:
+			v.SetUint(uint64(n))
+			return nil
+		case uint64:
+			v.SetUint(n)
+			return nil
+		case float64:
+			v.SetUint(uint64(n))
+			return nil
+		}
+
+	case reflect.Float32, reflect.Float64:
+		switch n := x.(type) {
+		case int64:
+			v.SetFloat(float64(n))
+			return nil
+		case uint64:
+			v.SetFloat(float64(n))
+			return nil
+		case float64:
+			v.SetFloat(n)
+			return nil
+		}
+
+	case reflect.String:
+		switch s := x.(type) {
+		case string:
+			v.SetString(s)
+			return nil
+		case []byte:
+			v.SetString(string(s))
+			return nil
+		}
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := x.(type) {
+			case []byte:
+				v.SetBytes(b)
+				return nil
+			case string:
+				v.SetBytes([]byte(b))
+				return nil
+			}
+		}
+		if arr, ok := x.([]any); ok {
+			s := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+			for i, el := range arr {
+				if err := msgpackAssign(s.Index(i), el); err != nil {
+					return err
+				}
+			}
+			v.Set(s)
+			return nil
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		m, ok := x.(map[string]any)
+		if !ok {
+			// PHP packs an empty array as an empty list
+			if arr, isArr := x.([]any); isArr && len(arr) == 0 {
+				m, ok = map[string]any{}, true
+			}
+		}
+		if ok {
+			out := reflect.MakeMapWithSize(v.Type(), len(m))
+			for k, el := range m {
+				ev := reflect.New(v.Type().Elem()).Elem()
+				if err := msgpackAssign(ev, el); err != nil {
+					return err
+				}
+				out.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), ev)
+			}
+			v.Set(out)
+			return nil
+		}
+
+	case reflect.Struct:
+		m, ok := x.(map[string]any)
+		if !ok {
+			if arr, isArr := x.([]any); isArr && len(arr) == 0 {
+				m, ok = map[string]any{}, true
+			}
+		}
+		if ok {
+			for _, f := range msgpackFields(v.Type()) {
+				el, present := m[f.name]
+				if !present {
+					continue
+				}
+				if err := msgpackAssign(v.Field(f.index), el); err != nil {
+					return fmt.Errorf("msgpack: field %q: %w", f.name, err)
+				}
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("msgpack: cannot decode %T into %s", x, v.Type())
+}
+
+// msgpackJSONSafe converts decoded binary values to strings so the tree can
+// be re-encoded as JSON.
+func msgpackJSONSafe(x any) any {
+	switch x := x.(type) {
+	case []byte:
+		return string(x)
+	case []any:
+		for i := range x {
+			x[i] = msgpackJSONSafe(x[i])
+		}
+	case map[string]any:
+		for k, v := range x {
+			x[k] = msgpackJSONSafe(v)
+		}
+	}
+	return x
+}
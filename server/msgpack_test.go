@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackRoundTripPayloads(t *testing.T) {
+	codec := MsgpackCodec{}
+
+	req := RequestPayload{
+		ID:      "abc",
+		Method:  "POST",
+		Path:    "/upload?x=1",
+		Headers: map[string][]string{"Content-Type": {"image/png"}, "X-Multi": {"a", "b"}},
+		Body:    "\x89PNG\r\n\x1a\n\x00\xff binary",
+		Form:    map[string][]string{"title": {"hello"}},
+		Files:   []UploadedFile{{Field: "f", Name: "a.png", Type: "image/png", Size: 123456789, TmpName: "/tmp/x"}},
+	}
+	raw, err := codec.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var gotReq RequestPayload
+	if err := codec.Unmarshal(raw, &gotReq); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(req, gotReq) {
+		t.Fatalf("request round trip mismatch:\n got %+v\nwant %+v", gotReq, req)
+	}
+
+	frame := StreamFrame{Type: "publish", Channel: "orders", Event: "created", Payload: json.RawMessage(`{"id":7,"total":12.5,"tags":["a"]}`)}
+	raw, err = codec.Marshal(frame)
+	if err != nil {
+		t.Fatalf("marshal frame: %v", err)
+	}
+	var gotFrame StreamFrame
+	if err := codec.Unmarshal(raw, &gotFrame); err != nil {
+		t.Fatalf("unmarshal frame: %v", err)
+	}
+	var want, got any
+	_ = json.Unmarshal(frame.Payload, &want)
+	_ = json.Unmarshal(gotFrame.Payload, &got)
+	if gotFrame.Channel != "orders" || !reflect.DeepEqual(want, got) {
+		t.Fatalf("frame round trip mismatch: %+v (payload %s)", gotFrame, gotFrame.Payload)
+	}
+}
+
+func TestMsgpackEncodingMatchesSpec(t *testing.T) {
+	tests := []struct {
+		in   any
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{5, []byte{0x05}},
+		{-1, []byte{0xff}},
+		{200, []byte{0xcc, 0xc8}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{70000, []byte{0xce, 0x00, 0x01, 0x11, 0x70}},
+		{"hi", []byte{0xa2, 'h', 'i'}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{[]byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+	}
+	for _, tt := range tests {
+		got, err := msgpackMarshal(tt.in)
+		if err != nil {
+			t.Fatalf("marshal %v: %v", tt.in, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("marshal %#v: got % x, want % x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackDecodesPHPShapes(t *testing.T) {
+	// PHP packs an empty array as an empty list, numeric keys as ints and
+	// may send str8 strings.
+	data := []byte{
+		0x84,
+		0xa2, 'i', 'd', 0xc0,
+		0xa6, 's', 't', 'a', 't', 'u', 's', 0xcd, 0x01, 0xf4,
+		0xa7, 'h', 'e', 'a', 'd', 'e', 'r', 's', 0x90,
+		0xa4, 'b', 'o', 'd', 'y', 0xd9, 0x03, 'e', 'r', 'r',
+	}
+	var resp ResponsePayload
+	if err := msgpackUnmarshal(data, &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if resp.Status != 500 || resp.Body != "err" || resp.Headers == nil || len(resp.Headers) != 0 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	var m map[string]string
+	if err := msgpackUnmarshal([]byte{0x81, 0x07, 0xa1, 'x'}, &m); err != nil {
+		t.Fatalf("unmarshal int-keyed map: %v", err)
+	}
+	if m["7"] != "x" {
+		t.Fatalf("expected int key to map to \"7\", got %v", m)
+	}
+}
+
+func TestMsgpackRejectsTruncatedInput(t *testing.T) {
+	raw, _ := msgpackMarshal(map[string]string{"key": strings.Repeat("v", 40)})
+	var m map[string]string
+	for i := 0; i < len(raw); i++ {
+		if err := msgpackUnmarshal(raw[:i], &m); err == nil {
+			t.Fatalf("expected error decoding %d of %d bytes", i, len(raw))
+		}
+	}
+}
+
+func TestMsgpackIntegerLimits(t *testing.T) {
+	for _, n := range []int64{math.MinInt64, math.MinInt32, -33, -32, 0, 127, 128, math.MaxUint16 + 1, math.MaxInt64} {
+		raw, _ := msgpackMarshal(n)
+		var got int64
+		if err := msgpackUnmarshal(raw, &got); err != nil || got != n {
+			t.Errorf("round trip %d: got %d, err %v", n, got, err)
+		}
+	}
+}
+
+func TestMsgpackLengthBoundaries(t *testing.T) {
+	// each length is the last or first one of a header size
+	strs := []struct {
+		n   int
+		tag byte
+	}{{31, 0xbf}, {32, 0xd9}, {255, 0xd9}, {256, 0xda}, {65535, 0xda}, {65536, 0xdb}}
+	for _, tt := range strs {
+		in := strings.Repeat("s", tt.n)
+		raw, _ := msgpackMarshal(in)
+		var got string
+		if raw[0] != tt.tag || msgpackUnmarshal(raw, &got) != nil || got != in {
+			t.Errorf("string of %d: tag 0x%02x, want 0x%02x; round trip ok: %v", tt.n, raw[0], tt.tag, got == in)
+		}
+	}
+
+	bins := []struct {
+		n   int
+		tag byte
+	}{{0, 0xc4}, {255, 0xc4}, {256, 0xc5}, {65535, 0xc5}, {65536, 0xc6}}
+	for _, tt := range bins {
+		in := bytes.Repeat([]byte{0xff}, tt.n)
+		raw, _ := msgpackMarshal(in)
+		var got []byte
+		if raw[0] != tt.tag || msgpackUnmarshal(raw, &got) != nil || !bytes.Equal(got, in) {
+			t.Errorf("bin of %d: tag 0x%02x, want 0x%02x", tt.n, raw[0], tt.tag)
+		}
+	}
+
+	arrays := []struct {
+		n   int
+		tag byte
+	}{{15, 0x9f}, {16, 0xdc}, {65535, 0xdc}, {65536, 0xdd}}
+	for _, tt := range arrays {
+		in := make([]int, tt.n)
+		in[tt.n-1] = 7
+		raw, _ := msgpackMarshal(in)
+		var got []int
+		if raw[0] != tt.tag || msgpackUnmarshal(raw, &got) != nil || !reflect.DeepEqual(got, in) {
+			t.Errorf("array of %d: tag 0x%02x, want 0x%02x", tt.n, raw[0], tt.tag)
+		}
+	}
+
+	maps := []struct {
+		n   int
+		tag byte
+	}{{15, 0x8f}, {16, 0xde}}
+	for _, tt := range maps {
+		in := make(map[string]int, tt.n)
+		for i := range tt.n {
+			in[strings.Repeat("k", i+1)] = i
+		}
+		raw, _ := msgpackMarshal(in)
+		var got map[string]int
+		if raw[0] != tt.tag || msgpackUnmarshal(raw, &got) != nil || !reflect.DeepEqual(got, in) {
+			t.Errorf("map of %d: tag 0x%02x, want 0x%02x", tt.n, raw[0], tt.tag)
+		}
+	}
+}
+
+func TestMsgpackNumbers(t *testing.T) {
+	raw, _ := msgpackMarshal(float32(1.5))
+	if !bytes.Equal(raw, []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}) {
+		t.Fatalf("float32: % x", raw)
+	}
+	raw, _ = msgpackMarshal(uint64(math.MaxUint64))
+	var u uint64
+	if raw[0] != 0xcf || msgpackUnmarshal(raw, &u) != nil || u != math.MaxUint64 {
+		t.Fatalf("uint64 max: % x decoded to %d", raw, u)
+	}
+
+	// PHP sends whole floats for ints and ints for floats
+	var n int
+	if err := msgpackUnmarshal([]byte{0xcb, 0x40, 0x45, 0, 0, 0, 0, 0, 0}, &n); err != nil || n != 42 {
+		t.Fatalf("float64 into int: %d, %v", n, err)
+	}
+	var f float64
+	if err := msgpackUnmarshal([]byte{0xd0, 0x9c}, &f); err != nil || f != -100 {
+		t.Fatalf("int8 into float64: %v, %v", f, err)
+	}
+
+	// json.Number keeps integers integers
+	for num, want := range map[json.Number][]byte{
+		"12":  {0x0c},
+		"-40": {0xd0, 0xd8},
+		"1.5": {0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+	} {
+		if raw, err := msgpackMarshal(num); err != nil || !bytes.Equal(raw, want) {
+			t.Errorf("json.Number %s: % x, %v; want % x", num, raw, err, want)
+		}
+	}
+	if _, err := msgpackMarshal(json.Number("twelve")); err == nil {
+		t.Error("expected an error for an invalid json.Number")
+	}
+}
+
+func TestMsgpackStructFields(t *testing.T) {
+	type inner struct {
+		N int `json:"n"`
+	}
+	type fields struct {
+		Renamed  string            `json:"renamed"`
+		Skipped  string            `json:"-"`
+		Omitted  string            `json:"omitted,omitempty"`
+		Kept     string            `json:"kept,omitempty"`
+		Untagged bool              // named after the field
+		Ptr      *inner            `json:"ptr,omitempty"`
+		Nested   inner             `json:"nested"`
+		Map      map[string]string `json:"map"`
+		hidden   string
+	}
+	in := fields{Renamed: "r", Skipped: "s", Kept: "k", Untagged: true, Ptr: &inner{N: 3}, Nested: inner{N: 4}, hidden: "h"}
+	raw, err := msgpackMarshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generic map[string]any
+	if err := msgpackUnmarshal(raw, &generic); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(generic))
+	for k := range generic {
+		keys = append(keys, k)
+	}
+	for _, k := range []string{"renamed", "kept", "Untagged", "ptr", "nested", "map"} {
+		if _, ok := generic[k]; !ok {
+			t.Errorf("key %q missing from %v", k, keys)
+		}
+	}
+	if len(generic) != 6 || generic["map"] != nil {
+		t.Fatalf("encoded keys %v, map %v", keys, generic["map"])
+	}
+
+	var got fields
+	if err := msgpackUnmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	in.Skipped, in.hidden = "", ""
+	if !reflect.DeepEqual(got, in) {
+		t.Fatalf("round trip:\n got %+v\nwant %+v", got, in)
+	}
+
+	// keys the struct doesn't know are skipped, not errors
+	raw, _ = msgpackMarshal(map[string]any{"n": 5, "extra": []string{"x"}})
+	var n inner
+	if err := msgpackUnmarshal(raw, &n); err != nil || n.N != 5 {
+		t.Fatalf("decode with an unknown key: %+v, %v", n, err)
+	}
+}
+
+func TestMsgpackRawMessage(t *testing.T) {
+	type holder struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	raw, _ := msgpackMarshal(holder{})
+	var got holder
+	if err := msgpackUnmarshal(raw, &got); err != nil || got.Payload != nil {
+		t.Fatalf("empty payload: %s, %v", got.Payload, err)
+	}
+
+	// binary strings in a payload come back as JSON strings
+	raw, _ = msgpackMarshal(map[string]any{"payload": map[string]any{"b": []byte("hi"), "n": 1}})
+	if err := msgpackUnmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(got.Payload, &decoded); err != nil || decoded["b"] != "hi" || decoded["n"] != 1.0 {
+		t.Fatalf("payload %s: %v", got.Payload, err)
+	}
+
+	if _, err := msgpackMarshal(holder{Payload: json.RawMessage(`{"a":`)}); err == nil {
+		t.Error("expected an error for invalid embedded JSON")
+	}
+}
+
+func TestMsgpackRejectsBadInput(t *testing.T) {
+	var s string
+	var n int
+	var m map[string]int
+	tests := []struct {
+		name string
+		data []byte
+		into any
+	}{
+		{"trailing bytes", []byte{0x01, 0x02}, &n},
+		{"reserved type byte", []byte{0xc1}, &n},
+		{"extension type", []byte{0xd4, 0x01, 0x00}, &n},
+		{"string into int", []byte{0xa1, 'x'}, &n},
+		{"int into string", []byte{0x01}, &s},
+		{"bool map key", []byte{0x81, 0xc3, 0x01}, &m},
+		// a length far past the data must fail without allocating it
+		{"huge array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, &[]int{}},
+		{"huge map", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, &m},
+		{"huge string", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, &s},
+	}
+	for _, tt := range tests {
+		if err := msgpackUnmarshal(tt.data, tt.into); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if err := msgpackUnmarshal([]byte{0x01}, n); err == nil {
+		t.Error("expected an error decoding into a non-pointer")
+	}
+	if err := msgpackUnmarshal([]byte{0x01}, (*int)(nil)); err == nil {
+		t.Error("expected an error decoding into a nil pointer")
+	}
+	var stringer interface{ String() string }
+	if err := msgpackUnmarshal([]byte{0x01}, &stringer); err == nil {
+		t.Error("expected an error decoding into a non-empty interface")
+	}
+
+	if _, err := msgpackMarshal(make(chan int)); err == nil {
+		t.Error("expected an error encoding a channel")
+	}
+	if _, err := msgpackMarshal(map[bool]int{true: 1}); err == nil {
+		t.Error("expected an error encoding a bool map key")
+	}
+	if _, err := msgpackMarshal(map[int]string{7: "x"}); err != nil {
+		t.Errorf("int map keys should encode as strings: %v", err)
+	}
+	if !errors.Is(msgpackUnmarshal([]byte{0xa3, 'a'}, &s), errMsgpackEOF) {
+		t.Error("expected errMsgpackEOF for a short string")
+	}
+}
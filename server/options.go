@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultServerMethods are the methods GlobalOptions advertises when none
+// are given: everything the Handler passes on to PHP.
+var defaultServerMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// GlobalOptions returns a middleware that answers the server-wide
+// "OPTIONS *" request with an Allow header listing methods (nil means
+// defaultServerMethods), so it never takes up a PHP worker. Other
+// requests pass through.
+//
+// net/http answers "OPTIONS *" itself unless the http.Server has
+// DisableGeneralOptionsHandler set, and then without an Allow header; set
+// it to let this middleware reply.
+func GlobalOptions(methods []string) Middleware {
+	if methods == nil {
+		methods = defaultServerMethods
+	}
+	allow := strings.Join(methods, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions || r.RequestURI != "*" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Allow", allow)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+}
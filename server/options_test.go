@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGlobalOptionsAnswersAsterisk(t *testing.T) {
+	called := false
+	h := GlobalOptions(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, "*", nil))
+	if called {
+		t.Fatal("OPTIONS * should not reach the next handler")
+	}
+	if rr.Code != http.StatusOK || rr.Header().Get("Allow") != "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS" {
+		t.Fatalf("unexpected response: %d Allow=%q", rr.Code, rr.Header().Get("Allow"))
+	}
+
+	// OPTIONS on a real path is the app's business
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodOptions, "/users", nil))
+	if !called {
+		t.Fatal("OPTIONS /users should pass through")
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Overflow says when a request may run on the other pool because its own
+// pool is saturated. See SetOverflow.
+type Overflow string
+
+const (
+	// OverflowOff keeps the pools strictly apart. It is the default.
+	OverflowOff Overflow = "off"
+
+	// OverflowFast lets fast requests borrow idle slow workers when every
+	// fast worker is busy. Slow workers usually have the longer timeout,
+	// so this direction is safe to turn on.
+	OverflowFast Overflow = "fast"
+
+	// OverflowBoth also lets slow requests borrow idle fast workers. They
+	// then run under the fast pool's request timeout and recycling limits.
+	OverflowBoth Overflow = "both"
+)
+
+// ParseOverflow validates an overflow policy from configuration. "" means
+// OverflowOff.
+func ParseOverflow(s string) (Overflow, error) {
+	switch Overflow(s) {
+	case "":
+		return OverflowOff, nil
+	case OverflowOff, OverflowFast, OverflowBoth:
+		return Overflow(s), nil
+	}
+	return "", fmt.Errorf("unknown pool overflow policy %q", s)
+}
+
+// SetOverflow sets when requests spill over to the other pool. With a
+// policy other than OverflowOff, a request whose pool has no idle worker
+// goes to the other pool if that one has an idle worker, instead of
+// queueing behind a busy one.
+func (s *Server) SetOverflow(o Overflow) {
+	s.overflow = o
+}
+
+// dispatchPool returns the pool req runs on: the one selectPool picks, or
+// the other one when the overflow policy allows it and only the other one
+// has a worker free right now. Named pools never overflow.
+func (s *Server) dispatchPool(req *RequestPayload) *WorkerPool {
+	name, pool := s.selectPool(req)
+	if name != "fast" && name != "slow" {
+		return pool
+	}
+
+	otherName, other := "slow", s.slowPool
+	if name == "slow" {
+		if s.overflow != OverflowBoth {
+			return pool
+		}
+		otherName, other = "fast", s.fastPool
+	} else if s.overflow != OverflowFast && s.overflow != OverflowBoth {
+		return pool
+	}
+
+	if other == nil || pool.hasIdleWorker() || !other.hasIdleWorker() {
+		return pool
+	}
+	req.traceAttr("php.pool_overflow", otherName)
+	return other
+}
+
+// hasIdleWorker reports whether any worker can take a request without
+// queueing behind another one: one with nothing in flight, or with a free
+// slot when pipelining (see Worker.SetMaxConcurrent) and no long request
+// in it (see SetLongRequestThreshold).
+func (p *WorkerPool) hasIdleWorker() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, w := range p.workers {
+		if w != nil && !w.isDead() && !w.isDraining() && !w.isPinned() && w.getInFlight() < w.capacity() && !p.isLongLocked(w, now) && !w.isWarming() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func newOverflowServer(t *testing.T, o Overflow) *Server {
+	t.Helper()
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{newFakeWorker(t, "fast", time.Second)}},
+		slowPool:   &WorkerPool{workers: []*Worker{newFakeWorker(t, "slow", time.Second)}},
+		slowCfg:    SlowRequestConfig{RoutePrefixes: []string{"/reports/"}},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetOverflow(o)
+	return s
+}
+
+func dispatchedBy(t *testing.T, s *Server, path string) string {
+	t.Helper()
+	resp, err := s.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: path})
+	if err != nil {
+		t.Fatalf("Dispatch(%s): %v", path, err)
+	}
+	return resp.Headers["X-Worker"]
+}
+
+func TestOverflowToIdlePool(t *testing.T) {
+	s := newOverflowServer(t, OverflowFast)
+
+	if got := dispatchedBy(t, s, "/users"); got != "fast" {
+		t.Fatalf("idle fast pool should serve fast requests, got %s", got)
+	}
+
+	// fast worker busy: borrow the idle slow one
+	s.fastPool.workers[0].incrInFlight()
+	if got := dispatchedBy(t, s, "/users"); got != "slow" {
+		t.Fatalf("saturated fast pool should overflow, got %s", got)
+	}
+
+	// the other direction needs OverflowBoth
+	s.fastPool.workers[0].decrInFlight()
+	s.slowPool.workers[0].incrInFlight()
+	defer s.slowPool.workers[0].decrInFlight()
+	if got := dispatchedBy(t, s, "/reports/daily"); got != "slow" {
+		t.Fatalf("slow requests should not overflow under %q, got %s", OverflowFast, got)
+	}
+	s.SetOverflow(OverflowBoth)
+	if got := dispatchedBy(t, s, "/reports/daily"); got != "fast" {
+		t.Fatalf("slow requests should overflow under %q, got %s", OverflowBoth, got)
+	}
+}
+
+func TestOverflowOffKeepsPoolsApart(t *testing.T) {
+	s := newOverflowServer(t, "")
+	s.fastPool.workers[0].incrInFlight()
+	defer s.fastPool.workers[0].decrInFlight()
+
+	if got := dispatchedBy(t, s, "/users"); got != "fast" {
+		t.Fatalf("overflow is off by default, got %s", got)
+	}
+}
+
+func TestOverflowNeedsAnIdleWorker(t *testing.T) {
+	s := newOverflowServer(t, OverflowBoth)
+	for _, p := range []*WorkerPool{s.fastPool, s.slowPool} {
+		p.workers[0].incrInFlight()
+		defer p.workers[0].decrInFlight()
+	}
+
+	if got := dispatchedBy(t, s, "/users"); got != "fast" {
+		t.Fatalf("with both pools busy the request should stay put, got %s", got)
+	}
+}
+
+func TestParseOverflow(t *testing.T) {
+	for in, want := range map[string]Overflow{"": OverflowOff, "off": OverflowOff, "fast": OverflowFast, "both": OverflowBoth} {
+		if got, err := ParseOverflow(in); err != nil || got != want {
+			t.Fatalf("ParseOverflow(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := ParseOverflow("slow"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
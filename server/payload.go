@@ -1,11 +1,130 @@
 package server
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 type RequestPayload struct {
-	ID      string              `json:"id"`
-	Method  string              `json:"method"`
-	Path    string              `json:"path"`
-	Headers map[string][]string `json:"headers"`
-	Body    string              `json:"body"`
+	ID     string              `json:"id"`
+	Method string              `json:"method"`
+	Path   string              `json:"path"`            // decoded URL path, without the query
+	Query  map[string][]string `json:"query,omitempty"` // decoded query parameters ($_GET)
+	// RawPath and RawQuery are the path and query as the client sent
+	// them, still percent-encoded and in their original order, for
+	// REQUEST_URI and QUERY_STRING: signed URLs must verify, and %2F in
+	// a path segment must not become a separator.
+	RawPath  string              `json:"raw_path,omitempty"`
+	RawQuery string              `json:"raw_query,omitempty"`
+	Headers  map[string][]string `json:"headers"`
+	Body     string              `json:"body"`
+
+	// BodyStream tells PHP the body is not in Body but follows the request
+	// frame as "chunk" frames closed by an "end" frame; see
+	// BuildStreamingPayload.
+	BodyStream bool `json:"body_stream,omitempty"`
+
+	// WebSocket tells PHP the request is a WebSocket upgrade to accept
+	// (a 101 headers frame) or refuse, followed by a message session; see
+	// Server.SetWebSocketConfig.
+	WebSocket bool `json:"websocket,omitempty"`
+
+	// StreamResponse tells PHP it may answer a unary request with a
+	// streamed response ("headers", "chunk" and "end" frames, as on stream
+	// routes) instead of a response frame, for a body too large to hold in
+	// one. Go relays the chunks to the client as they arrive. The Handler
+	// asks for it; see Worker.Handle.
+	StreamResponse bool `json:"stream_response,omitempty"`
+
+	// Client connection details for $_SERVER: the client IP (no port,
+	// resolved through trusted proxies by RealIP), "http" or "https", and
+	// the requested host.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Scheme     string `json:"scheme"`
+	Host       string `json:"host,omitempty"`
+
+	// multipart/form-data bodies are not sent inline: fields end up in
+	// Form and file parts are spooled to disk and described by Files.
+	Form  map[string][]string `json:"form,omitempty"`
+	Files []UploadedFile      `json:"files,omitempty"`
+
+	// Cookies holds the parsed Cookie headers, ready to use as $_COOKIE.
+	Cookies map[string]string `json:"cookies,omitempty"`
+
+	// Idempotent marks the request as safe to replay on a fresh worker
+	// when the pipe to the first one breaks. BuildPayload sets it for
+	// requests carrying an Idempotency-Key header. It is not sent to PHP.
+	Idempotent bool `json:"-"`
+
+	// Timeout, when positive, replaces the worker's request timeout for
+	// this request. The Handler sets it from the client's X-Request-Timeout
+	// or Timeout header; see Server.SetMaxHeaderTimeout. It is not sent to
+	// PHP.
+	Timeout time.Duration `json:"-"`
+
+	// span is the dispatch span of a traced request; see Tracing.
+	span Span
+	// timing is set when the Server adds Server-Timing headers.
+	timing *requestTiming
+	// info collects what DispatchWithInfo reports.
+	info *DispatchInfo
+	// slow is set when the Handler classified the request as slow from
+	// its headers, before the body was read; see IsSlowHTTPRequest.
+	slow bool
+	// headerPolicy guards the headers of the worker's response; see
+	// Server.SetHeaderPolicy.
+	headerPolicy *headerPolicy
+	// streamHook rewrites the headers of a streamed response; see
+	// Server.SetStreamHeadersHook.
+	streamHook StreamHeadersHook
+
+	// body is the unread request body when BodyStream is set, and
+	// bodySize its Content-Length (-1 if unknown).
+	body     io.Reader
+	bodySize int64
+
+	// rw takes a streamed answer to a unary request; nil keeps
+	// StreamResponse off. relayed is set once any of one was written.
+	rw      http.ResponseWriter
+	relayed bool
+}
+
+// traceAttr sets an attribute on the request's dispatch span, if traced,
+// and notes it in its DispatchInfo, if one is being collected.
+func (p *RequestPayload) traceAttr(key string, value any) {
+	if p.span != nil {
+		p.span.SetAttribute(key, value)
+	}
+	if p.info != nil {
+		p.info.note(key, value)
+	}
+}
+
+// Retryable reports whether the request may be sent to PHP a second time
+// after a broken pipe: safe methods (GET, HEAD, OPTIONS, TRACE) always
+// are, anything else only when marked Idempotent. Everything else is
+// delivered at most once, since PHP may already have acted on it.
+func (p *RequestPayload) Retryable() bool {
+	if p.BodyStream {
+		// the body was consumed by the first attempt
+		return false
+	}
+	if p.Idempotent {
+		return true
+	}
+	switch p.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
 }
 
 type ResponsePayload struct {
@@ -13,12 +132,223 @@ type ResponsePayload struct {
 	Status  int               `json:"status"`
 	Headers map[string]string `json:"headers"`
 	Body    string            `json:"body"`
+
+	// Trailers are sent after the body as HTTP trailers. Fields that can't
+	// be trailers, like Content-Type or Set-Cookie, are dropped.
+	Trailers map[string]string `json:"trailers,omitempty"`
+
+	// streamed is set when PHP streamed the response and it already went
+	// to the request's rw; only Status is filled in.
+	streamed bool
+}
+
+// checkStatus validates a status code sent by a worker, turning the
+// missing 0 into 200. Informational 1xx codes can't end a response, so
+// only 200-599 pass.
+func checkStatus(status *int) error {
+	if *status == 0 {
+		*status = http.StatusOK
+	}
+	if *status < 200 || *status > 599 {
+		return fmt.Errorf("%w: invalid status %d", ErrBadFrame, *status)
+	}
+	return nil
 }
 
 type StreamFrame struct {
-	Type    string              `json:"type"`              // "headers", "chunk", "end", "error"
-	Status  int                 `json:"status,omitempty"`  // only for headers
+	Type    string              `json:"type"`              // "headers", "chunk", "end", "error", "publish", "retry"; see wsproxy.go for WebSocket sessions
+	Status  int                 `json:"status,omitempty"`  // for headers, and optionally error
 	Headers map[string][]string `json:"headers,omitempty"` // only for headers
-	Data    string              `json:"data,omitempty"`    // for headers (optional) or chunk
+	Data    string              `json:"data,omitempty"`    // for headers (optional) or chunk; chunks also carry streamed request bodies
 	Error   string              `json:"error,omitempty"`   // optional error message
+
+	// Trailers, on an end frame, are sent as HTTP trailers after the body,
+	// e.g. a checksum or a late error status. Fields that can't be
+	// trailers, like Content-Type or Set-Cookie, are dropped.
+	Trailers map[string][]string `json:"trailers,omitempty"`
+
+	// Binary marks the Data of a WebSocket "message" frame as a binary
+	// message, base64-encoded so it survives the JSON codec.
+	Binary bool `json:"binary,omitempty"`
+
+	// publish frames carry an event for the Worker's Publisher instead of
+	// response data; they may be interleaved with any other frames.
+	Channel string          `json:"channel,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// ID names the request a "retry" frame gives back, in place of its
+	// response; see ErrRetryElsewhere. Error may say why.
+	ID string `json:"id,omitempty"`
+}
+
+// BuildPayload transforms an incoming HTTP request into the payload sent
+// to a PHP worker. It returns an error if the request body can't be read,
+// including *http.MaxBytesError when the body exceeds a limit installed
+// with http.MaxBytesReader.
+//
+// Multipart uploads are spooled to temp files; callers must call
+// RemoveUploads on the payload once the response has been produced.
+func BuildPayload(r *http.Request) (*RequestPayload, error) {
+	return buildPayload(r, false)
+}
+
+// BuildStreamingPayload is BuildPayload for large bodies: instead of
+// reading the body into memory it is left in r.Body and sent on to the
+// worker in chunk frames as the worker reads the request, so neither side
+// holds all of it at once. Multipart bodies are still spooled to disk.
+// Errors reading the body, such as *http.MaxBytesError, surface from the
+// dispatch instead.
+func BuildStreamingPayload(r *http.Request) (*RequestPayload, error) {
+	return buildPayload(r, true)
+}
+
+func buildPayload(r *http.Request, streamBody bool) (*RequestPayload, error) {
+	// Generate a request ID for logging + tracing
+	reqID := uuid.New().String()
+
+	// copy headers into map[string][]string with canonicalized names
+	headers := make(map[string][]string, len(r.Header)+3)
+
+	for name, values := range r.Header {
+		canonical := http.CanonicalHeaderKey(name)
+
+		// copy the slice so we don't share backing arrays with r.Header
+		copied := make([]string, len(values))
+		copy(copied, values)
+
+		headers[canonical] = copied
+	}
+
+	// ensure Host is present
+	host := r.Host
+	if host == "" && r.URL != nil {
+		host = r.URL.Host
+	}
+	if host != "" {
+		headers["Host"] = []string{host}
+	}
+
+	// add / extend X-Forwarded-For with the direct client IP
+	if peer := peerIP(r); peer != "" {
+		if existing, ok := headers["X-Forwarded-For"]; ok && len(existing) > 0 {
+			headers["X-Forwarded-For"] = []string{existing[0] + ", " + peer}
+		} else {
+			headers["X-Forwarded-For"] = []string{peer}
+		}
+	}
+
+	// Attach X-Request-Id if the client didn't send one
+	if _, ok := headers["X-Request-Id"]; !ok {
+		headers["X-Request-Id"] = []string{reqID}
+	}
+
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var query map[string][]string
+	if r.URL.RawQuery != "" {
+		query = r.URL.Query()
+	}
+
+	payload := &RequestPayload{
+		ID:       reqID,
+		Method:   r.Method,
+		Path:     path,
+		Query:    query,
+		RawPath:  r.URL.EscapedPath(),
+		RawQuery: r.URL.RawQuery,
+		Headers:  headers,
+		Cookies:  parseCookies(r),
+
+		RemoteAddr: ClientIP(r),
+		Scheme:     requestScheme(r),
+		Host:       host,
+
+		Idempotent: r.Header.Get("Idempotency-Key") != "",
+	}
+
+	if isMultipartForm(r) {
+		form, files, err := spoolMultipart(r, "")
+		_ = r.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading multipart body: %w", err)
+		}
+		payload.Form = form
+		payload.Files = files
+		return payload, nil
+	}
+
+	if streamBody {
+		payload.BodyStream = true
+		payload.body = r.Body
+		payload.bodySize = r.ContentLength
+		return payload, nil
+	}
+
+	bodyBytes, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	payload.Body = string(bodyBytes)
+
+	return payload, nil
+}
+
+// parseCookies collects every cookie sent in the request's Cookie headers.
+// Values are URL-decoded the way PHP fills $_COOKIE, and when a name
+// repeats the first occurrence wins: browsers send the cookie with the
+// most specific path first.
+func parseCookies(r *http.Request) map[string]string {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(cookies))
+	for _, c := range cookies {
+		if _, seen := out[c.Name]; seen {
+			continue
+		}
+		value, err := url.QueryUnescape(c.Value)
+		if err != nil {
+			value = c.Value
+		}
+		out[c.Name] = value
+	}
+	return out
+}
+
+// peerIP returns the IP of the directly connected peer.
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr without a port
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// requestScheme reports whether the client used http or https, honoring
+// X-Forwarded-Proto set by a (trusted) TLS-terminating proxy.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && trustForwardedHeaders(r) {
+		// a chain of proxies may append; the first value is the client's
+		if i := strings.IndexByte(proto, ','); i >= 0 {
+			proto = proto[:i]
+		}
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "https":
+			return "https"
+		case "http":
+			return "http"
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
 }
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuildPayloadCopiesHeadersAndPath(t *testing.T) {
+	body := bytes.NewBufferString("payload")
+	r := httptest.NewRequest(http.MethodPost, "/foo/bar?x=1", body)
+	r.RemoteAddr = net.IPv4(127, 0, 0, 1).String() + ":12345"
+	r.Header.Set("X-Custom", "val")
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.Method != http.MethodPost {
+		t.Fatalf("expected method %s, got %s", http.MethodPost, payload.Method)
+	}
+	if payload.Path != "/foo/bar" {
+		t.Fatalf("expected path without query, got %q", payload.Path)
+	}
+	if got := payload.Query["x"]; len(got) != 1 || got[0] != "1" {
+		t.Fatalf("expected query x=1, got %v", payload.Query)
+	}
+	if payload.Body != "payload" {
+		t.Fatalf("unexpected body: %q", payload.Body)
+	}
+	if payload.Headers["X-Custom"][0] != "val" {
+		t.Fatalf("expected X-Custom header to be copied")
+	}
+	if _, ok := payload.Headers["Host"]; !ok {
+		t.Fatalf("expected Host header to be set")
+	}
+	if xf, ok := payload.Headers["X-Forwarded-For"]; !ok || len(xf) == 0 {
+		t.Fatalf("expected X-Forwarded-For to be populated")
+	}
+	if _, ok := payload.Headers["X-Request-Id"]; !ok {
+		t.Fatalf("expected X-Request-Id to be injected")
+	}
+}
+
+func TestBuildPayloadWithExistingXForwardedFor(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.RemoteAddr = "192.168.1.1:12345"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	xff := payload.Headers["X-Forwarded-For"]
+	if len(xff) == 0 {
+		t.Fatalf("expected X-Forwarded-For to be set")
+	}
+	if !strings.Contains(xff[0], "192.168.1.1") {
+		t.Fatalf("expected X-Forwarded-For to include client IP")
+	}
+}
+
+func TestBuildPayloadWithExistingRequestId(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.Header.Set("X-Request-Id", "existing-id")
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.Headers["X-Request-Id"][0] != "existing-id" {
+		t.Fatalf("expected existing X-Request-Id to be preserved")
+	}
+}
+
+func TestBuildPayloadBodyTooLarge(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("0123456789"))
+	rr := httptest.NewRecorder()
+	r.Body = http.MaxBytesReader(rr, r.Body, 4)
+
+	_, err := BuildPayload(r)
+	if err == nil {
+		t.Fatalf("expected an error for an oversized body")
+	}
+
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		t.Fatalf("expected *http.MaxBytesError, got %T: %v", err, err)
+	}
+}
+
+func TestBuildPayloadParsesCookies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+	r.Header.Add("Cookie", "session=abc123; theme=dark")
+	r.Header.Add("Cookie", "theme=light; name=J%C3%BCrgen+Smith")
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+
+	want := map[string]string{
+		"session": "abc123",
+		"theme":   "dark", // first occurrence wins
+		"name":    "Jürgen Smith",
+	}
+	if len(payload.Cookies) != len(want) {
+		t.Fatalf("expected %d cookies, got %v", len(want), payload.Cookies)
+	}
+	for k, v := range want {
+		if payload.Cookies[k] != v {
+			t.Fatalf("cookie %q: expected %q, got %q", k, v, payload.Cookies[k])
+		}
+	}
+}
+
+func TestBuildPayloadWithoutCookies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/test", nil)
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.Cookies != nil {
+		t.Fatalf("expected no cookies, got %v", payload.Cookies)
+	}
+}
+
+func TestBuildPayloadQuery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/search%20results?tag=a&tag=b&q=caf%C3%A9+au+lait&empty=&filter%5Bcolor%5D=red", nil)
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.Path != "/search results" {
+		t.Fatalf("expected decoded path, got %q", payload.Path)
+	}
+
+	want := map[string][]string{
+		"tag":           {"a", "b"},
+		"q":             {"café au lait"},
+		"empty":         {""},
+		"filter[color]": {"red"},
+	}
+	if len(payload.Query) != len(want) {
+		t.Fatalf("expected %d query keys, got %v", len(want), payload.Query)
+	}
+	for k, vs := range want {
+		if strings.Join(payload.Query[k], "|") != strings.Join(vs, "|") {
+			t.Fatalf("query %q: expected %q, got %q", k, vs, payload.Query[k])
+		}
+	}
+}
+
+func TestBuildPayloadKeepsRawURI(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/files/a%2Fb?b=2&a=1&x=%2B", nil)
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	// for REQUEST_URI and QUERY_STRING: order and encoding as sent
+	if payload.RawPath != "/files/a%2Fb" || payload.RawQuery != "b=2&a=1&x=%2B" {
+		t.Fatalf("raw path %q, raw query %q", payload.RawPath, payload.RawQuery)
+	}
+	// for $_GET and routing on the decoded path
+	if payload.Path != "/files/a/b" || payload.Query["x"][0] != "+" || payload.Query["b"][0] != "2" {
+		t.Fatalf("path %q, query %v", payload.Path, payload.Query)
+	}
+}
+
+func TestBuildPayloadWithoutQuery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/plain", nil)
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.Query != nil {
+		t.Fatalf("expected nil query, got %v", payload.Query)
+	}
+}
+
+func TestBuildPayloadClientDetails(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com:8080/x", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	if payload.RemoteAddr != "203.0.113.7" {
+		t.Fatalf("expected remote addr without port, got %q", payload.RemoteAddr)
+	}
+	if payload.Scheme != "http" {
+		t.Fatalf("expected http, got %q", payload.Scheme)
+	}
+	if payload.Host != "example.com:8080" {
+		t.Fatalf("expected host example.com:8080, got %q", payload.Host)
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	tests := []struct {
+		name  string
+		tls   bool
+		proto string
+		want  string
+	}{
+		{"plain", false, "", "http"},
+		{"tls", true, "", "https"},
+		{"forwarded https", false, "https", "https"},
+		{"forwarded chain", false, "HTTPS, http", "https"},
+		{"forwarded http over tls", true, "http", "http"},
+		{"garbage ignored", true, "gopher", "https"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		if got := requestScheme(r); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestBuildPayloadMarksIdempotencyKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/pay", strings.NewReader("{}"))
+	r.Header.Set("Idempotency-Key", "order-42")
+	p, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload: %v", err)
+	}
+	if !p.Idempotent || !p.Retryable() {
+		t.Fatalf("expected a POST with Idempotency-Key to be retryable")
+	}
+
+	p, _ = BuildPayload(httptest.NewRequest(http.MethodPost, "/pay", strings.NewReader("{}")))
+	if p.Retryable() {
+		t.Fatalf("expected a plain POST not to be retryable")
+	}
+}
+
+func TestBuildStreamingPayloadLeavesBodyUnread(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/search", strings.NewReader(`{"q":"go"}`))
+
+	p, err := BuildStreamingPayload(r)
+	if err != nil {
+		t.Fatalf("BuildStreamingPayload: %v", err)
+	}
+	if !p.BodyStream || p.Body != "" || p.BodySize() != 10 {
+		t.Fatalf("unexpected payload: stream=%v body=%q size=%d", p.BodyStream, p.Body, p.BodySize())
+	}
+	if p.Retryable() {
+		t.Fatal("a streamed body can't be replayed")
+	}
+	rest, _ := io.ReadAll(p.body)
+	if string(rest) != `{"q":"go"}` {
+		t.Fatalf("body should be left for the worker, got %q", rest)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("x"))
+	r.ContentLength = -1
+	if p, _ := BuildStreamingPayload(r); p.BodySize() <= 1<<40 {
+		t.Fatalf("a body of unknown length should count as large, got %d", p.BodySize())
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultPingTimeout is how long a pinged worker has to answer when
+// SetPing is given no timeout.
+const DefaultPingTimeout = time.Second
+
+// SetPing has the reaper (see StartReaper) ping workers that have sat
+// idle for interval, and again every interval while they stay idle: a
+// "ping" frame goes down the pipe and the worker must answer with a
+// "pong" frame within timeout (0 means DefaultPingTimeout). A worker that
+// doesn't is killed and restarted, which catches a PHP process stuck in a
+// loop or on a lock that still holds its pipe open, before a request
+// finds it; /healthz sees it as dead meanwhile. Busy workers are never
+// pinged, and a request arriving mid-ping waits for the pong. An interval
+// of zero disables it.
+func (p *WorkerPool) SetPing(interval, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	p.mu.Lock()
+	p.pingInterval = max(interval, 0)
+	p.pingTimeout = timeout
+	p.mu.Unlock()
+}
+
+// pingIdle pings, in the background, every worker idle for the ping
+// interval that wasn't pinged within it.
+func (p *WorkerPool) pingIdle(now time.Time) {
+	p.mu.Lock()
+	interval, timeout := p.pingInterval, p.pingTimeout
+	p.mu.Unlock()
+	if interval <= 0 {
+		return
+	}
+
+	for _, w := range p.snapshot() {
+		if w == nil || w.idleFor(now) < interval || !w.pingDue(now, interval) {
+			continue
+		}
+		go func() {
+			if err := w.ping(timeout); err != nil {
+				w.log().Warn("worker failed a ping, restarting it", "err", err)
+			}
+		}()
+	}
+}
+
+// pingDue claims the next ping of w if one is due at now.
+func (w *Worker) pingDue(now time.Time, interval time.Duration) bool {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if w.pinging || now.Sub(w.lastPing) < interval {
+		return false
+	}
+	w.pinging = true
+	w.lastPing = now
+	return true
+}
+
+// ping sends a ping frame and waits up to timeout for the pong. It only
+// runs with the pipe to itself: a worker that is busy, or becomes busy
+// before ping gets the pipe, is left alone, as is one whose protocol
+// version predates pings. A worker that doesn't answer
+// in time, or answers anything but a pong, is killed and marked dead, so
+// the reaper restarts it.
+func (w *Worker) ping(timeout time.Duration) error {
+	defer func() {
+		w.stateMu.Lock()
+		w.pinging = false
+		w.stateMu.Unlock()
+	}()
+
+	if !w.mu.TryLock() {
+		return nil
+	}
+	defer w.mu.Unlock()
+	if w.getState() != WorkerIdle || w.getInFlight() > 0 || w.isPinned() {
+		return nil
+	}
+	if !w.speaks(protoPing) {
+		// an older worker would take the ping for a request
+		return nil
+	}
+
+	codec := w.frameCodec()
+	if err := writeFrame(w.stdin, codec, StreamFrame{Type: "ping"}); err != nil {
+		w.died("ping", err)
+		w.markDead()
+		w.killProcess()
+		return w.withStderr(err)
+	}
+
+	w.setReading(w.stdout)
+	defer w.setReading(nil)
+	stop := w.expireAfter(timeout)
+	err := w.readPong(codec)
+	if stop() {
+		err = fmt.Errorf("%w: no pong after %s", ErrWorkerTimeout, timeout)
+		w.died("ping", err)
+		return w.withStderr(err)
+	}
+	if err != nil {
+		w.died("ping", err)
+		w.markDead()
+		w.killProcess()
+		return w.withStderr(err)
+	}
+	return nil
+}
+
+// readPong reads the worker's answer to a ping.
+func (w *Worker) readPong(codec Codec) error {
+	body, buf, err := w.readFrame(w.stdout)
+	if err != nil {
+		return err
+	}
+	defer w.frames.put(buf)
+	var frame StreamFrame
+	if err := codec.Unmarshal(body, &frame); err != nil {
+		return w.badFrame(body, err)
+	}
+	if frame.Type != "pong" {
+		return w.badFrame(body, fmt.Errorf("expected a pong frame, got %q", frame.Type))
+	}
+	return nil
+}
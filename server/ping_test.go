@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pongWorker returns an idle worker whose fake PHP side answers each ping
+// with a pong, and how many it answered.
+func pongWorker(t *testing.T) (*Worker, *atomic.Int32) {
+	t.Helper()
+	var pongs atomic.Int32
+	w := newStallWorker(t, -1, func(stdout io.Writer) {
+		pongs.Add(1)
+		pong := []byte(`{"type":"pong"}`)
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(pong)))
+		stdout.Write(hdr[:])
+		stdout.Write(pong)
+	})
+	w.lastActive = time.Now().Add(-time.Minute)
+	return w, &pongs
+}
+
+func TestPingAnsweredKeepsWorker(t *testing.T) {
+	w, pongs := pongWorker(t)
+	if err := w.ping(time.Second); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if pongs.Load() != 1 || w.isDead() {
+		t.Fatalf("pongs = %d, dead = %v", pongs.Load(), w.isDead())
+	}
+}
+
+func TestPingUnansweredKillsWorker(t *testing.T) {
+	// stuck: reads the ping and never answers
+	w := newStallWorker(t, -1, func(io.Writer) {})
+	err := w.ping(20 * time.Millisecond)
+	if !errors.Is(err, ErrWorkerTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if !w.isDead() {
+		t.Fatal("a worker that doesn't answer a ping must be marked dead")
+	}
+}
+
+func TestPingSkipsBusyWorker(t *testing.T) {
+	w, pongs := pongWorker(t)
+
+	w.inFlight = 1
+	w.state = WorkerBusy
+	if err := w.ping(time.Second); err != nil || pongs.Load() != 0 {
+		t.Fatalf("a busy worker was pinged: %v", err)
+	}
+	w.inFlight = 0
+	w.state = WorkerIdle
+
+	// a request holding the pipe
+	w.mu.Lock()
+	err := w.ping(time.Second)
+	w.mu.Unlock()
+	if err != nil || pongs.Load() != 0 {
+		t.Fatalf("a worker whose pipe is in use was pinged: %v", err)
+	}
+}
+
+func TestReaperPingsIdleWorkers(t *testing.T) {
+	w, pongs := pongWorker(t)
+	pool := &WorkerPool{workers: []*Worker{w}}
+	pool.SetPing(time.Hour, 0)
+
+	now := time.Now()
+	pool.pingIdle(now)
+	if pool.pingTimeout != DefaultPingTimeout {
+		t.Fatalf("ping timeout = %s, want the default", pool.pingTimeout)
+	}
+	if pongs.Load() != 0 {
+		t.Fatal("a worker idle for less than the interval was pinged")
+	}
+
+	pool.SetPing(10*time.Millisecond, time.Second)
+	pool.pingIdle(now)
+	pool.pingIdle(now) // not due again yet
+	deadline := time.Now().Add(time.Second)
+	for pongs.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := pongs.Load(); n != 1 {
+		t.Fatalf("expected one ping, got %d", n)
+	}
+}
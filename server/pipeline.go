@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// SetMaxConcurrent lets up to n unary requests share the worker's pipe at
+// once. Requests are written as they come, and a single reader matches the
+// responses to them by RequestPayload.ID, so the worker must echo each
+// request's id (php/worker.php does). A worker that handles one request
+// at a time still gains from this, as the next request is already waiting
+// on its stdin; one that multiplexes may answer out of order.
+//
+// Streamed responses and streamed request bodies have no request ID on
+// their frames, so they still get the pipe to themselves: they wait for
+// the pipelined requests in flight and hold off new ones.
+//
+// n <= 1, the default, sends one request at a time.
+func (w *Worker) SetMaxConcurrent(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stateMu.Lock()
+	w.maxConcurrent = n
+	w.stateMu.Unlock()
+	if n > 1 {
+		w.slots = make(chan struct{}, n)
+	} else {
+		w.slots = nil
+	}
+}
+
+// capacity returns how many requests the worker takes before another has
+// to queue.
+func (w *Worker) capacity() int {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return max(w.maxConcurrent, 1)
+}
+
+// handlePipelined sends payload on the shared pipe and waits for the
+// response carrying its ID. w.mu must be held for reading.
+func (w *Worker) handlePipelined(payload *RequestPayload) (*ResponsePayload, error) {
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+
+	pl := w.pipeline()
+	ch, err := pl.register(payload.ID)
+	if err != nil {
+		return nil, err
+	}
+	payload.timing.sending()
+	if err := pl.send(payload); err != nil {
+		pl.unregister(payload.ID)
+		return nil, err
+	}
+
+	var res pipeResult
+	if timeout := w.timeoutFor(payload); timeout > 0 {
+		select {
+		case res = <-ch:
+		case <-time.After(timeout):
+			// the other requests on the pipe go down with the process
+			pl.unregister(payload.ID)
+			w.markDead()
+			w.killProcess()
+			_ = pl.stdout.Close()
+			return nil, fmt.Errorf("%w: no response after %s", ErrWorkerTimeout, timeout)
+		}
+	} else {
+		res = <-ch
+	}
+	if res.err == nil {
+		payload.timing.answered()
+	}
+	return res.resp, res.err
+}
+
+// pipeline returns the demultiplexer for the current process, creating it
+// on first use. w.mu must be held.
+func (w *Worker) pipeline() *pipeline {
+	w.pipeMu.Lock()
+	defer w.pipeMu.Unlock()
+	if w.pipe == nil {
+		w.pipe = &pipeline{
+			w:       w,
+			stdin:   w.stdin,
+			stdout:  w.stdout,
+			codec:   w.frameCodec(),
+			pub:     w.publisher,
+			pending: make(map[string]chan pipeResult),
+		}
+	}
+	return w.pipe
+}
+
+// resetPipeline drops the demultiplexer, for a new process or publisher.
+// w.mu must be held exclusively.
+func (w *Worker) resetPipeline() {
+	w.pipeMu.Lock()
+	w.pipe = nil
+	w.pipeMu.Unlock()
+}
+
+// pipeline matches responses on one process's stdout to the pipelined
+// requests waiting for them. A reader goroutine runs only while requests
+// are pending, so the pipe is free for exclusive use once they are done.
+type pipeline struct {
+	w      *Worker
+	stdin  io.Writer
+	stdout io.ReadCloser
+	codec  Codec
+	pub    Publisher
+
+	writeMu sync.Mutex // one frame at a time on stdin
+
+	mu      sync.Mutex
+	pending map[string]chan pipeResult
+	reading bool  // the reader goroutine is running
+	err     error // the pipe failed; no more requests
+}
+
+type pipeResult struct {
+	resp *ResponsePayload
+	err  error
+}
+
+// register adds a pending request, starting the reader if needed.
+func (pl *pipeline) register(id string) (chan pipeResult, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.err != nil {
+		return nil, pl.err
+	}
+	if _, dup := pl.pending[id]; dup {
+		return nil, fmt.Errorf("request %q is already in flight on this worker", id)
+	}
+	ch := make(chan pipeResult, 1)
+	pl.pending[id] = ch
+	if !pl.reading {
+		pl.reading = true
+		go pl.read()
+	}
+	return ch, nil
+}
+
+func (pl *pipeline) unregister(id string) {
+	pl.mu.Lock()
+	delete(pl.pending, id)
+	pl.mu.Unlock()
+}
+
+func (pl *pipeline) send(req *RequestPayload) error {
+	pl.writeMu.Lock()
+	defer pl.writeMu.Unlock()
+	return writeFrame(pl.stdin, pl.codec, req)
+}
+
+// read delivers responses until none are pending or the pipe fails.
+func (pl *pipeline) read() {
+	defer func() {
+		if p := recover(); p != nil {
+			pl.fail(recoveredError(pl.w.log(), "pipeline reader", p))
+		}
+	}()
+	for {
+		body, buf, err := pl.w.readFrame(pl.stdout)
+		if err != nil {
+			pl.fail(err)
+			return
+		}
+
+		var kind struct {
+			Type string `json:"type"`
+		}
+		var res pipeResult
+		var id string
+		if err := pl.codec.Unmarshal(body, &kind); err == nil && (kind.Type == "publish" || kind.Type == "retry") {
+			var frame StreamFrame
+			if err := pl.codec.Unmarshal(body, &frame); err != nil {
+				err = pl.w.badFrame(body, err)
+				pl.w.frames.put(buf)
+				pl.fail(err)
+				return
+			}
+			if frame.Type == "publish" {
+				pl.w.frames.put(buf)
+				pl.w.publishFrame(pl.pub, frame)
+				continue
+			}
+			// a retry frame answers its request in place of a response
+			id, res = frame.ID, pipeResult{nil, retryFrameError(frame)}
+		} else {
+			var resp ResponsePayload
+			if err := pl.codec.Unmarshal(body, &resp); err != nil {
+				err = pl.w.badFrame(body, err)
+				pl.w.frames.put(buf)
+				pl.fail(err)
+				return
+			}
+			id, res = resp.ID, pipeResult{&resp, nil}
+			if err := checkStatus(&resp.Status); err != nil {
+				res = pipeResult{nil, pl.w.badFrame(body, err)}
+			}
+		}
+
+		pl.mu.Lock()
+		ch, ok := pl.pending[id]
+		delete(pl.pending, id)
+		pl.mu.Unlock()
+		if !ok {
+			err := pl.w.badFrame(body, fmt.Errorf("response for unknown request %q", id))
+			pl.w.frames.put(buf)
+			pl.fail(err)
+			return
+		}
+		pl.w.frames.put(buf)
+		ch <- res
+
+		pl.mu.Lock()
+		if len(pl.pending) == 0 {
+			pl.reading = false
+			pl.mu.Unlock()
+			return
+		}
+		pl.mu.Unlock()
+	}
+}
+
+// fail marks the worker dead and hands err to every pending request.
+func (pl *pipeline) fail(err error) {
+	pl.w.markDead()
+
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.err = err
+	pl.reading = false
+	for id, ch := range pl.pending {
+		ch <- pipeResult{nil, err}
+		delete(pl.pending, id)
+	}
+}
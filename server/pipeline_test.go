@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBatchWorker returns a worker whose fake PHP side reads batch requests
+// before answering any, then answers them in reverse order, as a
+// multiplexing worker might. respond can change each response.
+func newBatchWorker(t *testing.T, batch int, respond func(*RequestPayload, *ResponsePayload)) *Worker {
+	t.Helper()
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() {
+		stdinR.Close()
+		stdoutW.Close()
+	})
+
+	go func() {
+		for {
+			reqs := make([]*RequestPayload, 0, batch)
+			for range batch {
+				frame, err := readFrame(stdinR)
+				if err != nil {
+					return
+				}
+				var req RequestPayload
+				if err := (JSONCodec{}).Unmarshal(frame, &req); err != nil {
+					return
+				}
+				reqs = append(reqs, &req)
+			}
+			for i := len(reqs) - 1; i >= 0; i-- {
+				resp := &ResponsePayload{ID: reqs[i].ID, Status: 200, Body: "re:" + reqs[i].Path}
+				if respond != nil {
+					respond(reqs[i], resp)
+				}
+				if err := writeFrame(stdoutW, JSONCodec{}, resp); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return &Worker{
+		stdin:          stdinW,
+		stdout:         stdoutR,
+		maxRequests:    1000,
+		requestTimeout: time.Second,
+	}
+}
+
+func TestPipelinedRequestsMatchedByID(t *testing.T) {
+	const n = 4
+	w := newBatchWorker(t, n, nil)
+	w.SetMaxConcurrent(n)
+
+	// the fake worker only answers once all n requests are on the pipe,
+	// so this deadlocks unless they are sent without waiting
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := "/item/" + strconv.Itoa(i)
+			resp, err := w.Handle(&RequestPayload{ID: strconv.Itoa(i), Method: "GET", Path: path})
+			if err != nil {
+				t.Errorf("Handle(%s): %v", path, err)
+				return
+			}
+			if resp.Body != "re:"+path {
+				t.Errorf("Handle(%s) got the response for another request: %q", path, resp.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if w.isDead() || w.getInFlight() != 0 {
+		t.Fatalf("worker should be idle and alive: dead=%v in flight=%d", w.isDead(), w.getInFlight())
+	}
+}
+
+func TestPipelinedUnknownIDFailsTheWorker(t *testing.T) {
+	w := newBatchWorker(t, 2, func(_ *RequestPayload, resp *ResponsePayload) {
+		resp.ID = "bogus"
+	})
+	w.SetMaxConcurrent(2)
+
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// POST: not retried on the restarted worker
+			_, err := w.Handle(&RequestPayload{ID: strconv.Itoa(i), Method: "POST", Path: "/"})
+			if !errors.Is(err, ErrBadFrame) {
+				t.Errorf("expected ErrBadFrame, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !w.isDead() {
+		t.Fatal("a worker that answers unknown requests can't be trusted")
+	}
+}
+
+func TestPipelinedTimeoutFailsPendingRequests(t *testing.T) {
+	w := newBatchWorker(t, 3, nil) // only two are sent: never answers
+	w.requestTimeout = 20 * time.Millisecond
+	w.SetMaxConcurrent(3)
+
+	errs := make(chan error, 2)
+	for i := range 2 {
+		go func() {
+			_, err := w.Handle(&RequestPayload{ID: strconv.Itoa(i), Method: "POST", Path: "/"})
+			errs <- err
+		}()
+	}
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatal("expected an error from the hung worker")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("pending request not released after the timeout")
+		}
+	}
+	if !w.isDead() {
+		t.Fatal("timed-out worker should be dead")
+	}
+}
+
+func TestMaxConcurrentCapacity(t *testing.T) {
+	w := &Worker{}
+	p := &WorkerPool{workers: []*Worker{w}}
+	p.SetMaxConcurrent(2)
+
+	w.incrInFlight()
+	if !p.hasIdleWorker() {
+		t.Fatal("a pipelined worker with a free slot can take a request")
+	}
+	w.incrInFlight()
+	if p.hasIdleWorker() {
+		t.Fatal("a pipelined worker with every slot taken is busy")
+	}
+	w.incrInFlight()
+	if st := p.Stats(); st.InFlight != 3 || st.Queued != 1 {
+		t.Fatalf("Stats: in flight %d, queued %d", st.InFlight, st.Queued)
+	}
+}
@@ -1,44 +1,181 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var ErrNoWorkers = errors.New("no workers available")
 
+// DefaultReaperInterval is how often a pool reaper looks for workers to
+// retire or restart.
+const DefaultReaperInterval = time.Second
+
 type WorkerPool struct {
-	workers []*Worker
-	mu      sync.Mutex
-	next    int
+	workers       []*Worker
+	mu            sync.Mutex
+	next          int
+	publisher     Publisher
+	maxLifetime   time.Duration
+	maxRSS        int64
+	maxConcurrent int           // see SetMaxConcurrent
+	drainTimeout  time.Duration // see SetDrainTimeout; guarded by mu
+
+	strategy     Strategy // see SetStrategy; "" is RoundRobin
+	stickyCookie string
+	longRequest  time.Duration // see SetLongRequestThreshold; 0 is the default; guarded by mu
+
+	logger  *slog.Logger  // see SetLogger; nil means slog.Default()
+	slowLog time.Duration // see SetSlowRequestLog; 0 is off; guarded by mu
+
+	events *eventQueue // see SetObserver; nil without an observer; guarded by mu
+	name   string      // the pool's name in a Server, for events; guarded by mu
+
+	reloadMu sync.Mutex // serializes Reload
+
+	// idle shrinking, see SetIdleTTL; guarded by mu
+	idleTTL    time.Duration
+	minWorkers int
+	maxWorkers int                     // size to grow back to
+	spawn      func() (*Worker, error) // starts a worker like the original ones; nil can't grow
+	retiring   []*Worker               // removed workers waiting for their last request
+	growing    atomic.Bool
+
+	// liveness pings, see SetPing; guarded by mu
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	reaperStop chan struct{} // non-nil while the reaper runs; guarded by mu
+	reaperKick chan struct{} // wakes the reaper early when a worker crashes
+
+	metricsOnce sync.Once
+	metrics     *poolMetrics
+}
+
+// requestMetrics returns the pool's request counters, creating them on
+// first use so zero-value pools work.
+func (p *WorkerPool) requestMetrics() *poolMetrics {
+	p.metricsOnce.Do(func() { p.metrics = newPoolMetrics() })
+	return p.metrics
 }
 
 // NewPool creates a pool with count workers, each configured
 // with maxRequests and requestTimeout.
 func NewPool(count int, maxRequests int, requestTimeout time.Duration) (*WorkerPool, error) {
-	workers := make([]*Worker, 0, count)
+	return NewPoolWithConfig(count, WorkerConfig{MaxRequests: maxRequests, RequestTimeout: requestTimeout})
+}
 
-	for i := 0; i < count; i++ {
-		w, err := NewWorker(maxRequests, requestTimeout)
-		if err != nil {
+// NewPoolWithConfig creates a pool of count workers configured by cfg.
+// Workers start concurrently; if any fails, the ones that did start are
+// stopped and the first error is returned. A php binary that can't be
+// run fails with ErrPHPNotFound, and an unknown codec fails, before any
+// worker is started.
+func NewPoolWithConfig(count int, cfg WorkerConfig) (*WorkerPool, error) {
+	if cfg.Start == nil && cfg.Address == "" && count > 0 {
+		// one clear error rather than one per worker
+		if _, err := lookPHP(cfg.PHPBinary); err != nil {
 			return nil, err
 		}
-		workers = append(workers, w)
+		if _, err := requestedCodec(cfg.Codec); err != nil {
+			return nil, err
+		}
+	}
+
+	workers := make([]*Worker, max(count, 0))
+	errs := make([]error, len(workers))
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers[i], errs[i] = NewWorkerWithConfig(cfg)
+		}()
 	}
+	wg.Wait()
 
-	return &WorkerPool{
-		workers: workers,
-	}, nil
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		for _, w := range workers {
+			if w != nil {
+				w.stop()
+			}
+		}
+		return nil, err
+	}
+
+	p := &WorkerPool{
+		workers:    workers,
+		reaperKick: make(chan struct{}, 1),
+		maxWorkers: len(workers),
+		spawn:      func() (*Worker, error) { return NewWorkerWithConfig(cfg) },
+	}
+	for _, w := range workers {
+		w.SetOnExit(p.workerExited)
+	}
+	return p, nil
+}
+
+// workerExited wakes the reaper so a crashed worker is restarted now
+// rather than on the next tick.
+func (p *WorkerPool) workerExited(*Worker) {
+	select {
+	case p.reaperKick <- struct{}{}:
+	default:
+	}
 }
 
 func (p *WorkerPool) Dispatch(req *RequestPayload) (*ResponsePayload, error) {
-	w := p.NextWorker()
+	p.growIfSaturated()
+	w := p.pickWorker(req)
 	if w == nil {
 		return nil, ErrNoWorkers
 	}
+	req.traceAttr("php.worker", p.indexOf(w))
+
+	var resp *ResponsePayload
+	handle := func() (err error) {
+		resp, err = w.Handle(req)
+		return err
+	}
+	err := p.serve(w, req, handle)
+	if errors.Is(err, ErrRetryElsewhere) && req.Retryable() {
+		w = p.retryWorker(req, w)
+		req.traceAttr("php.retried_elsewhere", true)
+		req.traceAttr("php.worker", p.indexOf(w))
+		err = p.serve(w, req, handle)
+	}
+	return resp, err
+}
+
+// DispatchStream sends req to the next available worker using the
+// streaming protocol, writing frames to rw as they arrive.
+func (p *WorkerPool) DispatchStream(req *RequestPayload, rw http.ResponseWriter) error {
+	p.growIfSaturated()
+	w := p.pickWorker(req)
+	if w == nil {
+		return ErrNoWorkers
+	}
+	req.traceAttr("php.worker", p.indexOf(w))
 
-	return w.Handle(req)
+	handle := func() error { return w.Stream(req, rw) }
+	err := p.serve(w, req, handle)
+	if errors.Is(err, ErrRetryElsewhere) && req.Retryable() {
+		// nothing reached rw: PHP gives a request back before its headers
+		w = p.retryWorker(req, w)
+		req.traceAttr("php.retried_elsewhere", true)
+		req.traceAttr("php.worker", p.indexOf(w))
+		err = p.serve(w, req, handle)
+	}
+	return err
 }
 func (p *WorkerPool) Stats() PoolStats {
 	stats := PoolStats{}
@@ -46,16 +183,268 @@ func (p *WorkerPool) Stats() PoolStats {
 		return stats
 	}
 
-	stats.Workers = len(p.workers)
-	for _, w := range p.workers {
-		if w != nil && w.isDead() {
+	workers := p.snapshot()
+	stats.Workers = len(workers)
+	for _, w := range workers {
+		if w == nil {
+			continue
+		}
+		switch w.getState() {
+		case WorkerDead:
 			stats.DeadWorkers++
+		case WorkerBusy:
+			stats.Busy++
+		case WorkerDraining:
+			stats.Draining++
+		case WorkerWarming:
+			stats.Warming++
+		default:
+			stats.Idle++
 		}
+		if n := w.getInFlight(); n > 0 {
+			stats.InFlight += n
+			stats.Queued += max(n-w.capacity(), 0)
+		}
+		stats.WorkerRSS = append(stats.WorkerRSS, w.RSS())
 	}
 
+	// workers removed by a shrink are no longer in the pool but still
+	// have requests to finish
+	p.mu.Lock()
+	retiring := append([]*Worker(nil), p.retiring...)
+	p.mu.Unlock()
+	for _, w := range retiring {
+		if w.isDead() {
+			continue
+		}
+		stats.Draining++
+		if n := w.getInFlight(); n > 0 {
+			stats.InFlight += n
+			stats.Queued += max(n-w.capacity(), 0)
+		}
+	}
+
+	m := p.requestMetrics()
+	m.mu.Lock()
+	stats.Requests, stats.Errors = m.requests, m.errors
+	m.mu.Unlock()
+	stats.Duration = m.duration.snapshot()
+
 	return stats
 }
 
+// WorkerStats returns a snapshot of each worker in the pool, in pool order.
+func (p *WorkerPool) WorkerStats() []WorkerStat {
+	if p == nil {
+		return nil
+	}
+	workers := p.snapshot()
+
+	p.mu.Lock()
+	long := p.longRequestLocked()
+	p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]WorkerStat, 0, len(workers))
+	for i, w := range workers {
+		if w == nil {
+			continue
+		}
+		st := w.stat(now)
+		st.Index = i
+		st.Long = long > 0 && st.BusySeconds >= long.Seconds()
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// SetPublisher routes publish frames from every worker in the pool,
+// including ones added later by ScaleTo, to pub.
+func (p *WorkerPool) SetPublisher(pub Publisher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.publisher = pub
+	for _, w := range p.workers {
+		if w != nil {
+			w.SetPublisher(pub)
+		}
+	}
+}
+
+// SetLogger makes every worker in the pool, including ones added later by
+// ScaleTo, log to l with a "worker" attribute holding its index.
+func (p *WorkerPool) SetLogger(l *slog.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.logger = l
+	for i, w := range p.workers {
+		if w != nil {
+			w.SetLogger(p.workerLogger(i))
+		}
+	}
+}
+
+// workerLogger returns the logger for the worker at index i, or nil for
+// the default; p.mu must be held.
+func (p *WorkerPool) workerLogger(i int) *slog.Logger {
+	if p.logger == nil {
+		return nil
+	}
+	return p.logger.With("worker", i)
+}
+
+// SetMaxLifetime applies Worker.SetMaxLifetime to every worker in the
+// pool, including ones added later by ScaleTo.
+func (p *WorkerPool) SetMaxLifetime(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxLifetime = d
+	for _, w := range p.workers {
+		if w != nil {
+			w.SetMaxLifetime(d)
+		}
+	}
+}
+
+// SetMaxRSS applies Worker.SetMaxRSS to every worker in the pool,
+// including ones added later by ScaleTo.
+func (p *WorkerPool) SetMaxRSS(limit int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxRSS = limit
+	for _, w := range p.workers {
+		if w != nil {
+			w.SetMaxRSS(limit)
+		}
+	}
+}
+
+// SetMaxConcurrent applies Worker.SetMaxConcurrent to every worker in the
+// pool, including ones added later by ScaleTo.
+func (p *WorkerPool) SetMaxConcurrent(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxConcurrent = n
+	for _, w := range p.workers {
+		if w != nil {
+			w.SetMaxConcurrent(n)
+		}
+	}
+}
+
+// StartReaper checks the pool every interval: worker memory is sampled,
+// workers over their RSS limit are drained, idle workers past their max
+// lifetime are retired, and dead workers (recycled after maxRequests,
+// lifetime or memory, by hot reload, or because the process crashed) are
+// restarted. With SetIdleTTL, workers idle for too long are removed. A
+// crash also triggers a pass straight away. It is a no-op if the reaper
+// is already running.
+func (p *WorkerPool) StartReaper(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reaperStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	p.reaperStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.reap(time.Now())
+			case <-p.reaperKick:
+				p.reap(time.Now())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopReaper stops a reaper started with StartReaper.
+func (p *WorkerPool) StopReaper() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reaperStop != nil {
+		close(p.reaperStop)
+		p.reaperStop = nil
+	}
+}
+
+// reap runs one reaper pass.
+func (p *WorkerPool) reap(now time.Time) {
+	workers := p.snapshot()
+
+	for _, w := range workers {
+		if w == nil || w.isDraining() {
+			continue
+		}
+		if !w.isDead() && w.sampleRSS() {
+			// let in-flight work finish; the last request out marks it dead
+			w.log().Info("worker over memory limit, recycling", "rss", w.RSS())
+			w.recycled(RecycleMemory)
+			w.startDraining()
+			if w.getInFlight() > 0 {
+				continue
+			}
+			w.markDead()
+		}
+		if !w.isDead() && w.getState() == WorkerIdle && w.expired(now) {
+			w.log().Info("worker reached max lifetime, recycling")
+			w.recycled(RecycleMaxLifetime)
+			w.markDead()
+		}
+		if w.isDead() {
+			if _, err := w.restartIfDead(); err != nil {
+				w.log().Error("worker restart failed", "err", err)
+			}
+		}
+	}
+
+	p.pingIdle(now)
+	p.shrinkIdle(now)
+}
+
+// stopAll kills every worker in the pool, and those removed from it that
+// are still finishing requests.
+func (p *WorkerPool) stopAll() {
+	p.StopReaper()
+
+	p.mu.Lock()
+	workers := append(append([]*Worker(nil), p.workers...), p.retiring...)
+	p.retiring = nil
+	p.mu.Unlock()
+	for _, w := range workers {
+		if w != nil {
+			w.stop()
+		}
+	}
+}
+
+// snapshot returns a copy of the pool's worker slice, taken under p.mu.
+// ScaleTo, SetIdleTTL and growth replace or truncate p.workers, so code
+// that walks the workers without holding the lock must use a snapshot.
+func (p *WorkerPool) snapshot() []*Worker {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Worker(nil), p.workers...)
+}
+
+// NextWorker returns the next live worker in round-robin order, or nil if
+// there is none. A worker running a long request (see
+// SetLongRequestThreshold) or still warming up (see WarmupConfig) is
+// passed over while any other worker isn't.
 func (p *WorkerPool) NextWorker() *Worker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -65,40 +454,126 @@ func (p *WorkerPool) NextWorker() *Worker {
 		return nil
 	}
 
+	now := time.Now()
+	var long *Worker
+	longIdx := 0
 	for i := 0; i < n; i++ {
-		w := p.workers[p.next]
-		p.next = (p.next + 1) % n
-		if w != nil && !w.isDead() && !w.isDraining() {
-			return w
+		idx := (p.next + i) % n
+		w := p.workers[idx]
+		if w == nil || w.isDead() || w.isDraining() || w.isPinned() {
+			continue
+		}
+		// one still warming up is as good as busy
+		if p.isLongLocked(w, now) || w.isWarming() {
+			if long == nil {
+				long, longIdx = w, idx
+			}
+			continue
+		}
+		p.next = (idx + 1) % n
+		return w
+	}
+	if long != nil {
+		p.next = (longIdx + 1) % n
+	}
+	return long
+}
+
+// indexOf returns w's position in the pool, or -1.
+func (p *WorkerPool) indexOf(w *Worker) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pw := range p.workers {
+		if pw == w {
+			return i
 		}
 	}
-	return nil
+	return -1
 }
 
+// DrainAll stops the pool taking requests: workers finish what is in
+// flight and are not restarted. With SetDrainTimeout, workers still
+// draining after the timeout are killed.
 func (p *WorkerPool) DrainAll() {
+	// drained workers must stay down
+	p.StopReaper()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	var drained []*Worker
 	for _, w := range p.workers {
 		if w != nil && !w.isDead() {
 			w.startDraining()
+			drained = append(drained, w)
+		}
+	}
+	if d := p.drainTimeout; d > 0 && len(drained) > 0 {
+		time.AfterFunc(d, func() {
+			for _, w := range drained {
+				if w.isDraining() {
+					w.log().Warn("worker still draining after the drain timeout, killing it", "in_flight", w.getInFlight(), "drain_timeout", d)
+					w.forceStop()
+				}
+			}
+		})
+	}
+}
+
+// shutdown waits for the in-flight requests of a drained pool to finish,
+// killing the workers still busy when ctx ends, and then stops them all.
+func (p *WorkerPool) shutdown(ctx context.Context) {
+	p.StopReaper()
+
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for p.busyWorkers() != nil {
+		select {
+		case <-ctx.Done():
+			for _, w := range p.busyWorkers() {
+				w.log().Warn("worker still busy at shutdown, killing it", "in_flight", w.getInFlight())
+				w.forceStop()
+			}
+			p.stopAll()
+			return
+		case <-tick.C:
+		}
+	}
+	p.stopAll()
+}
+
+// busyWorkers returns the workers, retiring ones included, with requests
+// in flight.
+func (p *WorkerPool) busyWorkers() []*Worker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var busy []*Worker
+	for _, w := range slices.Concat(p.workers, p.retiring) {
+		if w != nil && w.getInFlight() > 0 {
+			busy = append(busy, w)
 		}
 	}
+	return busy
 }
 
-// ScaleTo lets you grow/shrink the pool
+// ScaleTo lets you grow/shrink the pool. Workers cut off by a shrink
+// finish their in-flight requests and are then stopped by the reaper, or
+// killed once the drain timeout (see SetDrainTimeout) passes.
 func (p *WorkerPool) ScaleTo(newSize int, factory func() (*Worker, error)) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	cur := len(p.workers)
+	p.maxWorkers = newSize
 	switch {
 	case newSize == cur:
 		return nil
 	case newSize < cur:
 		// mark extras as draining so they shut down after in-flight work
 		for i := newSize; i < cur; i++ {
-			if p.workers[i] != nil {
-				p.workers[i].startDraining()
+			if w := p.workers[i]; w != nil {
+				w.recycled(RecycleScaleDown)
+				w.startDraining()
+				p.retire(w)
 			}
 		}
 		p.workers = p.workers[:newSize]
@@ -107,13 +582,70 @@ func (p *WorkerPool) ScaleTo(newSize int, factory func() (*Worker, error)) error
 		}
 		return nil
 	default: // grow
-		for i := cur; i < newSize; i++ {
+		for range newSize - cur {
 			w, err := factory()
 			if err != nil {
 				return err
 			}
-			p.workers = append(p.workers, w)
+			p.addWorker(w)
 		}
 		return nil
 	}
 }
+
+// SetDrainTimeout bounds how long a draining worker may take to finish
+// its in-flight requests after DrainAll, a ScaleTo shrink or idle
+// shrinking (see SetIdleTTL): once d passes it is killed, whatever it is
+// still doing. Zero waits as long as the requests take.
+func (p *WorkerPool) SetDrainTimeout(d time.Duration) {
+	p.mu.Lock()
+	p.drainTimeout = max(d, 0)
+	p.mu.Unlock()
+}
+
+// retire hands w, draining and already removed from p.workers, to the
+// reaper to stop once its last request is done, and arms the drain
+// timeout; p.mu must be held.
+func (p *WorkerPool) retire(w *Worker) {
+	p.retiring = append(p.retiring, w)
+	if d := p.drainTimeout; d > 0 {
+		time.AfterFunc(d, func() { p.killRetiring(w, d) })
+	}
+}
+
+// killRetiring stops w if the reaper hasn't yet.
+func (p *WorkerPool) killRetiring(w *Worker, d time.Duration) {
+	p.mu.Lock()
+	i := slices.Index(p.retiring, w)
+	if i >= 0 {
+		p.retiring = slices.Delete(p.retiring, i, i+1)
+	}
+	p.mu.Unlock()
+	if i < 0 {
+		return
+	}
+	w.log().Warn("worker still draining after the drain timeout, killing it", "in_flight", w.getInFlight(), "drain_timeout", d)
+	w.forceStop()
+}
+
+// addWorker applies the pool's settings to w and appends it; p.mu must be
+// held.
+func (p *WorkerPool) addWorker(w *Worker) {
+	if p.publisher != nil {
+		w.SetPublisher(p.publisher)
+	}
+	if p.maxLifetime > 0 {
+		w.SetMaxLifetime(p.maxLifetime)
+	}
+	if p.maxRSS > 0 {
+		w.SetMaxRSS(p.maxRSS)
+	}
+	if p.maxConcurrent > 1 {
+		w.SetMaxConcurrent(p.maxConcurrent)
+	}
+	w.SetOnExit(p.workerExited)
+	w.SetLogger(p.workerLogger(len(p.workers)))
+	w.events.Store(p.workerEvents(len(p.workers)))
+	p.workers = append(p.workers, w)
+	w.emitStarted()
+}
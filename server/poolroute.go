@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// PoolRoute sends the requests it matches to a named pool. See
+// ServerConfig.PoolRoutes.
+type PoolRoute struct {
+	// Pool is "fast", "slow" or a key of ServerConfig.Pools.
+	Pool string `json:"pool"`
+
+	// Prefix and Pattern (path.Match syntax, "/exports/*/csv") match the
+	// path; a route with both matches either. A route with neither
+	// matches every path.
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// Methods, if any, limits the route to these methods.
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (rt PoolRoute) matches(method, p string) bool {
+	if len(rt.Methods) > 0 && !slices.ContainsFunc(rt.Methods, func(m string) bool {
+		return strings.EqualFold(m, method)
+	}) {
+		return false
+	}
+	if rt.Prefix == "" && rt.Pattern == "" {
+		return true
+	}
+	if rt.Prefix != "" && strings.HasPrefix(p, rt.Prefix) {
+		return true
+	}
+	if rt.Pattern != "" {
+		if ok, _ := path.Match(rt.Pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type namedPool struct {
+	name string
+	pool *WorkerPool
+}
+
+// pools returns every pool of s: fast, slow, then the named pools in
+// name order.
+func (s *Server) pools() []namedPool {
+	all := []namedPool{{"fast", s.fastPool}, {"slow", s.slowPool}}
+	names := make([]string, 0, len(s.named))
+	for name := range s.named {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		all = append(all, namedPool{name, s.named[name]})
+	}
+	return all
+}
+
+// pool returns the pool called name, or nil.
+func (s *Server) pool(name string) *WorkerPool {
+	switch name {
+	case "fast":
+		return s.fastPool
+	case "slow":
+		return s.slowPool
+	}
+	return s.named[name]
+}
+
+// routePool returns the pool the routing table sends a request to: the
+// first matching route's, else the default pool. ok is false when neither
+// applies and the fast/slow heuristics decide.
+func (s *Server) routePool(method, p string) (name string, ok bool) {
+	for _, rt := range s.poolRoutes {
+		if rt.matches(method, p) {
+			return rt.Pool, true
+		}
+	}
+	return s.defaultPool, s.defaultPool != ""
+}
+
+// checkPoolRoutes reports routes or a default pointing at no pool.
+func (s *Server) checkPoolRoutes() error {
+	for i, rt := range s.poolRoutes {
+		if s.pool(rt.Pool) == nil {
+			return fmt.Errorf("pool route %d: unknown pool %q", i, rt.Pool)
+		}
+	}
+	if s.defaultPool != "" && s.pool(s.defaultPool) == nil {
+		return fmt.Errorf("unknown default pool %q", s.defaultPool)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRoutedServer(t *testing.T, routes []PoolRoute, defaultPool string) *Server {
+	t.Helper()
+	return &Server{
+		fastPool:    &WorkerPool{workers: []*Worker{newFakeWorker(t, "fast", time.Second)}},
+		slowPool:    &WorkerPool{workers: []*Worker{newFakeWorker(t, "slow", time.Second)}},
+		slowCfg:     SlowRequestConfig{RoutePrefixes: []string{"/reports/"}},
+		named:       map[string]*WorkerPool{"export": {workers: []*Worker{newFakeWorker(t, "export", time.Second)}}},
+		poolRoutes:  routes,
+		defaultPool: defaultPool,
+		routeStats:  make(map[string]*routeStats),
+	}
+}
+
+func TestPoolRoutesPickNamedPool(t *testing.T) {
+	s := newRoutedServer(t, []PoolRoute{
+		{Pool: "export", Prefix: "/exports/"},
+		{Pool: "export", Pattern: "/reports/*/csv", Methods: []string{"get"}},
+		{Pool: "fast", Prefix: "/reports/live"},
+	}, "")
+
+	for path, want := range map[string]string{
+		"/exports/users":     "export",
+		"/reports/daily/csv": "export",
+		"/reports/live":      "fast",
+		"/reports/daily":     "slow", // unrouted: the slow heuristics decide
+		"/users":             "fast",
+	} {
+		if got := dispatchedBy(t, s, path); got != want {
+			t.Errorf("%s went to %q, want %q", path, got, want)
+		}
+	}
+
+	resp, err := s.Dispatch(&RequestPayload{ID: "1", Method: "POST", Path: "/reports/daily/csv"})
+	if err != nil || resp.Headers["X-Worker"] != "slow" {
+		t.Fatalf("a route limited to GET matched a POST: %+v, %v", resp, err)
+	}
+}
+
+func TestDefaultPoolReplacesSlowHeuristics(t *testing.T) {
+	s := newRoutedServer(t, []PoolRoute{{Pool: "slow", Prefix: "/reports/"}}, "export")
+
+	if got := dispatchedBy(t, s, "/reports/daily"); got != "slow" {
+		t.Fatalf("routed request went to %q", got)
+	}
+	if got := dispatchedBy(t, s, "/users"); got != "export" {
+		t.Fatalf("unrouted request went to %q, want the default pool", got)
+	}
+}
+
+func TestNamedPoolsNeverOverflow(t *testing.T) {
+	s := newRoutedServer(t, []PoolRoute{{Pool: "export", Prefix: "/exports/"}}, "")
+	s.SetOverflow(OverflowBoth)
+	s.named["export"].workers[0].incrInFlight()
+	defer s.named["export"].workers[0].decrInFlight()
+
+	if got := dispatchedBy(t, s, "/exports/users"); got != "export" {
+		t.Fatalf("a busy named pool overflowed to %q", got)
+	}
+}
+
+func TestNamedPoolsInHealthAndMetrics(t *testing.T) {
+	s := newRoutedServer(t, nil, "")
+
+	if st, ok := s.Health().Pools["export"]; !ok || st.Workers != 1 {
+		t.Fatalf("named pool missing from the health summary: %+v", s.Health())
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(s).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `baremetal_workers{pool="export",state="idle"} 1`) {
+		t.Fatalf("named pool missing from metrics:\n%s", rec.Body)
+	}
+
+	s.named["export"].workers[0].markDead()
+	if code, st := probe(t, HealthzHandler(s)); code != 503 || st.Pools["export"] {
+		t.Fatalf("a dead named pool should fail the probe: %d %+v", code, st)
+	}
+}
+
+func TestNewServerRejectsUnknownPools(t *testing.T) {
+	for _, cfg := range []ServerConfig{
+		{PoolRoutes: []PoolRoute{{Pool: "export", Prefix: "/exports/"}}},
+		{DefaultPool: "export"},
+		{Pools: map[string]PoolConfig{"slow": {}}},
+	} {
+		if s, err := NewServerWithConfig(cfg); err == nil {
+			s.DrainWorkers()
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+
+	s, err := NewServerWithConfig(ServerConfig{
+		Pools:       map[string]PoolConfig{"export": {}},
+		PoolRoutes:  []PoolRoute{{Pool: "export", Prefix: "/exports/"}},
+		DefaultPool: "fast",
+	})
+	if err != nil {
+		t.Fatalf("valid routing table rejected: %v", err)
+	}
+	s.DrainWorkers()
+}
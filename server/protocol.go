@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ProtocolVersion is the version of the frame protocol Go speaks. Go
+// passes it to a worker it starts in GO_PHP_PROTOCOL, and the worker
+// answers with the version it speaks in its ready frame. The versions:
+//
+//  1. request and response frames, streamed responses ("headers",
+//     "chunk", "end" and "error" frames) and "publish" frames. A worker
+//     that sends no ready frame speaks version 1, and JSON.
+//  2. the ready frame itself, request bodies streamed to PHP in "chunk"
+//     and "end" frames (RequestPayload.BodyStream), "ping" frames (see
+//     WorkerPool.SetPing) and WebSocket sessions.
+//  3. "retry" frames, with which a worker gives a request back (see
+//     ErrRetryElsewhere). Only the worker sends them, so a worker checks
+//     GO_PHP_PROTOCOL before it does.
+//
+// Go falls back for an older worker rather than send it frames it would
+// misread: see Worker.speaks. The README describes each frame.
+const ProtocolVersion = 3
+
+// The protocol version each optional feature needs.
+const (
+	protoBodyStream = 2
+	protoPing       = 2
+	protoWebSocket  = 2
+)
+
+// ErrProtocolTooOld is wrapped by errors for requests the worker's
+// protocol version can't carry. The client gets 501.
+var ErrProtocolTooOld = errors.New("worker protocol too old")
+
+// legacyHandshakeWait is how long a worker started by Go gets to send its
+// ready frame before it is taken for a version 1 worker that never will.
+const legacyHandshakeWait = 2 * time.Second
+
+// readyFrame is the handshake a worker sends at startup. It is always
+// JSON-encoded and names the codec the worker agreed to use for
+// everything after it and the protocol version it speaks, 0 being 1.
+type readyFrame struct {
+	Type     string `json:"type"` // "ready"
+	Codec    string `json:"codec"`
+	Protocol int    `json:"protocol,omitempty"`
+}
+
+// speaks reports whether the worker's process speaks protocol version v.
+// Callers must hold w.mu.
+func (w *Worker) speaks(v int) bool {
+	if w.protocol == 0 {
+		// workers Go didn't start, through WorkerConfig.Start or Address,
+		// are taken to be current
+		return ProtocolVersion >= v
+	}
+	return w.protocol >= v
+}
+
+// inlineBody reads a body that was to be streamed into req.Body, for a
+// worker that can't take it in chunks.
+func (req *RequestPayload) inlineBody() error {
+	if req.body == nil {
+		return nil
+	}
+	b, err := io.ReadAll(req.body)
+	if err != nil {
+		return err
+	}
+	req.Body = string(b)
+	req.BodyStream = false
+	req.body = nil
+	return nil
+}
+
+// deadliner is implemented by pipes that can time out a read, as the
+// *os.File pipes to a PHP process do.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// readReady reads the worker's ready frame. When r can time out reads, a
+// worker that sends nothing within wait, or closes its output without a
+// word, is taken to predate the handshake: readReady returns a nil frame,
+// having read nothing, so the first response is left on the pipe. One
+// that exited is then found dead like any other.
+func readReady(r io.Reader, wait time.Duration) (*readyFrame, error) {
+	if d, ok := r.(deadliner); ok && wait > 0 && d.SetReadDeadline(time.Now().Add(wait)) == nil {
+		var first [1]byte
+		_, err := io.ReadFull(r, first[:])
+		if rerr := d.SetReadDeadline(time.Time{}); err == nil {
+			err = rerr
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading worker handshake: %w", err)
+		}
+		r = io.MultiReader(bytes.NewReader(first[:]), r)
+	}
+
+	body, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading worker handshake: %w", err)
+	}
+	var ready readyFrame
+	if err := json.Unmarshal(body, &ready); err != nil {
+		return nil, fmt.Errorf("decoding worker handshake: %w", err)
+	}
+	if ready.Type != "ready" {
+		return nil, fmt.Errorf("unexpected worker handshake frame %q", ready.Type)
+	}
+	return &ready, nil
+}
+
+// handshake reads the ready frame of a worker Go asked for codec want,
+// giving up after timeout, and returns the codec and protocol version the
+// worker agreed to.
+func handshake(logger *slog.Logger, r io.Reader, want Codec, timeout time.Duration) (Codec, int, error) {
+	type result struct {
+		ready *readyFrame
+		err   error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				resCh <- result{nil, recoveredError(logger, "handshake", p)}
+			}
+		}()
+		ready, err := readReady(r, legacyHandshakeWait)
+		resCh <- result{ready, err}
+	}()
+
+	// give a legacy worker time to be recognized as one
+	timeout = max(timeout, 2*legacyHandshakeWait)
+	var res result
+	select {
+	case res = <-resCh:
+	case <-time.After(timeout):
+		res.err = fmt.Errorf("worker handshake timeout after %s", timeout)
+	}
+	if res.err != nil {
+		return nil, 0, res.err
+	}
+
+	if res.ready == nil {
+		logger.Warn("worker sent no ready frame, assuming protocol 1 and JSON; update php/worker.php",
+			"wait", legacyHandshakeWait, "codec", want.Name())
+		return JSONCodec{}, 1, nil
+	}
+	codec, err := CodecByName(res.ready.Codec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return codec, max(res.ready.Protocol, 1), nil
+}
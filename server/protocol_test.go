@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReadyTellsLegacyWorkersApart(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// a version 1 worker stays silent until it gets a request
+	ready, err := readReady(r, 20*time.Millisecond)
+	if err != nil || ready != nil {
+		t.Fatalf("silent worker: %+v, %v", ready, err)
+	}
+	writeFrame(w, JSONCodec{}, ResponsePayload{ID: "1", Status: 200})
+	body, err := readFrame(r)
+	if err != nil || !strings.Contains(string(body), `"id":"1"`) {
+		t.Fatalf("the response after the wait should be intact: %q, %v", body, err)
+	}
+
+	writeFrame(w, JSONCodec{}, readyFrame{Type: "ready", Codec: "json", Protocol: 2})
+	ready, err = readReady(r, time.Second)
+	if err != nil || ready == nil || ready.Protocol != 2 {
+		t.Fatalf("ready frame: %+v, %v", ready, err)
+	}
+}
+
+func TestWorkerNegotiatesProtocol(t *testing.T) {
+	ready := `{"type":"ready","codec":"json","protocol":2}`
+	dir := newProjectDir(t)
+	php := filepath.Join(dir, "php2")
+	// only answers with a ready frame when Go says which version it speaks
+	script := fmt.Sprintf("#!/bin/sh\n[ \"$GO_PHP_PROTOCOL\" = %d ] && printf '\\000\\000\\000\\%03o%s'\nexec cat >/dev/null\n",
+		ProtocolVersion, len(ready), ready)
+	if err := os.WriteFile(php, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake php: %v", err)
+	}
+
+	w, err := NewWorkerWithConfig(WorkerConfig{PHPBinary: php, BaseDir: dir, RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewWorkerWithConfig: %v", err)
+	}
+	defer w.stop()
+	if w.protocol != 2 || w.frameCodec().Name() != "json" {
+		t.Fatalf("protocol = %d, codec = %s", w.protocol, w.frameCodec().Name())
+	}
+}
+
+func TestLegacyWorkerGetsBodyInline(t *testing.T) {
+	var resp bytes.Buffer
+	writeFrame(&resp, JSONCodec{}, ResponsePayload{Status: 200})
+	var sent bytes.Buffer
+	w := &Worker{
+		stdin:    nopWriteCloser{Writer: &sent},
+		stdout:   io.NopCloser(&resp),
+		protocol: 1,
+	}
+
+	p, err := BuildStreamingPayload(httptest.NewRequest(http.MethodPost, "/search", strings.NewReader(`{"q":"go"}`)))
+	if err != nil {
+		t.Fatalf("BuildStreamingPayload: %v", err)
+	}
+	if _, err := w.handleRequest(p); err != nil {
+		t.Fatalf("handleRequest: %v", err)
+	}
+
+	body, err := readFrame(&sent)
+	if err != nil {
+		t.Fatalf("reading sent frame: %v", err)
+	}
+	var req RequestPayload
+	if err := json.Unmarshal(body, &req); err != nil || req.BodyStream || req.Body != `{"q":"go"}` {
+		t.Fatalf("expected the body inline: %+v, %v", req, err)
+	}
+	if sent.Len() != 0 {
+		t.Fatalf("no chunk frames should follow, got %d more bytes", sent.Len())
+	}
+}
+
+func TestLegacyWorkerIsNotPinged(t *testing.T) {
+	w, pongs := pongWorker(t)
+	w.protocol = 1
+	if err := w.ping(time.Second); err != nil || pongs.Load() != 0 || w.isDead() {
+		t.Fatalf("a version 1 worker was pinged: %v, pongs %d", err, pongs.Load())
+	}
+}
+
+func TestLegacyWorkerRefusesWebSocket(t *testing.T) {
+	w := newFakeWorker(t, "php0", time.Second)
+	w.protocol = 1
+	defer w.stop()
+
+	err := w.webSocket(&RequestPayload{ID: "1", Method: "GET", Path: "/ws"}, httptest.NewRecorder(), nil, nil)
+	if !errors.Is(err, ErrProtocolTooOld) || mapWorkerErrorToStatus(err) != http.StatusNotImplemented {
+		t.Fatalf("expected a 501, got %v", err)
+	}
+
+	// the worker is still good for plain requests
+	resp, err := w.Handle(&RequestPayload{ID: "2", Method: "GET", Path: "/a"})
+	if err != nil || resp.Body != "php0:/a" {
+		t.Fatalf("%+v, %v", resp, err)
+	}
+}
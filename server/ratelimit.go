@@ -0,0 +1,141 @@
+package server
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitRule allows each client IP Rate requests per second under
+// Prefix, with bursts of up to Burst requests.
+type RateLimitRule struct {
+	Prefix string  `json:"prefix"` // "" or "/" matches every path
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+}
+
+const (
+	rateLimitShards = 32
+
+	// rateLimitMaxPerShard caps the buckets kept per shard, so a flood of
+	// one-off IPs can't grow the map without bound.
+	rateLimitMaxPerShard = 4096
+)
+
+// RateLimit returns a token-bucket rate limiter keyed by the client IP
+// (as resolved by RealIP). A request is checked against the rule with the
+// longest matching prefix, so a strict /login rule can sit next to a
+// looser catch-all. Requests over the limit get 429 with Retry-After.
+// Rules with a non-positive Rate or Burst are ignored.
+func RateLimit(rules []RateLimitRule) Middleware {
+	var limiters []*rateLimiter
+	for _, rule := range rules {
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			continue
+		}
+		if rule.Prefix == "/" {
+			rule.Prefix = ""
+		}
+		limiters = append(limiters, newRateLimiter(rule))
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(limiters) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var l *rateLimiter
+			for _, cand := range limiters {
+				if strings.HasPrefix(r.URL.Path, cand.rule.Prefix) && (l == nil || len(cand.rule.Prefix) > len(l.rule.Prefix)) {
+					l = cand
+				}
+			}
+			if l != nil {
+				if ok, wait := l.allow(ClientIP(r), time.Now()); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type rateLimiter struct {
+	rule   RateLimitRule
+	full   time.Duration // time for an empty bucket to refill
+	shards [rateLimitShards]rateShard
+}
+
+func newRateLimiter(rule RateLimitRule) *rateLimiter {
+	l := &rateLimiter{
+		rule: rule,
+		full: time.Duration(float64(rule.Burst) / rule.Rate * float64(time.Second)),
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return l
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	shard := &l.shards[h.Sum32()%rateLimitShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	b, ok := shard.buckets[key]
+	if !ok {
+		if len(shard.buckets) >= rateLimitMaxPerShard {
+			l.evict(shard, now)
+		}
+		b = &tokenBucket{tokens: float64(l.rule.Burst), last: now}
+		shard.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rule.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rule.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rule.Rate * float64(time.Second))
+}
+
+// evict makes room in a full shard. Buckets that have had time to refill
+// are the same as no bucket, so they go first; if none have, the shard is
+// under attack from many IPs and an arbitrary half is dropped.
+func (l *rateLimiter) evict(shard *rateShard, now time.Time) {
+	for key, b := range shard.buckets {
+		if now.Sub(b.last) >= l.full {
+			delete(shard.buckets, key)
+		}
+	}
+	if len(shard.buckets) < rateLimitMaxPerShard {
+		return
+	}
+	for key := range shard.buckets {
+		if len(shard.buckets) < rateLimitMaxPerShard/2 {
+			break
+		}
+		delete(shard.buckets, key)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitReturns429WithRetryAfter(t *testing.T) {
+	h := RateLimit([]RateLimitRule{{Prefix: "/", Rate: 1, Burst: 2}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		r.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := serve("203.0.113.1"); rr.Code != http.StatusNoContent {
+			t.Fatalf("request %d within burst got %d", i, rr.Code)
+		}
+	}
+	rr := serve("203.0.113.1")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the burst, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After: 1, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// other clients have their own bucket
+	if rr := serve("203.0.113.2"); rr.Code != http.StatusNoContent {
+		t.Fatalf("another IP was limited: %d", rr.Code)
+	}
+}
+
+func TestRateLimitLongestPrefixWins(t *testing.T) {
+	h := RateLimit([]RateLimitRule{
+		{Prefix: "/", Rate: 100, Burst: 100},
+		{Prefix: "/login", Rate: 0.1, Burst: 1},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := func(path string, n int) (out []int) {
+		for i := 0; i < n; i++ {
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+			out = append(out, rr.Code)
+		}
+		return out
+	}
+
+	if got := codes("/login", 2); got[0] != http.StatusOK || got[1] != http.StatusTooManyRequests {
+		t.Fatalf("strict /login rule not applied: %v", got)
+	}
+	if got := codes("/home", 5); got[4] != http.StatusOK {
+		t.Fatalf("catch-all rule too strict: %v", got)
+	}
+}
+
+func TestRateLimiterRefillsAndEvicts(t *testing.T) {
+	l := newRateLimiter(RateLimitRule{Rate: 10, Burst: 1})
+	now := time.Now()
+
+	if ok, _ := l.allow("a", now); !ok {
+		t.Fatal("first request denied")
+	}
+	if ok, wait := l.allow("a", now); ok || wait != 100*time.Millisecond {
+		t.Fatalf("expected denial with a 100ms wait, got %v %s", ok, wait)
+	}
+	if ok, _ := l.allow("a", now.Add(100*time.Millisecond)); !ok {
+		t.Fatal("bucket did not refill")
+	}
+
+	// flood one limiter with one-off IPs: the map must stay bounded
+	for i := 0; i < rateLimitShards*rateLimitMaxPerShard*2; i++ {
+		l.allow(fmt.Sprintf("ip-%d", i), now)
+	}
+	for i := range l.shards {
+		if n := len(l.shards[i].buckets); n > rateLimitMaxPerShard {
+			t.Fatalf("shard %d grew to %d buckets", i, n)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies is a set of networks whose X-Forwarded-For and
+// X-Forwarded-Proto headers are believed.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses CIDRs such as "10.0.0.0/8". Bare IPs are
+// accepted as single-host networks.
+func ParseTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			tp.nets = append(tp.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", c, err)
+		}
+		tp.nets = append(tp.nets, n)
+	}
+	return tp, nil
+}
+
+// Contains reports whether ip belongs to a trusted network.
+func (tp *TrustedProxies) Contains(ip net.IP) bool {
+	if tp == nil || ip == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client IP for r and whether the direct peer is a
+// trusted proxy. For a trusted peer X-Forwarded-For is walked right to
+// left, skipping trusted hops, and the first untrusted address is the
+// client; if every hop is trusted the left-most one is used. Anything
+// else gets the direct peer, so clients can't spoof their address.
+func (tp *TrustedProxies) resolve(r *http.Request) (string, bool) {
+	peer := peerIP(r)
+	if !tp.Contains(net.ParseIP(peer)) {
+		return peer, false
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// garbage from further upstream; stop at the last good hop
+			break
+		}
+		client = ip.String()
+		if !tp.Contains(ip) {
+			break
+		}
+	}
+	return client, true
+}
+
+type clientIPKey struct{}
+
+type clientIPInfo struct {
+	ip      string
+	trusted bool // request arrived through a trusted proxy
+}
+
+// RealIP resolves the client IP of each request against tp and records
+// it for BuildPayload and the access log (see ClientIP). X-Forwarded-Proto
+// is only honored from trusted proxies once RealIP is installed.
+func RealIP(tp *TrustedProxies) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, trusted := tp.resolve(r)
+			ctx := context.WithValue(r.Context(), clientIPKey{}, clientIPInfo{ip: ip, trusted: trusted})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the client IP resolved by RealIP, or the direct peer's
+// IP when RealIP isn't installed.
+func ClientIP(r *http.Request) string {
+	if info, ok := r.Context().Value(clientIPKey{}).(clientIPInfo); ok {
+		return info.ip
+	}
+	return peerIP(r)
+}
+
+// trustForwardedHeaders reports whether X-Forwarded-* headers on r may be
+// believed: always without RealIP, else only from a trusted proxy.
+func trustForwardedHeaders(r *http.Request) bool {
+	if info, ok := r.Context().Value(clientIPKey{}).(clientIPInfo); ok {
+		return info.trusted
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tp, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.5 ", "", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+	for _, ip := range []string{"10.1.2.3", "192.168.1.5", "fd00::1"} {
+		if !tp.Contains(parseIP(t, ip)) {
+			t.Errorf("expected %s to be trusted", ip)
+		}
+	}
+	for _, ip := range []string{"192.168.1.6", "8.8.8.8", "2001:db8::1"} {
+		if tp.Contains(parseIP(t, ip)) {
+			t.Errorf("expected %s to be untrusted", ip)
+		}
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+	if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error for invalid IP")
+	}
+}
+
+func TestRealIPResolvesClient(t *testing.T) {
+	tp, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		want   string
+		scheme string
+	}{
+		{"untrusted peer ignores header", "203.0.113.9:1000", []string{"1.2.3.4"}, "203.0.113.9", "http"},
+		{"trusted peer without header", "10.0.0.1:1000", nil, "10.0.0.1", "https"},
+		{"single hop", "10.0.0.1:1000", []string{"198.51.100.7"}, "198.51.100.7", "https"},
+		{"skips trusted hops", "10.0.0.1:1000", []string{"6.6.6.6, 198.51.100.7, 10.0.0.2"}, "198.51.100.7", "https"},
+		{"multiple headers", "10.0.0.1:1000", []string{"6.6.6.6", "198.51.100.7"}, "198.51.100.7", "https"},
+		{"all trusted", "10.0.0.1:1000", []string{"10.9.9.9, 10.0.0.2"}, "10.9.9.9", "https"},
+		{"garbage upstream", "10.0.0.1:1000", []string{"junk, 10.0.0.2"}, "10.0.0.2", "https"},
+	}
+
+	for _, tt := range tests {
+		var gotIP string
+		var payload *RequestPayload
+		h := RealIP(tp)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotIP = ClientIP(r)
+			payload, _ = BuildPayload(r)
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("X-Forwarded-Proto", "https")
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if gotIP != tt.want {
+			t.Errorf("%s: expected client %s, got %s", tt.name, tt.want, gotIP)
+		}
+		if payload.RemoteAddr != tt.want {
+			t.Errorf("%s: expected payload remote_addr %s, got %s", tt.name, tt.want, payload.RemoteAddr)
+		}
+		if payload.Scheme != tt.scheme {
+			t.Errorf("%s: expected scheme %s, got %s", tt.name, tt.scheme, payload.Scheme)
+		}
+	}
+}
+
+func TestClientIPWithoutRealIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+	if got := ClientIP(r); got != "192.0.2.1" {
+		t.Fatalf("expected direct peer, got %s", got)
+	}
+}
+
+func parseIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("bad test IP %q", s)
+	}
+	return ip
+}
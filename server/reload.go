@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Reload moves every worker onto a fresh PHP process, batch workers at a
+// time, so the rest of the pool keeps serving and capacity never drops to
+// zero. batch <= 0 restarts a quarter of the pool at once (at least one).
+//
+// A batch is drained first, so new requests go to the other workers while
+// it finishes its in-flight ones. When no other worker is available (a
+// pool of one) the batch is restarted in place instead, and requests sent
+// to it wait for the new process rather than fail. If a batch fails to
+// start (e.g. the new code does not boot) the remaining workers are left
+// on the old code and the error is returned. ctx is checked between
+// batches. Concurrent reloads of the same pool run one after the other.
+func (p *WorkerPool) Reload(ctx context.Context, batch int) error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	workers := p.snapshot()
+
+	if batch <= 0 {
+		batch = max(len(workers)/4, 1)
+	}
+	for start := 0; start < len(workers); start += batch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := min(start+batch, len(workers))
+		group := workers[start:end]
+		if available(workers[:start]) || available(workers[end:]) {
+			for _, w := range group {
+				if w != nil {
+					w.startDraining()
+				}
+			}
+		}
+
+		errs := make([]error, len(group))
+		var wg sync.WaitGroup
+		for i, w := range group {
+			if w == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.recycled(RecycleReload)
+				// restart waits for the in-flight request, which holds w.mu
+				if err := w.restart(); err != nil {
+					// its old process is gone; let the reaper retry
+					w.markDead()
+					errs[i] = err
+				}
+			}()
+		}
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			return fmt.Errorf("reload stopped after %d of %d workers: %w", start, len(workers), err)
+		}
+	}
+	return nil
+}
+
+// available reports whether any of workers can take a request.
+func available(workers []*Worker) bool {
+	for _, w := range workers {
+		if w != nil && !w.isDead() && !w.isDraining() {
+			return true
+		}
+	}
+	return false
+}
+
+// SetReloadBatch sets how many workers per pool ReloadWorkers and hot
+// reload restart at a time. n <= 0 means a quarter of the pool.
+func (s *Server) SetReloadBatch(n int) {
+	s.reloadBatch.Store(int64(n))
+}
+
+// ReloadWorkers gracefully restarts the workers of every pool onto fresh
+// PHP processes with a rolling WorkerPool.Reload (see SetReloadBatch),
+// e.g. to pick up a deploy without dropping requests.
+func (s *Server) ReloadWorkers(ctx context.Context) error {
+	s.log().Info("reloading workers", "event", "reload")
+	var errs []error
+	for _, np := range s.pools() {
+		if err := np.pool.Reload(ctx, int(s.reloadBatch.Load())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		s.log().Error("worker reload failed", "event", "reload", "err", err)
+	} else {
+		s.log().Info("workers reloaded", "event", "reload")
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func workerRestarts(p *WorkerPool) []uint64 {
+	restarts := make([]uint64, len(p.workers))
+	for i, w := range p.workers {
+		restarts[i] = atomic.LoadUint64(&w.restarts)
+	}
+	return restarts
+}
+
+func TestReloadRestartsEveryWorker(t *testing.T) {
+	pool, err := NewPoolWithConfig(3, WorkerConfig{MaxRequests: 10, RequestTimeout: time.Second, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+	before := workerRestarts(pool)
+
+	if err := pool.Reload(context.Background(), 2); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	after := workerRestarts(pool)
+	for i := range before {
+		if after[i] != before[i]+1 {
+			t.Fatalf("worker %d restarted %d times, want once", i, after[i]-before[i])
+		}
+		if pool.workers[i].isDead() {
+			t.Fatalf("worker %d is dead after reload", i)
+		}
+	}
+}
+
+func TestReloadStopsAtFailingBatch(t *testing.T) {
+	start := fakeStart(0)
+	var broken atomic.Bool
+	pool, err := NewPoolWithConfig(2, WorkerConfig{
+		MaxRequests:    10,
+		RequestTimeout: time.Second,
+		Start: func() (io.WriteCloser, io.ReadCloser, error) {
+			if broken.Load() {
+				return nil, nil, errors.New("new code does not boot")
+			}
+			return start()
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+	before := workerRestarts(pool)
+
+	broken.Store(true)
+	if err := pool.Reload(context.Background(), 1); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if !pool.workers[0].isDead() {
+		t.Fatal("failed worker should be left for the reaper")
+	}
+	if workerRestarts(pool)[1] != before[1] || pool.workers[1].isDead() {
+		t.Fatal("reload should not touch workers after the failing batch")
+	}
+}
+
+func TestReloadHonoursContext(t *testing.T) {
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 10, RequestTimeout: time.Second, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+	before := workerRestarts(pool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pool.Reload(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if workerRestarts(pool)[0] != before[0] {
+		t.Fatal("canceled reload restarted a worker")
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults for SetNoWorkerRetry used by cmd/server.
+const (
+	DefaultNoWorkerRetries       = 3
+	DefaultNoWorkerRetryInterval = 25 * time.Millisecond
+)
+
+// SetNoWorkerRetry makes Dispatch and DispatchStream try again, up to
+// retries more times, when a pool momentarily has no live worker, as
+// happens while a rolling reload or a burst of recycles restarts them.
+// The first retry waits interval and each one after that twice as long.
+// Only requests that are safe to run twice (RequestPayload.Retryable)
+// are retried. retries <= 0, the default, fails at once with ErrNoWorkers.
+func (s *Server) SetNoWorkerRetry(retries int, interval time.Duration) {
+	s.noWorkerRetries = max(retries, 0)
+	s.noWorkerInterval = interval
+}
+
+// retryNoWorkers runs dispatch, running it again after a short wait for
+// as long as it fails with ErrNoWorkers and req may be retried.
+func (s *Server) retryNoWorkers(req *RequestPayload, dispatch func() error) error {
+	err := dispatch()
+	wait := s.noWorkerInterval
+	for i := 1; i <= s.noWorkerRetries && errors.Is(err, ErrNoWorkers) && req.Retryable(); i++ {
+		time.Sleep(wait)
+		wait *= 2
+		req.traceAttr("php.no_worker_retries", i)
+		err = dispatch()
+	}
+	return err
+}
+
+// ErrRetryElsewhere is wrapped by errors for requests a worker gave back
+// with a "retry" frame instead of answering, because it found itself in
+// a bad state (say, a stale database connection) before acting on them.
+// WorkerPool.Dispatch sends such a request to another worker once, if it
+// is Retryable; otherwise the client gets 503.
+var ErrRetryElsewhere = errors.New("worker asked for the request to be retried elsewhere")
+
+// retryFrameError returns the error for a retry frame.
+func retryFrameError(frame StreamFrame) error {
+	if frame.Error == "" {
+		return ErrRetryElsewhere
+	}
+	return fmt.Errorf("%w: %s", ErrRetryElsewhere, frame.Error)
+}
+
+// recycleAfterRetry drains a worker that gave a request back: it takes no
+// new requests, and the last one out marks it dead for the reaper to
+// restart.
+func (w *Worker) recycleAfterRetry(err error) {
+	w.log().Info("worker gave a request back, recycling it", "err", err)
+	w.recycled(RecycleRetry)
+	w.startDraining()
+}
+
+// retryWorker picks the worker to retry a request given back by w on:
+// another one if the pool has one free, else w itself on a fresh process,
+// provided nothing else is still in flight on it.
+func (p *WorkerPool) retryWorker(req *RequestPayload, w *Worker) *Worker {
+	if other := p.pickWorker(req); other != nil && other != w {
+		return other
+	}
+	restarted, err := w.restartIfDead()
+	if err != nil {
+		w.log().Error("worker restart failed", "err", err)
+	}
+	if restarted {
+		req.traceAttr("php.worker_restarted", true)
+	}
+	return w
+}
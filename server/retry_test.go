@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// addWorkerAfter puts a fake worker into p after d, as the reaper would
+// bring one back.
+func addWorkerAfter(t *testing.T, p *WorkerPool, d time.Duration) {
+	w := newFakeWorker(t, "late", time.Second)
+	time.AfterFunc(d, func() {
+		p.mu.Lock()
+		p.workers = append(p.workers, w)
+		p.mu.Unlock()
+	})
+}
+
+func TestDispatchRetriesWhileNoWorkers(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetNoWorkerRetry(4, 10*time.Millisecond)
+	addWorkerAfter(t, s.fastPool, 15*time.Millisecond)
+
+	resp, err := s.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/"})
+	if err != nil {
+		t.Fatalf("GET should wait for the worker to come back: %v", err)
+	}
+	if resp.Body != "late:/" {
+		t.Fatalf("unexpected response %q", resp.Body)
+	}
+}
+
+func TestDispatchNoWorkerRetrySkipsUnsafeRequests(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetNoWorkerRetry(4, 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := s.Dispatch(&RequestPayload{ID: "1", Method: "POST", Path: "/orders"})
+	if !errors.Is(err, ErrNoWorkers) {
+		t.Fatalf("expected ErrNoWorkers, got %v", err)
+	}
+	if time.Since(start) >= 50*time.Millisecond {
+		t.Fatal("a POST must not be retried")
+	}
+
+	// nor is anything once retries are off
+	s.SetNoWorkerRetry(0, 50*time.Millisecond)
+	start = time.Now()
+	if _, err := s.Dispatch(&RequestPayload{ID: "2", Method: "GET", Path: "/"}); !errors.Is(err, ErrNoWorkers) {
+		t.Fatalf("expected ErrNoWorkers, got %v", err)
+	}
+	if time.Since(start) >= 50*time.Millisecond {
+		t.Fatal("nothing is retried with retries off")
+	}
+}
+
+func TestDispatchNoWorkerRetryGivesUp(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetNoWorkerRetry(2, time.Millisecond)
+
+	if _, err := s.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/"}); !errors.Is(err, ErrNoWorkers) {
+		t.Fatalf("expected ErrNoWorkers after the retries, got %v", err)
+	}
+}
+
+// giveBackStart is fakeStart where the first n processes give every
+// request back with a retry frame.
+func giveBackStart(n int) func() (io.WriteCloser, io.ReadCloser, error) {
+	var starts atomic.Int32
+	return func() (io.WriteCloser, io.ReadCloser, error) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		i := int(starts.Add(1) - 1)
+		if i >= n {
+			go runFakePHP(stdinR, stdoutW, "php"+strconv.Itoa(i), 0)
+			return stdinW, stdoutR, nil
+		}
+		go func() {
+			defer stdoutW.Close()
+			for {
+				body, err := readFrame(stdinR)
+				if err != nil {
+					return
+				}
+				var req RequestPayload
+				json.Unmarshal(body, &req)
+				writeFrame(stdoutW, JSONCodec{}, StreamFrame{Type: "retry", ID: req.ID, Error: "stale db connection"})
+			}
+		}()
+		return stdinW, stdoutR, nil
+	}
+}
+
+// newGiveBackPool returns a pool whose first worker gives every request
+// back, on its first process, and whose second, labeled other, answers.
+func newGiveBackPool(t *testing.T) *WorkerPool {
+	t.Helper()
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 1000, RequestTimeout: time.Second, Start: giveBackStart(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.stopAll)
+	pool.workers = append(pool.workers, newFakeWorker(t, "other", time.Second))
+	return pool
+}
+
+func TestRetryFrameMovesRequestToAnotherWorker(t *testing.T) {
+	pool := newGiveBackPool(t)
+	stale := pool.workers[0]
+
+	req := &RequestPayload{ID: "1", Method: "GET", Path: "/a"}
+	info := DispatchInfo{Worker: -1}
+	req.info = &info
+	resp, err := pool.Dispatch(req)
+	if err != nil || resp.Body != "other:/a" {
+		t.Fatalf("GET should be retried on the other worker: %+v, %v", resp, err)
+	}
+	if !info.RetriedElsewhere || info.Worker != 1 {
+		t.Fatalf("info = %+v", info)
+	}
+	if !stale.isDead() {
+		t.Fatal("the worker that gave the request back should be recycled")
+	}
+}
+
+func TestRetryFrameOnlyRetriesSafeRequests(t *testing.T) {
+	for _, maxConcurrent := range []int{1, 4} {
+		pool := newGiveBackPool(t)
+		pool.SetMaxConcurrent(maxConcurrent)
+
+		_, err := pool.Dispatch(&RequestPayload{ID: "1", Method: "POST", Path: "/pay"})
+		if !errors.Is(err, ErrRetryElsewhere) || mapWorkerErrorToStatus(err) != http.StatusServiceUnavailable {
+			t.Fatalf("max concurrent %d: a POST given back should get a 503, got %v", maxConcurrent, err)
+		}
+		if n := atomic.LoadUint64(&pool.workers[1].totalRequests); n != 0 {
+			t.Fatalf("max concurrent %d: the POST was run again", maxConcurrent)
+		}
+	}
+}
+
+func TestRetryFrameRestartsLoneWorker(t *testing.T) {
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 1000, RequestTimeout: time.Second, Start: giveBackStart(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.stopAll()
+
+	// with nobody else free, the retry gets a fresh process
+	resp, err := pool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/a"})
+	if err != nil || resp.Body != "php1:/a" {
+		t.Fatalf("%+v, %v", resp, err)
+	}
+}
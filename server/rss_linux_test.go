@@ -0,0 +1,47 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProcessRSSReadsStatm(t *testing.T) {
+	rss, err := processRSS(os.Getpid())
+	if err != nil {
+		t.Fatalf("processRSS: %v", err)
+	}
+	if rss <= 0 {
+		t.Fatalf("expected a positive RSS for the test process, got %d", rss)
+	}
+	if _, err := processRSS(-1); err == nil {
+		t.Fatalf("expected an error for a missing process")
+	}
+}
+
+func TestReapRecyclesWorkersOverRSSLimit(t *testing.T) {
+	php, dir := newStandInPHP(t)
+	pool, err := NewPoolWithConfig(2, WorkerConfig{MaxRequests: 10, RequestTimeout: 500 * time.Millisecond, PHPBinary: php, BaseDir: dir})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig returned error: %v", err)
+	}
+	defer pool.stopAll()
+	idle, busy := pool.workers[0], pool.workers[1]
+	idlePid := idle.pid
+	busy.incrInFlight()
+
+	pool.SetMaxRSS(1) // every process is over one byte
+	pool.reap(time.Now())
+
+	if idle.isDead() || idle.pid == idlePid {
+		t.Fatalf("expected idle worker over the limit to be restarted")
+	}
+	if !busy.isDraining() {
+		t.Fatalf("expected busy worker over the limit to be draining")
+	}
+	if stats := pool.Stats(); len(stats.WorkerRSS) != 2 || stats.WorkerRSS[1] <= 0 {
+		t.Fatalf("expected sampled RSS in stats, got %v", stats.WorkerRSS)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+// processRSS is only implemented on Linux; elsewhere memory-based
+// recycling is a no-op.
+func processRSS(pid int) (int64, error) {
+	return 0, errors.New("rss sampling not supported on this platform")
+}
@@ -1,12 +1,16 @@
 package server
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -16,6 +20,56 @@ import (
 type PoolStats struct {
 	Workers     int `json:"workers"`
 	DeadWorkers int `json:"dead_workers"`
+	Idle        int `json:"idle_workers"`
+	Busy        int `json:"busy_workers"`
+	// Draining also counts workers a shrink took out of the pool that
+	// are still finishing requests; Workers does not.
+	Draining int `json:"draining_workers"`
+	// Warming counts workers still sending their warm-up requests; see
+	// WarmupConfig.
+	Warming int `json:"warming_workers"`
+
+	// InFlight counts requests inside workers; Queued is the part of them
+	// waiting behind another request on the same worker.
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+
+	Requests uint64            `json:"requests"`
+	Errors   uint64            `json:"errors"`
+	Duration HistogramSnapshot `json:"duration_seconds"`
+
+	// WorkerRSS is each worker's resident memory in bytes as last sampled
+	// by the reaper (0 if not sampled).
+	WorkerRSS []int64 `json:"worker_rss_bytes,omitempty"`
+}
+
+// WorkerStat describes one worker of a pool; see WorkerPool.WorkerStats.
+type WorkerStat struct {
+	Index    int    `json:"index"`
+	PID      int    `json:"pid"`
+	State    string `json:"state"` // idle, busy, draining or dead
+	InFlight int    `json:"in_flight"`
+
+	// BusySeconds is how long the worker has had requests in flight
+	// without a break; 0 when idle. A large value means a stuck request.
+	// Long is set once it passes the pool's long request threshold, after
+	// which requests go to other workers while there are any (see
+	// WorkerPool.SetLongRequestThreshold).
+	BusySeconds float64 `json:"busy_seconds"`
+	Long        bool    `json:"long,omitempty"`
+
+	// Requests counts requests served by the current PHP process, which
+	// is recycled once it reaches MaxRequests (0 = never). TotalRequests
+	// spans every process the worker has run, for comparing load across
+	// workers.
+	Requests      uint64 `json:"requests"`
+	MaxRequests   int    `json:"max_requests"`
+	TotalRequests uint64 `json:"total_requests"`
+
+	Restarts      uint64    `json:"restarts"`
+	SpawnedAt     time.Time `json:"spawned_at"` // start of the current process
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	RSS           int64     `json:"rss_bytes"` // as last sampled; 0 if never
 }
 
 type routeStats struct {
@@ -27,34 +81,250 @@ type routeStats struct {
 type HealthSummary struct {
 	Fast PoolStats `json:"fast_pool"`
 	Slow PoolStats `json:"slow_pool"`
+
+	// Pools holds the named pools of ServerConfig.Pools, if any.
+	Pools map[string]PoolStats `json:"pools,omitempty"`
 }
 type SlowRequestConfig struct {
 	RoutePrefixes []string
 	Methods       []string
 	BodyThreshold int
+
+	// ContentTypes sends requests whose body has one of these media
+	// types to the slow pool, e.g. "multipart/form-data" or "video/*".
+	ContentTypes []string
+}
+
+// StreamConfig decides which requests are answered through the worker
+// streaming protocol instead of a single buffered response.
+type StreamConfig struct {
+	// RoutePrefixes stream every request whose path starts with one of them.
+	RoutePrefixes []string
+	// RoutePatterns stream every request whose path matches one of them,
+	// in path.Match syntax ("/jobs/*/progress").
+	RoutePatterns []string
+	// AcceptEventStream streams requests that send Accept: text/event-stream.
+	AcceptEventStream bool
+	// Match, if set, is consulted for requests the rules above don't match.
+	Match func(r *http.Request) bool
 }
 
+// DefaultMaxBodyBytes is the request body limit applied by NewServer. It
+// stays below the 10MB frame limit enforced by php/worker.php.
+const DefaultMaxBodyBytes int64 = 8 << 20
+
 type Server struct {
 	fastPool *WorkerPool
 	slowPool *WorkerPool
 	slowCfg  SlowRequestConfig
 
+	named       map[string]*WorkerPool // ServerConfig.Pools
+	poolRoutes  []PoolRoute
+	defaultPool string // "" leaves unrouted requests to the slow heuristics
+
+	streamCfg StreamConfig
+	ws        *wsProxy // nil until SetWebSocketConfig
+
+	routeLimits []*routeLimiter // see SetRouteLimits
+
+	// request body limits in bytes; <= 0 means unlimited
+	maxBodyBytes     int64
+	slowMaxBodyBytes int64
+
+	streamBodyBytes int64 // see SetBodyStreamThreshold
+
+	collapseRoutes []CollapseRoute // see SetCollapseRoutes
+	collapsed      collapser
+
+	// see SetMaxRequestHeaders
+	maxHeaderBytes int
+	maxHeaderCount int
+
+	overflow Overflow // see SetOverflow; "" is OverflowOff
+
+	maxHeaderTimeout time.Duration // see SetMaxHeaderTimeout
+
+	// see SetNoWorkerRetry
+	noWorkerRetries  int
+	noWorkerInterval time.Duration
+
 	routeMu    sync.Mutex
 	routeStats map[string]*routeStats
+
+	ready atomic.Bool // see SetReady
+
+	logger *slog.Logger // see SetLogger; nil means slog.Default()
+
+	reloadBatch atomic.Int64 // see SetReloadBatch
+
+	errorPages  map[int]ErrorPage // see SetErrorPages
+	debugErrors bool              // see SetDebugErrors
+
+	serverTiming bool          // see SetServerTiming
+	headerPolicy *headerPolicy // see SetHeaderPolicy; nil copies what PHP sends
+
+	responseHook ResponseHook      // see SetResponseHook
+	streamHook   StreamHeadersHook // see SetStreamHeadersHook
+}
+
+// PoolConfig configures one of the Server's worker pools.
+type PoolConfig struct {
+	Workers        int
+	MaxRequests    int           // recycle a worker after this many requests
+	RequestTimeout time.Duration // per-request timeout
+	MaxLifetime    time.Duration // recycle a worker after this much uptime; 0 disables
+	MaxRSS         int64         // recycle a worker over this many bytes of RSS; 0 disables
+	MaxConcurrent  int           // requests pipelined on one worker; <= 1 sends one at a time
+
+	// ReadIdleTimeout bounds a stall in the middle of a frame; see
+	// WorkerConfig.ReadIdleTimeout.
+	ReadIdleTimeout time.Duration
+	// FrameBufferSize is the typical response size read into recycled
+	// buffers; see WorkerConfig.FrameBufferSize.
+	FrameBufferSize int
+
+	// Address connects the pool's workers to PHP listening on a socket
+	// instead of launching php/worker.php; see WorkerConfig.Address.
+	Address string
+	// Codec is the frame codec the pool's workers ask PHP for; "" uses
+	// ServerConfig.Codec. See WorkerConfig.Codec.
+	Codec string
+
+	Strategy     Strategy // how workers are picked; "" is RoundRobin
+	StickyCookie string   // session cookie for Sticky; "" is DefaultStickyCookie
+
+	// LongRequestThreshold is how long a worker must be busy before
+	// requests avoid it; 0 is DefaultLongRequestThreshold, negative never
+	// (see SetLongRequestThreshold).
+	LongRequestThreshold time.Duration
+
+	IdleTTL    time.Duration // stop workers idle this long; 0 disables (see SetIdleTTL)
+	MinWorkers int           // workers kept however long they idle
+
+	// DrainTimeout kills workers still draining this long after a
+	// shutdown or shrink; 0 waits for them (see SetDrainTimeout).
+	DrainTimeout time.Duration
+
+	// SlowRequestLog logs requests a worker takes at least this long over
+	// at WARN; 0 disables (see SetSlowRequestLog).
+	SlowRequestLog time.Duration
+
+	// PingInterval pings workers idle this long and restarts those that
+	// don't answer within PingTimeout; 0 disables (see SetPing).
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// Warmup primes every new worker process before it takes requests;
+	// see WarmupConfig.
+	Warmup WarmupConfig
+}
+
+// ServerConfig configures NewServerWithConfig. The fast and slow pools are
+// configured separately, so slow routes can get a longer timeout or a
+// different recycling policy.
+type ServerConfig struct {
+	Fast PoolConfig
+	Slow PoolConfig
+
+	SlowRequests SlowRequestConfig
+
+	// Pools adds named pools next to fast and slow, e.g. an "export" pool
+	// that keeps long CSV exports away from the slow routes. Requests
+	// only reach them through PoolRoutes or DefaultPool.
+	Pools map[string]PoolConfig
+	// PoolRoutes send matching requests to a pool by name; the first
+	// match wins. Requests no route matches go to DefaultPool or, when
+	// that is "", to fast or slow as SlowRequests decides.
+	PoolRoutes  []PoolRoute
+	DefaultPool string
+
+	// PHPBinary is the php executable; "" means "php" from PATH.
+	PHPBinary string
+	// Codec is the frame codec for pools that don't set their own; ""
+	// means GO_PHP_CODEC, or JSON. See WorkerConfig.Codec.
+	Codec string
+	// ProjectRoot holds php/worker.php; "" uses the directory containing
+	// go.mod above the current directory, and fails if there is none.
+	// Either way a missing worker script fails NewServerWithConfig.
+	ProjectRoot string
 }
 
 // NewServer builds fast and slow pools with shared settings.
 func NewServer(fastCount, slowCount, maxRequests int, requestTimeout time.Duration, slowCfg SlowRequestConfig) (*Server, error) {
-	fp, err := NewPool(fastCount, maxRequests, requestTimeout)
+	return NewServerWithConfig(ServerConfig{
+		Fast:         PoolConfig{Workers: fastCount, MaxRequests: maxRequests, RequestTimeout: requestTimeout},
+		Slow:         PoolConfig{Workers: slowCount, MaxRequests: maxRequests, RequestTimeout: requestTimeout},
+		SlowRequests: slowCfg,
+	})
+}
+
+// NewServerWithConfig builds the fast and slow pools described by cfg.
+func NewServerWithConfig(cfg ServerConfig) (*Server, error) {
+	newPool := func(pc PoolConfig) (*WorkerPool, error) {
+		codec := pc.Codec
+		if codec == "" {
+			codec = cfg.Codec
+		}
+		p, err := NewPoolWithConfig(pc.Workers, WorkerConfig{
+			MaxRequests:     pc.MaxRequests,
+			RequestTimeout:  pc.RequestTimeout,
+			ReadIdleTimeout: pc.ReadIdleTimeout,
+			FrameBufferSize: pc.FrameBufferSize,
+			Address:         pc.Address,
+			Warmup:          pc.Warmup,
+			PHPBinary:       cfg.PHPBinary,
+			Codec:           codec,
+			BaseDir:         cfg.ProjectRoot,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.SetMaxLifetime(pc.MaxLifetime)
+		p.SetMaxRSS(pc.MaxRSS)
+		p.SetMaxConcurrent(pc.MaxConcurrent)
+		p.SetStrategy(pc.Strategy, pc.StickyCookie)
+		p.SetLongRequestThreshold(pc.LongRequestThreshold)
+		p.SetIdleTTL(pc.IdleTTL, pc.MinWorkers)
+		p.SetDrainTimeout(pc.DrainTimeout)
+		p.SetPing(pc.PingInterval, pc.PingTimeout)
+		p.SetSlowRequestLog(pc.SlowRequestLog)
+		return p, nil
+	}
+
+	fp, err := newPool(cfg.Fast)
 	if err != nil {
 		return nil, err
 	}
 
-	sp, err := NewPool(slowCount, maxRequests, requestTimeout)
+	sp, err := newPool(cfg.Slow)
 	if err != nil {
+		fp.stopAll()
 		return nil, err
 	}
 
+	named := make(map[string]*WorkerPool, len(cfg.Pools))
+	stopAll := func() {
+		fp.stopAll()
+		sp.stopAll()
+		for _, p := range named {
+			p.stopAll()
+		}
+	}
+	for name, pc := range cfg.Pools {
+		if name == "" || name == "fast" || name == "slow" {
+			stopAll()
+			return nil, fmt.Errorf("pool name %q is reserved", name)
+		}
+		p, err := newPool(pc)
+		if err != nil {
+			stopAll()
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		named[name] = p
+	}
+
+	slowCfg := cfg.SlowRequests
+
 	// Apply defaults if caller leaves fields empty.
 	if slowCfg.BodyThreshold <= 0 {
 		slowCfg.BodyThreshold = 2_000_000
@@ -64,30 +334,132 @@ func NewServer(fastCount, slowCount, maxRequests int, requestTimeout time.Durati
 		slowCfg.Methods = []string{"PUT", "DELETE"}
 	}
 
-	return &Server{
-		fastPool:   fp,
-		slowPool:   sp,
-		slowCfg:    slowCfg,
-		routeStats: make(map[string]*routeStats),
-	}, nil
+	s := &Server{
+		fastPool:         fp,
+		slowPool:         sp,
+		slowCfg:          slowCfg,
+		named:            named,
+		poolRoutes:       cfg.PoolRoutes,
+		defaultPool:      cfg.DefaultPool,
+		maxBodyBytes:     DefaultMaxBodyBytes,
+		slowMaxBodyBytes: DefaultMaxBodyBytes,
+		maxHeaderBytes:   DefaultMaxHeaderBytes,
+		maxHeaderCount:   DefaultMaxHeaderCount,
+		routeStats:       make(map[string]*routeStats),
+	}
+	if err := s.checkPoolRoutes(); err != nil {
+		stopAll()
+		return nil, err
+	}
+	// every worker has completed its handshake by now
+	s.SetReady(true)
+	return s, nil
+}
+
+// SetMaxBodySize sets the maximum request body size in bytes for requests
+// headed to the fast pool and for slow routes (matched by prefix or method).
+// A value <= 0 disables the limit.
+func (s *Server) SetMaxBodySize(fast, slow int64) {
+	s.maxBodyBytes = fast
+	s.slowMaxBodyBytes = slow
+}
+
+// SetBodyStreamThreshold makes the Handler stream request bodies larger
+// than n bytes, or of unknown length, to the worker in chunks instead of
+// reading them into memory first (see BuildStreamingPayload). Multipart
+// uploads are spooled to disk either way. n <= 0 turns streaming off.
+func (s *Server) SetBodyStreamThreshold(n int64) {
+	s.streamBodyBytes = n
+}
+
+// streamsBody reports whether r's body should be streamed to the worker.
+func (s *Server) streamsBody(r *http.Request) bool {
+	if s.streamBodyBytes <= 0 || isMultipartForm(r) {
+		return false
+	}
+	return r.ContentLength < 0 || r.ContentLength > s.streamBodyBytes
+}
+
+// MaxBodySize returns the body limit that applies to r. Only the route,
+// method and headers are considered, since the body hasn't been read yet
+// (see IsSlowHTTPRequest). Requests routed to a named pool get the fast
+// limit.
+func (s *Server) MaxBodySize(r *http.Request) int64 {
+	if name, ok := s.routePool(r.Method, r.URL.Path); ok {
+		if name == "slow" {
+			return s.slowMaxBodyBytes
+		}
+		return s.maxBodyBytes
+	}
+	if s.IsSlowHTTPRequest(r) {
+		return s.slowMaxBodyBytes
+	}
+	return s.maxBodyBytes
 }
 
 // Simple heuristics to decide if a request should go to the "slow" pool. -- driven by SlowRequestConfig
 func (s *Server) IsSlowRequest(r *RequestPayload) bool {
-	// Route Prefixes
-	for _, prefix := range s.slowCfg.RoutePrefixes {
-		if prefix != "" && strings.HasPrefix(r.Path, prefix) {
-			return true
-		}
+	if r.slow || s.isSlowRoute(r.Method, r.Path) {
+		return true
 	}
 
 	// Body size threshold
-	if s.slowCfg.BodyThreshold > 0 && len(r.Body) > s.slowCfg.BodyThreshold {
+	if s.slowCfg.BodyThreshold > 0 && r.BodySize() > int64(s.slowCfg.BodyThreshold) {
+		return true
+	}
+
+	if ct := r.Headers["Content-Type"]; len(ct) > 0 && s.isSlowContentType(ct[0]) {
+		return true
+	}
+
+	return false
+}
+
+// IsSlowHTTPRequest is IsSlowRequest for a request whose body hasn't been
+// read: the declared Content-Length stands in for the body size. The
+// Handler classifies requests with it up front, so a large upload gets
+// the slow pool's body limit and isn't buffered just to find out where
+// it goes.
+func (s *Server) IsSlowHTTPRequest(r *http.Request) bool {
+	if s.isSlowRoute(r.Method, r.URL.Path) {
 		return true
 	}
+	if s.slowCfg.BodyThreshold > 0 && r.ContentLength > int64(s.slowCfg.BodyThreshold) {
+		return true
+	}
+	return s.isSlowContentType(r.Header.Get("Content-Type"))
+}
+
+// isSlowContentType reports whether ct matches SlowRequestConfig.ContentTypes.
+func (s *Server) isSlowContentType(ct string) bool {
+	if ct == "" || len(s.slowCfg.ContentTypes) == 0 {
+		return false
+	}
+	mt, _, _ := strings.Cut(ct, ";")
+	mt = strings.ToLower(strings.TrimSpace(mt))
+	for _, want := range s.slowCfg.ContentTypes {
+		want = strings.ToLower(want)
+		if mt == want {
+			return true
+		}
+		if major, ok := strings.CutSuffix(want, "/*"); ok && strings.HasPrefix(mt, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSlowRoute applies the parts of the slow heuristics that don't need the body.
+func (s *Server) isSlowRoute(method, path string) bool {
+	// Route Prefixes
+	for _, prefix := range s.slowCfg.RoutePrefixes {
+		if prefix != "" && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
 
 	// HTTP methods
-	method := strings.ToUpper(r.Method)
+	method = strings.ToUpper(method)
 	for _, m := range s.slowCfg.Methods {
 		if method == strings.ToUpper(m) {
 			return true
@@ -98,10 +470,17 @@ func (s *Server) IsSlowRequest(r *RequestPayload) bool {
 }
 
 func (s *Server) Health() HealthSummary {
-	return HealthSummary{
+	h := HealthSummary{
 		Fast: s.fastPool.Stats(),
 		Slow: s.slowPool.Stats(),
 	}
+	for name, p := range s.named {
+		if h.Pools == nil {
+			h.Pools = make(map[string]PoolStats, len(s.named))
+		}
+		h.Pools[name] = p.Stats()
+	}
+	return h
 }
 
 func (s *Server) RecordLatency(path string, d time.Duration) {
@@ -131,7 +510,7 @@ func (s *Server) RecordLatency(path string, d time.Duration) {
 		avg := rs.totalLatency / time.Duration(rs.count)
 		if avg > 500*time.Millisecond && !s.hasSlowPrefix(prefix) {
 			s.slowCfg.RoutePrefixes = append(s.slowCfg.RoutePrefixes, prefix)
-			log.Printf("[adaptive] promoting prefix %q to slow pool (avg=%v, count=%d)", prefix, avg, rs.count)
+			s.log().Info("promoting prefix to slow pool", "event", "adaptive", "prefix", prefix, "avg", avg, "count", rs.count)
 		}
 
 	}
@@ -147,41 +526,164 @@ func (s *Server) hasSlowPrefix(prefix string) bool {
 	return false
 }
 
-func (s *Server) Dispatch(req *RequestPayload) (*ResponsePayload, error) {
+// selectPool returns the name and pool that req should go to: the one
+// the pool routes pick, else "fast" or "slow".
+func (s *Server) selectPool(req *RequestPayload) (string, *WorkerPool) {
+	if name, ok := s.routePool(req.Method, req.Path); ok {
+		return name, s.pool(name)
+	}
 	if s.IsSlowRequest(req) {
-		return s.slowPool.Dispatch(req)
+		return "slow", s.slowPool
+	}
+	return "fast", s.fastPool
+}
+
+// Dispatch sends req to a worker of the pool it belongs to and returns
+// the worker's response.
+func (s *Server) Dispatch(req *RequestPayload) (*ResponsePayload, error) {
+	resp, _, err := s.DispatchWithInfo(req)
+	return resp, err
+}
+
+func (s *Server) dispatch(req *RequestPayload) (*ResponsePayload, error) {
+	if key := s.collapseKey(req); key != "" {
+		// the waiting requests need a response they can copy
+		req.rw = nil
+		return s.collapsed.do(req, key, func() (*ResponsePayload, error) {
+			return s.dispatchOne(req)
+		})
+	}
+	return s.dispatchOne(req)
+}
+
+// dispatchOne sends req to a worker of its own.
+func (s *Server) dispatchOne(req *RequestPayload) (*ResponsePayload, error) {
+	release, err := s.acquireRouteSlot(req)
+	defer release()
+	if err != nil {
+		return nil, err
 	}
-	return s.fastPool.Dispatch(req)
+
+	var resp *ResponsePayload
+	err = s.retryNoWorkers(req, func() (err error) {
+		resp, err = s.dispatchPool(req).Dispatch(req)
+		return err
+	})
+	return resp, err
 }
 
+// DispatchStream sends req through the worker streaming protocol
+// (headers/chunk/end frames), writing each frame to rw as it arrives.
 func (s *Server) DispatchStream(req *RequestPayload, rw http.ResponseWriter) error {
-	var pool *WorkerPool
-	if s.IsSlowRequest(req) {
-		pool = s.slowPool
-	} else {
-		pool = s.fastPool
+	release, err := s.acquireRouteSlot(req)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	return s.retryNoWorkers(req, func() error {
+		return s.dispatchPool(req).DispatchStream(req, rw)
+	})
+}
+
+// SetPublisher routes events that PHP workers emit with publish frames
+// to pub, typically an *SSEHub.
+func (s *Server) SetPublisher(pub Publisher) {
+	for _, np := range s.pools() {
+		np.pool.SetPublisher(pub)
+	}
+}
+
+// SetMaxLifetime recycles workers in every pool after about d of
+// uptime, in addition to the request-count limit. Zero disables it.
+// Recycled workers are restarted by the reaper (see StartReaper).
+func (s *Server) SetMaxLifetime(d time.Duration) {
+	for _, np := range s.pools() {
+		np.pool.SetMaxLifetime(d)
 	}
+}
 
-	w := pool.NextWorker() // you may need to add this helper
-	if w == nil {
-		// no healthy workers in pool
-		return ErrNoWorkers
+// SetMaxRSS recycles workers in every pool once their resident memory
+// exceeds limit bytes, draining them first. Memory is sampled by the
+// reaper (see StartReaper), on Linux only. Zero disables it.
+func (s *Server) SetMaxRSS(limit int64) {
+	for _, np := range s.pools() {
+		np.pool.SetMaxRSS(limit)
 	}
+}
 
-	return w.Stream(req, rw)
+// StartReaper starts the worker reaper of every pool, checking every
+// interval for workers to retire or restart. DrainWorkers stops it.
+func (s *Server) StartReaper(interval time.Duration) {
+	for _, np := range s.pools() {
+		np.pool.StartReaper(interval)
+	}
+}
+
+// SetLogger sets where the server, its pools and their workers log.
+// Pool and worker logs carry "pool" and "worker" attributes. nil means
+// slog.Default().
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = l
+	for _, np := range s.pools() {
+		if l == nil {
+			np.pool.SetLogger(nil)
+		} else {
+			np.pool.SetLogger(l.With("pool", np.name))
+		}
+	}
+}
+
+func (s *Server) log() *slog.Logger {
+	if s.logger != nil {
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// SetStreamConfig sets which requests the Handler sends through DispatchStream.
+func (s *Server) SetStreamConfig(cfg StreamConfig) {
+	s.streamCfg = cfg
+}
+
+// IsStreamRequest reports whether r should use the worker streaming
+// protocol: either the client asked for it with X-Go-Stream: 1, or it
+// matches the server's StreamConfig.
+func (s *Server) IsStreamRequest(r *http.Request) bool {
+	if r.Header.Get("X-Go-Stream") == "1" {
+		return true
+	}
+
+	for _, prefix := range s.streamCfg.RoutePrefixes {
+		if prefix != "" && strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range s.streamCfg.RoutePatterns {
+		if ok, _ := path.Match(pattern, r.URL.Path); ok {
+			return true
+		}
+	}
+
+	if s.streamCfg.AcceptEventStream && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return true
+	}
+
+	return s.streamCfg.Match != nil && s.streamCfg.Match(r)
 }
 
 // -------------------------------------------------------------
 // Hot reload support
 // -------------------------------------------------------------
 
-// markAllWorkersDead forces both pools to recreate workers on next request.
+// markAllWorkersDead forces every pool to recreate workers on next request.
 func (s *Server) markAllWorkersDead() {
-	for _, w := range s.fastPool.workers {
-		w.markDead()
-	}
-	for _, w := range s.slowPool.workers {
-		w.markDead()
+	for _, np := range s.pools() {
+		for _, w := range np.pool.snapshot() {
+			if w != nil {
+				w.markDead()
+			}
+		}
 	}
 }
 
@@ -189,23 +691,73 @@ func (s *Server) ForceRecycleWorkers() {
 	s.markAllWorkersDead()
 }
 
+// DrainWorkers stops the pools from taking requests: in-flight ones
+// finish, new ones fail with ErrWorkerDraining. Shutdown calls it once
+// no more requests are coming.
 func (s *Server) DrainWorkers() {
-	s.fastPool.DrainAll()
-	s.slowPool.DrainAll()
+	for _, np := range s.pools() {
+		np.pool.DrainAll()
+	}
 }
 
-// EnableHotReload watches php/ and routes/ under projectRoot and marks all
-// workers dead when changes are detected, so they restart lazily on next request.
-func (s *Server) EnableHotReload(projectRoot string) error {
+// Shutdown stops the server in the order that lets every request finish
+// on its worker:
+//
+//  1. readiness fails (see SetReady), so load balancers stop sending
+//     traffic;
+//  2. srv.Shutdown closes the listeners and idle connections and waits
+//     for the handlers still running, which keep using the workers;
+//  3. the pools are drained, and each worker is stopped once its last
+//     request is done.
+//
+// Draining the pools before the handlers are done would fail requests
+// that are still arriving or waiting for a worker with
+// ErrWorkerDraining. Register anything that keeps handlers open
+// indefinitely, like SSEHub.Close, with srv.RegisterOnShutdown. When ctx
+// ends first, workers still busy are killed and the error from
+// srv.Shutdown is returned. srv may be nil when the Handler is served
+// some other way, in which case the caller must have stopped it already.
+func (s *Server) Shutdown(ctx context.Context, srv *http.Server) error {
+	s.SetReady(false)
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+
+	s.DrainWorkers()
+	var wg sync.WaitGroup
+	for _, np := range s.pools() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			np.pool.shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// EnableHotReload watches dirs (php/ and routes/ if none are given) under
+// projectRoot and reloads the workers when changes are detected, a batch
+// at a time (see ReloadWorkers) so some stay warm throughout. Absolute
+// dirs are used as is.
+func (s *Server) EnableHotReload(projectRoot string, dirs ...string) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 
 	// Directories to watch
-	watchDirs := []string{
-		filepath.Join(projectRoot, "php"),
-		filepath.Join(projectRoot, "routes"),
+	if len(dirs) == 0 {
+		dirs = []string{"php", "routes"}
+	}
+	watchDirs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(projectRoot, dir)
+		}
+		watchDirs = append(watchDirs, dir)
 	}
 
 	for _, dir := range watchDirs {
@@ -214,13 +766,23 @@ func (s *Server) EnableHotReload(projectRoot string) error {
 			continue
 		}
 		if err := watcher.Add(dir); err != nil {
-			log.Println("hot reload: failed to watch", dir, ":", err)
+			s.log().Warn("hot reload: failed to watch directory", "event", "hot_reload", "dir", dir, "err", err)
 		} else {
-			log.Println("hot reload: watching", dir)
+			s.log().Debug("hot reload: watching directory", "event", "hot_reload", "dir", dir)
 		}
 	}
 
+	// one save often fires several events; changes seen while a rolling
+	// reload runs coalesce into a single follow-up reload
+	reload := make(chan struct{}, 1)
+	go func() {
+		for range reload {
+			_ = s.ReloadWorkers(context.Background())
+		}
+	}()
+
 	go func() {
+		defer close(reload)
 		for {
 			select {
 			case ev, ok := <-watcher.Events:
@@ -228,15 +790,18 @@ func (s *Server) EnableHotReload(projectRoot string) error {
 					return
 				}
 				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
-					log.Println("hot reload: change detected in", ev.Name, "- recycling workers...")
-					s.markAllWorkersDead()
+					s.log().Info("hot reload: change detected, recycling workers", "event", "hot_reload", "file", ev.Name)
+					select {
+					case reload <- struct{}{}:
+					default: // a reload is already pending
+					}
 				}
 
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
-				log.Println("hot reload watcher error:", err)
+				s.log().Error("hot reload: watcher error", "event", "hot_reload", "err", err)
 			}
 		}
 	}()
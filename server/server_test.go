@@ -1,8 +1,17 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -67,6 +76,79 @@ func TestIsSlowRequestByBodyThreshold(t *testing.T) {
 	}
 }
 
+func TestIsSlowHTTPRequestUsesHeaders(t *testing.T) {
+	s := &Server{
+		slowCfg: SlowRequestConfig{
+			BodyThreshold: 10,
+			ContentTypes:  []string{"video/*", "application/zip"},
+		},
+		maxBodyBytes:     16,
+		slowMaxBodyBytes: 1 << 20,
+	}
+
+	for _, tt := range []struct {
+		ct     string
+		length int64
+		slow   bool
+	}{
+		{"application/json", 5, false},
+		{"application/json", 11, true},
+		{"application/json", -1, false}, // unknown: decided once read
+		{"video/mp4", 5, true},
+		{"Application/ZIP; name=x", 5, true},
+		{"application/zip-compressed", 5, false},
+		{"", 5, false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("body"))
+		r.ContentLength = tt.length
+		if tt.ct != "" {
+			r.Header.Set("Content-Type", tt.ct)
+		}
+		if got := s.IsSlowHTTPRequest(r); got != tt.slow {
+			t.Errorf("%q, %d bytes: slow = %v, want %v", tt.ct, tt.length, got, tt.slow)
+		}
+		want := s.maxBodyBytes
+		if tt.slow {
+			want = s.slowMaxBodyBytes
+		}
+		if got := s.MaxBodySize(r); got != want {
+			t.Errorf("%q, %d bytes: body limit %d, want %d", tt.ct, tt.length, got, want)
+		}
+	}
+}
+
+func TestHandlerClassifiesBeforeReadingBody(t *testing.T) {
+	s := &Server{
+		fastPool:         newFakePool(t, 1, time.Second),
+		slowPool:         newFakePool(t, 1, time.Second),
+		routeStats:       make(map[string]*routeStats),
+		slowCfg:          SlowRequestConfig{BodyThreshold: 8},
+		maxBodyBytes:     8,
+		slowMaxBodyBytes: 1 << 20,
+	}
+
+	// over the fast limit, but declared as large: the slow limit applies
+	body := strings.Repeat("x", 64)
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("large upload: got %d, want 200", rr.Code)
+	}
+	if got := s.slowPool.Stats().Requests; got != 1 {
+		t.Fatalf("large upload should go to the slow pool, slow requests = %d", got)
+	}
+
+	// a gzipped body loses its length when decoded; the classification
+	// made from the declared one sticks
+	r := httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(gzipped(t, "a,b")))
+	r.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK || s.slowPool.Stats().Requests != 2 {
+		t.Fatalf("gzipped upload: %d, slow requests = %d", rr.Code, s.slowPool.Stats().Requests)
+	}
+}
+
 func TestDispatchUsesFastAndSlowPools(t *testing.T) {
 	fast := newFakePool(t, 1, time.Second)
 	slow := newFakePool(t, 1, time.Second)
@@ -336,3 +418,241 @@ func TestRecordLatencyDoesNotPromoteIfBelowThreshold(t *testing.T) {
 		t.Fatalf("expected /fast not to be promoted (too fast)")
 	}
 }
+
+func TestIsStreamRequest(t *testing.T) {
+	s := &Server{}
+	s.SetStreamConfig(StreamConfig{
+		RoutePrefixes:     []string{"/stream/"},
+		RoutePatterns:     []string{"/jobs/*/progress"},
+		AcceptEventStream: true,
+		Match: func(r *http.Request) bool {
+			return r.URL.Query().Get("live") == "1"
+		},
+	})
+
+	cases := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   bool
+	}{
+		{"plain request", "/users", nil, false},
+		{"stream prefix", "/stream/logs", nil, true},
+		{"stream pattern", "/jobs/42/progress", nil, true},
+		{"pattern is anchored", "/jobs/42/progress/old", nil, false},
+		{"explicit header", "/users", map[string]string{"X-Go-Stream": "1"}, true},
+		{"event-stream accept", "/events", map[string]string{"Accept": "text/event-stream"}, true},
+		{"custom predicate", "/jobs?live=1", nil, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := s.IsStreamRequest(r); got != c.want {
+			t.Fatalf("%s: IsStreamRequest = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestStreamsBody(t *testing.T) {
+	s := &Server{}
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 100)))
+	if s.streamsBody(r) {
+		t.Fatal("streaming should be off by default")
+	}
+
+	s.SetBodyStreamThreshold(50)
+	if !s.streamsBody(r) {
+		t.Fatal("body over the threshold should stream")
+	}
+	r.ContentLength = -1
+	if !s.streamsBody(r) {
+		t.Fatal("body of unknown length should stream")
+	}
+	if s.streamsBody(httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("small"))) {
+		t.Fatal("body under the threshold should not stream")
+	}
+	r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	if s.streamsBody(r) {
+		t.Fatal("multipart uploads are spooled, not streamed")
+	}
+}
+
+func TestNewServerWithConfigPerPoolSettings(t *testing.T) {
+	php, dir := newStandInPHP(t)
+	s, err := NewServerWithConfig(ServerConfig{
+		Fast:        PoolConfig{Workers: 2, MaxRequests: 100, RequestTimeout: time.Second},
+		Slow:        PoolConfig{Workers: 1, MaxRequests: 10, RequestTimeout: time.Minute, MaxLifetime: time.Hour},
+		PHPBinary:   php,
+		ProjectRoot: dir,
+	})
+	if err != nil {
+		t.Fatalf("NewServerWithConfig error: %v", err)
+	}
+	defer s.Shutdown(context.Background(), nil)
+
+	if len(s.fastPool.workers) != 2 || len(s.slowPool.workers) != 1 {
+		t.Fatalf("unexpected pool sizes: fast=%d slow=%d", len(s.fastPool.workers), len(s.slowPool.workers))
+	}
+	fw, sw := s.fastPool.workers[0], s.slowPool.workers[0]
+	if fw.maxRequests != 100 || fw.requestTimeout != time.Second || fw.maxLifetime != 0 {
+		t.Fatalf("fast worker misconfigured: max=%d timeout=%s lifetime=%s", fw.maxRequests, fw.requestTimeout, fw.maxLifetime)
+	}
+	if sw.maxRequests != 10 || sw.requestTimeout != time.Minute || sw.maxLifetime != time.Hour {
+		t.Fatalf("slow worker misconfigured: max=%d timeout=%s lifetime=%s", sw.maxRequests, sw.requestTimeout, sw.maxLifetime)
+	}
+	if len(s.slowCfg.Methods) == 0 {
+		t.Fatalf("expected slow request defaults to be applied")
+	}
+}
+
+func TestNewServerWithConfigPHPBinary(t *testing.T) {
+	_, err := NewServerWithConfig(ServerConfig{
+		Fast:      PoolConfig{Workers: 1},
+		PHPBinary: "/nonexistent/php",
+	})
+	if err == nil {
+		t.Fatalf("expected an error starting workers with a missing php binary")
+	}
+}
+
+func TestSetLoggerTagsPoolsAndWorkers(t *testing.T) {
+	s := &Server{
+		fastPool: newFakePool(t, 1, time.Second),
+		slowPool: newFakePool(t, 2, time.Second),
+	}
+	var buf bytes.Buffer
+	s.SetLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	s.slowPool.workers[1].log().Info("hello")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decode log line %q: %v", buf.String(), err)
+	}
+	if rec["pool"] != "slow" || rec["worker"] != float64(1) || rec["msg"] != "hello" {
+		t.Fatalf("unexpected log record: %v", rec)
+	}
+}
+
+func TestHandlerLogsWorkerErrorsAtConfiguredLevel(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}}
+	var buf bytes.Buffer
+	s.SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	NewHandler(s).ServeHTTP(httptest.NewRecorder(), r)
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decode log line %q: %v", buf.String(), err)
+	}
+	if rec["level"] != "ERROR" || rec["request_id"] != "req-1" || rec["pool"] != "fast" ||
+		rec["path"] != "/users" || rec["status"] != float64(http.StatusServiceUnavailable) {
+		t.Fatalf("unexpected log record: %v", rec)
+	}
+
+	buf.Reset()
+	s.SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})))
+	s.log().Info("filtered")
+	if buf.Len() != 0 {
+		t.Fatalf("info record logged at error level: %s", buf.String())
+	}
+}
+
+func TestShutdownLetsInFlightRequestsFinish(t *testing.T) {
+	w := newStallWorker(t, 0, func(stdout io.Writer) {
+		time.Sleep(50 * time.Millisecond)
+		body, _ := json.Marshal(ResponsePayload{ID: "1", Status: 200, Body: "done"})
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(body)))
+		stdout.Write(append(hdr[:], body...))
+	})
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetReady(true)
+
+	// two requests for one worker, both accepted but yet to pick a worker
+	// when the shutdown starts: neither may find it draining
+	var entered sync.WaitGroup
+	entered.Add(2)
+	gate := make(chan struct{})
+	h := NewHandler(s)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		entered.Done()
+		<-gate
+		h.ServeHTTP(rw, r)
+	}))
+	defer ts.Close()
+
+	res := make(chan string, 2)
+	for range 2 {
+		go func() {
+			resp, err := http.Get(ts.URL + "/slow")
+			if err != nil {
+				res <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			res <- strconv.Itoa(resp.StatusCode) + " " + string(b)
+		}()
+	}
+
+	entered.Wait()
+	time.AfterFunc(50*time.Millisecond, func() { close(gate) })
+	if err := s.Shutdown(context.Background(), ts.Config); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for range 2 {
+		if r := <-res; r != "200 done" {
+			t.Fatalf("request in flight during shutdown: %s", r)
+		}
+	}
+	if s.Ready() {
+		t.Fatal("still ready after Shutdown")
+	}
+	if !w.isDead() {
+		t.Fatal("the worker should be stopped once the handlers are done")
+	}
+}
+
+func TestShutdownKillsWorkersBusyPastTheDeadline(t *testing.T) {
+	started := make(chan struct{})
+	w := newStallWorker(t, 0, func(io.Writer) { close(started) }) // never answers
+	s := &Server{fastPool: &WorkerPool{workers: []*Worker{w}}, slowPool: &WorkerPool{}}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/"})
+		done <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx, nil); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Shutdown took %s past a 50ms deadline", d)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("a request cut off by shutdown should fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the busy worker was not killed")
+	}
+	if !w.isDead() {
+		t.Fatal("the busy worker should be dead")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetServerTiming adds a Server-Timing header to responses from PHP:
+// "queue" is the time from dispatch until the request went onto a
+// worker's pipe (route limits, a busy worker, a restart), "php" the time
+// until the worker answered, or sent the headers of a streamed response,
+// and "total" the time since the Handler started dispatching. The
+// timings reveal how busy the server is, so only turn this on for
+// debugging.
+func (s *Server) SetServerTiming(on bool) {
+	s.serverTiming = on
+}
+
+// requestTiming records where a dispatched request's time went. A nil
+// *requestTiming records nothing.
+type requestTiming struct {
+	start time.Time     // dispatch started
+	sent  time.Time     // the request went onto a worker's pipe; zero if it never did
+	php   time.Duration // from sent until the worker answered
+}
+
+// sending marks the request going onto a worker's pipe. A replayed
+// request starts over.
+func (t *requestTiming) sending() {
+	if t != nil {
+		t.sent = time.Now()
+		t.php = 0
+	}
+}
+
+// answered marks the worker's response, or the headers of a streamed
+// one, arriving.
+func (t *requestTiming) answered() {
+	if t != nil && !t.sent.IsZero() {
+		t.php = time.Since(t.sent)
+	}
+}
+
+// setHeader sets the Server-Timing header on h.
+func (t *requestTiming) setHeader(h http.Header) {
+	if t == nil {
+		return
+	}
+	var metrics []string
+	if !t.sent.IsZero() {
+		metrics = append(metrics, timingMetric("queue", t.sent.Sub(t.start)))
+		if t.php > 0 {
+			metrics = append(metrics, timingMetric("php", t.php))
+		}
+	}
+	metrics = append(metrics, timingMetric("total", time.Since(t.start)))
+	h.Set("Server-Timing", strings.Join(metrics, ", "))
+}
+
+// timingMetric formats a Server-Timing metric in milliseconds.
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000)
+}
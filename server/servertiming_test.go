@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var serverTimingRE = regexp.MustCompile(`^queue;dur=[0-9.]+, php;dur=[0-9.]+, total;dur=[0-9.]+$`)
+
+func TestServerTimingIsOptIn(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, time.Second),
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if got := rr.Header().Get("Server-Timing"); got != "" {
+		t.Fatalf("Server-Timing sent without being enabled: %q", got)
+	}
+
+	s.SetServerTiming(true)
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if got := rr.Header().Get("Server-Timing"); !serverTimingRE.MatchString(got) {
+		t.Fatalf("Server-Timing = %q", got)
+	}
+}
+
+func TestServerTimingOnStreamsAndErrors(t *testing.T) {
+	w := newFakeStreamWorker(t, http.StatusOK, nil, []string{" world"})
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetStreamConfig(StreamConfig{RoutePrefixes: []string{"/stream/"}})
+	s.SetServerTiming(true)
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream/logs", nil))
+	if got := rr.Header().Get("Server-Timing"); !serverTimingRE.MatchString(got) {
+		t.Fatalf("streamed Server-Timing = %q", got)
+	}
+
+	// no worker ever got the request: only the total is known
+	s = &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}, routeStats: make(map[string]*routeStats)}
+	s.SetServerTiming(true)
+	s.SetNoWorkerRetry(-1, 0)
+	rr = httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if got := rr.Header().Get("Server-Timing"); rr.Code != http.StatusServiceUnavailable || !regexp.MustCompile(`^total;dur=[0-9.]+$`).MatchString(got) {
+		t.Fatalf("error response: %d, Server-Timing = %q", rr.Code, got)
+	}
+}
+
+func TestRequestTimingQueue(t *testing.T) {
+	start := time.Now().Add(-50 * time.Millisecond)
+	rt := &requestTiming{start: start}
+	rt.sending()
+	rt.answered()
+
+	h := http.Header{}
+	rt.setHeader(h)
+	m := regexp.MustCompile(`^queue;dur=([0-9.]+), `).FindStringSubmatch(h.Get("Server-Timing"))
+	if m == nil {
+		t.Fatalf("no queue time: %q", h.Get("Server-Timing"))
+	}
+	if ms, _ := strconv.ParseFloat(m[1], 64); ms < 50 {
+		t.Fatalf("queue time should cover the wait before sending: %q", h.Get("Server-Timing"))
+	}
+
+	var none *requestTiming
+	none.sending()
+	none.answered()
+	none.setHeader(h) // no-op
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+)
+
+// SetSlowRequestLog logs, at WARN, each request a worker of the pool takes
+// at least threshold to serve, with its method, path, duration, worker
+// index and request ID: the pool's slow query log, which finds the
+// endpoints behind tail latency without logging every request. Each
+// attempt is timed on its own, so a request given back to another worker
+// (see ErrRetryElsewhere) is judged on the worker that served it. 0 turns
+// it off.
+func (p *WorkerPool) SetSlowRequestLog(threshold time.Duration) {
+	p.mu.Lock()
+	p.slowLog = max(threshold, 0)
+	p.mu.Unlock()
+}
+
+// logSlow logs req if w took long enough over it for the slow request log.
+func (p *WorkerPool) logSlow(w *Worker, req *RequestPayload, d time.Duration, err error) {
+	p.mu.Lock()
+	threshold, logger := p.slowLog, p.logger
+	p.mu.Unlock()
+	if threshold <= 0 || d < threshold {
+		return
+	}
+
+	if logger == nil {
+		logger = w.log()
+	}
+	id := req.ID
+	if ids := req.Headers["X-Request-Id"]; len(ids) > 0 {
+		// the id the access log and PHP see, not the internal one
+		id = ids[0]
+	}
+	attrs := []any{"method", req.Method, "path", req.Path, "duration", d, "worker", p.indexOf(w), "request_id", id, "threshold", threshold}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	logger.Warn("slow request", attrs...)
+}
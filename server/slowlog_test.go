@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowRequestLog(t *testing.T) {
+	w := newFakeWorker(t, "php0", time.Second)
+	defer w.stop()
+	pool := &WorkerPool{workers: []*Worker{w}}
+	buf := new(bytes.Buffer)
+	pool.SetLogger(slog.New(slog.NewJSONHandler(buf, nil)))
+
+	req := &RequestPayload{ID: "internal", Method: "GET", Path: "/report", Headers: map[string][]string{"X-Request-Id": {"abc"}}}
+	pool.SetSlowRequestLog(time.Hour)
+	if _, err := pool.Dispatch(req); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("a fast request was logged: %s", buf)
+	}
+
+	pool.SetSlowRequestLog(time.Nanosecond)
+	if _, err := pool.Dispatch(req); err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Level, Msg, Method, Path string
+		RequestID                string `json:"request_id"`
+		Worker                   int
+		Duration                 int64
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &line); err != nil {
+		t.Fatalf("expected one log line, got %q: %v", buf, err)
+	}
+	if line.Level != "WARN" || line.Msg != "slow request" || line.Method != "GET" || line.Path != "/report" ||
+		line.RequestID != "abc" || line.Worker != 0 || line.Duration <= 0 {
+		t.Fatalf("slow request line = %+v", line)
+	}
+
+	buf.Reset()
+	pool.SetSlowRequestLog(0)
+	pool.Dispatch(req)
+	if strings.Contains(buf.String(), "slow request") {
+		t.Fatal("the log should be off at 0")
+	}
+}
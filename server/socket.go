@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultDialTimeout bounds connecting to a worker that listens on a
+// socket (see WorkerConfig.Address).
+const DefaultDialTimeout = 5 * time.Second
+
+// parseWorkerAddress splits a worker address, "unix:///run/php/app.sock"
+// or "tcp://10.0.0.5:9000", into the network and address for net.Dial.
+// These are the forms php/worker.php takes in GO_PHP_LISTEN.
+func parseWorkerAddress(addr string) (network, address string, err error) {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("worker address %q: want unix:///path or tcp://host:port", addr)
+	}
+	switch network {
+	case "unix":
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("worker address %q: %w", addr, err)
+		}
+	default:
+		return "", "", fmt.Errorf("worker address %q: unsupported network %q", addr, network)
+	}
+	return network, address, nil
+}
+
+// dialStart returns a WorkerConfig.Start that connects to the worker
+// listening at addr. The connection carries both directions of the frame
+// protocol; closing it ends the session, and the listener serves the
+// next connection, the one a restart dials, from a fresh process.
+func dialStart(addr string) (func() (io.WriteCloser, io.ReadCloser, error), error) {
+	network, address, err := parseWorkerAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.WriteCloser, io.ReadCloser, error) {
+		conn, err := net.DialTimeout(network, address, DefaultDialTimeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn, nil
+	}, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveFakePHP answers each connection accepted on ln like newFakeWorker,
+// labelling them php0, php1, ... in accept order.
+func serveFakePHP(t *testing.T, ln net.Listener) {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			stdinR, stdinW := io.Pipe()
+			stdoutR, stdoutW := io.Pipe()
+			go func() {
+				io.Copy(stdinW, conn)
+				stdinW.Close()
+			}()
+			go func() {
+				io.Copy(conn, stdoutR)
+				conn.Close()
+			}()
+			go runFakePHP(stdinR, stdoutW, "php"+strconv.Itoa(n), 0)
+		}
+	}()
+}
+
+func TestParseWorkerAddress(t *testing.T) {
+	for addr, want := range map[string][2]string{
+		"unix:///run/php/app.sock": {"unix", "/run/php/app.sock"},
+		"tcp://10.0.0.5:9000":      {"tcp", "10.0.0.5:9000"},
+		"tcp6://[::1]:9000":        {"tcp6", "[::1]:9000"},
+	} {
+		network, address, err := parseWorkerAddress(addr)
+		if err != nil || network != want[0] || address != want[1] {
+			t.Errorf("parseWorkerAddress(%q) = %q, %q, %v", addr, network, address, err)
+		}
+	}
+	for _, addr := range []string{"", "/run/php/app.sock", "unix://", "tcp://10.0.0.5", "udp://10.0.0.5:9000"} {
+		if _, _, err := parseWorkerAddress(addr); err == nil {
+			t.Errorf("parseWorkerAddress(%q) should fail", addr)
+		}
+	}
+}
+
+func TestWorkerOverSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "php.sock")
+	unixLn, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveFakePHP(t, unixLn)
+	serveFakePHP(t, tcpLn)
+
+	for _, addr := range []string{"unix://" + sock, "tcp://" + tcpLn.Addr().String()} {
+		w, err := NewWorkerWithConfig(WorkerConfig{MaxRequests: 1000, RequestTimeout: time.Second, Address: addr})
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		resp, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/a"})
+		if err != nil || resp.Body != "php0:/a" {
+			t.Fatalf("%s: %+v, %v", addr, resp, err)
+		}
+
+		// a restart closes the connection and dials a new one
+		if err := w.restart(); err != nil {
+			t.Fatalf("%s: restart: %v", addr, err)
+		}
+		resp, err = w.Handle(&RequestPayload{ID: "2", Method: "GET", Path: "/b"})
+		if err != nil || resp.Body != "php1:/b" {
+			t.Fatalf("%s after restart: %+v, %v", addr, resp, err)
+		}
+		w.stop()
+	}
+}
+
+func TestWorkerAddressErrors(t *testing.T) {
+	if _, err := NewWorkerWithConfig(WorkerConfig{Address: "localhost:9000"}); err == nil {
+		t.Fatal("an address without a network should be rejected")
+	}
+	sock := filepath.Join(t.TempDir(), "nobody.sock")
+	if _, err := NewWorkerWithConfig(WorkerConfig{Address: "unix://" + sock}); err == nil {
+		t.Fatal("dialing a socket nobody listens on should fail")
+	}
+}
@@ -1,20 +1,61 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// DefaultSSEHeartbeat is how often an idle SSE stream gets a keepalive
+// comment, short enough to stay under typical proxy idle timeouts.
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// DefaultSSEBuffer is the per-client event buffer used when neither the
+// subscriber nor the channel asks for a specific size.
+const DefaultSSEBuffer = 16
+
+// DropPolicy decides what happens when an event arrives for a client whose
+// buffer is full.
+type DropPolicy int
+
+const (
+	// DropNewest discards the incoming event.
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest buffered event to make room.
+	DropOldest
+	// EvictClient unsubscribes the client, ending its stream, rather than
+	// let it miss events.
+	EvictClient
+)
+
+// SubscribeOptions tunes backpressure for a subscription.
+type SubscribeOptions struct {
+	Buffer int // events buffered per client; 0 means DefaultSSEBuffer
+	Policy DropPolicy
+}
+
 type sseEvent struct {
+	ID      uint64 // per-channel sequence number, assigned by the hub
 	Channel string
 	Event   string
 	Data    []byte
 }
 
 type sseClient struct {
-	ch   chan sseEvent
-	done chan struct{}
+	ch     chan sseEvent
+	done   chan struct{}
+	policy DropPolicy
+
+	// replay holds buffered events the client missed, to be sent before
+	// anything arriving on ch.
+	replay []sseEvent
 }
 
 // Ch returns the event channel for the client
@@ -27,17 +68,63 @@ func (c *sseClient) Done() <-chan struct{} {
 	return c.done
 }
 
+// SSEStats is a point-in-time view of an SSEHub.
+type SSEStats struct {
+	Subscribers int            `json:"subscribers"`
+	Channels    map[string]int `json:"channels"` // channel or pattern -> subscribers
+	Published   uint64         `json:"published"`
+	Dropped     uint64         `json:"dropped"` // events not delivered to a backed-up client
+	Evicted     uint64         `json:"evicted"` // clients disconnected by EvictClient
+}
+
+// SSEHub fans events out to Server-Sent Events subscribers.
+//
+// Events on a channel are numbered 1, 2, 3... in the order the hub
+// accepts them, and every client gets them in that order: one goroutine
+// numbers and delivers them, and each client's buffer is a queue. Events
+// a single goroutine publishes keep their order; those from concurrent
+// publishers are ordered by whichever Publish call the hub takes first.
+// A client that falls behind loses events under its DropPolicy but never
+// sees them reordered, so a jump in the IDs it receives (the SSE "id"
+// field) tells it how many it missed, e.g. to resync its state.
 type SSEHub struct {
 	mu       sync.RWMutex
 	clients  map[string]map[*sseClient]struct{} // channel -> set of clients
-	incoming chan sseEvent
+	patterns map[string]map[*sseClient]struct{} // glob pattern -> set of clients
+	incoming chan []sseEvent                    // events of one Publish or PublishBatch
+	stopped  chan struct{}                      // closed when run returns
+
+	// closeMu guards closed and keeps Close from closing incoming while a
+	// Publish is sending on it.
+	closeMu sync.RWMutex
+	closed  bool
+
+	seq               map[string]uint64     // channel -> last assigned event ID
+	history           map[string][]sseEvent // channel -> recent events, oldest first
+	replaySize        map[string]int        // per-channel history size overrides
+	defaultReplaySize int
+
+	heartbeat      time.Duration
+	channelOptions map[string]SubscribeOptions // per-channel subscription defaults
+
+	published uint64 // guarded by mu
+	dropped   uint64 // guarded by mu
+	evicted   uint64 // guarded by mu
 }
 
 // NewSSEHub creates a hub and starts its fanout goroutine
 func NewSSEHub() *SSEHub {
 	h := &SSEHub{
-		clients:  make(map[string]map[*sseClient]struct{}),
-		incoming: make(chan sseEvent, 256),
+		clients:    make(map[string]map[*sseClient]struct{}),
+		patterns:   make(map[string]map[*sseClient]struct{}),
+		incoming:   make(chan []sseEvent, 256),
+		stopped:    make(chan struct{}),
+		seq:        make(map[string]uint64),
+		history:    make(map[string][]sseEvent),
+		replaySize: make(map[string]int),
+		heartbeat:  DefaultSSEHeartbeat,
+
+		channelOptions: make(map[string]SubscribeOptions),
 	}
 
 	go h.run()
@@ -45,65 +132,493 @@ func NewSSEHub() *SSEHub {
 }
 
 func (h *SSEHub) run() {
-	for ev := range h.incoming {
-		h.mu.RLock()
-		subs := h.clients[ev.Channel]
+	defer close(h.stopped)
+
+	for batch := range h.incoming {
+		// a batch is fanned out under one lock, in order
+		h.mu.Lock()
+		for _, ev := range batch {
+			h.fanout(ev)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// fanout numbers ev, remembers it for replay and hands it to every
+// subscriber of its channel. Callers must hold h.mu.
+func (h *SSEHub) fanout(ev sseEvent) {
+	h.seq[ev.Channel]++
+	ev.ID = h.seq[ev.Channel]
+	h.remember(ev)
+	h.published++
+
+	for c := range h.clients[ev.Channel] {
+		h.deliver(h.clients, ev.Channel, c, ev)
+	}
+	// pattern subscribers are rare; skip matching entirely without them
+	for pattern, subs := range h.patterns {
+		if ok, _ := path.Match(pattern, ev.Channel); !ok {
+			continue
+		}
 		for c := range subs {
-			select {
-			case c.ch <- ev:
-			default:
-				// slow / backed-up clients drop events
+			h.deliver(h.patterns, pattern, c, ev)
+		}
+	}
+}
 
-			}
+// deliver hands ev to c without blocking, applying c's drop policy when
+// its buffer is full. set and key locate c's subscription for eviction.
+// Callers must hold h.mu.
+func (h *SSEHub) deliver(set map[string]map[*sseClient]struct{}, key string, c *sseClient, ev sseEvent) {
+	select {
+	case c.ch <- ev:
+		return
+	default:
+	}
+
+	h.dropped++
+	switch c.policy {
+	case DropOldest:
+		select {
+		case <-c.ch:
+		default:
 		}
-		h.mu.RUnlock()
+		select {
+		case c.ch <- ev:
+		default:
+		}
+	case EvictClient:
+		h.removeClient(set, key, c)
+		h.evicted++
 	}
 }
 
-// Subscribe returns a client subscribed to a channel.
-func (h *SSEHub) Subscribe(channel string) *sseClient {
-	c := &sseClient{
-		ch:   make(chan sseEvent, 16),
-		done: make(chan struct{}),
+// Stats reports subscriber counts and delivery totals.
+func (h *SSEHub) Stats() SSEStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := SSEStats{
+		Channels:  make(map[string]int, len(h.clients)+len(h.patterns)),
+		Published: h.published,
+		Dropped:   h.dropped,
+		Evicted:   h.evicted,
+	}
+	for _, set := range []map[string]map[*sseClient]struct{}{h.clients, h.patterns} {
+		for channel, subs := range set {
+			stats.Channels[channel] = len(subs)
+			stats.Subscribers += len(subs)
+		}
 	}
+	return stats
+}
 
+// isChannelPattern reports whether channel is a glob such as "orders.*"
+// rather than a literal channel name.
+func isChannelPattern(channel string) bool {
+	return strings.ContainsAny(channel, "*?[")
+}
+
+// subscribers returns the client set channel belongs to, exact or pattern.
+// Callers must hold h.mu.
+func (h *SSEHub) subscribers(channel string) map[string]map[*sseClient]struct{} {
+	if isChannelPattern(channel) {
+		return h.patterns
+	}
+	return h.clients
+}
+
+// remember appends ev to its channel's history, evicting the oldest event
+// once the buffer is full. Callers must hold h.mu.
+func (h *SSEHub) remember(ev sseEvent) {
+	size := h.replaySizeFor(ev.Channel)
+	if size <= 0 {
+		delete(h.history, ev.Channel)
+		return
+	}
+
+	buf := append(h.history[ev.Channel], ev)
+	if len(buf) > size {
+		buf = append(buf[:0:0], buf[len(buf)-size:]...)
+	}
+	h.history[ev.Channel] = buf
+}
+
+// replaySizeFor returns the history size for channel. Callers must hold h.mu.
+func (h *SSEHub) replaySizeFor(channel string) int {
+	if n, ok := h.replaySize[channel]; ok {
+		return n
+	}
+	return h.defaultReplaySize
+}
+
+// SetReplaySize sets how many recent events are kept for channel so that
+// reconnecting clients can catch up. 0 disables replay for the channel.
+func (h *SSEHub) SetReplaySize(channel string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.replaySize[channel] = n
+	h.trimHistory(channel)
+}
+
+// SetDefaultReplaySize sets the history size for channels without their
+// own SetReplaySize. It defaults to 0 (no replay).
+func (h *SSEHub) SetDefaultReplaySize(n int) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if h.clients[channel] == nil {
-		h.clients[channel] = make(map[*sseClient]struct{})
+	h.defaultReplaySize = n
+	for channel := range h.history {
+		h.trimHistory(channel)
 	}
-	h.clients[channel][c] = struct{}{}
+}
+
+// trimHistory shrinks channel's history to its configured size. Callers
+// must hold h.mu.
+func (h *SSEHub) trimHistory(channel string) {
+	size := h.replaySizeFor(channel)
+	buf := h.history[channel]
+	switch {
+	case size <= 0:
+		delete(h.history, channel)
+	case len(buf) > size:
+		h.history[channel] = append(buf[:0:0], buf[len(buf)-size:]...)
+	}
+}
+
+// SetHeartbeat sets how long a stream may stay quiet before the handler
+// writes a ": ping" comment to keep proxies from closing it. 0 disables
+// heartbeats.
+func (h *SSEHub) SetHeartbeat(d time.Duration) {
+	h.mu.Lock()
+	h.heartbeat = d
+	h.mu.Unlock()
+}
+
+// SetChannelOptions sets the buffer size and drop policy used for
+// subscriptions to channel (an exact name or a pattern) that don't pass
+// their own SubscribeOptions, including those made by the HTTP handler.
+func (h *SSEHub) SetChannelOptions(channel string, opts SubscribeOptions) {
+	h.mu.Lock()
+	h.channelOptions[channel] = opts
+	h.mu.Unlock()
+}
+
+// Subscribe returns a client subscribed to a channel. The channel may be a
+// glob pattern (path.Match syntax, e.g. "orders.*"), in which case the
+// client receives events from every matching channel. opts, if given,
+// overrides the channel's SubscribeOptions.
+func (h *SSEHub) Subscribe(channel string, opts ...SubscribeOptions) *sseClient {
+	return h.subscribe(channel, 0, false, opts)
+}
+
+// SubscribeSince subscribes to a channel and queues every buffered event
+// published after lastID for replay ahead of live events. If lastID is
+// newer than anything the hub has assigned (e.g. the server restarted),
+// the whole buffer is replayed. Event IDs are per channel, so pattern
+// subscriptions get no replay.
+func (h *SSEHub) SubscribeSince(channel string, lastID uint64, opts ...SubscribeOptions) *sseClient {
+	return h.subscribe(channel, lastID, true, opts)
+}
+
+func (h *SSEHub) subscribe(channel string, lastID uint64, replay bool, opts []SubscribeOptions) *sseClient {
+	h.closeMu.RLock()
+	defer h.closeMu.RUnlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	o := h.channelOptions[channel]
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Buffer <= 0 {
+		o.Buffer = DefaultSSEBuffer
+	}
+	c := &sseClient{
+		ch:     make(chan sseEvent, o.Buffer),
+		done:   make(chan struct{}),
+		policy: o.Policy,
+	}
+
+	if h.closed {
+		close(c.done)
+		return c
+	}
+
+	// Collecting the replay and registering the client under the same lock
+	// means nothing published in between is either missed or sent twice.
+	if replay && !isChannelPattern(channel) {
+		if lastID > h.seq[channel] {
+			lastID = 0
+		}
+		for _, ev := range h.history[channel] {
+			if ev.ID > lastID {
+				c.replay = append(c.replay, ev)
+			}
+		}
+	}
+
+	set := h.subscribers(channel)
+	if set[channel] == nil {
+		set[channel] = make(map[*sseClient]struct{})
+	}
+	set[channel][c] = struct{}{}
 	return c
 }
 
-// Unsubscribe Unsusbscribe removes a client from a channel and closes its done channel.
+// Unsubscribe removes a client from a channel and closes its done channel.
+// It is a no-op if the client was already removed (for example evicted).
 func (h *SSEHub) Unsubscribe(channel string, c *sseClient) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	subs := h.clients[channel]
-	if subs == nil {
+	h.removeClient(h.subscribers(channel), channel, c)
+}
+
+// removeClient drops c from set[key] and closes its done channel. Callers
+// must hold h.mu.
+func (h *SSEHub) removeClient(set map[string]map[*sseClient]struct{}, key string, c *sseClient) {
+	subs := set[key]
+	if _, ok := subs[c]; !ok {
 		return
 	}
 
 	delete(subs, c)
 	close(c.done)
 	if len(subs) == 0 {
-		delete(h.clients, channel)
+		delete(set, key)
 	}
 }
 
-// Publish JSON-encodes payload and broadcasts it to all subscribers
+// Publish JSON-encodes payload and broadcasts it to all subscribers. The
+// event is queued before Publish returns, so it is numbered and delivered
+// after anything the caller published earlier. It is a no-op once the
+// hub is closed.
 func (h *SSEHub) Publish(channel, event string, payload any) {
 	data, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("[sse] marshal error: %v", err)
+		slog.Error("sse publish: marshal failed", "channel", channel, "err", err)
+		return
+	}
+	h.enqueue([]sseEvent{{Channel: channel, Event: event, Data: data}})
+}
+
+// PublishBatch broadcasts each of payloads as its own event, in order,
+// for the cost of one Publish: the burst is queued and fanned out in a
+// single pass, and subscribers get it in one write. Payloads that fail to
+// encode are skipped. To send a burst as a single SSE event instead,
+// Publish the slice itself.
+func (h *SSEHub) PublishBatch(channel, event string, payloads []any) {
+	batch := make([]sseEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			slog.Error("sse publish: marshal failed", "channel", channel, "err", err)
+			continue
+		}
+		batch = append(batch, sseEvent{Channel: channel, Event: event, Data: data})
+	}
+	if len(batch) > 0 {
+		h.enqueue(batch)
+	}
+}
+
+// enqueue hands batch to the fanout goroutine unless the hub is closed.
+func (h *SSEHub) enqueue(batch []sseEvent) {
+	h.closeMu.RLock()
+	defer h.closeMu.RUnlock()
+	if h.closed {
 		return
 	}
-	h.incoming <- sseEvent{
-		Channel: channel,
-		Event:   event,
-		Data:    data,
+	h.incoming <- batch
+}
+
+// Close shuts the hub down: further Publish calls are ignored, the fanout
+// goroutine finishes delivering what was already queued and exits, and
+// every subscriber's Done channel is closed so their handlers return.
+// Subscribing after Close yields a client that is already done. Close is
+// safe to call more than once.
+func (h *SSEHub) Close() {
+	h.closeMu.Lock()
+	if h.closed {
+		h.closeMu.Unlock()
+		return
+	}
+	h.closed = true
+	close(h.incoming)
+	h.closeMu.Unlock()
+
+	<-h.stopped
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, set := range []map[string]map[*sseClient]struct{}{h.clients, h.patterns} {
+		for _, subs := range set {
+			for c := range subs {
+				close(c.done)
+			}
+		}
+	}
+	h.clients = make(map[string]map[*sseClient]struct{})
+	h.patterns = make(map[string]map[*sseClient]struct{})
+	h.history = make(map[string][]sseEvent)
+}
+
+// ServeHTTP streams the channel named by the "channel" query parameter to
+// the client as text/event-stream.
+func (h *SSEHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Handler(func(r *http.Request) string {
+		return r.URL.Query().Get("channel")
+	}).ServeHTTP(w, r)
+}
+
+// Handler returns an http.Handler that subscribes each client to the channel
+// returned by channelFor, streams events until the client disconnects and
+// then unsubscribes it.
+func (h *SSEHub) Handler(channelFor func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		channel := channelFor(r)
+		if channel == "" {
+			http.Error(w, "missing channel", http.StatusBadRequest)
+			return
+		}
+
+		var client *sseClient
+		if lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+			client = h.SubscribeSince(channel, lastID)
+		} else {
+			client = h.Subscribe(channel)
+		}
+		defer h.Unsubscribe(channel, client)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// initial comment so EventSource opens
+		_, _ = w.Write([]byte(": connected\n\n"))
+
+		for _, ev := range client.replay {
+			if err := writeSSEEvent(w, ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		h.mu.RLock()
+		interval := h.heartbeat
+		h.mu.RUnlock()
+
+		// heartbeat fires after interval of silence; it stays nil (and so
+		// never fires) when heartbeats are disabled
+		var (
+			timer     *time.Timer
+			heartbeat <-chan time.Time
+		)
+		if interval > 0 {
+			timer = time.NewTimer(interval)
+			defer timer.Stop()
+			heartbeat = timer.C
+		}
+
+		for {
+			select {
+			case ev := <-client.Ch():
+				if err := writeSSEEvent(w, ev); err != nil {
+					return
+				}
+				// a burst that is already buffered goes out in one flush
+				if err := writeBuffered(w, client); err != nil {
+					return
+				}
+				flusher.Flush()
+				if timer != nil {
+					resetTimer(timer, interval)
+				}
+			case <-heartbeat:
+				if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+					return
+				}
+				flusher.Flush()
+				timer.Reset(interval)
+			case <-r.Context().Done():
+				return
+			case <-client.Done():
+				return
+			}
+		}
+	})
+}
+
+// writeBuffered writes the events waiting in c's buffer, up to its size
+// so a steady stream can't hold back the flush.
+func writeBuffered(w io.Writer, c *sseClient) error {
+	for range cap(c.ch) {
+		select {
+		case ev := <-c.ch:
+			if err := writeSSEEvent(w, ev); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// resetTimer restarts t for d, discarding a tick that fired but was not
+// received yet.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
 	}
+	t.Reset(d)
+}
+
+// writeSSEEvent writes ev in text/event-stream wire format. The ID is sent
+// so EventSource reports it back as Last-Event-ID on reconnect. The event name
+// is emitted when set so browsers can addEventListener on it; data that
+// contains newlines is split across several data: lines, as the spec
+// requires, so the client reassembles it unchanged.
+func writeSSEEvent(w io.Writer, ev sseEvent) error {
+	var buf bytes.Buffer
+	if ev.ID != 0 {
+		buf.WriteString("id: ")
+		buf.WriteString(strconv.FormatUint(ev.ID, 10))
+		buf.WriteByte('\n')
+	}
+	if name := sseFieldValue(ev.Event); name != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+
+	data := bytes.ReplaceAll(ev.Data, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sseFieldValue strips line breaks from a single-line SSE field so a
+// caller-supplied value can't inject extra fields or end the event early.
+func sseFieldValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(v)
 }
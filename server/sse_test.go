@@ -1,8 +1,16 @@
 package server
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSSEHubSubscribeAndPublish(t *testing.T) {
@@ -25,10 +33,11 @@ func TestSSEHubSubscribeAndPublish(t *testing.T) {
 
 		var data map[string]any
 		if err := json.Unmarshal(ev.Data, &data); err != nil {
-			t.Fatalf("unmarshal error: %v", err)
+			t.Errorf("unmarshal error: %v", err)
+			return
 		}
 		if data["hello"] != "world" {
-			t.Fatalf("expected hello=world, got %v", data["hello"])
+			t.Errorf("expected hello=world, got %v", data["hello"])
 		}
 	}()
 
@@ -65,6 +74,595 @@ func TestSSEHubPublishWithUnmarshalableData(t *testing.T) {
 	// We can't easily test the log output, but we can ensure it doesn't crash
 }
 
+// waitForSubscribers polls until channel has n subscribers.
+func waitForSubscribers(t *testing.T, hub *SSEHub, channel string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		hub.mu.RLock()
+		got := len(hub.clients[channel])
+		hub.mu.RUnlock()
+		if got == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d subscribers on %q", n, channel)
+}
+
+// readSSEEvent reads lines up to the next blank line and returns them.
+func readSSEEvent(t *testing.T, br *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestSSEHubServeHTTPStreamsEvents(t *testing.T) {
+	hub := NewSSEHub()
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?channel=news")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	if got := readSSEEvent(t, br); len(got) != 1 || got[0] != ": connected" {
+		t.Fatalf("expected connected comment, got %q", got)
+	}
+
+	waitForSubscribers(t, hub, "news", 1)
+	hub.Publish("news", "update", map[string]string{"hello": "world"})
+
+	got := readSSEEvent(t, br)
+	want := []string{"id: 1", "event: update", `data: {"hello":"world"}`}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSSEHubServeHTTPMissingChannel(t *testing.T) {
+	hub := NewSSEHub()
+	rr := httptest.NewRecorder()
+	hub.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestSSEHubServeHTTPUnsubscribesOnDisconnect(t *testing.T) {
+	hub := NewSSEHub()
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?channel=gone")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	waitForSubscribers(t, hub, "gone", 1)
+
+	resp.Body.Close()
+	waitForSubscribers(t, hub, "gone", 0)
+}
+
+func TestWriteSSEEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   sseEvent
+		want string
+	}{
+		{"default event", sseEvent{Data: []byte(`{"a":1}`)}, "data: {\"a\":1}\n\n"},
+		{"named event", sseEvent{Event: "update", Data: []byte(`"x"`)}, "event: update\ndata: \"x\"\n\n"},
+		{"multiline data", sseEvent{Data: []byte("one\ntwo\r\nthree")}, "data: one\ndata: two\ndata: three\n\n"},
+		{"with id", sseEvent{ID: 42, Event: "tick", Data: []byte("1")}, "id: 42\nevent: tick\ndata: 1\n\n"},
+		{"event name injection", sseEvent{Event: "a\ndata: evil", Data: []byte("1")}, "event: adata: evil\ndata: 1\n\n"},
+	}
+
+	for _, tt := range tests {
+		var buf strings.Builder
+		if err := writeSSEEvent(&buf, tt.ev); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, buf.String())
+		}
+	}
+}
+
+// drainIDs reads n events from c and returns their IDs.
+func drainIDs(t *testing.T, c *sseClient, n int) []uint64 {
+	t.Helper()
+	var ids []uint64
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-c.ch:
+			ids = append(ids, ev.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d events", i, n)
+		}
+	}
+	return ids
+}
+
+func idsOf(events []sseEvent) []uint64 {
+	var ids []uint64
+	for _, ev := range events {
+		ids = append(ids, ev.ID)
+	}
+	return ids
+}
+
+func TestSSEHubReplaysEventsSinceLastID(t *testing.T) {
+	hub := NewSSEHub()
+	hub.SetReplaySize("feed", 3)
+
+	// a live subscriber lets us wait until the hub has processed each publish
+	watcher := hub.Subscribe("feed")
+	defer hub.Unsubscribe("feed", watcher)
+	for i := 0; i < 5; i++ {
+		hub.Publish("feed", "tick", i)
+	}
+	if got := drainIDs(t, watcher, 5); fmt.Sprint(got) != "[1 2 3 4 5]" {
+		t.Fatalf("expected sequential IDs, got %v", got)
+	}
+
+	c := hub.SubscribeSince("feed", 3)
+	defer hub.Unsubscribe("feed", c)
+	if got := idsOf(c.replay); fmt.Sprint(got) != "[4 5]" {
+		t.Fatalf("expected replay of [4 5], got %v", got)
+	}
+
+	// older than the buffer: replay what is left
+	old := hub.SubscribeSince("feed", 1)
+	defer hub.Unsubscribe("feed", old)
+	if got := idsOf(old.replay); fmt.Sprint(got) != "[3 4 5]" {
+		t.Fatalf("expected replay of [3 4 5], got %v", got)
+	}
+
+	// ahead of the hub (server restarted): replay everything
+	ahead := hub.SubscribeSince("feed", 99)
+	defer hub.Unsubscribe("feed", ahead)
+	if got := idsOf(ahead.replay); fmt.Sprint(got) != "[3 4 5]" {
+		t.Fatalf("expected full replay, got %v", got)
+	}
+}
+
+func TestSSEHubReplayDisabledByDefault(t *testing.T) {
+	hub := NewSSEHub()
+
+	watcher := hub.Subscribe("quiet")
+	defer hub.Unsubscribe("quiet", watcher)
+	hub.Publish("quiet", "tick", 1)
+	drainIDs(t, watcher, 1)
+
+	c := hub.SubscribeSince("quiet", 0)
+	defer hub.Unsubscribe("quiet", c)
+	if len(c.replay) != 0 {
+		t.Fatalf("expected no replay, got %v", idsOf(c.replay))
+	}
+}
+
+func TestSSEHubServeHTTPReplaysFromLastEventID(t *testing.T) {
+	hub := NewSSEHub()
+	hub.SetReplaySize("news", 10)
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	watcher := hub.Subscribe("news")
+	defer hub.Unsubscribe("news", watcher)
+	hub.Publish("news", "a", 1)
+	hub.Publish("news", "b", 2)
+	drainIDs(t, watcher, 2)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"?channel=news", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	readSSEEvent(t, br) // ": connected"
+
+	got := readSSEEvent(t, br)
+	want := []string{"id: 2", "event: b", "data: 2"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSSEHubServeHTTPHeartbeat(t *testing.T) {
+	hub := NewSSEHub()
+	hub.SetHeartbeat(20 * time.Millisecond)
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?channel=idle")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	readSSEEvent(t, br) // ": connected"
+
+	if got := readSSEEvent(t, br); len(got) != 1 || got[0] != ": ping" {
+		t.Fatalf("expected heartbeat comment, got %q", got)
+	}
+}
+
+func TestSSEHubPatternSubscription(t *testing.T) {
+	hub := NewSSEHub()
+
+	all := hub.Subscribe("orders.*")
+	defer hub.Unsubscribe("orders.*", all)
+	exact := hub.Subscribe("orders.created")
+	defer hub.Unsubscribe("orders.created", exact)
+
+	hub.Publish("orders.created", "new", 1)
+	hub.Publish("orders.shipped", "shipped", 2)
+	hub.Publish("users.created", "new", 3)
+
+	var channels []string
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-all.ch:
+			channels = append(channels, ev.Channel)
+		case <-time.After(time.Second):
+			t.Fatalf("pattern subscriber got %v, expected 2 events", channels)
+		}
+	}
+	if fmt.Sprint(channels) != "[orders.created orders.shipped]" {
+		t.Fatalf("unexpected channels for pattern subscriber: %v", channels)
+	}
+
+	if got := drainIDs(t, exact, 1); fmt.Sprint(got) != "[1]" {
+		t.Fatalf("exact subscriber expected event 1, got %v", got)
+	}
+	select {
+	case ev := <-exact.ch:
+		t.Fatalf("exact subscriber got unexpected event on %s", ev.Channel)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	hub.Unsubscribe("orders.*", all)
+	hub.mu.RLock()
+	n := len(hub.patterns)
+	hub.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("expected pattern set to be empty after unsubscribe, got %d", n)
+	}
+}
+
+func TestSSEHubClose(t *testing.T) {
+	hub := NewSSEHub()
+	exact := hub.Subscribe("a")
+	pattern := hub.Subscribe("a.*")
+
+	hub.Close()
+
+	for name, c := range map[string]*sseClient{"exact": exact, "pattern": pattern} {
+		select {
+		case <-c.Done():
+		default:
+			t.Fatalf("%s subscriber not signalled on Close", name)
+		}
+	}
+
+	select {
+	case <-hub.stopped:
+	default:
+		t.Fatal("fanout goroutine still running after Close")
+	}
+
+	// none of these may panic
+	hub.Publish("a", "late", 1)
+	hub.Unsubscribe("a", exact)
+	hub.Close()
+
+	late := hub.Subscribe("a")
+	select {
+	case <-late.Done():
+	default:
+		t.Fatal("subscribe after Close should return a finished client")
+	}
+}
+
+func TestSSEHubCloseEndsHandler(t *testing.T) {
+	hub := NewSSEHub()
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?channel=bye")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	waitForSubscribers(t, hub, "bye", 1)
+
+	hub.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream still open after Close")
+	}
+}
+
+func TestSSEHubStats(t *testing.T) {
+	hub := NewSSEHub()
+	a1 := hub.Subscribe("a")
+	a2 := hub.Subscribe("a")
+	all := hub.Subscribe("*")
+	defer hub.Close()
+
+	// nobody reads a1, so its 16-slot buffer overflows
+	for i := 0; i < 20; i++ {
+		hub.Publish("a", "tick", i)
+	}
+	drainIDs(t, a2, 16)
+	drainIDs(t, all, 16)
+
+	// wait for the fanout goroutine to finish the batch
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Stats().Published < 20 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stats := hub.Stats()
+	if stats.Subscribers != 3 {
+		t.Fatalf("expected 3 subscribers, got %d", stats.Subscribers)
+	}
+	if stats.Channels["a"] != 2 || stats.Channels["*"] != 1 {
+		t.Fatalf("unexpected per-channel counts: %v", stats.Channels)
+	}
+	if stats.Published != 20 {
+		t.Fatalf("expected 20 published, got %d", stats.Published)
+	}
+	if stats.Dropped < 4 {
+		t.Fatalf("expected at least 4 dropped events for the stalled client, got %d", stats.Dropped)
+	}
+
+	hub.Unsubscribe("a", a1)
+	if got := hub.Stats().Channels["a"]; got != 1 {
+		t.Fatalf("expected 1 subscriber on a after unsubscribe, got %d", got)
+	}
+}
+
+// publishAndSettle publishes n events on channel and waits until the hub has
+// fanned all of them out.
+func publishAndSettle(t *testing.T, hub *SSEHub, channel string, n int) {
+	t.Helper()
+	want := hub.Stats().Published + uint64(n)
+	for i := 0; i < n; i++ {
+		hub.Publish(channel, "tick", i)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Stats().Published < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub did not process %d events", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSSEHubSubscribeBufferSize(t *testing.T) {
+	hub := NewSSEHub()
+	defer hub.Close()
+
+	c := hub.Subscribe("big", SubscribeOptions{Buffer: 64})
+	if cap(c.ch) != 64 {
+		t.Fatalf("expected buffer 64, got %d", cap(c.ch))
+	}
+
+	hub.SetChannelOptions("small", SubscribeOptions{Buffer: 2})
+	if c := hub.Subscribe("small"); cap(c.ch) != 2 {
+		t.Fatalf("expected channel default buffer 2, got %d", cap(c.ch))
+	}
+	if c := hub.Subscribe("other"); cap(c.ch) != DefaultSSEBuffer {
+		t.Fatalf("expected default buffer %d, got %d", DefaultSSEBuffer, cap(c.ch))
+	}
+}
+
+func TestSSEHubDropPolicies(t *testing.T) {
+	tests := []struct {
+		policy  DropPolicy
+		wantIDs string
+	}{
+		{DropNewest, "[1 2]"},
+		{DropOldest, "[4 5]"},
+	}
+
+	for _, tt := range tests {
+		hub := NewSSEHub()
+		c := hub.Subscribe("burst", SubscribeOptions{Buffer: 2, Policy: tt.policy})
+		publishAndSettle(t, hub, "burst", 5)
+
+		if got := fmt.Sprint(drainIDs(t, c, 2)); got != tt.wantIDs {
+			t.Errorf("policy %d: expected %s, got %s", tt.policy, tt.wantIDs, got)
+		}
+		if d := hub.Stats().Dropped; d != 3 {
+			t.Errorf("policy %d: expected 3 dropped, got %d", tt.policy, d)
+		}
+		hub.Close()
+	}
+}
+
+func TestSSEHubEvictClient(t *testing.T) {
+	hub := NewSSEHub()
+	defer hub.Close()
+
+	c := hub.Subscribe("strict", SubscribeOptions{Buffer: 1, Policy: EvictClient})
+	publishAndSettle(t, hub, "strict", 2)
+
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("expected evicted client to be done")
+	}
+
+	stats := hub.Stats()
+	if stats.Evicted != 1 || stats.Subscribers != 0 {
+		t.Fatalf("expected 1 eviction and no subscribers, got %+v", stats)
+	}
+
+	// the handler's deferred Unsubscribe must not double-close done
+	hub.Unsubscribe("strict", c)
+}
+
+func TestSSEHubDeliversInPublishOrder(t *testing.T) {
+	hub := NewSSEHub()
+	defer hub.Close()
+
+	const publishers, each = 8, 50
+	c := hub.Subscribe("state", SubscribeOptions{Buffer: publishers * each})
+
+	var wg sync.WaitGroup
+	for p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range each {
+				if i%10 == 0 {
+					hub.PublishBatch("state", "set", []any{[2]int{p, i}})
+				} else {
+					hub.Publish("state", "set", [2]int{p, i})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	last := make([]int, publishers)
+	for p := range last {
+		last[p] = -1
+	}
+	for n := 1; n <= publishers*each; n++ {
+		ev := <-c.Ch()
+		if ev.ID != uint64(n) {
+			t.Fatalf("event %d has ID %d: IDs must follow delivery order", n, ev.ID)
+		}
+		var v [2]int
+		if err := json.Unmarshal(ev.Data, &v); err != nil {
+			t.Fatal(err)
+		}
+		if v[1] != last[v[0]]+1 {
+			t.Fatalf("publisher %d: got event %d after %d", v[0], v[1], last[v[0]])
+		}
+		last[v[0]] = v[1]
+	}
+}
+
+func TestSSEHubDropsShowAsIDGaps(t *testing.T) {
+	hub := NewSSEHub()
+	defer hub.Close()
+
+	c := hub.Subscribe("state", SubscribeOptions{Buffer: 2, Policy: DropNewest})
+	publishAndSettle(t, hub, "state", 4)
+	if got := fmt.Sprint(drainIDs(t, c, 2)); got != "[1 2]" {
+		t.Fatalf("expected [1 2], got %s", got)
+	}
+	publishAndSettle(t, hub, "state", 1)
+	if got := fmt.Sprint(drainIDs(t, c, 1)); got != "[5]" {
+		t.Fatalf("the client should see the gap left by the 2 dropped events, got %s", got)
+	}
+}
+
+func TestSSEHubPublishBatch(t *testing.T) {
+	hub := NewSSEHub()
+	defer hub.Close()
+
+	c := hub.Subscribe("rows")
+	p := hub.Subscribe("row*")
+	hub.PublishBatch("rows", "row", []any{1, func() {}, 2, 3})
+
+	if got := drainIDs(t, c, 3); fmt.Sprint(got) != "[1 2 3]" {
+		t.Fatalf("expected the batch in order, got %v", got)
+	}
+	if got := drainIDs(t, p, 3); fmt.Sprint(got) != "[1 2 3]" {
+		t.Fatalf("pattern subscribers should get the batch too, got %v", got)
+	}
+	if n := hub.Stats().Published; n != 3 {
+		t.Fatalf("the unencodable payload should be skipped, published %d", n)
+	}
+
+	hub.PublishBatch("rows", "row", nil) // nothing to send
+	hub.Close()
+	hub.PublishBatch("rows", "row", []any{4}) // no-op once closed
+}
+
+func TestSSEHubServeHTTPWritesBatch(t *testing.T) {
+	hub := NewSSEHub()
+	ts := httptest.NewServer(hub)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?channel=rows")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	readSSEEvent(t, br) // connected
+	waitForSubscribers(t, hub, "rows", 1)
+	hub.PublishBatch("rows", "row", []any{"a", "b", "c"})
+
+	for i, want := range []string{`data: "a"`, `data: "b"`, `data: "c"`} {
+		got := readSSEEvent(t, br)
+		if len(got) != 3 || got[0] != fmt.Sprintf("id: %d", i+1) || got[2] != want {
+			t.Fatalf("event %d: got %q", i, got)
+		}
+	}
+}
+
+func BenchmarkSSEHubPublishBatch(b *testing.B) {
+	hub := NewSSEHub()
+
+	for i := 0; i < 500; i++ {
+		c := hub.Subscribe("bench")
+		go func(cl *sseClient) {
+			for range cl.ch {
+				// discard
+			}
+		}(c)
+	}
+
+	batch := make([]any, 100)
+	for i := range batch {
+		batch[i] = map[string]int{"row": i}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		hub.PublishBatch("bench", "bench", batch)
+	}
+}
+
 func BenchmarkSSEHubPublish(b *testing.B) {
 	hub := NewSSEHub()
 
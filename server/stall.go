@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReadIdleTimeout is how long NewWorkerWithConfig lets a frame
+// stall halfway when WorkerConfig.ReadIdleTimeout is 0.
+const DefaultReadIdleTimeout = 10 * time.Second
+
+// readIdleTimeout applies the WorkerConfig.ReadIdleTimeout defaults.
+func readIdleTimeout(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultReadIdleTimeout
+	}
+	return max(d, 0)
+}
+
+// readFrame reads the next frame from r, the worker's stdout. Once the
+// first byte of a frame has arrived the rest must follow with no gap
+// longer than the read idle timeout; otherwise the worker is killed and
+// r closed. This catches a worker that wrote a length prefix and hung,
+// which would block the reader forever when there is no request timeout.
+// Waiting for a frame to start is not bounded here.
+//
+// When the frame was read into a recycled buffer, buf is that buffer:
+// the caller hands it back with w.frames.put once the frame is decoded,
+// and must not touch body after that. buf is nil otherwise.
+func (w *Worker) readFrame(r io.ReadCloser) (body []byte, buf *[]byte, err error) {
+	buf = w.frames.get()
+	var into []byte
+	if buf != nil {
+		into = *buf
+	}
+
+	var sr *stallReader
+	var src io.Reader = r
+	if w.readIdleTimeout > 0 {
+		sr = &stallReader{r: r, idle: w.readIdleTimeout, stall: func() {
+			w.recycled(RecycleTimeout)
+			w.markDead()
+			w.killProcess()
+			_ = r.Close()
+		}}
+		src = sr
+	}
+	body, err = readFrameInto(src, into)
+	if sr != nil && sr.stop() {
+		err = fmt.Errorf("%w: frame stalled for %s after %d bytes", ErrBadFrame, w.readIdleTimeout, sr.n)
+	}
+	if err != nil || len(body) > len(into) {
+		// nothing, or a frame too big for the buffer, was read into it
+		w.frames.put(buf)
+		buf = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, buf, nil
+}
+
+// stallReader calls stall when idle passes between two reads of a frame,
+// counting from the first byte.
+type stallReader struct {
+	r     io.Reader
+	idle  time.Duration
+	stall func()
+
+	timer *time.Timer
+	n     int // bytes read so far
+	fired atomic.Bool
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.n += n
+		if s.timer == nil {
+			s.timer = time.AfterFunc(s.idle, func() {
+				s.fired.Store(true)
+				s.stall()
+			})
+		} else {
+			s.timer.Reset(s.idle)
+		}
+	}
+	return n, err
+}
+
+// stop disarms the timer and reports whether it went off, in which case
+// the pipe is closed whatever the read returned.
+func (s *stallReader) stop() bool {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	return s.fired.Load()
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// newStallWorker returns a worker with no request timeout whose fake PHP
+// side answers each request by calling respond with its stdout.
+func newStallWorker(t *testing.T, idle time.Duration, respond func(stdout io.Writer)) *Worker {
+	t.Helper()
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() {
+		stdinR.Close()
+		stdoutW.Close()
+	})
+	go func() {
+		for {
+			if _, err := readFrame(stdinR); err != nil {
+				return
+			}
+			respond(stdoutW)
+		}
+	}()
+
+	return &Worker{
+		stdin:           stdinW,
+		stdout:          stdoutR,
+		maxRequests:     1000,
+		readIdleTimeout: idle,
+	}
+}
+
+func TestStalledFrameKillsWorker(t *testing.T) {
+	w := newStallWorker(t, 30*time.Millisecond, func(stdout io.Writer) {
+		// a length prefix and half a body, then nothing
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], 100)
+		stdout.Write(hdr[:])
+		stdout.Write([]byte(`{"status":`))
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Handle(&RequestPayload{ID: "1", Method: "POST", Path: "/"})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBadFrame) {
+			t.Fatalf("expected a bad frame error, got %v", err)
+		}
+		if mapWorkerErrorToStatus(err) != 502 {
+			t.Fatalf("a stalled frame should be a 502, got %d", mapWorkerErrorToStatus(err))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the read of a stalled frame never gave up")
+	}
+	if !w.isDead() {
+		t.Fatal("a worker that stalls mid-frame must be marked dead")
+	}
+}
+
+func TestSlowFramesWithinIdleTimeoutSucceed(t *testing.T) {
+	w := newStallWorker(t, 50*time.Millisecond, func(stdout io.Writer) {
+		// slow to start, then a frame trickling in with short gaps
+		time.Sleep(80 * time.Millisecond)
+		body, _ := json.Marshal(ResponsePayload{ID: "1", Status: 200, Body: "ok"})
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(body)))
+		stdout.Write(hdr[:])
+		for len(body) > 0 {
+			n := min(len(body), 8)
+			time.Sleep(10 * time.Millisecond)
+			stdout.Write(body[:n])
+			body = body[n:]
+		}
+	})
+
+	resp, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/"})
+	if err != nil || resp.Body != "ok" {
+		t.Fatalf("Handle: %+v, %v", resp, err)
+	}
+	if w.isDead() {
+		t.Fatal("a frame that keeps arriving is not a stall")
+	}
+}
+
+func TestReadIdleTimeoutDefaults(t *testing.T) {
+	for in, want := range map[time.Duration]time.Duration{
+		0:           DefaultReadIdleTimeout,
+		time.Second: time.Second,
+		-1:          0,
+	} {
+		if got := readIdleTimeout(in); got != want {
+			t.Errorf("readIdleTimeout(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticRule serves the files in Dir, relative to the project root, for
+// request paths starting with Prefix.
+type StaticRule struct {
+	Prefix string `json:"prefix"`
+	Dir    string `json:"dir"`
+
+	// Cache-Control sent with files from this rule, e.g.
+	// "public, max-age=31536000, immutable" for fingerprinted builds.
+	CacheControl string `json:"cache_control,omitempty"`
+
+	// Index is served for directory paths, e.g. "index.html".
+	Index string `json:"index,omitempty"`
+
+	// Fallback, relative to Dir, is served for paths under Prefix that
+	// don't exist, so a single-page app can route on the client. Index
+	// and Fallback files are sent with "Cache-Control: no-cache" rather
+	// than CacheControl, as they change with every build.
+	Fallback string `json:"spa_fallback,omitempty"`
+
+	// ContentTypes overrides the Content-Type of files by extension, e.g.
+	// {".wasm": "application/wasm"}, for types Go guesses wrong or not at
+	// all. The leading dot is optional.
+	ContentTypes map[string]string `json:"content_types,omitempty"`
+
+	// Precompressed serves file.br or file.gz in place of file when the
+	// client accepts that encoding and the sidecar exists, with the
+	// Content-Type of file and the matching Content-Encoding.
+	Precompressed bool `json:"precompressed,omitempty"`
+}
+
+// StaticFallback says when NewAppHandler gives the static rules a second
+// chance at a request PHP answered, for assets PHP doesn't know about.
+// Only paths under a rule's Prefix are ever handed back, so API routes
+// elsewhere keep their 404s; an app whose 404s under a static prefix are
+// meaningful can narrow it further or turn it off.
+type StaticFallback struct {
+	// Disabled leaves every PHP response as it is.
+	Disabled bool `json:"disabled,omitempty"`
+	// Statuses are the PHP statuses handed back; nil means just 404.
+	Statuses []int `json:"statuses,omitempty"`
+	// Methods are the request methods handed back; nil means any.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// wrap limits try to the requests f hands back to rules.
+func (f StaticFallback) wrap(rules []StaticRule, try TryServeFunc) TryServeFunc {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if f.Methods != nil && !slices.Contains(f.Methods, r.Method) {
+			return false
+		}
+		if !underStaticPrefix(rules, r.URL.Path) {
+			return false
+		}
+		return try(w, r)
+	}
+}
+
+// underStaticPrefix reports whether path is under one of the rules'
+// prefixes.
+func underStaticPrefix(rules []StaticRule, path string) bool {
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentType returns the Content-Type configured for the file at path,
+// or "" to let it be guessed.
+func (rule *StaticRule) contentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return ""
+	}
+	if ct, ok := rule.ContentTypes[ext]; ok {
+		return ct
+	}
+	return rule.ContentTypes[ext[1:]]
+}
+
+// ServeStatic returns a TryServeFunc serving files for rules, whose
+// directories are relative to root. NewAppHandler tries it before PHP and
+// again when PHP answers 404.
+func ServeStatic(root string, rules []StaticRule) TryServeFunc {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		return tryServeStatic(w, r, root, rules)
+	}
+}
+
+// tryServeStatic serves static assets based on rules.
+//
+// Other methods on a path that resolves to a static file are answered here
+// too: OPTIONS with the allowed methods, anything else with a 405. Paths
+// with no file behind them still go to PHP, which may own other routes
+// under the same prefix.
+func tryServeStatic(w http.ResponseWriter, r *http.Request, projectRoot string, rules []StaticRule) bool {
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	path := r.URL.Path
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(path, rule.Prefix) {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(path, rule.Prefix)
+		relPath = filepath.Clean(relPath)
+
+		baseDir := filepath.Join(projectRoot, rule.Dir)
+		fullPath := filepath.Join(baseDir, relPath)
+
+		// Prevent ../../ escapes (and sibling dirs sharing a name prefix)
+		if !isWithinDir(baseDir, fullPath) {
+			if !readOnly {
+				return false
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return true
+		}
+
+		info, err := os.Stat(fullPath)
+		if err == nil && !info.IsDir() {
+			if !readOnly {
+				staticMethodNotAllowed(w, r)
+				return true
+			}
+			serveStaticFile(w, r, &rule, fullPath, info, rule.CacheControl)
+			return true
+		}
+
+		if err == nil && rule.Index != "" {
+			indexPath := filepath.Join(fullPath, rule.Index)
+			if info, err := os.Stat(indexPath); err == nil && !info.IsDir() && isWithinDir(baseDir, indexPath) {
+				if !readOnly {
+					staticMethodNotAllowed(w, r)
+					return true
+				}
+				// relative links in the page need the trailing slash
+				if !strings.HasSuffix(path, "/") {
+					target := path + "/"
+					if r.URL.RawQuery != "" {
+						target += "?" + r.URL.RawQuery
+					}
+					http.Redirect(w, r, target, http.StatusMovedPermanently)
+					return true
+				}
+				serveStaticFile(w, r, &rule, indexPath, info, "no-cache")
+				return true
+			}
+		}
+
+		// single-page apps route on the client: unknown paths get the app
+		if readOnly && errors.Is(err, os.ErrNotExist) && rule.Fallback != "" {
+			fallback := filepath.Join(baseDir, rule.Fallback)
+			if info, err := os.Stat(fallback); err == nil && !info.IsDir() && isWithinDir(baseDir, fallback) {
+				serveStaticFile(w, r, &rule, fallback, info, "no-cache")
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// staticAllow lists the methods a static file supports.
+const staticAllow = "GET, HEAD, OPTIONS"
+
+// staticMethodNotAllowed answers a non-GET/HEAD request for a static
+// file: OPTIONS gets the allowed methods, anything else a 405.
+func staticMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", staticAllow)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// serveStaticFile serves the file at fullPath, or the precompressed
+// variant of it the client takes, with its ETag and the given
+// Cache-Control (none if empty).
+func serveStaticFile(w http.ResponseWriter, r *http.Request, rule *StaticRule, fullPath string, info os.FileInfo, cacheControl string) {
+	servePath := fullPath
+	ctype := rule.contentType(fullPath)
+	if rule.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if path, encoding, vinfo := precompressedVariant(r, fullPath); path != "" {
+			servePath, info = path, vinfo
+			w.Header().Set("Content-Encoding", encoding)
+			// ServeFile would take the type from the sidecar's name or bytes
+			if ctype == "" {
+				ctype = mime.TypeByExtension(filepath.Ext(fullPath))
+			}
+			if ctype == "" {
+				ctype = sniffContentType(fullPath)
+			}
+		}
+	}
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	// ServeFile answers If-None-Match / If-Range from the ETag we set
+	if tag, err := staticETags.get(servePath, info); err == nil {
+		w.Header().Set("ETag", tag)
+	} else {
+		slog.Warn("static etag failed", "path", servePath, "err", err)
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	http.ServeFile(w, r, servePath)
+}
+
+// precompressedEncodings are the sidecar files a Precompressed rule looks
+// for, in order of preference.
+var precompressedEncodings = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedVariant returns the sidecar of fullPath in the encoding the
+// client prefers among those it accepts, or "" if there is none.
+func precompressedVariant(r *http.Request, fullPath string) (string, string, os.FileInfo) {
+	accept := r.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return "", "", nil
+	}
+	var best, bestEncoding string
+	var bestInfo os.FileInfo
+	bestQ := 0.0
+	for _, pc := range precompressedEncodings {
+		q := encodingQ(accept, pc.encoding)
+		if q <= bestQ {
+			continue
+		}
+		path := fullPath + pc.ext
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			best, bestEncoding, bestInfo, bestQ = path, pc.encoding, info, q
+		}
+	}
+	return best, bestEncoding, bestInfo
+}
+
+// encodingQ returns the quality an Accept-Encoding header gives encoding,
+// falling back to "*"; 0 means not acceptable.
+func encodingQ(accept, encoding string) float64 {
+	q, anyQ := -1.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		pq := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				pq = f
+			}
+		}
+		switch name = strings.ToLower(strings.TrimSpace(name)); {
+		case name == encoding || (encoding == "gzip" && name == "x-gzip"):
+			q = pq
+		case name == "*":
+			anyQ = pq
+		}
+	}
+	if q < 0 {
+		return anyQ
+	}
+	return q
+}
+
+// sniffContentType guesses the Content-Type of the file at path from its
+// first bytes, as ServeFile does.
+func sniffContentType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	return http.DetectContentType(buf[:n])
+}
+
+// etagCache remembers content-hash ETags of static files, keyed by path
+// and invalidated when the file's mtime or size changes.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	tag     string
+}
+
+var staticETags = &etagCache{entries: make(map[string]etagEntry)}
+
+// get returns the strong ETag for the file at path, hashing it only when
+// it isn't cached for info's mtime and size.
+func (c *etagCache) get(path string, info os.FileInfo) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+		return e.tag, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	tag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+
+	c.mu.Lock()
+	c.entries[path] = etagEntry{modTime: info.ModTime(), size: info.Size(), tag: tag}
+	c.mu.Unlock()
+	return tag, nil
+}
+
+// isWithinDir reports whether path is baseDir itself or lies below it.
+// It compares whole path elements, so /app/public/css-secrets is not
+// considered to be inside /app/public/css.
+func isWithinDir(baseDir, path string) bool {
+	rel, err := filepath.Rel(baseDir, path)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
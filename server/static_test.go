@@ -0,0 +1,408 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTryServeStaticServesFile(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "public", "assets")
+	if err := os.MkdirAll(staticDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	const fileContent = "hello world"
+	if err := os.WriteFile(filepath.Join(staticDir, "test.txt"), []byte(fileContent), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/assets/test.txt", nil)
+	w := httptest.NewRecorder()
+
+	rules := []StaticRule{
+		{Prefix: "/assets/", Dir: "public/assets"},
+	}
+
+	served := tryServeStatic(w, r, root, rules)
+	if !served {
+		t.Fatalf("expected tryServeStatic to return true")
+	}
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != fileContent {
+		t.Fatalf("unexpected body: %q", string(body))
+	}
+}
+
+func TestTryServeStaticWrongMethod(t *testing.T) {
+	root := t.TempDir()
+	r := httptest.NewRequest(http.MethodPost, "/assets/test.txt", nil)
+	w := httptest.NewRecorder()
+
+	served := tryServeStatic(w, r, root, []StaticRule{
+		{Prefix: "/assets/", Dir: "public/assets"},
+	})
+	if served {
+		t.Fatalf("expected tryServeStatic to return false for non-GET/HEAD")
+	}
+}
+
+func TestTryServeStaticOtherMethodsOnFiles(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "public", "assets")
+	if err := os.MkdirAll(staticDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(staticDir, "app.js"), []byte("js"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	rules := []StaticRule{{Prefix: "/assets/", Dir: "public/assets"}}
+
+	w := httptest.NewRecorder()
+	if !tryServeStatic(w, httptest.NewRequest(http.MethodPost, "/assets/app.js", nil), root, rules) {
+		t.Fatal("POST to a static file should be answered without PHP")
+	}
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("expected 405 with Allow, got %d Allow=%q", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	if !tryServeStatic(w, httptest.NewRequest(http.MethodOptions, "/assets/app.js", nil), root, rules) {
+		t.Fatal("OPTIONS on a static file should be answered without PHP")
+	}
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("expected 204 with Allow, got %d Allow=%q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestTryServeStaticDirectoryTraversal(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "public", "assets")
+	if err := os.MkdirAll(staticDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/assets/../../etc/passwd", nil)
+	w := httptest.NewRecorder()
+
+	served := tryServeStatic(w, r, root, []StaticRule{
+		{Prefix: "/assets/", Dir: "public/assets"},
+	})
+	if !served {
+		t.Fatalf("expected tryServeStatic to return true (handled with 403)")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
+
+func TestTryServeStaticEncodedTraversal(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "public", "assets"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/assets/%2e%2e/%2e%2e/secret.txt", nil)
+	w := httptest.NewRecorder()
+
+	served := tryServeStatic(w, r, root, []StaticRule{
+		{Prefix: "/assets/", Dir: "public/assets"},
+	})
+	if !served || w.Code != http.StatusForbidden {
+		t.Fatalf("expected encoded traversal to be rejected with 403, got served=%v code=%d", served, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("file outside the static dir leaked: %q", w.Body.String())
+	}
+}
+
+func TestTryServeStaticSiblingPrefixDir(t *testing.T) {
+	root := t.TempDir()
+	cssDir := filepath.Join(root, "public", "css")
+	secretsDir := filepath.Join(root, "public", "css-secrets")
+	for _, dir := range []string{cssDir, secretsDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(secretsDir, "key.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/css/../css-secrets/key.txt", nil)
+	w := httptest.NewRecorder()
+
+	served := tryServeStatic(w, r, root, []StaticRule{
+		{Prefix: "/css/", Dir: "public/css"},
+	})
+	if !served || w.Code != http.StatusForbidden {
+		t.Fatalf("expected sibling-prefix dir to be rejected with 403, got served=%v code=%d", served, w.Code)
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	base := filepath.Join("app", "public", "css")
+
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{filepath.Join(base, "site.css"), true},
+		{filepath.Join(base, "nested", "a.css"), true},
+		{base, true},
+		{filepath.Join("app", "public", "css-secrets", "key.txt"), false},
+		{filepath.Join("app", "public"), false},
+		{filepath.Join(base, "..", "..", "etc", "passwd"), false},
+		{filepath.Join(base, "..foo"), true},
+	}
+
+	for _, c := range cases {
+		if got := isWithinDir(base, c.path); got != c.want {
+			t.Fatalf("isWithinDir(%q, %q) = %v, want %v", base, c.path, got, c.want)
+		}
+	}
+}
+
+func TestTryServeStaticNotFound(t *testing.T) {
+	root := t.TempDir()
+	r := httptest.NewRequest(http.MethodGet, "/assets/nonexistent.txt", nil)
+	w := httptest.NewRecorder()
+
+	served := tryServeStatic(w, r, root, []StaticRule{
+		{Prefix: "/assets/", Dir: "public/assets"},
+	})
+	if served {
+		t.Fatalf("expected tryServeStatic to return false for nonexistent file")
+	}
+}
+
+func TestTryServeStaticIndexAndSPAFallback(t *testing.T) {
+	root := t.TempDir()
+	appDir := filepath.Join(root, "public", "app")
+	if err := os.MkdirAll(filepath.Join(appDir, "docs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, content := range map[string]string{
+		"index.html":      "app shell",
+		"docs/index.html": "docs index",
+		"main.js":         "js",
+	} {
+		if err := os.WriteFile(filepath.Join(appDir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	rules := []StaticRule{{
+		Prefix:       "/app/",
+		Dir:          "public/app",
+		CacheControl: "max-age=31536000, immutable",
+		Index:        "index.html",
+		Fallback:     "index.html",
+	}}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if !tryServeStatic(w, httptest.NewRequest(http.MethodGet, path, nil), root, rules) {
+			t.Fatalf("%s was not served", path)
+		}
+		return w
+	}
+
+	if w := get("/app/docs/"); w.Body.String() != "docs index" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("index: %d %q (%s)", w.Code, w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+	if w := get("/app/docs?x=1"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/app/docs/?x=1" {
+		t.Fatalf("directory without slash: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := get("/app/users/42"); w.Code != http.StatusOK || w.Body.String() != "app shell" {
+		t.Fatalf("fallback: %d %q", w.Code, w.Body.String())
+	}
+	if w := get("/app/main.js"); w.Body.String() != "js" || w.Header().Get("Cache-Control") != "max-age=31536000, immutable" {
+		t.Fatalf("asset: %q (%s)", w.Body.String(), w.Header().Get("Cache-Control"))
+	}
+
+	// traversal is still refused, not answered with the fallback
+	w := get("/app/../../go.mod")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("traversal: %d", w.Code)
+	}
+}
+
+func TestTryServeStaticFallbackMustStayInDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "public"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	w := httptest.NewRecorder()
+	served := tryServeStatic(w, httptest.NewRequest(http.MethodGet, "/app/missing", nil), root, []StaticRule{
+		{Prefix: "/app/", Dir: "public", Fallback: "../secret.txt"},
+	})
+	if served {
+		t.Fatalf("fallback outside the rule's dir was served: %q", w.Body.String())
+	}
+}
+
+func TestTryServeStaticETagAndCacheControl(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "public", "build")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	file := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(file, []byte("console.log(1)"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	rules := []StaticRule{
+		{Prefix: "/build/", Dir: "public/build", CacheControl: "public, max-age=31536000, immutable"},
+	}
+
+	w := httptest.NewRecorder()
+	tryServeStatic(w, httptest.NewRequest(http.MethodGet, "/build/app.js", nil), root, rules)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("expected 200 with a strong ETag, got %d %q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != rules[0].CacheControl {
+		t.Fatalf("unexpected Cache-Control %q", got)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/build/app.js", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	tryServeStatic(w, r, root, rules)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected empty 304 for matching If-None-Match, got %d (%d bytes)", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("expected Cache-Control on the 304 too")
+	}
+
+	// new content (and mtime) must produce a new ETag
+	if err := os.WriteFile(file, []byte("console.log(2)"), 0o644); err != nil {
+		t.Fatalf("rewrite file: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	w = httptest.NewRecorder()
+	tryServeStatic(w, r, root, rules)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected a fresh 200 with a new ETag after the file changed, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestTryServeStaticContentTypes(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "public")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, name := range []string{"app.wasm", "photo.AVIF", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	rules := []StaticRule{{Prefix: "/", Dir: "public", ContentTypes: map[string]string{
+		".wasm": "application/wasm",
+		"avif":  "image/avif",
+	}}}
+
+	for path, want := range map[string]string{
+		"/app.wasm":   "application/wasm",
+		"/photo.AVIF": "image/avif",
+		"/notes.txt":  "text/plain; charset=utf-8",
+	} {
+		w := httptest.NewRecorder()
+		tryServeStatic(w, httptest.NewRequest(http.MethodGet, path, nil), root, rules)
+		if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != want {
+			t.Errorf("%s: %d with Content-Type %q, want %q", path, w.Code, got, want)
+		}
+	}
+}
+
+func TestTryServeStaticPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "public")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, content := range map[string]string{
+		"app.css":    "body{}",
+		"app.css.br": "brotli bytes",
+		"app.css.gz": "gzip bytes",
+		"plain.js":   "alert(1)",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write file: %v", err)
+		}
+	}
+	rules := []StaticRule{{Prefix: "/", Dir: "public", Precompressed: true}}
+
+	for _, tc := range []struct{ path, accept, encoding, body string }{
+		{"/app.css", "gzip, deflate, br", "br", "brotli bytes"},
+		{"/app.css", "gzip", "gzip", "gzip bytes"},
+		{"/app.css", "br;q=0, *", "gzip", "gzip bytes"},
+		{"/app.css", "br;q=0.5, gzip", "gzip", "gzip bytes"},
+		{"/app.css", "", "", "body{}"},
+		{"/app.css", "identity", "", "body{}"},
+		{"/plain.js", "br, gzip", "", "alert(1)"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept-Encoding", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		tryServeStatic(w, r, root, rules)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != tc.encoding || w.Body.String() != tc.body {
+			t.Errorf("%s with %q: %d %q %q, want %q %q", tc.path, tc.accept, w.Code, w.Header().Get("Content-Encoding"), w.Body.String(), tc.encoding, tc.body)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s with %q: missing Vary: Accept-Encoding", tc.path, tc.accept)
+		}
+		if tc.path == "/app.css" && !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+			t.Errorf("%s with %q: Content-Type %q", tc.path, tc.accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestStaticFallbackOnlyUnderPrefixes(t *testing.T) {
+	var tried []string
+	try := func(w http.ResponseWriter, r *http.Request) bool {
+		tried = append(tried, r.Method+" "+r.URL.Path)
+		return true
+	}
+	rules := []StaticRule{{Prefix: "/assets/", Dir: "public/assets"}}
+
+	all := StaticFallback{}.wrap(rules, try)
+	if all(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/users/1", nil)) {
+		t.Fatal("an API route's 404 was handed to the static rules")
+	}
+	if !all(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/assets/app.js", nil)) {
+		t.Fatal("without Methods, any method under a prefix falls back")
+	}
+
+	getOnly := StaticFallback{Methods: []string{http.MethodGet}}.wrap(rules, try)
+	if getOnly(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/assets/app.js", nil)) {
+		t.Fatal("a POST fell back with Methods GET")
+	}
+	getOnly(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/assets/app.js", nil))
+
+	if want := []string{"POST /assets/app.js", "GET /assets/app.js"}; !slices.Equal(tried, want) {
+		t.Fatalf("tried %v, want %v", tried, want)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Bounds on the stderr kept per worker, so a chatty process can't turn
+// an error message into a dump of its output.
+const (
+	stderrTailLines   = 5
+	stderrTailLineMax = 512
+)
+
+// stderrTail passes a worker's stderr through to out and remembers the
+// last few lines, so errors about the worker can say what PHP printed
+// before it hung or died.
+//
+// Writes to out happen on a goroutine of their own, so the pipe is always
+// drained however slow out is: a PHP process blocked writing to stderr
+// stops reading its stdin, and Go, blocked writing a request to it, would
+// wait forever. What out can't keep up with is dropped, with a note.
+type stderrTail struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	lines   []string // oldest first, at most stderrTailLines
+	partial []byte   // current unterminated line, at most stderrTailLineMax
+	pending []byte   // waiting to go to out, at most stderrPendingMax
+	dropped int      // bytes dropped since out last kept up
+	writing bool     // a goroutine is writing pending to out
+	idle    sync.Cond
+}
+
+// stderrPendingMax bounds the stderr held for a slow out, besides what
+// out is already being given.
+const stderrPendingMax = 1 << 20
+
+func newStderrTail(out io.Writer) *stderrTail {
+	t := &stderrTail{out: out}
+	t.idle.L = &t.mu
+	return t
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	n := len(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.out != nil {
+		t.queue(p)
+	}
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if room := stderrTailLineMax - len(t.partial); room > 0 {
+			t.partial = append(t.partial, chunk[:min(room, len(chunk))]...)
+		}
+		if i < 0 {
+			break
+		}
+		t.push(string(t.partial))
+		t.partial = t.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// queue hands p to the goroutine writing to out, starting it if need be;
+// t.mu must be held.
+func (t *stderrTail) queue(p []byte) {
+	if len(t.pending)+len(p) > stderrPendingMax {
+		t.dropped += len(p)
+		return
+	}
+	t.pending = append(t.pending, p...)
+	if !t.writing {
+		t.writing = true
+		go t.drain()
+	}
+}
+
+// drain writes what is pending to out until nothing is.
+func (t *stderrTail) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.pending) > 0 || t.dropped > 0 {
+		p := t.pending
+		if t.dropped > 0 {
+			p = fmt.Appendf(p, "[go-php: dropped %d bytes of worker stderr, the log can't keep up]\n", t.dropped)
+		}
+		t.pending, t.dropped = nil, 0
+		t.mu.Unlock()
+		// the log is best effort; a failed write mustn't break the pipe
+		_, _ = t.out.Write(p)
+		t.mu.Lock()
+	}
+	t.writing = false
+	t.idle.Broadcast()
+}
+
+// flush waits for everything written so far to reach out.
+func (t *stderrTail) flush() {
+	t.mu.Lock()
+	for t.writing {
+		t.idle.Wait()
+	}
+	t.mu.Unlock()
+}
+
+// push appends a complete line, dropping blank ones; t.mu must be held.
+func (t *stderrTail) push(line string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > stderrTailLines {
+		t.lines = t.lines[len(t.lines)-stderrTailLines:]
+	}
+}
+
+// Lines returns the remembered lines, oldest first, including a trailing
+// line that hasn't been terminated yet.
+func (t *stderrTail) Lines() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string(nil), t.lines...)
+	if last := strings.TrimSpace(string(t.partial)); last != "" {
+		lines = append(lines, string(t.partial))
+	}
+	if len(lines) > stderrTailLines {
+		lines = lines[len(lines)-stderrTailLines:]
+	}
+	return lines
+}
+
+// Reset forgets everything, e.g. when a new process takes over.
+func (t *stderrTail) Reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.lines = nil
+	t.partial = t.partial[:0]
+	t.mu.Unlock()
+}
+
+// withStderr adds the worker's recent stderr to timeout, broken pipe and
+// dead-worker errors, which otherwise say nothing about why PHP stopped
+// answering. Other errors, and errors from a worker with nothing on
+// stderr, are returned as is. The result still matches err with
+// errors.Is.
+func (w *Worker) withStderr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrWorkerTimeout) && !errors.Is(err, ErrWorkerDead) && !isBrokenPipe(err) {
+		return err
+	}
+	lines := w.stderr.Lines()
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (stderr: %s)", err, strings.Join(lines, " | "))
+}
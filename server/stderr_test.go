@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStderrTailKeepsLastLines(t *testing.T) {
+	var out bytes.Buffer
+	tail := newStderrTail(&out)
+
+	for i := range 8 {
+		fmt.Fprintf(tail, "line %d\n", i)
+	}
+	// lines can arrive split across writes
+	fmt.Fprint(tail, "Fatal error: ")
+	fmt.Fprint(tail, "out of memory")
+
+	want := []string{"line 4", "line 5", "line 6", "line 7", "Fatal error: out of memory"}
+	if got := tail.Lines(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("Lines() = %q, want %q", got, want)
+	}
+	tail.flush()
+	if !strings.HasPrefix(out.String(), "line 0\n") {
+		t.Fatalf("stderr should still be passed through, got %q", out.String())
+	}
+
+	tail.Reset()
+	if got := tail.Lines(); len(got) != 0 {
+		t.Fatalf("Lines() after Reset = %q", got)
+	}
+}
+
+func TestStderrTailBoundsLongLines(t *testing.T) {
+	tail := newStderrTail(nil)
+	fmt.Fprintln(tail, strings.Repeat("x", 10*stderrTailLineMax))
+
+	lines := tail.Lines()
+	if len(lines) != 1 || len(lines[0]) != stderrTailLineMax {
+		t.Fatalf("long line not truncated: %d lines, %d bytes", len(lines), len(lines[0]))
+	}
+}
+
+// blockingWriter is a log sink that takes nothing until released.
+type blockingWriter struct {
+	release chan struct{}
+	got     bytes.Buffer
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+	return b.got.Write(p)
+}
+
+func TestStderrTailNeverBlocksOnSlowLog(t *testing.T) {
+	out := &blockingWriter{release: make(chan struct{})}
+	tail := newStderrTail(out)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		line := strings.Repeat("x", 1023) + "\n"
+		for range 4 * stderrPendingMax / len(line) {
+			fmt.Fprint(tail, line)
+		}
+		fmt.Fprintln(tail, "PHP Fatal error: the last one")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing stderr waited for the log")
+	}
+	if lines := tail.Lines(); lines[len(lines)-1] != "PHP Fatal error: the last one" {
+		t.Fatalf("Lines() = %q", lines)
+	}
+
+	close(out.release)
+	tail.flush()
+	// one batch was already on its way to the log when it blocked
+	if got := out.got.Len(); got > 2*stderrPendingMax+1024 {
+		t.Fatalf("%d bytes held for the log, want at most about %d", got, 2*stderrPendingMax)
+	}
+	if !strings.Contains(out.got.String(), "bytes of worker stderr") {
+		t.Fatal("the log should say stderr was dropped")
+	}
+}
+
+func TestWorkerTimeoutIncludesStderr(t *testing.T) {
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() { stdoutW.Close() })
+
+	w := &Worker{
+		stdin:          nopWriteCloser{Writer: io.Discard},
+		stdout:         stdoutR, // never answers
+		stderr:         newStderrTail(nil),
+		maxRequests:    1000,
+		requestTimeout: 10 * time.Millisecond,
+	}
+	fmt.Fprintln(w.stderr, "PHP Warning: waiting for lock on table users")
+
+	_, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/slow"})
+	if !errors.Is(err, ErrWorkerTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "waiting for lock on table users") {
+		t.Fatalf("timeout error should carry the worker's stderr: %v", err)
+	}
+
+	// and so does the next request to the dead worker
+	_, err = w.Handle(&RequestPayload{ID: "2", Method: "GET", Path: "/"})
+	if !errors.Is(err, ErrWorkerDead) || !strings.Contains(err.Error(), "waiting for lock") {
+		t.Fatalf("dead worker error should carry stderr: %v", err)
+	}
+}
+
+func TestWithStderrLeavesOtherErrorsAlone(t *testing.T) {
+	w := &Worker{stderr: newStderrTail(nil)}
+	fmt.Fprintln(w.stderr, "noise")
+
+	other := errors.New("invalid frame")
+	if got := w.withStderr(other); got != other {
+		t.Fatalf("unrelated error was changed: %v", got)
+	}
+	if got := (&Worker{}).withStderr(io.EOF); got != io.EOF {
+		t.Fatalf("worker without stderr capture changed the error: %v", got)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
@@ -54,6 +56,9 @@ func TestWorkerStreamErrorFramePropagates(t *testing.T) {
 	if err.Error() != "stream error from worker: something went wrong" {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	if got := mapWorkerErrorToStatus(err); got != http.StatusInternalServerError {
+		t.Fatalf("error frame without a status → %d, want 500", got)
+	}
 }
 
 func TestFrameHeadersMultiValue(t *testing.T) {
@@ -340,3 +345,139 @@ func TestWorkerStreamHeadersFrameWithoutData(t *testing.T) {
 		t.Fatalf("streamInternal error: %v", err)
 	}
 }
+
+type publishedEvent struct {
+	channel, event string
+	payload        string
+}
+
+type recordingPublisher struct {
+	events []publishedEvent
+}
+
+func (p *recordingPublisher) Publish(channel, event string, payload any) {
+	raw, _ := json.Marshal(payload)
+	p.events = append(p.events, publishedEvent{channel, event, string(raw)})
+}
+
+func TestStreamPublishFrameRoutesToPublisher(t *testing.T) {
+	pub := &recordingPublisher{}
+	w := &Worker{
+		stdin:     nopWriteCloser{Writer: io.Discard},
+		publisher: pub,
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: 200}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "publish", Channel: "orders", Event: "created", Payload: json.RawMessage(`{"id":7}`)}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "ok"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+	w.stdout = io.NopCloser(buf)
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{}, rr); err != nil {
+		t.Fatalf("streamInternal: %v", err)
+	}
+
+	if rr.Body.String() != "ok" {
+		t.Fatalf("publish frame leaked into the response body: %q", rr.Body.String())
+	}
+	want := publishedEvent{"orders", "created", `{"id":7}`}
+	if len(pub.events) != 1 || pub.events[0] != want {
+		t.Fatalf("expected %+v to be published, got %+v", want, pub.events)
+	}
+}
+
+func TestHandleRequestSkipsPublishFrames(t *testing.T) {
+	pub := &recordingPublisher{}
+	w := &Worker{
+		stdin:     nopWriteCloser{Writer: io.Discard},
+		publisher: pub,
+	}
+
+	resp, err := json.Marshal(ResponsePayload{Status: 201, Body: "done"})
+	if err != nil {
+		t.Fatalf("marshal response: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "publish", Channel: "jobs", Event: "finished", Payload: json.RawMessage(`"report.csv"`)}))
+	_ = binary.Write(buf, binary.BigEndian, uint32(len(resp)))
+	buf.Write(resp)
+	w.stdout = io.NopCloser(buf)
+
+	got, err := w.handleRequest(&RequestPayload{})
+	if err != nil {
+		t.Fatalf("handleRequest: %v", err)
+	}
+	if got.Status != 201 || got.Body != "done" {
+		t.Fatalf("unexpected response: %+v", got)
+	}
+	if len(pub.events) != 1 || pub.events[0].channel != "jobs" || pub.events[0].payload != `"report.csv"` {
+		t.Fatalf("unexpected published events: %+v", pub.events)
+	}
+}
+
+func TestWorkerStreamHeadDropsChunks(t *testing.T) {
+	w := &Worker{requestTimeout: 500 * time.Millisecond}
+
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: 200, Headers: map[string][]string{"X-Test": {"1"}}, Data: "first"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "second"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end"}))
+
+	w.stdout = io.NopCloser(bytes.NewReader(buf.Bytes()))
+	w.stdin = nopWriteCloser{Writer: io.Discard}
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{Method: "HEAD"}, rr); err != nil {
+		t.Fatalf("streamInternal error: %v", err)
+	}
+	if rr.Body.Len() != 0 {
+		t.Fatalf("HEAD stream carried a body: %q", rr.Body.String())
+	}
+	if rr.Header().Get("X-Test") != "1" {
+		t.Fatalf("expected headers to be sent, got %v", rr.Header())
+	}
+}
+
+func TestWorkerStreamRejectsInvalidStatus(t *testing.T) {
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(bytes.NewReader(encodeFrame(t, StreamFrame{Type: "headers", Status: 42}))),
+	}
+
+	rr := httptest.NewRecorder()
+	err := w.streamInternal(&RequestPayload{}, rr)
+	if !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("expected ErrBadFrame, got %v", err)
+	}
+	if !w.isDead() {
+		t.Fatal("worker should be marked dead after abandoning the stream")
+	}
+}
+
+func TestWorkerStreamWritesTrailers(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "headers", Status: 200}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "chunk", Data: "payload"}))
+	buf.Write(encodeFrame(t, StreamFrame{Type: "end", Trailers: map[string][]string{
+		"grpc-status":  {"0"},
+		"Content-Type": {"text/evil"},
+	}}))
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(buf),
+	}
+
+	rr := httptest.NewRecorder()
+	if err := w.streamInternal(&RequestPayload{}, rr); err != nil {
+		t.Fatalf("streamInternal: %v", err)
+	}
+	res := rr.Result()
+	if got := res.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("trailer not sent, got %q (trailers %v)", got, res.Trailer)
+	}
+	if _, ok := res.Trailer["Content-Type"]; ok {
+		t.Fatal("Content-Type must not be sent as a trailer")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -134,7 +135,9 @@ func TestWorkerStreamHappyPath(t *testing.T) {
 }
 
 // TestEnableHotReloadHappyPath makes sure that when a watched file changes,
-// EnableHotReload's watcher eventually calls markAllWorkersDead.
+// EnableHotReload's watcher reloads the workers of both pools, draining and
+// restarting them a batch at a time so the fast pool never runs out of
+// workers.
 func TestEnableHotReloadHappyPath(t *testing.T) {
 	tmp := t.TempDir()
 
@@ -147,33 +150,80 @@ func TestEnableHotReloadHappyPath(t *testing.T) {
 		t.Fatalf("mkdir routes: %v", err)
 	}
 
-	fast := &Worker{}
-	slow := &Worker{}
+	// restarted workers take a moment to boot, so the drain is visible
+	var booting atomic.Bool
+	slowStart := func(start func() (io.WriteCloser, io.ReadCloser, error)) func() (io.WriteCloser, io.ReadCloser, error) {
+		return func() (io.WriteCloser, io.ReadCloser, error) {
+			if booting.Load() {
+				time.Sleep(30 * time.Millisecond)
+			}
+			return start()
+		}
+	}
+	fastPool, err := NewPoolWithConfig(3, WorkerConfig{RequestTimeout: time.Second, Start: slowStart(fakeStart(0))})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer fastPool.stopAll()
+	slowPool, err := NewPoolWithConfig(1, WorkerConfig{RequestTimeout: time.Second, Start: slowStart(fakeStart(0))})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer slowPool.stopAll()
 
 	s := &Server{
-		fastPool: &WorkerPool{workers: []*Worker{fast}},
-		slowPool: &WorkerPool{workers: []*Worker{slow}},
+		fastPool: fastPool,
+		slowPool: slowPool,
 		slowCfg:  SlowRequestConfig{},
 	}
+	s.SetReloadBatch(1)
+	before := append(workerRestarts(fastPool), workerRestarts(slowPool)...)
 
 	if err := s.EnableHotReload(tmp); err != nil {
 		t.Fatalf("EnableHotReload returned error: %v", err)
 	}
 
 	// Touch a file in php/ to trigger a change event
+	booting.Store(true)
 	testFile := filepath.Join(phpDir, "test.php")
 	if err := os.WriteFile(testFile, []byte("<?php // test"), 0o644); err != nil {
 		t.Fatalf("write test file: %v", err)
 	}
 
-	// wait up to 2 sreconds for the watcher goroutine to observe the change.
+	// wait up to 2 seconds for the watcher goroutine to reload every
+	// worker, checking all along that the fast pool can take a request
+	sawDrain := false
 	deadline := time.Now().Add(2 * time.Second)
 	for time.Now().Before(deadline) {
-		if fast.isDead() && slow.isDead() {
+		if !available(fastPool.snapshot()) {
+			t.Fatal("no fast worker available during the rolling reload")
+		}
+		for _, w := range fastPool.snapshot() {
+			if w.isDraining() {
+				sawDrain = true
+			}
+		}
+
+		after := append(workerRestarts(fastPool), workerRestarts(slowPool)...)
+		reloaded := true
+		for i := range before {
+			if after[i] <= before[i] {
+				reloaded = false
+			}
+		}
+		if reloaded {
+			if !sawDrain {
+				t.Fatal("fast workers were restarted without being drained first")
+			}
+			for _, w := range append(fastPool.workers, slowPool.workers...) {
+				if w.isDead() {
+					t.Fatal("reloaded worker is dead; hot reload should keep workers warm")
+				}
+			}
 			return // success
 		}
-		time.Sleep(20 * time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
 	}
 
-	t.Fatalf("expected workers to be marked dead after file change; fast.dead=%v slow.dead=%v", fast.isDead(), slow.isDead())
+	t.Fatal("expected every worker to be reloaded after the file change")
 }
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeoutHeaders are checked in order for a client-supplied timeout.
+var timeoutHeaders = []string{"X-Request-Timeout", "Timeout"}
+
+// SetMaxHeaderTimeout makes the Handler honor a timeout sent by the
+// client (or an upstream gateway) in an X-Request-Timeout or Timeout
+// header, in place of the pool's request timeout, up to max. A request
+// whose worker doesn't answer in time is aborted and gets a 504. Zero,
+// the default, ignores the headers.
+func (s *Server) SetMaxHeaderTimeout(max time.Duration) {
+	s.maxHeaderTimeout = max
+}
+
+// headerTimeout returns the timeout r asks for, clamped to the configured
+// maximum, or 0 if it asks for none (or headers are not honored).
+func (s *Server) headerTimeout(r *http.Request) time.Duration {
+	if s.maxHeaderTimeout <= 0 {
+		return 0
+	}
+	for _, name := range timeoutHeaders {
+		v := r.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		d, ok := parseTimeout(v)
+		if !ok {
+			return 0
+		}
+		return min(d, s.maxHeaderTimeout)
+	}
+	return 0
+}
+
+// parseTimeout reads a timeout header: a number of seconds ("2", "0.5")
+// or a Go duration ("500ms", "1m30s"). It must be positive.
+func parseTimeout(v string) (time.Duration, bool) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		d := time.Duration(secs * float64(time.Second))
+		return d, secs > 0 && d > 0
+	}
+	d, err := time.ParseDuration(v)
+	return d, err == nil && d > 0
+}
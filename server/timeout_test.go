@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"2":      2 * time.Second,
+		"0.5":    500 * time.Millisecond,
+		"250ms":  250 * time.Millisecond,
+		"1m30s":  90 * time.Second,
+		"0":      0,
+		"-1":     0,
+		"soon":   0,
+		"-100ms": 0,
+	}
+	for in, want := range cases {
+		got, ok := parseTimeout(in)
+		if ok != (want > 0) || (ok && got != want) {
+			t.Fatalf("parseTimeout(%q) = %s, %v; want %s", in, got, ok, want)
+		}
+	}
+}
+
+func TestHeaderTimeoutClampsAndPrefersXRequestTimeout(t *testing.T) {
+	s := &Server{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-Timeout", "3")
+	r.Header.Set("Timeout", "1")
+	if got := s.headerTimeout(r); got != 0 {
+		t.Fatalf("headers should be ignored unless enabled, got %s", got)
+	}
+
+	s.SetMaxHeaderTimeout(10 * time.Second)
+	if got := s.headerTimeout(r); got != 3*time.Second {
+		t.Fatalf("expected X-Request-Timeout to win, got %s", got)
+	}
+
+	r.Header.Set("X-Request-Timeout", "1h")
+	if got := s.headerTimeout(r); got != 10*time.Second {
+		t.Fatalf("expected the timeout clamped to the max, got %s", got)
+	}
+}
+
+func TestHandlerHonorsTimeoutHeader(t *testing.T) {
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() { stdoutW.Close() })
+	w := &Worker{
+		stdin:          nopWriteCloser{Writer: io.Discard},
+		stdout:         stdoutR, // never answers
+		maxRequests:    1000,
+		requestTimeout: time.Minute,
+	}
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetMaxHeaderTimeout(time.Second)
+
+	r := httptest.NewRequest(http.MethodGet, "/report", nil)
+	r.Header.Set("X-Request-Timeout", "20ms")
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	NewHandler(s).ServeHTTP(rr, r)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("request ran for %s, the header asked for 20ms", elapsed)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+// Tracer starts spans. It is the small slice of the OpenTelemetry
+// tracing API the server needs, so an OTel tracer plugs in through a thin
+// adapter. Without one (see Tracing) nothing is recorded.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, or of the remote
+	// parent in RemoteTraceParent(ctx) when ctx has no span yet.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one timed operation in a trace.
+type Span interface {
+	SetAttribute(key string, value any)
+	// RecordError records err on the span and marks it failed.
+	RecordError(err error)
+	End()
+	// TraceParent returns the W3C traceparent value identifying this span,
+	// passed on to PHP so it can continue the trace. "" if unknown.
+	TraceParent() string
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) RecordError(error)        {}
+func (nopSpan) End()                     {}
+func (nopSpan) TraceParent() string      { return "" }
+
+type tracerKey struct{}
+type traceParentKey struct{}
+
+// traceParentRE matches a version-00 W3C traceparent header.
+var traceParentRE = regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// Tracing returns a middleware that starts a server span per request
+// with tracer and makes tracer available to the dispatch step, which adds
+// a child span around the worker call. A valid incoming traceparent
+// header is exposed to the tracer through RemoteTraceParent. A nil tracer
+// disables tracing.
+func Tracing(tracer Tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		if tracer == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), tracerKey{}, tracer)
+			if tp := r.Header.Get("Traceparent"); traceParentRE.MatchString(tp) {
+				ctx = context.WithValue(ctx, traceParentKey{}, tp)
+			}
+
+			ctx, span := tracer.Start(ctx, "HTTP "+r.Method)
+			defer span.End()
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.target", r.URL.Path)
+			if id := r.Header.Get("X-Request-Id"); id != "" {
+				span.SetAttribute("http.request_id", id)
+			}
+
+			sw := NewStatusWriter(w)
+			next.ServeHTTP(sw, r.WithContext(ctx))
+
+			status := sw.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", status)
+		})
+	}
+}
+
+// RemoteTraceParent returns the traceparent header the client sent with
+// the request behind ctx, if it was well formed.
+func RemoteTraceParent(ctx context.Context) string {
+	tp, _ := ctx.Value(traceParentKey{}).(string)
+	return tp
+}
+
+// startSpan starts a span with the tracer installed by Tracing, or a
+// no-op span when tracing is off.
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if t, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return t.Start(ctx, name)
+	}
+	return ctx, nopSpan{}
+}
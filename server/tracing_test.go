@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedSpan struct {
+	name   string
+	parent string // TraceParent of the parent span, or the remote parent
+	attrs  map[string]any
+	errs   []error
+	ended  bool
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type spanCtxKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &recordedSpan{name: name, attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanCtxKey{}).(*testSpan); ok {
+		s.parent = parent.TraceParent()
+	} else {
+		s.parent = RemoteTraceParent(ctx)
+	}
+	t.spans = append(t.spans, s)
+	sp := &testSpan{t: t, rec: s, id: len(t.spans)}
+	return context.WithValue(ctx, spanCtxKey{}, sp), sp
+}
+
+type testSpan struct {
+	t   *recordingTracer
+	rec *recordedSpan
+	id  int
+}
+
+func (s *testSpan) SetAttribute(k string, v any) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.rec.attrs[k] = v
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.rec.errs = append(s.rec.errs, err)
+}
+
+func (s *testSpan) End() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.rec.ended = true
+}
+
+func (s *testSpan) TraceParent() string {
+	return "00-4bf92f3577b34da6a3ce929d0e0e4736-000000000000000" + string(rune('0'+s.id)) + "-01"
+}
+
+func TestTracingRecordsServerAndDispatchSpans(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 2, time.Second),
+		slowPool:   newFakePool(t, 1, time.Second),
+		routeStats: make(map[string]*routeStats),
+	}
+	tracer := &recordingTracer{}
+	h := Chain(NewHandler(s), Tracing(tracer))
+
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.Header.Set("traceparent", remote)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected a server and a dispatch span, got %d", len(tracer.spans))
+	}
+	srvSpan, dispatch := tracer.spans[0], tracer.spans[1]
+
+	if srvSpan.parent != remote {
+		t.Fatalf("server span did not continue the incoming trace: %q", srvSpan.parent)
+	}
+	if srvSpan.attrs["http.status_code"] != http.StatusOK || srvSpan.attrs["http.method"] != "GET" {
+		t.Fatalf("server span attributes: %v", srvSpan.attrs)
+	}
+	if dispatch.parent == "" || dispatch.parent == remote {
+		t.Fatalf("dispatch span should be a child of the server span, parent %q", dispatch.parent)
+	}
+	if dispatch.attrs["php.pool"] != "fast" || dispatch.attrs["php.worker"] != 0 || dispatch.attrs["php.status"] != http.StatusOK {
+		t.Fatalf("dispatch span attributes: %v", dispatch.attrs)
+	}
+	if !srvSpan.ended || !dispatch.ended {
+		t.Fatal("spans were not ended")
+	}
+}
+
+func TestTracingRecordsWorkerErrors(t *testing.T) {
+	s := &Server{fastPool: &WorkerPool{}, slowPool: &WorkerPool{}}
+	tracer := &recordingTracer{}
+	h := Chain(NewHandler(s), Tracing(tracer))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	dispatch := tracer.spans[1]
+	if len(dispatch.errs) != 1 || dispatch.errs[0] != ErrNoWorkers {
+		t.Fatalf("expected ErrNoWorkers on the dispatch span, got %v", dispatch.errs)
+	}
+	if code := tracer.spans[0].attrs["http.status_code"]; code == http.StatusOK {
+		t.Fatalf("server span status should reflect the failure, got %v", code)
+	}
+}
+
+func TestNoTracingIsANoOp(t *testing.T) {
+	_, span := startSpan(context.Background(), "x")
+	if _, ok := span.(nopSpan); !ok {
+		t.Fatalf("expected a no-op span without a tracer, got %T", span)
+	}
+	if RemoteTraceParent(context.Background()) != "" {
+		t.Fatal("unexpected remote parent")
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxMultipartFieldBytes caps the total size of the non-file fields of a
+// multipart body, which are kept in memory.
+const maxMultipartFieldBytes = 10 << 20
+
+// UploadedFile describes a multipart file part that was spooled to disk.
+// Its JSON shape mirrors a PHP $_FILES entry.
+type UploadedFile struct {
+	Field   string `json:"field"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	TmpName string `json:"tmp_name"`
+}
+
+// RemoveUploads deletes the temp files backing p.Files. It is safe to call
+// more than once.
+func (p *RequestPayload) RemoveUploads() {
+	for i := range p.Files {
+		if p.Files[i].TmpName == "" {
+			continue
+		}
+		_ = os.Remove(p.Files[i].TmpName)
+		p.Files[i].TmpName = ""
+	}
+}
+
+// BodySize returns the size of the request body, including uploads that
+// were spooled to disk.
+func (p *RequestPayload) BodySize() int64 {
+	if p.BodyStream {
+		// not read yet: trust Content-Length, and treat a body of unknown
+		// length as large
+		if p.bodySize < 0 {
+			return math.MaxInt64
+		}
+		return p.bodySize
+	}
+	n := int64(len(p.Body))
+	for _, f := range p.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// isMultipartForm reports whether r carries a multipart/form-data body.
+func isMultipartForm(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// spoolMultipart reads a multipart/form-data body part by part. File parts
+// are written to temp files in dir (os.TempDir when empty) and everything
+// else is collected as form values, so the file contents never sit in
+// memory. On error any temp files already written are removed.
+func spoolMultipart(r *http.Request, dir string) (map[string][]string, []UploadedFile, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	form := make(map[string][]string)
+	var files []UploadedFile
+	fieldBytes := int64(0)
+
+	cleanup := func() {
+		for _, f := range files {
+			_ = os.Remove(f.TmpName)
+		}
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			_ = part.Close()
+			continue
+		}
+
+		// plain form field
+		if part.FileName() == "" {
+			remaining := maxMultipartFieldBytes - fieldBytes
+			value, err := io.ReadAll(io.LimitReader(part, remaining+1))
+			_ = part.Close()
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			fieldBytes += int64(len(value))
+			if fieldBytes > maxMultipartFieldBytes {
+				cleanup()
+				// a 413 like any other body over its limit
+				return nil, nil, fmt.Errorf("multipart form fields: %w", &http.MaxBytesError{Limit: maxMultipartFieldBytes})
+			}
+			form[name] = append(form[name], string(value))
+			continue
+		}
+
+		// file part: spool to disk
+		tmp, err := os.CreateTemp(dir, "go-php-upload-*")
+		if err != nil {
+			_ = part.Close()
+			cleanup()
+			return nil, nil, err
+		}
+
+		size, err := io.Copy(tmp, part)
+		_ = part.Close()
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+			cleanup()
+			return nil, nil, fmt.Errorf("spooling upload %q: %w", part.FileName(), err)
+		}
+
+		contentType := part.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		files = append(files, UploadedFile{
+			Field:   name,
+			Name:    strings.TrimSpace(part.FileName()),
+			Type:    contentType,
+			Size:    size,
+			TmpName: tmp.Name(),
+		})
+	}
+
+	return form, files, nil
+}
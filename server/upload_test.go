@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newMultipartRequest(t *testing.T) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	if err := mw.WriteField("title", "report"); err != nil {
+		t.Fatalf("write field: %v", err)
+	}
+	if err := mw.WriteField("tag", "a"); err != nil {
+		t.Fatalf("write field: %v", err)
+	}
+	if err := mw.WriteField("tag", "b"); err != nil {
+		t.Fatalf("write field: %v", err)
+	}
+	fw, err := mw.CreateFormFile("upload", "data.csv")
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	if _, err := fw.Write([]byte("a,b,c\n1,2,3\n")); err != nil {
+		t.Fatalf("write file part: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/import", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestBuildPayloadSpoolsMultipartUploads(t *testing.T) {
+	payload, err := BuildPayload(newMultipartRequest(t))
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	defer payload.RemoveUploads()
+
+	if payload.Body != "" {
+		t.Fatalf("expected multipart body not to be inlined, got %q", payload.Body)
+	}
+	if got := payload.Form["title"]; len(got) != 1 || got[0] != "report" {
+		t.Fatalf("unexpected title field: %v", got)
+	}
+	if got := payload.Form["tag"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("expected repeated tag fields to be preserved, got %v", got)
+	}
+
+	if len(payload.Files) != 1 {
+		t.Fatalf("expected 1 uploaded file, got %d", len(payload.Files))
+	}
+	f := payload.Files[0]
+	if f.Field != "upload" || f.Name != "data.csv" || f.Size != 12 {
+		t.Fatalf("unexpected file descriptor: %#v", f)
+	}
+
+	data, err := os.ReadFile(f.TmpName)
+	if err != nil {
+		t.Fatalf("read spooled file: %v", err)
+	}
+	if string(data) != "a,b,c\n1,2,3\n" {
+		t.Fatalf("unexpected spooled content: %q", string(data))
+	}
+	if payload.BodySize() != 12 {
+		t.Fatalf("expected BodySize to include uploads, got %d", payload.BodySize())
+	}
+
+	tmp := f.TmpName
+	payload.RemoveUploads()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected temp file to be removed, stat err=%v", err)
+	}
+}
+
+func TestBuildPayloadKeepsFilesSharingAField(t *testing.T) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		fw, err := mw.CreateFormFile("photos[]", name)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		if _, err := fw.Write([]byte(name)); err != nil {
+			t.Fatalf("write file part: %v", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/gallery", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	payload, err := BuildPayload(r)
+	if err != nil {
+		t.Fatalf("BuildPayload error: %v", err)
+	}
+	defer payload.RemoveUploads()
+
+	// the bridge nests both under $_FILES['photos'], in this order
+	if len(payload.Files) != 2 {
+		t.Fatalf("expected 2 uploaded files, got %#v", payload.Files)
+	}
+	for i, name := range []string{"a.jpg", "b.jpg"} {
+		f := payload.Files[i]
+		if f.Field != "photos[]" || f.Name != name {
+			t.Fatalf("file %d: unexpected descriptor %#v", i, f)
+		}
+		if data, err := os.ReadFile(f.TmpName); err != nil || string(data) != name {
+			t.Fatalf("file %d: spooled %q, %v", i, data, err)
+		}
+	}
+}
+
+func TestHandlerRemovesUploadsAfterResponse(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, 0),
+		slowPool:   newFakePool(t, 1, 0),
+		routeStats: make(map[string]*routeStats),
+	}
+
+	uploads := filepath.Join(os.TempDir(), "go-php-upload-*")
+	before, _ := filepath.Glob(uploads)
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, newMultipartRequest(t))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	after, _ := filepath.Glob(uploads)
+	if len(after) > len(before) {
+		t.Fatalf("expected spooled uploads to be cleaned up (%d entries before, %d after)", len(before), len(after))
+	}
+}
+
+func TestHandlerRejectsOversizedMultipartFieldsWith413(t *testing.T) {
+	s := &Server{
+		fastPool:   newFakePool(t, 1, 0),
+		slowPool:   newFakePool(t, 1, 0),
+		routeStats: make(map[string]*routeStats),
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	if err := mw.WriteField("notes", strings.Repeat("x", maxMultipartFieldBytes+1)); err != nil {
+		t.Fatalf("write field: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/import", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	NewHandler(s).ServeHTTP(rr, r)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+}
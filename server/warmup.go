@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WarmupConfig primes a worker's new process, at startup and after every
+// restart, before real traffic reaches it: the first requests a PHP
+// process serves pay for filling opcache and the JIT and for whatever the
+// framework sets up lazily. The warm-up requests don't count towards
+// WorkerConfig.MaxRequests and aren't reported to observers or metrics.
+//
+// While warming the worker is in state WorkerWarming and gets new
+// requests only when no other worker can take them; a request that
+// found the worker dead and restarted it waits for the warm-up.
+type WarmupConfig struct {
+	// Paths are requested with GET, in order, e.g. "/" and a typical page.
+	// None turns warm-up off.
+	Paths []string
+	// Rounds is how many times Paths are requested; <= 0 means once.
+	Rounds int
+}
+
+// WarmupHeader marks warm-up requests, so the app can tell them apart
+// from real ones, e.g. to keep them out of its analytics.
+const WarmupHeader = "X-Go-Warmup"
+
+// isWarming reports whether the worker is being warmed up.
+func (w *Worker) isWarming() bool {
+	return w.getState() == WorkerWarming
+}
+
+// warm is warmLocked for a worker nothing else can see yet.
+func (w *Worker) warm() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warmLocked()
+}
+
+// warmLocked sends the current process its warm-up requests, keeping the
+// worker out of rotation until they are done. A failed warm-up is logged
+// and ends early; if it killed the process, the worker is left dead to be
+// restarted like any other. Callers must hold w.mu.
+func (w *Worker) warmLocked() {
+	if len(w.warmup.Paths) == 0 {
+		return
+	}
+	w.stateMu.Lock()
+	if w.state == WorkerIdle || w.state == WorkerBusy {
+		w.state = WorkerWarming
+	}
+	w.stateMu.Unlock()
+
+	start := time.Now()
+	sent := 0
+	var err error
+rounds:
+	for round := range max(w.warmup.Rounds, 1) {
+		for _, path := range w.warmup.Paths {
+			sent++
+			if _, err = w.handleLocked(warmupRequest(round, sent, path)); err != nil {
+				break rounds
+			}
+		}
+	}
+
+	w.stateMu.Lock()
+	if w.state == WorkerWarming {
+		w.state = WorkerIdle
+		if w.inFlight > 0 {
+			w.state = WorkerBusy
+		}
+		w.lastActive = time.Now()
+	}
+	w.stateMu.Unlock()
+
+	if err != nil {
+		w.log().Warn("worker warm-up failed", "requests", sent, "err", w.withStderr(err))
+		return
+	}
+	w.log().Debug("worker warmed up", "requests", sent, "duration", time.Since(start))
+}
+
+// warmupRequest returns warm-up request n, in the given round, for path.
+func warmupRequest(round, n int, path string) *RequestPayload {
+	return &RequestPayload{
+		ID:         fmt.Sprintf("warmup-%d-%d", round, n),
+		Method:     http.MethodGet,
+		Path:       path,
+		Headers:    map[string][]string{WarmupHeader: {"1"}},
+		Scheme:     "http",
+		Host:       "localhost",
+		RemoteAddr: "127.0.0.1",
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingStart wraps fakeStart, keeping every frame Go sends.
+func recordingStart(sent *bytes.Buffer) func() (io.WriteCloser, io.ReadCloser, error) {
+	start := fakeStart(0)
+	return func() (io.WriteCloser, io.ReadCloser, error) {
+		stdin, stdout, err := start()
+		if err != nil {
+			return nil, nil, err
+		}
+		return struct {
+			io.Writer
+			io.Closer
+		}{io.MultiWriter(stdin, sent), stdin}, stdout, nil
+	}
+}
+
+// sentPaths decodes the request frames in sent, returning their paths and
+// whether each was marked as a warm-up.
+func sentPaths(t *testing.T, sent *bytes.Buffer) (paths []string, warm []bool) {
+	t.Helper()
+	for sent.Len() > 0 {
+		body, err := readFrame(sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req RequestPayload
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, req.Path)
+		warm = append(warm, len(req.Headers[WarmupHeader]) > 0)
+	}
+	return paths, warm
+}
+
+func TestWorkerWarmsUpEachProcess(t *testing.T) {
+	var sent bytes.Buffer
+	w, err := NewWorkerWithConfig(WorkerConfig{
+		MaxRequests:    1000,
+		RequestTimeout: time.Second,
+		Start:          recordingStart(&sent),
+		Warmup:         WarmupConfig{Paths: []string{"/", "/home"}, Rounds: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.stop()
+
+	paths, warm := sentPaths(t, &sent)
+	if want := []string{"/", "/home", "/", "/home"}; !slices.Equal(paths, want) || slices.Contains(warm, false) {
+		t.Fatalf("warm-up sent %v (marked %v), want %v", paths, warm, want)
+	}
+	if w.getState() != WorkerIdle || atomic.LoadUint64(&w.requestCount) != 0 {
+		t.Fatalf("after warm-up: state %s, %d requests counted", w.getState(), atomic.LoadUint64(&w.requestCount))
+	}
+
+	resp, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/real"})
+	if err != nil || resp.Body != "php0:/real" {
+		t.Fatalf("%+v, %v", resp, err)
+	}
+	if _, warm = sentPaths(t, &sent); len(warm) != 1 || warm[0] {
+		t.Fatalf("a real request was marked as a warm-up: %v", warm)
+	}
+
+	// a restart warms the new process up too
+	w.markDead()
+	if _, err := w.restartIfDead(); err != nil {
+		t.Fatal(err)
+	}
+	if paths, _ = sentPaths(t, &sent); len(paths) != 4 {
+		t.Fatalf("restart warm-up sent %v", paths)
+	}
+	resp, err = w.Handle(&RequestPayload{ID: "2", Method: "GET", Path: "/real"})
+	if err != nil || resp.Body != "php1:/real" || atomic.LoadUint64(&w.requestCount) != 1 {
+		t.Fatalf("%+v, %v, %d requests counted", resp, err, atomic.LoadUint64(&w.requestCount))
+	}
+}
+
+func TestWarmingWorkerIsPickedLast(t *testing.T) {
+	pool := newFakePool(t, 2, time.Second)
+	defer pool.stopAll()
+
+	pool.workers[0].setState(WorkerWarming)
+	for range 3 {
+		if got := pool.NextWorker(); got != pool.workers[1] {
+			t.Fatal("a warming worker was picked while another was free")
+		}
+	}
+	if pool.Stats().Warming != 1 {
+		t.Fatalf("stats = %+v", pool.Stats())
+	}
+
+	// with nothing else, it beats no worker at all
+	pool.workers[1].setState(WorkerWarming)
+	if got := pool.NextWorker(); got == nil {
+		t.Fatal("no worker while all of them are warming")
+	}
+}
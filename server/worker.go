@@ -1,15 +1,19 @@
 package server
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -23,79 +27,477 @@ const (
 	WorkerBusy
 	WorkerDraining
 	WorkerDead
+	WorkerWarming // a new process is sent its warm-up requests; see WarmupConfig
 )
 
+func (s WorkerState) String() string {
+	switch s {
+	case WorkerIdle:
+		return "idle"
+	case WorkerBusy:
+		return "busy"
+	case WorkerDraining:
+		return "draining"
+	case WorkerDead:
+		return "dead"
+	case WorkerWarming:
+		return "warming"
+	}
+	return "unknown"
+}
+
+// Publisher receives the events workers emit with "publish" frames.
+// *SSEHub implements it.
+type Publisher interface {
+	Publish(channel, event string, payload any)
+}
+
 type Worker struct {
-	cmd            *exec.Cmd
-	stdin          io.WriteCloser
-	stdout         io.ReadCloser
-	mu             sync.Mutex // protects cmd/stdin/stdout during request I/O
-	baseDir        string
-	dead           bool
-	deadMu         sync.RWMutex // protects dead flag
-	maxRequests    int
-	requestTimeout time.Duration
-	requestCount   uint64
-
-	stateMu  sync.RWMutex // protects state + inFlight
-	state    WorkerState
-	inFlight int
+	proc            *process // current PHP process; guarded by stateMu
+	stdin           io.WriteCloser
+	stdout          io.ReadCloser
+	mu              sync.RWMutex // held during request I/O on stdin/stdout; shared by pipelined requests
+	baseDir         string
+	phpBinary       string
+	wantCodec       Codec                                         // WorkerConfig.Codec, asked of every process
+	start           func() (io.WriteCloser, io.ReadCloser, error) // WorkerConfig.Start; nil runs php
+	dead            bool
+	deadMu          sync.RWMutex // protects dead flag
+	maxRequests     int
+	requestTimeout  time.Duration
+	readIdleTimeout time.Duration // see readFrame; 0 disables
+	frames          *framePool    // recycles read buffers; nil allocates each frame
+	requestCount    uint64        // requests served by the current process; atomic
+	totalRequests   uint64        // requests served by every process; atomic
+	restarts        uint64        // processes started after the first; atomic
+	publisher       Publisher     // guarded by mu
+	codec           Codec         // negotiated at spawn; nil means JSON; guarded by mu
+	protocol        int           // negotiated at spawn; 0 means ProtocolVersion; guarded by mu
+	stderr          *stderrTail   // recent stderr of the current process; nil in tests
+	warmup          WarmupConfig  // see warmLocked
+
+	stateMu       sync.RWMutex // protects state, inFlight and the lifetime fields
+	state         WorkerState
+	inFlight      int
+	startedAt     time.Time     // when the current process was started
+	spawnedAt     time.Time     // when it was ready
+	lastActive    time.Time     // when the last request finished, or spawnedAt
+	busySince     time.Time     // when inFlight last went from 0 to 1; zero while idle
+	maxLifetime   time.Duration // 0 disables time-based recycling
+	jitter        float64       // fraction of maxLifetime this process retires early
+	pid           int
+	onExit        func(*Worker) // called after the process crashes; see SetOnExit
+	reading       io.Closer     // stdout while a response is read from it; see abortRead
+	maxConcurrent int           // requests sharing the pipe; see SetMaxConcurrent
+	pinned        bool          // a WebSocket session owns the worker; see webSocket
+	lastPing      time.Time     // see pingDue
+	pinging       bool          // a ping is on its way
+
+	slots  chan struct{} // pipelined requests on the pipe; nil when not pipelining; guarded by mu
+	pipeMu sync.Mutex    // protects pipe
+	pipe   *pipeline     // demultiplexes pipelined responses; nil until used
+
+	rss    int64 // last sampled resident set size in bytes; atomic
+	maxRSS int64 // recycle once rss exceeds this; 0 disables; atomic
+
+	logger atomic.Pointer[slog.Logger]  // see SetLogger
+	events atomic.Pointer[workerEvents] // see WorkerPool.SetObserver
+}
+
+// lifetimeJitter is the largest fraction of the max lifetime by which a
+// worker may retire early, so workers started together don't all
+// restart at once.
+const lifetimeJitter = 0.1
+
+// WorkerConfig configures a single PHP worker.
+type WorkerConfig struct {
+	MaxRequests    int           // recycle after this many requests; <= 0 never
+	RequestTimeout time.Duration // per-request timeout; 0 waits forever
+
+	// ReadIdleTimeout bounds how long a frame may stall once it started
+	// arriving, even with no RequestTimeout. 0 means
+	// DefaultReadIdleTimeout; negative disables it.
+	ReadIdleTimeout time.Duration
+
+	// FrameBufferSize is the typical response frame size in bytes.
+	// Frames up to this size are read into recycled buffers, larger ones
+	// into a buffer of their own. 0 means DefaultFrameBufferSize;
+	// negative allocates every frame.
+	FrameBufferSize int
+
+	// PHPBinary is the php executable; "" means "php" from PATH.
+	PHPBinary string
+	// Codec names the frame codec to ask PHP for, "json" or "msgpack";
+	// "" means GO_PHP_CODEC, or JSON if that is unset too. An unknown name
+	// fails NewWorkerWithConfig. Workers on Address or Start always use
+	// JSON.
+	Codec string
+	// BaseDir is the project root holding php/worker.php; "" walks up
+	// from the current directory to the one containing go.mod (see
+	// FindProjectRoot), and fails if there is none.
+	BaseDir string
+
+	// Logger receives the worker's logs; nil uses slog.Default().
+	Logger *slog.Logger
+
+	// Address, if set, connects to a worker listening on a Unix socket,
+	// "unix:///run/php/app.sock", or TCP, "tcp://10.0.0.5:9000", instead
+	// of launching php/worker.php; see dialStart. The same length-prefixed
+	// frames go over the connection, in JSON. As with Start there is no
+	// process to watch, and a restart dials again.
+	Address string
+
+	// Start, if set, replaces launching php/worker.php: it returns the
+	// pipe to a fresh worker that speaks the frame protocol in JSON, and
+	// is called again on every restart. Such a worker has no process, so
+	// no PID, RSS or crash watcher; closing stdout is how it dies. Tests
+	// use it to run the whole dispatch path against a fake PHP side.
+	Start func() (stdin io.WriteCloser, stdout io.ReadCloser, err error)
+
+	// Warmup is sent to every new process before it takes requests.
+	Warmup WarmupConfig
 }
 
 // NewWorker walks up from the current directory to find go.mod,
 // assumes php/worker.php relative to that, and starts a PHP worker.
 func NewWorker(maxRequests int, requestTimeout time.Duration) (*Worker, error) {
-	wd, err := os.Getwd()
+	return NewWorkerWithConfig(WorkerConfig{MaxRequests: maxRequests, RequestTimeout: requestTimeout})
+}
+
+// NewWorkerWithConfig starts a PHP worker configured by cfg.
+func NewWorkerWithConfig(cfg WorkerConfig) (*Worker, error) {
+	if cfg.Start == nil && cfg.Address != "" {
+		start, err := dialStart(cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Start = start
+	}
+	if cfg.Start != nil {
+		return newStartedWorker(cfg)
+	}
+
+	baseDir := cfg.BaseDir
+	if baseDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		if baseDir, err = FindProjectRoot(wd); err != nil {
+			return nil, err
+		}
+	}
+
+	want, err := requestedCodec(cfg.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	stderr := newStderrTail(log.Writer())
+	startedAt := time.Now()
+	cmd, stdin, stdout, codec, protocol, err := startWorkerProcess(logger, cfg.PHPBinary, baseDir, want, cfg.RequestTimeout, stderr)
 	if err != nil {
 		return nil, err
 	}
 
-	baseDir := wd
+	now := time.Now()
+	w := &Worker{
+		stdin:           stdin,
+		stdout:          stdout,
+		codec:           codec,
+		protocol:        protocol,
+		stderr:          stderr,
+		baseDir:         baseDir,
+		phpBinary:       cfg.PHPBinary,
+		wantCodec:       want,
+		dead:            false,
+		maxRequests:     cfg.MaxRequests,
+		requestTimeout:  cfg.RequestTimeout,
+		readIdleTimeout: readIdleTimeout(cfg.ReadIdleTimeout),
+		frames:          framePoolFor(cfg.FrameBufferSize),
+		state:           WorkerIdle,
+		startedAt:       startedAt,
+		spawnedAt:       now,
+		lastActive:      now,
+		jitter:          rand.Float64() * lifetimeJitter,
+		pid:             cmd.Process.Pid,
+		warmup:          cfg.Warmup,
+	}
+	w.logger.Store(cfg.Logger)
+	// under stateMu, as in restartLocked, so a process that already
+	// exited is seen as this worker's by its watcher
+	w.stateMu.Lock()
+	w.proc = w.watch(cmd)
+	w.stateMu.Unlock()
+	w.warm()
+	return w, nil
+}
+
+// newStartedWorker returns a worker on the pipe cfg.Start opens.
+func newStartedWorker(cfg WorkerConfig) (*Worker, error) {
+	startedAt := time.Now()
+	stdin, stdout, err := cfg.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	w := &Worker{
+		stdin:           stdin,
+		stdout:          stdout,
+		start:           cfg.Start,
+		maxRequests:     cfg.MaxRequests,
+		requestTimeout:  cfg.RequestTimeout,
+		readIdleTimeout: readIdleTimeout(cfg.ReadIdleTimeout),
+		frames:          framePoolFor(cfg.FrameBufferSize),
+		state:           WorkerIdle,
+		startedAt:       startedAt,
+		spawnedAt:       now,
+		lastActive:      now,
+		jitter:          rand.Float64() * lifetimeJitter,
+		warmup:          cfg.Warmup,
+	}
+	w.logger.Store(cfg.Logger)
+	w.warm()
+	return w, nil
+}
+
+// SetLogger sets where the worker logs; nil means slog.Default(). Pools
+// pass a logger tagged with the pool and worker index.
+func (w *Worker) SetLogger(l *slog.Logger) {
+	w.logger.Store(l)
+}
+
+func (w *Worker) log() *slog.Logger {
+	if l := w.logger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// process is one running PHP process of a worker. Exits we cause
+// (recycle, timeout, shutdown) set intended first, so the watcher can
+// tell them apart from crashes.
+type process struct {
+	cmd      *exec.Cmd
+	done     chan struct{} // closed once the process has exited
+	intended atomic.Bool
+}
+
+// watch waits for cmd in the background. If it exits without us killing
+// it (fatal error, exit(), OOM killer) the worker is marked dead right
+// away rather than on the next request's broken pipe.
+//
+// It uses Process.Wait rather than cmd.Wait, which would close stdout
+// under a reader that may still be draining it.
+func (w *Worker) watch(cmd *exec.Cmd) *process {
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		state, err := cmd.Process.Wait()
+		close(p.done)
+		if p.intended.Load() {
+			return
+		}
+
+		w.stateMu.RLock()
+		current, onExit := w.proc == p, w.onExit
+		w.stateMu.RUnlock()
+		if !current {
+			return
+		}
+
+		if err != nil {
+			w.log().Error("waiting for worker process failed", "pid", cmd.Process.Pid, "err", err)
+		} else {
+			w.log().Warn("worker exited unexpectedly", "pid", cmd.Process.Pid, "status", state.String())
+		}
+		reason := "exit"
+		if state != nil {
+			reason = state.String()
+		}
+		w.died(reason, err)
+		w.markDead()
+		if onExit != nil {
+			onExit(w)
+		}
+	}()
+	return p
+}
+
+// kill stops the process on purpose and waits for it to exit.
+func (p *process) kill() {
+	if p == nil {
+		return
+	}
+	p.intended.Store(true)
+	_ = p.cmd.Process.Kill()
+	<-p.done
+}
+
+// currentProcess returns the worker's running process, or nil.
+func (w *Worker) currentProcess() *process {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return w.proc
+}
+
+// killProcess kills the worker's current process, if any.
+func (w *Worker) killProcess() {
+	w.currentProcess().kill()
+}
+
+// expectExit flags the current process as going away on purpose. Call it
+// before closing its pipes, which may make PHP exit by itself.
+func (w *Worker) expectExit() {
+	if p := w.currentProcess(); p != nil {
+		p.intended.Store(true)
+	}
+}
+
+// SetOnExit registers fn to run when the worker's process dies on its
+// own. Pools use it to restart crashed workers promptly.
+func (w *Worker) SetOnExit(fn func(*Worker)) {
+	w.stateMu.Lock()
+	w.onExit = fn
+	w.stateMu.Unlock()
+}
+
+// ErrNoProjectRoot is wrapped by FindProjectRoot's error when no
+// directory up to the filesystem root has a go.mod.
+var ErrNoProjectRoot = errors.New("no go.mod found")
+
+// FindProjectRoot returns the closest directory at or above dir that
+// contains go.mod: the project root that holds php/worker.php.
+func FindProjectRoot(dir string) (string, error) {
+	baseDir := dir
 	for {
 		if _, err := os.Stat(filepath.Join(baseDir, "go.mod")); err == nil {
-			break
+			return baseDir, nil
 		}
 		parent := filepath.Dir(baseDir)
 		if parent == baseDir {
-			break
+			return "", fmt.Errorf("%w in %s or any directory above it", ErrNoProjectRoot, dir)
 		}
 		baseDir = parent
 	}
+}
 
+// workerScript returns the path of php/worker.php under baseDir, or an
+// error saying why it can't be run.
+func workerScript(baseDir string) (string, error) {
 	workerPath := filepath.Join(baseDir, "php", "worker.php")
+	info, err := os.Stat(workerPath)
+	if err != nil {
+		return "", fmt.Errorf("worker script: %w (is %s the project root?)", err, baseDir)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("worker script %s is a directory", workerPath)
+	}
+	return workerPath, nil
+}
+
+// ErrPHPNotFound is wrapped by errors for a php binary that doesn't
+// exist or can't be executed.
+var ErrPHPNotFound = errors.New("php binary not found")
+
+// lookPHP returns the path of phpBinary ("php" if empty), looked up on
+// PATH unless it contains a slash, and checks that it is executable. The
+// error says what to do about it, as this is usually the first thing to
+// go wrong on a new machine.
+func lookPHP(phpBinary string) (string, error) {
+	if phpBinary == "" {
+		phpBinary = "php"
+	}
+	path, err := exec.LookPath(phpBinary)
+	if err != nil {
+		// the name is in the message already
+		var execErr *exec.Error
+		var pathErr *fs.PathError
+		if errors.As(err, &execErr) {
+			err = execErr.Err
+		}
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return "", fmt.Errorf("%w: %q: %v; install PHP or set GO_PHP_BINARY (php_binary in the config file) to the php executable", ErrPHPNotFound, phpBinary, err)
+	}
+	return path, nil
+}
+
+// startWorkerProcess launches php/worker.php under baseDir using phpBinary
+// ("php" if empty). ProtocolVersion, and the codec when want is something
+// other than JSON, are passed to PHP in the environment,
+// and the worker answers with a ready frame naming the codec it will
+// actually use (it falls back to JSON if, say, the msgpack extension is
+// missing) and the protocol version it speaks; see handshake. The
+// process's stderr goes to stderr, or the standard logger if nil.
+func startWorkerProcess(logger *slog.Logger, phpBinary, baseDir string, want Codec, handshakeTimeout time.Duration, stderr io.Writer) (*exec.Cmd, io.WriteCloser, io.ReadCloser, Codec, int, error) {
+	workerPath, err := workerScript(baseDir)
+	if err != nil {
+		return nil, nil, nil, nil, 0, err
+	}
 
-	cmd := exec.Command("php", workerPath)
+	phpPath, err := lookPHP(phpBinary)
+	if err != nil {
+		return nil, nil, nil, nil, 0, err
+	}
+	cmd := exec.Command(phpPath, workerPath)
 	cmd.Dir = baseDir
 
+	cmd.Env = append(os.Environ(), "GO_PHP_PROTOCOL="+strconv.Itoa(ProtocolVersion))
+	if want.Name() != "json" {
+		cmd.Env = append(cmd.Env, "GO_PHP_CODEC="+want.Name())
+	}
+
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, nil, 0, err
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		_ = stdin.Close()
-		return nil, err
+		return nil, nil, nil, nil, 0, err
 	}
 
-	cmd.Stderr = log.Writer()
+	cmd.Stderr = stderr
+	if stderr == nil {
+		cmd.Stderr = log.Writer()
+	}
 
 	if err := cmd.Start(); err != nil {
 		_ = stdin.Close()
 		_ = stdout.Close()
-		return nil, err
+		return nil, nil, nil, nil, 0, err
 	}
 
-	return &Worker{
-		cmd:            cmd,
-		stdin:          stdin,
-		stdout:         stdout,
-		baseDir:        baseDir,
-		dead:           false,
-		maxRequests:    maxRequests,
-		requestTimeout: requestTimeout,
-		state:          WorkerIdle,
-	}, nil
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = 10 * time.Second
+	}
+	codec, protocol, err := handshake(logger, stdout, want, handshakeTimeout)
+	if err != nil {
+		_ = stdin.Close()
+		_ = cmd.Process.Kill()
+		_, _ = cmd.Process.Wait()
+		return nil, nil, nil, nil, 0, err
+	}
+
+	if codec.Name() != want.Name() {
+		logger.Warn("worker chose a different codec", "requested", want.Name(), "codec", codec.Name())
+	}
+	return cmd, stdin, stdout, codec, protocol, nil
+}
+
+// frameCodec returns the codec for the current process. Callers must hold w.mu.
+func (w *Worker) frameCodec() Codec {
+	if w.codec == nil {
+		return JSONCodec{}
+	}
+	return w.codec
 }
 
 func (w *Worker) isDead() bool {
@@ -130,16 +532,121 @@ func (w *Worker) getState() WorkerState {
 
 func (w *Worker) incrInFlight() {
 	w.stateMu.Lock()
-	w.inFlight++
+	w.incrInFlightLocked()
 	w.stateMu.Unlock()
 }
 
 func (w *Worker) decrInFlight() {
 	w.stateMu.Lock()
+	w.decrInFlightLocked()
+	w.stateMu.Unlock()
+}
+
+// incrInFlightLocked and decrInFlightLocked adjust the in-flight count;
+// w.stateMu must be held.
+func (w *Worker) incrInFlightLocked() {
+	if w.inFlight == 0 {
+		w.busySince = time.Now()
+	}
+	w.inFlight++
+}
+
+func (w *Worker) decrInFlightLocked() {
 	if w.inFlight > 0 {
 		w.inFlight--
 	}
+	if w.inFlight == 0 {
+		w.busySince = time.Time{}
+	}
+	w.lastActive = time.Now()
+}
+
+// setReading records r as the pipe a response is being read from, or
+// clears it with nil.
+func (w *Worker) setReading(r io.Closer) {
+	w.stateMu.Lock()
+	w.reading = r
+	w.stateMu.Unlock()
+}
+
+// abortRead closes the pipe a timed-out request is reading from, so its
+// reader can't outlive the request even when the killed process's stdout
+// stays open (say, inherited by a child PHP started).
+func (w *Worker) abortRead() {
+	w.stateMu.Lock()
+	r := w.reading
+	w.reading = nil
+	w.stateMu.Unlock()
+	if r != nil {
+		_ = r.Close()
+	}
+}
+
+// beginRequest counts a request in and marks the worker busy. It reports
+// false, counting nothing, if the worker is draining. A dead worker is
+// still taken: the request restarts it.
+func (w *Worker) beginRequest() bool {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	if w.state == WorkerDraining {
+		return false
+	}
+	w.incrInFlightLocked()
+	if w.state != WorkerDead && w.state != WorkerWarming {
+		w.state = WorkerBusy
+	}
+	return true
+}
+
+// endRequest counts a request out. The request that leaves a draining or
+// expired worker with nothing in flight marks it dead for the reaper to
+// restart; the count and the check share one critical section, so that
+// happens exactly once and never under another request.
+func (w *Worker) endRequest() {
+	w.stateMu.Lock()
+	w.decrInFlightLocked()
+	recycle, expired := false, false
+	if w.inFlight == 0 {
+		switch {
+		case w.state == WorkerDraining:
+			// whoever drained it reported why
+			recycle = true
+		case w.state != WorkerDead && w.expiredLocked(time.Now()):
+			recycle, expired = true, true
+		case w.state != WorkerDead && w.state != WorkerWarming:
+			w.state = WorkerIdle
+		}
+	}
 	w.stateMu.Unlock()
+
+	if expired {
+		w.recycled(RecycleMaxLifetime)
+	}
+	if recycle {
+		w.markDead()
+	}
+}
+
+// idleFor returns how long the worker has been idle with nothing in
+// flight, or 0 if it is busy or not idle.
+func (w *Worker) idleFor(now time.Time) time.Duration {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	if w.state != WorkerIdle || w.inFlight > 0 || w.lastActive.IsZero() {
+		return 0
+	}
+	return now.Sub(w.lastActive)
+}
+
+// busyFor returns how long the worker has had requests in flight without
+// a break, or 0 if it is idle.
+func (w *Worker) busyFor(now time.Time) time.Duration {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	if w.busySince.IsZero() {
+		return 0
+	}
+	return now.Sub(w.busySince)
 }
 
 func (w *Worker) getInFlight() int {
@@ -164,365 +671,753 @@ func (w *Worker) isDraining() bool {
 	return draining
 }
 
+// stop kills the worker's process and marks it dead.
+func (w *Worker) stop() {
+	w.markDead()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expectExit()
+	if w.stdin != nil {
+		_ = w.stdin.Close()
+	}
+	w.killProcess()
+}
+
+// forceStop kills the worker's process and marks it dead without
+// waiting, as stop does, for the request it is serving, which fails.
+func (w *Worker) forceStop() {
+	w.markDead()
+	w.expectExit()
+	w.killProcess()
+	w.abortRead()
+}
+
 func (w *Worker) restart() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.restartLocked()
+}
 
+// restartIfDead restarts the worker unless a concurrent request already
+// did. It reports whether it restarted it.
+func (w *Worker) restartIfDead() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.isDead() {
+		return false, nil
+	}
+	return true, w.restartLocked()
+}
+
+// restartLocked is restart for callers holding w.mu.
+func (w *Worker) restartLocked() error {
+	w.expectExit()
 	if w.stdin != nil {
 		_ = w.stdin.Close()
 	}
 	if w.stdout != nil {
 		_ = w.stdout.Close()
 	}
-	if w.cmd != nil && w.cmd.Process != nil {
-		_ = w.cmd.Process.Kill()
-		_, _ = w.cmd.Process.Wait()
-	}
+	w.killProcess()
 
-	workerPath := filepath.Join(w.baseDir, "php", "worker.php")
-	cmd := exec.Command("php", workerPath)
-	cmd.Dir = w.baseDir
-
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
+	// what the old process printed is no help with the new one
+	w.stderr.Reset()
+	var stderr io.Writer
+	if w.stderr != nil {
+		stderr = w.stderr
 	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		_ = stdin.Close()
-		return err
+	var (
+		cmd      *exec.Cmd
+		stdin    io.WriteCloser
+		stdout   io.ReadCloser
+		codec    Codec
+		protocol int
+		err      error
+	)
+	startedAt := time.Now()
+	if w.start != nil {
+		stdin, stdout, err = w.start()
+	} else {
+		cmd, stdin, stdout, codec, protocol, err = startWorkerProcess(w.log(), w.phpBinary, w.baseDir, w.wantCodec, w.requestTimeout, stderr)
 	}
-
-	cmd.Stderr = log.Writer()
-
-	if err := cmd.Start(); err != nil {
-		_ = stdin.Close()
-		_ = stdout.Close()
+	if err != nil {
+		w.died("start failed", err)
 		return err
 	}
 
-	w.cmd = cmd
 	w.stdin = stdin
 	w.stdout = stdout
+	w.codec = codec
+	w.protocol = protocol
+	w.resetPipeline()
 
 	w.deadMu.Lock()
 	w.dead = false
 	w.deadMu.Unlock()
 
 	w.stateMu.Lock()
+	// requests queued on the old process are still counted in; each
+	// counts itself out when it finishes
 	w.state = WorkerIdle
-	w.inFlight = 0
+	if w.inFlight > 0 {
+		w.state = WorkerBusy
+	}
+	w.startedAt = startedAt
+	w.spawnedAt = time.Now()
+	w.lastActive = w.spawnedAt
+	w.jitter = rand.Float64() * lifetimeJitter
+	w.pid, w.proc = 0, nil
+	if cmd != nil {
+		w.pid = cmd.Process.Pid
+		w.proc = w.watch(cmd)
+	}
+	pid := w.pid
 	w.stateMu.Unlock()
+	atomic.StoreInt64(&w.rss, 0)
 
 	atomic.StoreUint64(&w.requestCount, 0)
+	atomic.AddUint64(&w.restarts, 1)
 
-	log.Println("Restarted PHP worker in", w.baseDir)
+	w.log().Info("worker restarted", "pid", pid, "dir", w.baseDir)
+	w.emitStarted()
+	w.warmLocked()
 
 	return nil
 }
 
+// stat returns a snapshot of the worker as of now.
+func (w *Worker) stat(now time.Time) WorkerStat {
+	w.stateMu.RLock()
+	st := WorkerStat{
+		PID:       w.pid,
+		State:     w.state.String(),
+		InFlight:  w.inFlight,
+		SpawnedAt: w.spawnedAt,
+	}
+	w.stateMu.RUnlock()
+
+	st.BusySeconds = w.busyFor(now).Seconds()
+
+	if !st.SpawnedAt.IsZero() {
+		st.UptimeSeconds = now.Sub(st.SpawnedAt).Seconds()
+	}
+	st.Requests = atomic.LoadUint64(&w.requestCount)
+	st.TotalRequests = atomic.LoadUint64(&w.totalRequests)
+	st.MaxRequests = w.maxRequests
+	st.Restarts = atomic.LoadUint64(&w.restarts)
+	st.RSS = w.RSS()
+	return st
+}
+
+// SetMaxLifetime recycles the worker's process once it has been running
+// for about d, whatever its request count. Each process retires at a
+// random point up to 10% early. Zero disables it.
+func (w *Worker) SetMaxLifetime(d time.Duration) {
+	w.stateMu.Lock()
+	w.maxLifetime = d
+	w.stateMu.Unlock()
+}
+
+// expired reports whether the process has outlived its max lifetime.
+func (w *Worker) expired(now time.Time) bool {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return w.expiredLocked(now)
+}
+
+// expiredLocked is expired for callers holding w.stateMu.
+func (w *Worker) expiredLocked(now time.Time) bool {
+	if w.maxLifetime <= 0 || w.spawnedAt.IsZero() {
+		return false
+	}
+	limit := time.Duration(float64(w.maxLifetime) * (1 - w.jitter))
+	return now.Sub(w.spawnedAt) >= limit
+}
+
+// SetMaxRSS recycles the worker once its resident memory exceeds limit
+// bytes, as sampled by the pool reaper. Zero disables it.
+func (w *Worker) SetMaxRSS(limit int64) {
+	atomic.StoreInt64(&w.maxRSS, limit)
+}
+
+// RSS returns the worker's resident memory in bytes as last sampled, or 0
+// if it hasn't been sampled (or can't be on this platform).
+func (w *Worker) RSS() int64 {
+	return atomic.LoadInt64(&w.rss)
+}
+
+// sampleRSS refreshes the worker's RSS and reports whether it is over the
+// configured limit.
+func (w *Worker) sampleRSS() bool {
+	w.stateMu.RLock()
+	pid := w.pid
+	w.stateMu.RUnlock()
+	if pid == 0 {
+		return false
+	}
+
+	rss, err := processRSS(pid)
+	if err != nil {
+		return false
+	}
+	atomic.StoreInt64(&w.rss, rss)
+
+	limit := atomic.LoadInt64(&w.maxRSS)
+	return limit > 0 && rss > limit
+}
+
+// SetPublisher routes the worker's publish frames to p. A nil p drops them.
+func (w *Worker) SetPublisher(p Publisher) {
+	w.mu.Lock()
+	w.publisher = p
+	w.resetPipeline()
+	w.mu.Unlock()
+}
+
+// publishFrame hands a publish frame to pub.
+func (w *Worker) publishFrame(pub Publisher, frame StreamFrame) {
+	if frame.Channel == "" {
+		w.log().Warn("publish frame without channel dropped")
+		return
+	}
+	if pub == nil {
+		w.log().Warn("publish frame dropped: no publisher configured", "channel", frame.Channel)
+		return
+	}
+	pub.Publish(frame.Channel, frame.Event, frame.Payload)
+}
+
 func (w *Worker) Handle(payload *RequestPayload) (*ResponsePayload, error) {
 	if w.isDead() {
-		return nil, ErrWorkerDead
+		return nil, w.withStderr(ErrWorkerDead)
 	}
 
 	// don't send new work to draining workers
-	if w.isDraining() {
+	if !w.beginRequest() {
 		return nil, ErrWorkerDraining
 	}
-
-	w.incrInFlight()
-	w.setState(WorkerBusy)
-	defer func() {
-		w.decrInFlight()
-		if w.getInFlight() == 0 && w.isDraining() {
-			// safe to recycle
-			w.markDead()
-		} else if !w.isDead() {
-			w.setState(WorkerIdle)
-		}
-	}()
+	defer w.endRequest()
 
 	for attempt := 0; attempt < 2; attempt++ {
 		if w.isDead() {
-			if err := w.restart(); err != nil {
+			restarted, err := w.restartIfDead()
+			if err != nil {
 				return nil, err
 			}
+			if restarted {
+				payload.traceAttr("php.worker_restarted", true)
+			}
 		}
 
 		resp, err := w.handleRequest(payload)
 		if err != nil {
+			if errors.Is(err, ErrRetryElsewhere) {
+				// the pipe is fine, the process isn't
+				w.recycleAfterRetry(err)
+				return nil, err
+			}
 			if isBrokenPipe(err) {
+				w.died("broken pipe", err)
 				w.markDead()
-				continue
+				// PHP may have acted on the request before the pipe broke,
+				// so only replay what is safe to run twice, and what the
+				// client has seen none of
+				if payload.Retryable() && !payload.relayed {
+					payload.traceAttr("php.retried", true)
+					continue
+				}
 			}
-			return nil, err
+			return nil, w.withStderr(err)
 		}
 
 		// increment request count and recycle if exceeding maxRequests
 		n := atomic.AddUint64(&w.requestCount, 1)
+		atomic.AddUint64(&w.totalRequests, 1)
 		if w.maxRequests > 0 && int(n) >= w.maxRequests {
+			w.recycled(RecycleMaxRequests)
 			w.markDead()
 		}
 
 		return resp, nil
 	}
 
-	return nil, io.ErrUnexpectedEOF
+	return nil, w.withStderr(io.ErrUnexpectedEOF)
+}
+
+// recoveredError logs a panic recovered in a worker goroutine and turns
+// it into an error for the waiting request, so a malformed frame from a
+// worker can't take the whole process down.
+func recoveredError(logger *slog.Logger, where string, p any) error {
+	logger.Error("panic in worker goroutine", "where", where, "panic", p, "stack", string(debug.Stack()))
+	return fmt.Errorf("worker %s panic: %v", where, p)
 }
 
+// isBrokenPipe reports whether err means the pipe to the worker is gone.
+// io.ErrClosedPipe is what an in-process worker (WorkerConfig.Start) on
+// an io.Pipe gives instead of EPIPE.
 func isBrokenPipe(err error) bool {
 	if err == nil {
 		return false
 	}
 	errStr := err.Error()
-	return err == io.EOF ||
-		err == io.ErrUnexpectedEOF ||
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
 		strings.Contains(errStr, "broken pipe") ||
 		strings.Contains(errStr, "write |1:") ||
 		strings.Contains(errStr, "read |0:")
 }
 
 func (w *Worker) handleRequest(payload *RequestPayload) (*ResponsePayload, error) {
+	if payload.body == nil {
+		w.mu.RLock()
+		if w.slots != nil {
+			defer w.mu.RUnlock()
+			// responses share the pipe, so none may come in pieces
+			payload.StreamResponse = false
+			return w.handlePipelined(payload)
+		}
+		w.mu.RUnlock()
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.handleLocked(payload)
+}
 
-	jsonBytes, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-	length := uint32(len(jsonBytes))
+// handleLocked is handleRequest for callers holding w.mu: the request has
+// the pipe to itself.
+func (w *Worker) handleLocked(payload *RequestPayload) (*ResponsePayload, error) {
+	payload.StreamResponse = payload.rw != nil
 
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, length)
+	if !w.speaks(protoBodyStream) {
+		if err := payload.inlineBody(); err != nil {
+			return nil, err
+		}
+	}
 
-	if _, err := w.stdin.Write(header); err != nil {
+	codec := w.frameCodec()
+	payload.timing.sending()
+	sent := time.Now()
+	if err := writeFrame(w.stdin, codec, payload); err != nil {
+		// part of the frame may be on the pipe, leaving it out of step
+		w.markDead()
 		return nil, err
 	}
-	if _, err := w.stdin.Write(jsonBytes); err != nil {
-		return nil, err
+	var bodyDone <-chan error
+	if payload.body != nil {
+		bodyDone = w.sendBody(codec, payload.body)
 	}
 
 	type result struct {
-		resp *ResponsePayload
-		err  error
+		resp   *ResponsePayload
+		stream *StreamFrame // the first frame of a streamed response
+		err    error
 	}
 
 	resCh := make(chan result, 1)
+	stdout, pub := w.stdout, w.publisher
+	w.setReading(stdout)
+	defer w.setReading(nil)
 
 	go func() {
-		// read length header
-		hdr := make([]byte, 4)
-		if _, err := io.ReadFull(w.stdout, hdr); err != nil {
-			resCh <- result{nil, err}
-			return
-		}
-
-		respLen := binary.BigEndian.Uint32(hdr)
+		defer func() {
+			if p := recover(); p != nil {
+				// the pipe is in an unknown state now
+				w.markDead()
+				resCh <- result{err: recoveredError(w.log(), "reader", p)}
+			}
+		}()
+		for {
+			body, buf, err := w.readFrame(stdout)
+			if err != nil {
+				// whatever is left on the pipe can't be trusted
+				w.markDead()
+				resCh <- result{err: err}
+				return
+			}
 
-		if respLen == 0 || respLen > 10*1024*1024 {
-			resCh <- result{nil, io.ErrUnexpectedEOF}
-			return
-		}
+			// publish frames may precede the response; route them and
+			// keep reading. A retry frame takes the response's place.
+			var kind struct {
+				Type string `json:"type"`
+			}
+			kindErr := codec.Unmarshal(body, &kind)
+			if kindErr == nil && payload.StreamResponse && (kind.Type == "headers" || kind.Type == "chunk") {
+				// PHP chose to stream the response; the caller relays it,
+				// so nothing touches the client after a timeout here
+				frame, err := w.decodeStreamFrame(codec, body, buf)
+				if err != nil {
+					w.markDead()
+					resCh <- result{err: err}
+					return
+				}
+				resCh <- result{stream: frame}
+				return
+			}
+			if kindErr == nil && (kind.Type == "publish" || kind.Type == "retry") {
+				var frame StreamFrame
+				if err := codec.Unmarshal(body, &frame); err != nil {
+					w.markDead()
+					err = w.badFrame(body, err)
+					w.frames.put(buf)
+					resCh <- result{err: err}
+					return
+				}
+				w.frames.put(buf)
+				if frame.Type == "retry" {
+					resCh <- result{err: retryFrameError(frame)}
+					return
+				}
+				w.publishFrame(pub, frame)
+				continue
+			}
 
-		respJSON := make([]byte, respLen)
-		if _, err := io.ReadFull(w.stdout, respJSON); err != nil {
-			resCh <- result{nil, err}
-			return
-		}
+			// decoding copies everything out of body, so the buffer can
+			// go back before the response is handed over
+			var resp ResponsePayload
+			if err := codec.Unmarshal(body, &resp); err != nil {
+				w.markDead()
+				err = w.badFrame(body, err)
+				w.frames.put(buf)
+				resCh <- result{err: err}
+				return
+			}
+			if err := checkStatus(&resp.Status); err != nil {
+				// the frame itself was fine, so the pipe is still in step
+				err = w.badFrame(body, err)
+				w.frames.put(buf)
+				resCh <- result{err: err}
+				return
+			}
+			w.frames.put(buf)
 
-		var resp ResponsePayload
-		if err := json.Unmarshal(respJSON, &resp); err != nil {
-			resCh <- result{nil, err}
+			resCh <- result{resp: &resp}
 			return
 		}
-
-		resCh <- result{&resp, nil}
 	}()
 
-	if w.requestTimeout > 0 {
+	var res result
+	timeout := w.timeoutFor(payload)
+	if timeout > 0 {
 		select {
-		case res := <-resCh:
-			return res.resp, res.err
-		case <-time.After(w.requestTimeout):
-			// Kill and mark dead on timeout
+		case res = <-resCh:
+		case <-time.After(timeout):
+			// Kill and mark dead on timeout; closing stdout ends the reader
+			w.recycled(RecycleTimeout)
 			w.markDead()
-			if w.cmd != nil && w.cmd.Process != nil {
-				_ = w.cmd.Process.Kill()
-				_, _ = w.cmd.Process.Wait()
-			}
-			return nil, fmt.Errorf("worker request timeout after %s", w.requestTimeout)
+			w.killProcess()
+			w.abortRead()
+			return nil, fmt.Errorf("%w: no response after %s", ErrWorkerTimeout, timeout)
 		}
+	} else {
+		res = <-resCh
 	}
 
-	res := <-resCh
+	if res.stream != nil {
+		// relayed here, under w.mu, so the client is never written to
+		// after we return; what is left of the timeout bounds it
+		stop := func() bool { return false }
+		if timeout > 0 {
+			stop = w.expireAfter(max(timeout-time.Since(sent), time.Millisecond))
+		}
+		status, err := w.relayStream(payload, payload.rw, codec, res.stream)
+		if stop() {
+			w.recycled(RecycleTimeout)
+			err = fmt.Errorf("%w: streamed response not finished after %s", ErrWorkerTimeout, timeout)
+		}
+		res = result{err: err}
+		if err == nil {
+			res.resp = &ResponsePayload{ID: payload.ID, Status: status, streamed: true}
+		}
+	}
+
+	if err := bodyError(bodyDone, res.err != nil); err != nil {
+		return nil, err
+	}
+	if res.err == nil {
+		payload.timing.answered()
+	}
 	return res.resp, res.err
 }
 
-// Stream sends the request and streams the response frames directly to the client.
-func (w *Worker) Stream(req *RequestPayload, rw http.ResponseWriter) error {
-	if w.isDead() || w.isDraining() {
-		return ErrWorkerDead
+// badFrame logs a frame the worker sent that was rejected with err, and
+// returns err marked as ErrBadFrame.
+func (w *Worker) badFrame(frame []byte, err error) error {
+	w.log().Debug("malformed frame from worker", "frame", frameSnippet(frame), "err", err)
+	if errors.Is(err, ErrBadFrame) {
+		return err
 	}
+	return fmt.Errorf("%w: %v", ErrBadFrame, err)
+}
 
-	w.incrInFlight()
-	w.setState(WorkerBusy)
-	defer func() {
-		w.decrInFlight()
-		if w.getInFlight() == 0 && w.isDraining() {
+// timeoutFor returns how long the worker waits for req: its own Timeout
+// if set, else the worker's request timeout.
+func (w *Worker) timeoutFor(req *RequestPayload) time.Duration {
+	if req.Timeout > 0 {
+		return req.Timeout
+	}
+	return w.requestTimeout
+}
+
+// sendBody streams a request body to the worker in the background, so the
+// response can be read while the body is still going out. If sending
+// fails the worker is left mid-request, so its process is killed; the
+// error, which explains the failed exchange better than the broken pipe
+// the reader sees, is delivered on the returned channel.
+func (w *Worker) sendBody(codec Codec, body io.Reader) <-chan error {
+	done := make(chan error, 1)
+	stdin := w.stdin
+	go func() {
+		err := writeBodyFrames(stdin, codec, body)
+		// report before killing, so the reader's EOF finds it
+		done <- err
+		if err != nil {
 			w.markDead()
-		} else if !w.isDead() {
-			w.setState(WorkerIdle)
+			_ = stdin.Close()
+			w.killProcess()
 		}
 	}()
+	return done
+}
 
-	type result struct {
-		err error
+// bodyError returns the error sendBody delivered on done, if any. After a
+// successful exchange it waits for the body to finish, as PHP drains what
+// it didn't read before taking the next request. After a failed one it
+// only picks up an error that is already there: the writer may be stuck
+// on a slow client, and the process is gone anyway.
+func bodyError(done <-chan error, failed bool) error {
+	if done == nil {
+		return nil
 	}
+	if !failed {
+		return <-done
+	}
+	select {
+	case err := <-done:
+		return err
+	default:
+		return nil
+	}
+}
 
-	resCh := make(chan result, 1)
-
-	go func() {
-		resCh <- result{err: w.streamInternal(req, rw)}
-	}()
-
-	if w.requestTimeout > 0 {
-		select {
-		case res := <-resCh:
-			return res.err
-		case <-time.After(w.requestTimeout):
-			// Kill and mark dead on timeout
-			w.markDead()
-			if w.cmd != nil && w.cmd.Process != nil {
-				_ = w.cmd.Process.Kill()
-				_, _ = w.cmd.Process.Wait()
+// Stream sends the request and streams the response frames directly to the client.
+func (w *Worker) Stream(req *RequestPayload, rw http.ResponseWriter) error {
+	if w.isDead() {
+		return w.withStderr(ErrWorkerDead)
+	}
+	if !w.beginRequest() {
+		return ErrWorkerDraining
+	}
+	defer w.endRequest()
+
+	// relayed on this goroutine, so rw is never written to after Stream
+	// returns; on timeout the killed process ends the relay
+	timeout := w.timeoutFor(req)
+	stop := w.expireAfter(timeout)
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				w.markDead()
+				err = recoveredError(w.log(), "stream", p)
 			}
-			return fmt.Errorf("worker stream timeout after %s", w.requestTimeout)
-		}
+		}()
+		return w.streamInternal(req, rw)
+	}()
+	if stop() {
+		w.recycled(RecycleTimeout)
+		return w.withStderr(fmt.Errorf("%w: stream not finished after %s", ErrWorkerTimeout, timeout))
 	}
-
-	res := <-resCh
-	return res.err
+	if errors.Is(err, ErrRetryElsewhere) {
+		w.recycleAfterRetry(err)
+		return err
+	}
+	return w.withStderr(err)
 }
 
 // streamInternal performs the actual length-prefixed send/receive under lock.
-func (w *Worker) streamInternal(req *RequestPayload, rw http.ResponseWriter) error {
+func (w *Worker) streamInternal(req *RequestPayload, rw http.ResponseWriter) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.isDead() {
-		if err := w.restart(); err != nil {
+		if err := w.restartLocked(); err != nil {
 			return err
 		}
+		req.traceAttr("php.worker_restarted", true)
 	}
 
-	// 1) Encode and send the request as length-prefixed JSON
-	jsonBytes, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-	length := uint32(len(jsonBytes))
+	w.setReading(w.stdout)
+	defer w.setReading(nil)
 
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, length)
+	if !w.speaks(protoBodyStream) {
+		if err := req.inlineBody(); err != nil {
+			return err
+		}
+	}
 
-	if _, err := w.stdin.Write(header); err != nil {
+	// 1) Encode and send the request as a length-prefixed frame
+	codec := w.frameCodec()
+	req.timing.sending()
+	if err := writeFrame(w.stdin, codec, req); err != nil {
+		w.markDead()
 		return err
 	}
-	if _, err := w.stdin.Write(jsonBytes); err != nil {
-		return err
+	if req.body != nil {
+		bodyDone := w.sendBody(codec, req.body)
+		defer func() {
+			if berr := bodyError(bodyDone, err != nil); berr != nil {
+				err = berr
+			}
+		}()
 	}
 
+	_, err = w.relayStream(req, rw, codec, nil)
+	return err
+}
+
+// relayStream writes the streamed response the worker sends for req to rw
+// as its frames arrive, starting with first if the caller already read
+// it, and returns the response status. Callers must hold w.mu.
+func (w *Worker) relayStream(req *RequestPayload, rw http.ResponseWriter, codec Codec, first *StreamFrame) (int, error) {
 	headersSent := false
 	statusCode := http.StatusOK
 
-	for {
-		// 2) Read 4-byte frame length
-		hdr := make([]byte, 4)
-		if _, err := io.ReadFull(w.stdout, hdr); err != nil {
-			w.markDead()
-			return err
+	// HEAD, 204 and 304 responses have no body, so chunks from the worker
+	// are dropped
+	head := req.Method == http.MethodHead
+	noBody := head
+	writeData := func(data string) error {
+		if data == "" || noBody {
+			return nil
 		}
-
-		frameLen := binary.BigEndian.Uint32(hdr)
-
-		if frameLen == 0 || frameLen > 10*1024*1024 {
-			w.markDead()
-			return io.ErrUnexpectedEOF
-		}
-
-		// 3) Read JSON frame
-		frameJSON := make([]byte, frameLen)
-		if _, err := io.ReadFull(w.stdout, frameJSON); err != nil {
+		if _, err := rw.Write([]byte(data)); err != nil {
+			// the client is gone; the rest of the response is
+			// abandoned on the pipe
 			w.markDead()
 			return err
 		}
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
 
-		var frame StreamFrame
-		if err := json.Unmarshal(frameJSON, &frame); err != nil {
-			w.markDead()
-			return err
+	for {
+		frame := first
+		first = nil
+		if frame == nil {
+			var err error
+			if frame, err = w.readStreamFrame(codec); err != nil {
+				return statusCode, err
+			}
 		}
 
 		switch frame.Type {
 		case "headers":
-			if frame.Headers != nil {
-				for k, vs := range frame.Headers {
-					if len(vs) == 0 {
-						continue
-					}
-
-					if strings.ToLower(k) == "set-cookie" {
-						// can't join, must be dealt with separately
-						for _, v := range vs {
-							rw.Header().Add(k, v)
-						}
-					} else {
-						// RFC-compliant: join
-						rw.Header().Set(k, strings.Join(vs, ", "))
-					}
-
-				}
+			frame.Headers = guardHeaders(req.headerPolicy, frame.Headers)
+			if req.streamHook != nil {
+				req.streamHook(req, frame)
 			}
+			copyFrameHeaders(rw.Header(), frame.Headers)
 			if frame.Status != 0 {
 				statusCode = frame.Status
 			}
+			if !bodyAllowed(statusCode) {
+				noBody = true
+				rw.Header().Del("Content-Length")
+				rw.Header().Del("Transfer-Encoding")
+			}
+			if isEventStream(rw.Header()) {
+				prepareEventStream(rw.Header())
+			}
+			req.timing.answered()
+			req.timing.setHeader(rw.Header())
 			rw.WriteHeader(statusCode)
-			headersSent = true
+			headersSent, req.relayed = true, true
 
-			if frame.Data != "" {
-				if _, err := rw.Write([]byte(frame.Data)); err != nil {
-					return err
-				}
-				if f, ok := rw.(http.Flusher); ok {
-					f.Flush()
-				}
+			if err := writeData(frame.Data); err != nil {
+				return statusCode, err
 			}
 
 		case "chunk":
+			if !headersSent && req.streamHook != nil {
+				// no headers frame, but the hook still gets its say
+				hf := &StreamFrame{Type: "headers", Status: statusCode}
+				req.streamHook(req, hf)
+				copyFrameHeaders(rw.Header(), hf.Headers)
+				if hf.Status != 0 {
+					statusCode = hf.Status
+				}
+				frame.Data = hf.Data + frame.Data
+			}
 			if !headersSent {
+				req.timing.answered()
+				req.timing.setHeader(rw.Header())
 				rw.WriteHeader(statusCode)
-				headersSent = true
+				headersSent, req.relayed = true, true
 			}
-			if frame.Data != "" {
-				if _, err := rw.Write([]byte(frame.Data)); err != nil {
-					return err
-				}
-				if f, ok := rw.(http.Flusher); ok {
-					f.Flush()
-				}
+			if err := writeData(frame.Data); err != nil {
+				return statusCode, err
 			}
 
+		case "publish":
+			w.publishFrame(w.publisher, *frame)
+
 		case "end":
 			// Normal end of stream
-			return nil
+			if !noBody {
+				addTrailers(rw.Header(), guardHeaders(req.headerPolicy, frame.Trailers))
+			}
+			return statusCode, nil
 
 		case "error":
-			return fmt.Errorf("stream error from worker: %s", frame.Error)
+			return statusCode, &WorkerError{Status: frame.Status, Message: frame.Error}
+
+		case "retry":
+			if headersSent {
+				// too late to hand the request to another worker
+				w.startDraining()
+				return statusCode, &WorkerError{Message: "retry after the response started: " + frame.Error}
+			}
+			return statusCode, retryFrameError(*frame)
 
 		default:
-			return fmt.Errorf("unknown stream frame type: %q", frame.Type)
+			return statusCode, fmt.Errorf("unknown stream frame type: %q", frame.Type)
 		}
 	}
 }
+
+// readStreamFrame reads and decodes the next frame of a streamed response.
+// Callers must hold w.mu.
+func (w *Worker) readStreamFrame(codec Codec) (*StreamFrame, error) {
+	body, buf, err := w.readFrame(w.stdout)
+	if err != nil {
+		w.markDead()
+		return nil, err
+	}
+	return w.decodeStreamFrame(codec, body, buf)
+}
+
+// decodeStreamFrame decodes a frame of a streamed response read into buf,
+// which it gives back.
+func (w *Worker) decodeStreamFrame(codec Codec, body []byte, buf *[]byte) (*StreamFrame, error) {
+	var frame StreamFrame
+	err := codec.Unmarshal(body, &frame)
+	if err == nil && frame.Type == "headers" {
+		err = checkStatus(&frame.Status)
+	}
+	if err != nil {
+		// for a bad status, the rest of the response is abandoned on
+		// the pipe
+		w.markDead()
+		err = w.badFrame(body, err)
+		w.frames.put(buf)
+		return nil, err
+	}
+	// frame holds copies of everything in body, so the buffer goes
+	// back before any data is handed to rw
+	w.frames.put(buf)
+	return &frame, nil
+}
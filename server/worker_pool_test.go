@@ -1,13 +1,22 @@
 package server
 
 import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-// NOTE: these tests operate only on the Worker state flags and pool logic.
+// NOTE: most of these tests operate only on the Worker state flags and pool logic.
 // we do not need real php worker processes; zero-value *Worker is fine
-// as long as we only use state helpers (markDead, startDraining, etc.)
+// as long as we only use state helpers (markDead, startDraining, etc.).
+// The ones that dispatch requests use WorkerConfig.Start with fakeStart.
 
 func TestNewPoolCreatesCorrectNumberOfWorkers(t *testing.T) {
 	poolSize := 3
@@ -128,6 +137,32 @@ func TestScaleToGrowUsesFactory(t *testing.T) {
 	}
 }
 
+func TestStatsConcurrentWithScaleTo(t *testing.T) {
+	pool := &WorkerPool{workers: []*Worker{{}}}
+	s := &Server{fastPool: pool, slowPool: &WorkerPool{}}
+	factory := func() (*Worker, error) { return &Worker{}, nil }
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 500 {
+			_ = pool.ScaleTo(1+i%4, factory)
+			runtime.Gosched()
+		}
+	}()
+
+	for range 500 {
+		if st := pool.Stats(); st.Workers < 1 || st.Workers > 4 {
+			t.Fatalf("torn stats: %+v", st)
+		}
+		_ = pool.WorkerStats()
+		s.markAllWorkersDead()
+		runtime.Gosched()
+	}
+	wg.Wait()
+}
+
 func TestStatsCountsDeadWorkers(t *testing.T) {
 	w1 := &Worker{}
 	w2 := &Worker{}
@@ -147,3 +182,356 @@ func TestStatsCountsDeadWorkers(t *testing.T) {
 		t.Fatalf("expected DeadWorkers=1, got %d", stats.DeadWorkers)
 	}
 }
+
+func TestReapRestartsExpiredAndDeadWorkers(t *testing.T) {
+	pool, err := NewPoolWithConfig(3, WorkerConfig{MaxRequests: 10, RequestTimeout: 500 * time.Millisecond, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig returned error: %v", err)
+	}
+	defer pool.stopAll()
+	expired, dead, draining := pool.workers[0], pool.workers[1], pool.workers[2]
+	pool.SetMaxLifetime(time.Minute)
+
+	old := time.Now().Add(-time.Hour)
+	for _, w := range pool.workers {
+		w.spawnedAt = old
+	}
+	dead.markDead()
+	draining.startDraining()
+
+	pool.reap(time.Now())
+
+	for name, w := range map[string]*Worker{"expired": expired, "dead": dead} {
+		if w.isDead() || !w.spawnedAt.After(old) {
+			t.Fatalf("expected %s worker to be restarted (dead=%v)", name, w.isDead())
+		}
+	}
+	if !draining.isDraining() || draining.spawnedAt != old {
+		t.Fatalf("draining worker must be left alone")
+	}
+}
+
+func TestNewPoolStartsWorkersConcurrently(t *testing.T) {
+	// a php stand-in that takes a while to boot before its ready frame
+	dir := newProjectDir(t)
+	php := filepath.Join(dir, "slowphp")
+	script := "#!/bin/sh\nsleep 0.4\nprintf '\\000\\000\\000\\037{\"type\":\"ready\",\"codec\":\"json\"}'\nexec cat >/dev/null\n"
+	if err := os.WriteFile(php, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake php: %v", err)
+	}
+	t.Setenv("GO_PHP_CODEC", "msgpack") // makes NewWorker wait for the handshake
+
+	start := time.Now()
+	pool, err := NewPoolWithConfig(4, WorkerConfig{PHPBinary: php, BaseDir: dir, RequestTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+
+	if elapsed := time.Since(start); elapsed > 1200*time.Millisecond {
+		t.Fatalf("4 workers took %s to start; expected them to boot in parallel", elapsed)
+	}
+	if len(pool.workers) != 4 {
+		t.Fatalf("expected 4 workers, got %d", len(pool.workers))
+	}
+	for i, w := range pool.workers {
+		if w == nil || w.isDead() {
+			t.Fatalf("worker %d not started", i)
+		}
+	}
+}
+
+func TestNewPoolFailsWhenWorkersCannotStart(t *testing.T) {
+	pool, err := NewPoolWithConfig(3, WorkerConfig{PHPBinary: "/nonexistent/php"})
+	if err == nil || pool != nil {
+		t.Fatalf("expected an error and no pool, got %v, %v", pool, err)
+	}
+	if !errors.Is(err, ErrPHPNotFound) || strings.Count(err.Error(), "/nonexistent/php") != 1 {
+		t.Fatalf("expected one ErrPHPNotFound for the pool, got %v", err)
+	}
+}
+
+func TestCrashedWorkerIsRestartedWithoutARequest(t *testing.T) {
+	// a php stand-in that dies on its own shortly after booting
+	dir := newProjectDir(t)
+	php := filepath.Join(dir, "crashphp")
+	script := "#!/bin/sh\nprintf '\\000\\000\\000\\054{\"type\":\"ready\",\"codec\":\"json\",\"protocol\":2}'\nsleep 0.2\nexit 3\n"
+	if err := os.WriteFile(php, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake php: %v", err)
+	}
+
+	pool, err := NewPoolWithConfig(1, WorkerConfig{PHPBinary: php, BaseDir: dir, RequestTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+	w := pool.workers[0]
+	w.stateMu.RLock()
+	spawned := w.spawnedAt
+	w.stateMu.RUnlock()
+
+	// an interval this long means only the crash can trigger a pass
+	pool.StartReaper(time.Hour)
+	defer pool.StopReaper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		w.stateMu.RLock()
+		restarted := w.spawnedAt.After(spawned)
+		w.stateMu.RUnlock()
+		if restarted {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("crashed worker was not restarted")
+}
+
+func TestIntentionalRestartIsNotACrash(t *testing.T) {
+	// a real process, since only those have an exit to watch; the
+	// stand-in exits by itself once its stdin is closed, as PHP does
+	php, dir := newStandInPHP(t)
+	w, err := NewWorkerWithConfig(WorkerConfig{MaxRequests: 10, RequestTimeout: 500 * time.Millisecond, PHPBinary: php, BaseDir: dir})
+	if err != nil {
+		t.Fatalf("NewWorkerWithConfig: %v", err)
+	}
+	defer w.stop()
+
+	var crashes atomic.Int32
+	w.SetOnExit(func(*Worker) { crashes.Add(1) })
+
+	if err := w.restart(); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if crashes.Load() != 0 || w.isDead() {
+		t.Fatalf("restart was treated as a crash (crashes=%d dead=%v)", crashes.Load(), w.isDead())
+	}
+
+	w.stop()
+	time.Sleep(100 * time.Millisecond)
+	if crashes.Load() != 0 {
+		t.Fatalf("stop was treated as a crash")
+	}
+}
+
+func TestWorkerStatsReportsPerWorkerCounts(t *testing.T) {
+	pool := newFakePool(t, 2, time.Second)
+	for i := 0; i < 3; i++ {
+		if _, err := pool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/"}); err != nil {
+			t.Fatalf("Dispatch: %v", err)
+		}
+	}
+	pool.workers[1].startDraining()
+
+	stats := pool.WorkerStats()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 worker stats, got %d", len(stats))
+	}
+	if stats[0].Index != 0 || stats[0].Requests != 2 || stats[0].TotalRequests != 2 || stats[0].State != "idle" {
+		t.Fatalf("worker 0: %+v", stats[0])
+	}
+	if stats[1].Index != 1 || stats[1].Requests != 1 || stats[1].State != "draining" || stats[1].MaxRequests != 1000 {
+		t.Fatalf("worker 1: %+v", stats[1])
+	}
+}
+
+func TestWorkerStatsCountsRestarts(t *testing.T) {
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 10, RequestTimeout: time.Second, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+	w := pool.workers[0]
+	atomic.StoreUint64(&w.requestCount, 4)
+	atomic.StoreUint64(&w.totalRequests, 4)
+	spawned := pool.WorkerStats()[0].SpawnedAt
+
+	if err := w.restart(); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	st := pool.WorkerStats()[0]
+	if st.Restarts != 1 || st.Requests != 0 || st.TotalRequests != 4 {
+		t.Fatalf("unexpected stats after restart: %+v", st)
+	}
+	if !st.SpawnedAt.After(spawned) || st.UptimeSeconds < 0 {
+		t.Fatalf("spawn time not reset by the restart: %+v", st)
+	}
+}
+
+func TestPoolWithStartDispatchesThroughFramesAndRecycles(t *testing.T) {
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 2, RequestTimeout: time.Second, Start: fakeStart(0)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+
+	// the worker recycles after every second request, and each restart
+	// by the reaper starts a new fake PHP side
+	want := []string{"php0:/a", "php0:/b", "php1:/c", "php1:/d", "php2:/e"}
+	for _, w := range want {
+		pool.reap(time.Now())
+		path := w[strings.Index(w, ":")+1:]
+		resp, err := pool.Dispatch(&RequestPayload{ID: path, Method: "GET", Path: path})
+		if err != nil {
+			t.Fatalf("Dispatch(%s): %v", path, err)
+		}
+		if resp.Body != w {
+			t.Fatalf("Dispatch(%s) = %q, want %q", path, resp.Body, w)
+		}
+	}
+	if st := pool.WorkerStats()[0]; st.Restarts != 2 || st.TotalRequests != 5 || st.PID != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestPoolWithStartReplaysAfterBrokenPipe(t *testing.T) {
+	// each fake PHP side dies after one request
+	pool, err := NewPoolWithConfig(1, WorkerConfig{MaxRequests: 100, RequestTimeout: time.Second, Start: fakeStart(1)})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+
+	if _, err := pool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/first"}); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	resp, err := pool.Dispatch(&RequestPayload{ID: "2", Method: "GET", Path: "/again"})
+	if err != nil || resp.Body != "php1:/again" {
+		t.Fatalf("a GET on a broken pipe is replayed on a new worker: %+v, %v", resp, err)
+	}
+
+	if _, err := pool.Dispatch(&RequestPayload{ID: "3", Method: "POST", Path: "/once"}); err == nil {
+		t.Fatal("a POST on a broken pipe must fail rather than run twice")
+	}
+}
+
+func TestPoolWithStartTimesOut(t *testing.T) {
+	start := func() (io.WriteCloser, io.ReadCloser, error) {
+		// a PHP side that reads requests and never answers
+		stdinR, stdinW := io.Pipe()
+		stdoutR, _ := io.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, stdinR) }()
+		return stdinW, stdoutR, nil
+	}
+	pool, err := NewPoolWithConfig(1, WorkerConfig{RequestTimeout: 20 * time.Millisecond, Start: start})
+	if err != nil {
+		t.Fatalf("NewPoolWithConfig: %v", err)
+	}
+	defer pool.stopAll()
+
+	_, err = pool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/slow"})
+	if !errors.Is(err, ErrWorkerTimeout) {
+		t.Fatalf("expected ErrWorkerTimeout, got %v", err)
+	}
+	if !pool.workers[0].isDead() {
+		t.Fatal("a timed-out worker is restarted before its next request")
+	}
+}
+
+// waitDead fails the test unless w is marked dead within a second.
+func waitDead(t *testing.T, w *Worker, what string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !w.isDead() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s should have been killed after the drain timeout", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDrainAllKillsWorkersPastDrainTimeout(t *testing.T) {
+	busy := &Worker{inFlight: 1}
+	pool := &WorkerPool{workers: []*Worker{busy, {}}}
+	pool.SetDrainTimeout(20 * time.Millisecond)
+
+	pool.DrainAll()
+	if busy.isDead() || !busy.isDraining() {
+		t.Fatal("a busy worker should drain before the timeout")
+	}
+	waitDead(t, busy, "a worker with a request still in flight")
+	waitDead(t, pool.workers[1], "an idle worker still draining")
+}
+
+func TestScaleToShrinkTracksCutOffWorkers(t *testing.T) {
+	w1, idle, busy := &Worker{}, &Worker{}, &Worker{inFlight: 1}
+	pool := &WorkerPool{workers: []*Worker{w1, idle, busy}}
+
+	if err := pool.ScaleTo(1, nil); err != nil {
+		t.Fatalf("ScaleTo(1) returned error: %v", err)
+	}
+	if len(pool.retiring) != 2 {
+		t.Fatalf("cut-off workers should be retiring, got %d", len(pool.retiring))
+	}
+	if st := pool.Stats(); st.Workers != 1 || st.Draining != 2 || st.InFlight != 1 {
+		t.Fatalf("Stats should count cut-off workers as draining: %+v", st)
+	}
+
+	// without a drain timeout the reaper stops them once they are idle
+	pool.shrinkIdle(time.Now())
+	if !idle.isDead() || busy.isDead() {
+		t.Fatalf("only the idle worker should be stopped: idle dead=%v, busy dead=%v", idle.isDead(), busy.isDead())
+	}
+	if len(pool.retiring) != 1 || pool.retiring[0] != busy {
+		t.Fatalf("the busy worker should still be retiring: %v", pool.retiring)
+	}
+	if st := pool.Stats(); st.Draining != 1 {
+		t.Fatalf("a stopped worker is no longer draining: %+v", st)
+	}
+
+	pool.stopAll()
+	if !busy.isDead() || len(pool.retiring) != 0 {
+		t.Fatal("stopAll should stop workers still retiring")
+	}
+}
+
+func TestScaleToShrinkKillsWorkersPastDrainTimeout(t *testing.T) {
+	w1, busy := &Worker{}, &Worker{inFlight: 1}
+	pool := &WorkerPool{workers: []*Worker{w1, busy}}
+	pool.SetDrainTimeout(20 * time.Millisecond)
+
+	if err := pool.ScaleTo(1, nil); err != nil {
+		t.Fatalf("ScaleTo(1) returned error: %v", err)
+	}
+	waitDead(t, busy, "a cut-off worker with a request still in flight")
+
+	pool.mu.Lock()
+	left := len(pool.retiring)
+	pool.mu.Unlock()
+	if left != 0 {
+		t.Fatalf("a killed worker should no longer be retiring, %d left", left)
+	}
+	if w1.isDead() {
+		t.Fatal("the remaining worker must not be touched")
+	}
+}
+
+func TestDrainTimeoutFailsHungRequest(t *testing.T) {
+	// the fake PHP side never answers
+	w := newStallWorker(t, -1, func(io.Writer) {})
+	pool := &WorkerPool{workers: []*Worker{w}}
+	pool.SetDrainTimeout(20 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Dispatch(&RequestPayload{ID: "1", Method: "GET", Path: "/hang"})
+		done <- err
+	}()
+	for w.getInFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.DrainAll()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("a request cut off by the drain timeout should fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the drain timeout never ended the hung request")
+	}
+	if !w.isDead() {
+		t.Fatal("the worker should be dead")
+	}
+}
@@ -1,8 +1,18 @@
 package server
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,6 +45,10 @@ func TestIsBrokenPipe(t *testing.T) {
 		t.Fatalf("expected io.EOF to be treated as broken pipe")
 	}
 
+	if !isBrokenPipe(fmt.Errorf("writing request: %w", io.ErrClosedPipe)) {
+		t.Fatalf("expected a closed io.Pipe to be treated as broken pipe")
+	}
+
 	if isBrokenPipe(nil) {
 		t.Fatalf("nil error should not be broken pipe")
 	}
@@ -91,3 +105,424 @@ type nopReadCloser struct{}
 
 func (nopReadCloser) Read(p []byte) (int, error) { return 0, io.EOF }
 func (nopReadCloser) Close() error               { return nil }
+
+type panickingPublisher struct{}
+
+func (panickingPublisher) Publish(channel, event string, payload any) { panic("boom") }
+
+func TestHandleRequestRecoversReaderPanic(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.Write(encodeFrame(t, StreamFrame{Type: "publish", Channel: "c", Event: "e"}))
+	w := &Worker{
+		stdin:     nopWriteCloser{Writer: io.Discard},
+		stdout:    io.NopCloser(buf),
+		publisher: panickingPublisher{},
+	}
+
+	_, err := w.handleRequest(&RequestPayload{})
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Fatalf("expected panic to surface as an error, got %v", err)
+	}
+	if !w.isDead() {
+		t.Fatalf("expected worker to be marked dead after a reader panic")
+	}
+}
+
+func TestWorkerExpiredHonorsJitter(t *testing.T) {
+	start := time.Now()
+	w := &Worker{spawnedAt: start, jitter: 0.1}
+	if w.expired(start.Add(time.Hour)) {
+		t.Fatalf("worker without a max lifetime must never expire")
+	}
+
+	w.SetMaxLifetime(10 * time.Second)
+	if w.expired(start.Add(8900 * time.Millisecond)) {
+		t.Fatalf("expired before lifetime minus jitter")
+	}
+	if !w.expired(start.Add(9 * time.Second)) {
+		t.Fatalf("expected expiry once lifetime minus jitter has passed")
+	}
+}
+
+func TestHandleRetiresWorkerPastMaxLifetime(t *testing.T) {
+	w := newFakeWorker(t, "w0", time.Second)
+	w.spawnedAt = time.Now().Add(-time.Minute)
+	w.SetMaxLifetime(time.Second)
+
+	if _, err := w.Handle(&RequestPayload{ID: "1", Method: "GET", Path: "/"}); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if !w.isDead() {
+		t.Fatalf("expected worker past its max lifetime to be retired after the request")
+	}
+}
+
+func TestHandleRetriesOnlyRetryableRequests(t *testing.T) {
+	brokenWorker := func(sent *bytes.Buffer) *Worker {
+		return &Worker{
+			stdin:          nopWriteCloser{Writer: sent},
+			stdout:         nopReadCloser{}, // pipe broke: EOF before any response
+			requestTimeout: time.Second,
+			phpBinary:      "/nonexistent/php", // a replay has to restart and fails visibly
+		}
+	}
+
+	var sent bytes.Buffer
+	w := brokenWorker(&sent)
+	_, err := w.Handle(&RequestPayload{ID: "1", Method: "POST", Path: "/pay"})
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the broken pipe error for a POST, got %v", err)
+	}
+	if _, err := readFrame(&sent); err != nil {
+		t.Fatalf("expected the POST to be sent once: %v", err)
+	}
+	if sent.Len() != 0 {
+		t.Fatalf("POST was replayed")
+	}
+	if !w.isDead() {
+		t.Fatalf("expected the worker to be marked dead")
+	}
+
+	for _, req := range []*RequestPayload{
+		{ID: "2", Method: "GET", Path: "/"},
+		{ID: "3", Method: "POST", Path: "/pay", Idempotent: true},
+	} {
+		w := brokenWorker(new(bytes.Buffer))
+		if _, err := w.Handle(req); err == nil || errors.Is(err, io.EOF) {
+			t.Fatalf("%s (idempotent=%v): expected a replay attempt, got %v", req.Method, req.Idempotent, err)
+		}
+	}
+}
+
+func TestWorkerDyingMidFrameIsMarkedDead(t *testing.T) {
+	var starts atomic.Int32
+	start := func() (io.WriteCloser, io.ReadCloser, error) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		if starts.Add(1) > 1 {
+			go runFakePHP(stdinR, stdoutW, "php1", 0)
+			return stdinW, stdoutR, nil
+		}
+		// reads the request, then dies between a frame's header and the
+		// end of its body
+		go func() {
+			readFrame(stdinR)
+			stdoutW.Write([]byte{0, 0, 0, 64})
+			stdoutW.Write([]byte(`{"status":`))
+			stdoutW.Close()
+			stdinR.Close()
+		}()
+		return stdinW, stdoutR, nil
+	}
+	w, err := NewWorkerWithConfig(WorkerConfig{MaxRequests: 1000, RequestTimeout: time.Second, Start: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.stop()
+
+	_, err = w.Handle(&RequestPayload{ID: "1", Method: "POST", Path: "/pay"})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || mapWorkerErrorToStatus(err) != 502 {
+		t.Fatalf("expected a 502 for the cut-off frame, got %v", err)
+	}
+	if !w.isDead() {
+		t.Fatal("a worker that died mid-frame was left in rotation")
+	}
+
+	// and is brought back with a fresh process, as the reaper does
+	if restarted, err := w.restartIfDead(); !restarted || err != nil {
+		t.Fatalf("restart: %v, %v", restarted, err)
+	}
+	resp, err := w.Handle(&RequestPayload{ID: "2", Method: "POST", Path: "/pay"})
+	if err != nil || resp.Body != "php1:/pay" {
+		t.Fatalf("expected a restarted worker, got %+v, %v", resp, err)
+	}
+}
+
+func TestRequestPayloadRetryable(t *testing.T) {
+	for method, want := range map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "POST": false, "PUT": false, "DELETE": false, "PATCH": false} {
+		if got := (&RequestPayload{Method: method}).Retryable(); got != want {
+			t.Errorf("%s: Retryable() = %v, want %v", method, got, want)
+		}
+	}
+}
+
+// rawFrame length-prefixes body as a worker would.
+func rawFrame(body string) []byte {
+	frame := []byte{byte(len(body) >> 24), byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(frame, body...)
+}
+
+func TestHandleRequestRejectsMalformedFrames(t *testing.T) {
+	cases := []struct {
+		name     string
+		frame    string
+		wantDead bool
+	}{
+		{"not json", "<br />\nFatal error: oops", true},
+		{"wrong shape", `{"status":"teapot"}`, true},
+		{"absurd status", `{"status":1000,"body":"x"}`, false},
+		{"informational status", `{"status":100}`, false},
+	}
+
+	for _, c := range cases {
+		w := &Worker{
+			stdin:  nopWriteCloser{Writer: io.Discard},
+			stdout: io.NopCloser(bytes.NewReader(rawFrame(c.frame))),
+		}
+		_, err := w.handleRequest(&RequestPayload{})
+		if !errors.Is(err, ErrBadFrame) {
+			t.Fatalf("%s: expected ErrBadFrame, got %v", c.name, err)
+		}
+		if got := mapWorkerErrorToStatus(err); got != 502 {
+			t.Fatalf("%s: status %d, want 502", c.name, got)
+		}
+		if w.isDead() != c.wantDead {
+			t.Fatalf("%s: dead = %v, want %v", c.name, w.isDead(), c.wantDead)
+		}
+	}
+}
+
+func TestHandleRequestDefaultsMissingStatus(t *testing.T) {
+	w := &Worker{
+		stdin:  nopWriteCloser{Writer: io.Discard},
+		stdout: io.NopCloser(bytes.NewReader(rawFrame(`{"body":"ok"}`))),
+	}
+	resp, err := w.handleRequest(&RequestPayload{})
+	if err != nil {
+		t.Fatalf("handleRequest: %v", err)
+	}
+	if resp.Status != 200 {
+		t.Fatalf("missing status should mean 200, got %d", resp.Status)
+	}
+}
+
+func TestDrainingWorkerRecycledOnceByLastRequest(t *testing.T) {
+	for range 100 {
+		w := newFakeWorker(t, "w", time.Second)
+		const n = 8
+
+		for range n {
+			if !w.beginRequest() {
+				t.Fatal("idle worker refused a request")
+			}
+		}
+		w.startDraining()
+		if w.beginRequest() {
+			t.Fatal("draining worker accepted a request")
+		}
+
+		var wg sync.WaitGroup
+		var early atomic.Int32
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// still counted in, so nobody may have recycled it yet
+				if w.isDead() {
+					early.Add(1)
+				}
+				w.endRequest()
+			}()
+		}
+		wg.Wait()
+
+		if early.Load() > 0 {
+			t.Fatalf("worker marked dead under %d in-flight requests", early.Load())
+		}
+		if !w.isDead() || w.getInFlight() != 0 {
+			t.Fatalf("last request out should recycle: dead=%v in flight=%d", w.isDead(), w.getInFlight())
+		}
+	}
+}
+
+func TestConcurrentHandleKeepsWorkerBusyUntilLastRequest(t *testing.T) {
+	w := newFakeWorker(t, "w", time.Second)
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := w.Handle(&RequestPayload{ID: strconv.Itoa(i), Method: "GET", Path: "/"}); err != nil {
+				t.Errorf("Handle: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := w.getState(); got != WorkerIdle || w.getInFlight() != 0 {
+		t.Fatalf("after all requests: state %v, in flight %d", got, w.getInFlight())
+	}
+}
+
+func TestTimeoutDoesNotLeakReader(t *testing.T) {
+	hung := func() *Worker {
+		// stdout stays open and silent, like a killed worker whose pipe
+		// is still held by a child process
+		stdoutR, stdoutW := io.Pipe()
+		t.Cleanup(func() { stdoutW.Close() })
+		return &Worker{
+			stdin:          nopWriteCloser{Writer: io.Discard},
+			stdout:         stdoutR,
+			maxRequests:    1000,
+			requestTimeout: 5 * time.Millisecond,
+		}
+	}
+
+	before := runtime.NumGoroutine()
+	for i := range 20 {
+		if _, err := hung().Handle(&RequestPayload{ID: strconv.Itoa(i), Method: "GET", Path: "/"}); !errors.Is(err, ErrWorkerTimeout) {
+			t.Fatalf("Handle: expected a timeout, got %v", err)
+		}
+		rr := httptest.NewRecorder()
+		if err := hung().Stream(&RequestPayload{ID: strconv.Itoa(i), Method: "GET", Path: "/"}, rr); !errors.Is(err, ErrWorkerTimeout) {
+			t.Fatalf("Stream: expected a timeout, got %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("readers leaked: %d goroutines before, %d after", before, after)
+	}
+}
+
+func TestFindProjectRoot(t *testing.T) {
+	tmp := t.TempDir()
+	if _, err := FindProjectRoot(tmp); !errors.Is(err, ErrNoProjectRoot) {
+		t.Fatalf("expected ErrNoProjectRoot without a go.mod, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module example.com/app"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(tmp, "a", "b")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if root, err := FindProjectRoot(sub); err != nil || root != tmp {
+		t.Fatalf("FindProjectRoot(%s) = %q, %v; want %q", sub, root, err, tmp)
+	}
+}
+
+func TestNewWorkerFailsWithoutWorkerScript(t *testing.T) {
+	tmp := t.TempDir()
+	_, err := NewWorkerWithConfig(WorkerConfig{BaseDir: tmp})
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), filepath.Join(tmp, "php", "worker.php")) {
+		t.Fatalf("expected a missing worker script to be named, got %v", err)
+	}
+}
+
+func TestMissingPHPBinaryFailsWithAdvice(t *testing.T) {
+	dir := newProjectDir(t)
+	notExec := filepath.Join(dir, "php-not-executable")
+	if err := os.WriteFile(notExec, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bin := range []string{"no-such-php-binary", filepath.Join(dir, "missing"), notExec} {
+		_, err := NewWorkerWithConfig(WorkerConfig{PHPBinary: bin, BaseDir: dir})
+		if !errors.Is(err, ErrPHPNotFound) || !strings.Contains(err.Error(), strconv.Quote(bin)) || !strings.Contains(err.Error(), "GO_PHP_BINARY") {
+			t.Fatalf("%s: expected ErrPHPNotFound naming the binary and GO_PHP_BINARY, got %v", bin, err)
+		}
+	}
+}
+
+func TestUnaryRequestTakesStreamedResponse(t *testing.T) {
+	var frames bytes.Buffer
+	writeFrame(&frames, JSONCodec{}, StreamFrame{Type: "headers", Status: 201, Headers: map[string][]string{"Content-Length": {"10"}}})
+	writeFrame(&frames, JSONCodec{}, StreamFrame{Type: "chunk", Data: "hello"})
+	writeFrame(&frames, JSONCodec{}, StreamFrame{Type: "chunk", Data: "world"})
+	writeFrame(&frames, JSONCodec{}, StreamFrame{Type: "end"})
+	var sent bytes.Buffer
+	w := &Worker{stdin: nopWriteCloser{Writer: &sent}, stdout: io.NopCloser(&frames)}
+
+	rec := httptest.NewRecorder()
+	payload := &RequestPayload{ID: "1", Method: "GET", Path: "/download", rw: rec}
+	resp, err := w.handleRequest(payload)
+	if err != nil {
+		t.Fatalf("handleRequest: %v", err)
+	}
+	if !resp.streamed || resp.Status != 201 || !payload.relayed {
+		t.Fatalf("resp = %+v, relayed = %v", resp, payload.relayed)
+	}
+	if rec.Code != 201 || rec.Body.String() != "helloworld" || rec.Header().Get("Content-Length") != "10" {
+		t.Fatalf("client got %d %q, headers %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if !strings.Contains(sent.String(), `"stream_response":true`) {
+		t.Fatalf("the request should allow a streamed response: %q", sent.String())
+	}
+
+	// without a writer to relay to, PHP is not offered the choice
+	sent.Reset()
+	writeFrame(&frames, JSONCodec{}, ResponsePayload{ID: "2", Status: 200, Body: "small"})
+	resp, err = w.handleRequest(&RequestPayload{ID: "2", Method: "GET", Path: "/"})
+	if err != nil || resp.streamed || resp.Body != "small" {
+		t.Fatalf("%+v, %v", resp, err)
+	}
+	if strings.Contains(sent.String(), "stream_response") {
+		t.Fatalf("stream_response sent without a writer: %q", sent.String())
+	}
+}
+
+func TestStreamedUnaryResponseTimesOut(t *testing.T) {
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() { stdoutW.Close() })
+	w := &Worker{
+		stdin:          nopWriteCloser{Writer: io.Discard},
+		stdout:         stdoutR,
+		requestTimeout: 50 * time.Millisecond,
+	}
+	go func() {
+		writeFrame(stdoutW, JSONCodec{}, StreamFrame{Type: "headers", Status: 200})
+		writeFrame(stdoutW, JSONCodec{}, StreamFrame{Type: "chunk", Data: "partial"})
+		// and then it stalls
+	}()
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	_, err := w.handleRequest(&RequestPayload{ID: "1", Method: "GET", Path: "/download", rw: rec})
+	if !errors.Is(err, ErrWorkerTimeout) || !w.isDead() {
+		t.Fatalf("expected a timeout that kills the worker, got %v (dead %v)", err, w.isDead())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the stalled stream held the request for %s", d)
+	}
+	// everything was written before handleRequest returned, so reading
+	// the recorder here doesn't race with the relay
+	if rec.Code != 200 || rec.Body.String() != "partial" {
+		t.Fatalf("client got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStreamTimesOutWithoutWritingAfterReturn(t *testing.T) {
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() { stdoutW.Close() })
+	w := &Worker{
+		stdin:          nopWriteCloser{Writer: io.Discard},
+		stdout:         stdoutR,
+		requestTimeout: 50 * time.Millisecond,
+	}
+	go func() {
+		writeFrame(stdoutW, JSONCodec{}, StreamFrame{Type: "headers", Status: 200})
+		writeFrame(stdoutW, JSONCodec{}, StreamFrame{Type: "chunk", Data: "partial"})
+		// and then it stalls
+	}()
+
+	sw := NewStatusWriter(httptest.NewRecorder())
+	start := time.Now()
+	err := w.Stream(&RequestPayload{ID: "1", Method: "GET", Path: "/events"}, sw)
+	if !errors.Is(err, ErrWorkerTimeout) || !w.isDead() {
+		t.Fatalf("expected a timeout that kills the worker, got %v (dead %v)", err, w.isDead())
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the stalled stream held the request for %s", d)
+	}
+	// the relay is over by now, so the caller may write its own error
+	// response without racing it
+	if !sw.WroteHeader() || sw.Status != 200 || sw.Bytes != int64(len("partial")) {
+		t.Fatalf("client got %d, %d bytes", sw.Status, sw.Bytes)
+	}
+}
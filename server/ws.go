@@ -2,7 +2,7 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
 )
 
@@ -65,7 +65,7 @@ func (h *WSHub) Unsubscribe(channel string, c *WSClient) {
 func (h *WSHub) Publish(channel, msgType string, payload any) {
 	data, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("[ws] marshal error: %v", err)
+		slog.Error("ws publish: marshal failed", "channel", channel, "err", err)
 		return
 	}
 
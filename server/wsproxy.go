@@ -0,0 +1,555 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A WebSocket session runs over the worker's pipe like a streamed response:
+//
+//   - Go sends the upgrade request with RequestPayload.WebSocket set.
+//   - PHP accepts with a 101 "headers" frame, whose headers (say
+//     Sec-WebSocket-Protocol or Set-Cookie) go out with the handshake, or
+//     refuses with any other status, answered like a streamed response
+//     (headers, chunks, end).
+//   - Each client message reaches PHP as a "message" frame, and each
+//     "message" frame PHP sends goes to the client. Binary messages set
+//     StreamFrame.Binary and carry their data base64-encoded.
+//   - When the client leaves, or the worker has to go, Go sends a "close"
+//     frame with the close code in Status and the reason in Data.
+//   - PHP ends the session with an "end" frame, optionally carrying the
+//     close code and reason for the client. "error" ends it with 1011.
+//   - Go sends exactly one "close" frame per session, after which it
+//     writes nothing more; if PHP ended the session first, it answers
+//     with one. PHP reads up to it before taking the next request.
+//
+// "publish" frames may come at any time. A worker that doesn't end the
+// session within WebSocketConfig.CloseTimeout of a close frame is killed.
+
+// DefaultWebSocketCloseTimeout is how long a worker has to end a session
+// after Go closed it, unless WebSocketConfig.CloseTimeout says otherwise.
+const DefaultWebSocketCloseTimeout = 5 * time.Second
+
+// wsWatchInterval is how often a session checks whether its worker is
+// draining or was stopped.
+const wsWatchInterval = time.Second
+
+// wsMaxMessage caps client messages so that, base64-encoded, they still
+// fit in a frame.
+const wsMaxMessage = maxFrameBytes / 2
+
+// WebSocketConfig sets which WebSocket upgrades the Handler proxies to a
+// PHP worker.
+type WebSocketConfig struct {
+	// RoutePrefixes proxy every upgrade whose path starts with one of them.
+	RoutePrefixes []string
+	// CheckOrigin vets the Origin header of an upgrade. nil accepts only
+	// upgrades from the same host.
+	CheckOrigin func(r *http.Request) bool
+	// CloseTimeout is how long a worker gets to end a session once the
+	// client is gone; 0 means DefaultWebSocketCloseTimeout.
+	CloseTimeout time.Duration
+}
+
+// wsProxy is a Server's WebSocket configuration, ready to serve.
+type wsProxy struct {
+	prefixes     []string
+	upgrader     websocket.Upgrader
+	closeTimeout time.Duration
+	watch        time.Duration
+}
+
+// SetWebSocketConfig makes the Handler proxy WebSocket upgrades on the
+// configured routes to a worker, which keeps the connection to itself
+// until it closes. Such a worker takes no other request meanwhile. A
+// session counts toward neither max_requests nor the request timeout; a
+// worker that is drained or stopped closes its session with 1001 (going
+// away).
+func (s *Server) SetWebSocketConfig(cfg WebSocketConfig) {
+	px := &wsProxy{
+		prefixes:     cfg.RoutePrefixes,
+		closeTimeout: cfg.CloseTimeout,
+		watch:        wsWatchInterval,
+	}
+	px.upgrader.CheckOrigin = cfg.CheckOrigin
+	if px.closeTimeout <= 0 {
+		px.closeTimeout = DefaultWebSocketCloseTimeout
+	}
+	s.ws = px
+}
+
+// IsWebSocketRequest reports whether r is a WebSocket upgrade on one of
+// the routes set with SetWebSocketConfig.
+func (s *Server) IsWebSocketRequest(r *http.Request) bool {
+	if s.ws == nil || !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	for _, prefix := range s.ws.prefixes {
+		if prefix != "" && strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DispatchWebSocket hands the upgrade request r, built into req, to a
+// worker and relays messages between it and the client until the session
+// ends. Once the connection is upgraded errors can only be logged; an rw
+// that is a *StatusWriter has status 101 by then.
+func (s *Server) DispatchWebSocket(req *RequestPayload, rw http.ResponseWriter, r *http.Request) error {
+	if s.ws == nil {
+		return errors.New("websocket proxying is not configured")
+	}
+	return s.retryNoWorkers(req, func() error {
+		return s.dispatchPool(req).dispatchWebSocket(req, rw, r, s.ws)
+	})
+}
+
+func (p *WorkerPool) dispatchWebSocket(req *RequestPayload, rw http.ResponseWriter, r *http.Request, px *wsProxy) error {
+	p.growIfSaturated()
+	w := p.pickWorker(req)
+	if w == nil {
+		return ErrNoWorkers
+	}
+	req.traceAttr("php.worker", p.indexOf(w))
+
+	// not recorded in the request metrics: a session's length says
+	// nothing about how fast the worker is
+	w.emit(WorkerEvent{Kind: WorkerRequestStarted, Request: req.ID})
+	start := time.Now()
+	err := w.webSocket(req, rw, r, px)
+	w.emit(WorkerEvent{Kind: WorkerRequestFinished, Request: req.ID, Duration: time.Since(start), Err: err})
+	return err
+}
+
+func (w *Worker) setPinned(pinned bool) {
+	w.stateMu.Lock()
+	w.pinned = pinned
+	w.stateMu.Unlock()
+}
+
+// isPinned reports whether a WebSocket session owns the worker, so it
+// can't be given other requests.
+func (w *Worker) isPinned() bool {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return w.pinned
+}
+
+// expireAfter kills the worker's process unless the returned stop func is
+// called within d. stop reports whether it came too late. d <= 0 never
+// expires.
+func (w *Worker) expireAfter(d time.Duration) (stop func() bool) {
+	if d <= 0 {
+		return func() bool { return false }
+	}
+	t := time.AfterFunc(d, func() {
+		w.markDead()
+		w.killProcess()
+		w.abortRead()
+	})
+	return func() bool { return !t.Stop() }
+}
+
+// webSocket runs a WebSocket session for req on the worker, holding its
+// pipe for as long as the connection lasts.
+func (w *Worker) webSocket(req *RequestPayload, rw http.ResponseWriter, r *http.Request, px *wsProxy) error {
+	if w.isDead() {
+		return w.withStderr(ErrWorkerDead)
+	}
+	if !w.beginRequest() {
+		return ErrWorkerDraining
+	}
+	defer w.endRequest()
+	w.setPinned(true)
+	defer w.setPinned(false)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.isDead() {
+		if err := w.restartLocked(); err != nil {
+			return err
+		}
+		req.traceAttr("php.worker_restarted", true)
+	}
+	if !w.speaks(protoWebSocket) {
+		return fmt.Errorf("%w: WebSocket sessions need protocol %d, the worker speaks %d", ErrProtocolTooOld, protoWebSocket, w.protocol)
+	}
+
+	w.setReading(w.stdout)
+	defer w.setReading(nil)
+
+	s := &wsSession{w: w, codec: w.frameCodec(), headers: req.headerPolicy}
+	req.WebSocket = true
+	if err := writeFrame(w.stdin, s.codec, req); err != nil {
+		w.markDead()
+		return w.withStderr(err)
+	}
+
+	// accepting or refusing is bounded by the request timeout; the
+	// session itself is not
+	timeout := w.timeoutFor(req)
+	stop := w.expireAfter(timeout)
+	accept, err := s.handshake(rw)
+	if stop() {
+		return w.withStderr(fmt.Errorf("%w: no WebSocket handshake after %s", ErrWorkerTimeout, timeout))
+	}
+	if err != nil || accept == nil {
+		return w.withStderr(err)
+	}
+
+	up := px.upgrader
+	up.Error = func(_ http.ResponseWriter, _ *http.Request, status int, reason error) {
+		http.Error(rw, http.StatusText(status), status)
+	}
+	conn, err := up.Upgrade(hijacker(rw), r, wsResponseHeader(guardHeaders(req.headerPolicy, accept.Headers)))
+	if err != nil {
+		// the client got an error; PHP still thinks the session is on
+		s.close(websocket.CloseAbnormalClosure, "upgrade failed", px.closeTimeout)
+		if derr := s.drain(); derr != nil {
+			return w.withStderr(derr)
+		}
+		return err
+	}
+	if sw, ok := rw.(*StatusWriter); ok {
+		sw.Status, sw.wroteHeader = http.StatusSwitchingProtocols, true
+	}
+
+	return w.withStderr(s.relay(conn, px))
+}
+
+// hijacker returns the writer under rw's wrappers that can hand over the
+// connection, or rw if there is none.
+func hijacker(rw http.ResponseWriter) http.ResponseWriter {
+	for {
+		if _, ok := rw.(http.Hijacker); ok {
+			return rw
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return rw
+		}
+		rw = u.Unwrap()
+	}
+}
+
+// wsResponseHeader returns the headers of PHP's 101 frame that may go out
+// with the handshake. Upgrade writes the rest itself.
+func wsResponseHeader(frame map[string][]string) http.Header {
+	h := http.Header{}
+	copyFrameHeaders(h, frame)
+	for k := range h {
+		if strings.HasPrefix(k, "Sec-Websocket-") && k != "Sec-Websocket-Protocol" {
+			h.Del(k)
+		}
+	}
+	return h
+}
+
+// wsSession is one WebSocket session on a worker's pipe. Frames to PHP go
+// through send, as both the client reader and the relay loop write them.
+type wsSession struct {
+	w       *Worker
+	codec   Codec
+	headers *headerPolicy // guards a refusal's headers
+	buf     *[]byte       // the last frame's recycled buffer; see next
+
+	mu       sync.Mutex
+	closing  bool        // the close frame went to PHP; nothing more will
+	stop     func() bool // stops the close timeout; nil until closing
+	timedOut bool        // the close timeout killed the worker
+}
+
+// next reads the next frame from PHP, handing publish frames to the
+// worker's publisher on the way. The body it returns, kept for error
+// logs, is only valid until the following call.
+func (s *wsSession) next() (StreamFrame, []byte, error) {
+	s.w.frames.put(s.buf)
+	s.buf = nil
+	for {
+		body, buf, err := s.w.readFrame(s.w.stdout)
+		if err != nil {
+			s.w.markDead()
+			return StreamFrame{}, nil, err
+		}
+		var frame StreamFrame
+		if err := s.codec.Unmarshal(body, &frame); err != nil {
+			s.w.markDead()
+			return StreamFrame{}, nil, s.w.badFrame(body, err)
+		}
+		if frame.Type == "publish" {
+			s.w.frames.put(buf)
+			s.w.publishFrame(s.w.publisher, frame)
+			continue
+		}
+		s.buf = buf
+		return frame, body, nil
+	}
+}
+
+// handshake reads PHP's answer to the upgrade. It returns the 101 headers
+// frame, or nil once a refusal has been written to rw.
+func (s *wsSession) handshake(rw http.ResponseWriter) (*StreamFrame, error) {
+	frame, body, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	switch frame.Type {
+	case "headers":
+	case "error":
+		return nil, &WorkerError{Status: frame.Status, Message: frame.Error}
+	default:
+		s.w.markDead()
+		return nil, s.w.badFrame(body, fmt.Errorf("expected a headers frame, got %q", frame.Type))
+	}
+	if frame.Status == http.StatusSwitchingProtocols {
+		return &frame, nil
+	}
+
+	if err := checkStatus(&frame.Status); err != nil {
+		s.w.markDead()
+		return nil, s.w.badFrame(body, err)
+	}
+	copyFrameHeaders(rw.Header(), guardHeaders(s.headers, frame.Headers))
+	rw.WriteHeader(frame.Status)
+	data := frame.Data
+	for {
+		if data != "" {
+			if _, err := rw.Write([]byte(data)); err != nil {
+				// the rest of the refusal is abandoned on the pipe
+				s.w.markDead()
+				return nil, err
+			}
+		}
+		frame, body, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		switch frame.Type {
+		case "chunk":
+			data = frame.Data
+		case "end":
+			return nil, nil
+		case "error":
+			return nil, &WorkerError{Status: frame.Status, Message: frame.Error}
+		default:
+			s.w.markDead()
+			return nil, s.w.badFrame(body, fmt.Errorf("unexpected %q frame in a refused WebSocket upgrade", frame.Type))
+		}
+	}
+}
+
+// send writes frame to PHP, unless the session is closing.
+func (s *wsSession) send(frame StreamFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	return writeFrame(s.w.stdin, s.codec, frame)
+}
+
+// close tells PHP to end the session, giving it timeout to do so.
+func (s *wsSession) close(code int, reason string, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return
+	}
+	s.closeLocked(code, reason)
+	s.stop = s.w.expireAfter(timeout)
+}
+
+// closeLocked sends the close frame, the last frame of a session on
+// stdin, so PHP knows where the next request starts.
+func (s *wsSession) closeLocked(code int, reason string) {
+	s.closing = true
+	if err := writeFrame(s.w.stdin, s.codec, StreamFrame{Type: "close", Status: code, Data: reason}); err != nil {
+		s.w.markDead()
+	}
+}
+
+// end records that PHP ended the session, sending the close frame if Go
+// hadn't yet. It reports false if the close timeout killed the worker
+// first.
+func (s *wsSession) end(code int, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopLocked() {
+		return false
+	}
+	if !s.closing {
+		s.closeLocked(code, reason)
+	}
+	return true
+}
+
+// expired reports whether the close timeout killed the worker.
+func (s *wsSession) expired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.stopLocked()
+}
+
+// stopLocked stops the close timeout, reporting false if it already
+// fired.
+func (s *wsSession) stopLocked() bool {
+	if s.stop != nil {
+		s.timedOut = s.stop()
+		s.stop = nil
+	}
+	return !s.timedOut
+}
+
+// drain reads frames until PHP ends a session the client never joined.
+func (s *wsSession) drain() error {
+	for {
+		frame, body, err := s.next()
+		if err != nil {
+			if s.expired() {
+				return fmt.Errorf("%w: WebSocket session not ended after closing", ErrWorkerTimeout)
+			}
+			return err
+		}
+		switch frame.Type {
+		case "message":
+		case "end", "error":
+			s.end(frame.Status, frame.Data)
+			return nil
+		default:
+			s.w.markDead()
+			return s.w.badFrame(body, fmt.Errorf("unexpected %q frame in a WebSocket session", frame.Type))
+		}
+	}
+}
+
+// relay passes messages between conn and PHP until the session ends.
+func (s *wsSession) relay(conn *websocket.Conn, px *wsProxy) error {
+	conn.SetReadLimit(wsMaxMessage)
+
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	defer func() {
+		close(done)
+		_ = conn.Close()
+		<-readerDone
+	}()
+
+	// client -> PHP
+	go func() {
+		defer close(readerDone)
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				code, reason := websocket.CloseAbnormalClosure, ""
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					code, reason = ce.Code, ce.Text
+				}
+				s.close(code, reason, px.closeTimeout)
+				return
+			}
+			frame := StreamFrame{Type: "message", Data: string(data)}
+			if kind == websocket.BinaryMessage {
+				frame.Binary = true
+				frame.Data = base64.StdEncoding.EncodeToString(data)
+			}
+			if err := s.send(frame); err != nil {
+				// the relay loop finds the worker gone too
+				s.w.markDead()
+				s.w.abortRead()
+				return
+			}
+		}
+	}()
+
+	// a worker that is drained or stopped hangs up on the client
+	go func() {
+		t := time.NewTicker(px.watch)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			switch {
+			case s.w.isDead():
+				s.w.killProcess()
+				s.w.abortRead()
+			case s.w.isDraining():
+				s.close(websocket.CloseGoingAway, "server restarting", px.closeTimeout)
+			default:
+				continue
+			}
+			writeClose(conn, websocket.CloseGoingAway, "server restarting")
+			return
+		}
+	}()
+
+	// PHP -> client
+	for {
+		frame, body, err := s.next()
+		if err != nil {
+			writeClose(conn, websocket.CloseInternalServerErr, "")
+			if s.expired() {
+				return fmt.Errorf("%w: WebSocket session not ended %s after closing", ErrWorkerTimeout, px.closeTimeout)
+			}
+			return err
+		}
+
+		switch frame.Type {
+		case "message":
+			kind, data := websocket.TextMessage, []byte(frame.Data)
+			if frame.Binary {
+				kind = websocket.BinaryMessage
+				if data, err = base64.StdEncoding.DecodeString(frame.Data); err != nil {
+					s.w.markDead()
+					writeClose(conn, websocket.CloseInternalServerErr, "")
+					return s.w.badFrame(body, err)
+				}
+			}
+			if err := conn.WriteMessage(kind, data); err != nil {
+				// the reader fails too and closes the session
+				_ = conn.Close()
+			}
+
+		case "end":
+			code := frame.Status
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			if !s.end(code, frame.Data) {
+				continue // the worker is being killed; next fails
+			}
+			writeClose(conn, code, frame.Data)
+			return nil
+
+		case "error":
+			if !s.end(websocket.CloseInternalServerErr, "") {
+				continue
+			}
+			writeClose(conn, websocket.CloseInternalServerErr, "")
+			return &WorkerError{Status: frame.Status, Message: frame.Error}
+
+		default:
+			s.w.markDead()
+			writeClose(conn, websocket.CloseInternalServerErr, "")
+			return s.w.badFrame(body, fmt.Errorf("unexpected %q frame in a WebSocket session", frame.Type))
+		}
+	}
+}
+
+// writeClose sends a close message to the client, if it is still there.
+func writeClose(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWSWorker returns a worker whose fake PHP side accepts WebSocket
+// upgrades, except on /ws/deny, and echoes each message back prefixed
+// with "echo:". The message "bye" makes it end the session with 4000.
+// The close frames it gets are sent on closes, if not nil; with
+// ignoreClose it never answers them. Plain requests get a unary response.
+func newWSWorker(t *testing.T, closes chan<- StreamFrame, ignoreClose bool) *Worker {
+	t.Helper()
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	t.Cleanup(func() {
+		stdinR.Close()
+		stdoutW.Close()
+	})
+
+	send := func(v any) bool {
+		return writeFrame(stdoutW, JSONCodec{}, v) == nil
+	}
+	go func() {
+		for {
+			raw, err := readFrame(stdinR)
+			if err != nil {
+				return
+			}
+			var req RequestPayload
+			if err := json.Unmarshal(raw, &req); err != nil {
+				return
+			}
+			if !req.WebSocket {
+				send(&ResponsePayload{ID: req.ID, Status: 200, Body: "plain:" + req.Path})
+				continue
+			}
+			if req.Path == "/ws/deny" {
+				send(StreamFrame{Type: "headers", Status: 403, Headers: map[string][]string{"X-Why": {"test"}}, Data: "no"})
+				send(StreamFrame{Type: "chunk", Data: " entry"})
+				send(StreamFrame{Type: "end"})
+				continue
+			}
+			send(StreamFrame{Type: "headers", Status: 101, Headers: map[string][]string{"Sec-WebSocket-Protocol": {"chat"}}})
+
+			ended := false
+		session:
+			for {
+				raw, err := readFrame(stdinR)
+				if err != nil {
+					return
+				}
+				var frame StreamFrame
+				if err := json.Unmarshal(raw, &frame); err != nil {
+					return
+				}
+				switch {
+				case frame.Type == "close":
+					if closes != nil {
+						closes <- frame
+					}
+					if ignoreClose {
+						continue
+					}
+					if !ended {
+						send(StreamFrame{Type: "end"})
+					}
+					break session
+				case ended:
+					// sent before Go saw the end; skip up to the close
+				case frame.Data == "bye":
+					send(StreamFrame{Type: "end", Status: 4000, Data: "bye"})
+					ended = true
+				case frame.Binary:
+					data, _ := base64.StdEncoding.DecodeString(frame.Data)
+					frame.Data = base64.StdEncoding.EncodeToString(append([]byte("echo:"), data...))
+					send(frame)
+				default:
+					frame.Data = "echo:" + frame.Data
+					send(frame)
+				}
+			}
+		}
+	}()
+
+	return &Worker{
+		stdin:          stdinW,
+		stdout:         stdoutR,
+		maxRequests:    1000,
+		requestTimeout: time.Second,
+	}
+}
+
+// newWSServer serves a Handler proxying /ws/ upgrades to w.
+func newWSServer(t *testing.T, w *Worker) (*Server, *httptest.Server) {
+	t.Helper()
+	s := &Server{
+		fastPool:   &WorkerPool{workers: []*Worker{w}},
+		slowPool:   &WorkerPool{},
+		routeStats: make(map[string]*routeStats),
+	}
+	s.SetWebSocketConfig(WebSocketConfig{RoutePrefixes: []string{"/ws/"}})
+	ts := httptest.NewServer(NewHandler(s))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func dialWS(t *testing.T, ts *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: []string{"chat"}}
+	return d.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+}
+
+// waitIdle waits for w's session to be over.
+func waitIdle(t *testing.T, w *Worker) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for w.isPinned() || w.getInFlight() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the session never released the worker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebSocketRelaysMessages(t *testing.T) {
+	w := newWSWorker(t, nil, false)
+	_, ts := newWSServer(t, w)
+
+	conn, resp, err := dialWS(t, ts, "/ws/chat")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+		t.Fatalf("the worker's handshake headers were dropped: protocol %q", got)
+	}
+	if !w.isPinned() {
+		t.Fatal("a session should own its worker")
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if kind, data, err := conn.ReadMessage(); err != nil || kind != websocket.TextMessage || string(data) != "echo:hi" {
+		t.Fatalf("text message: %d %q %v", kind, data, err)
+	}
+
+	bin := []byte{0, 0xff, '"', '\n'}
+	if err := conn.WriteMessage(websocket.BinaryMessage, bin); err != nil {
+		t.Fatal(err)
+	}
+	if kind, data, err := conn.ReadMessage(); err != nil || kind != websocket.BinaryMessage || string(data) != "echo:"+string(bin) {
+		t.Fatalf("binary message: %d %q %v", kind, data, err)
+	}
+
+	// the worker ends the session
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != 4000 || ce.Text != "bye" {
+		t.Fatalf("expected the worker's close code, got %v", err)
+	}
+
+	waitIdle(t, w)
+	if w.isDead() || w.requestCount != 0 {
+		t.Fatalf("a session neither kills the worker nor counts as a request: dead=%v requests=%d", w.isDead(), w.requestCount)
+	}
+	// the worker read up to the close frame Go answered its end with
+	after, err := w.Handle(&RequestPayload{ID: "next", Method: "GET", Path: "/after"})
+	if err != nil || after.Body != "plain:/after" {
+		t.Fatalf("request after the session: %+v, %v", after, err)
+	}
+}
+
+func TestWebSocketClientCloseReachesWorker(t *testing.T) {
+	closes := make(chan StreamFrame, 1)
+	w := newWSWorker(t, closes, false)
+	s, ts := newWSServer(t, w)
+
+	conn, _, err := dialWS(t, ts, "/ws/chat")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case frame := <-closes:
+		if frame.Status != websocket.CloseNormalClosure || frame.Data != "done" {
+			t.Fatalf("close frame: %+v", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the worker was not told the client left")
+	}
+
+	// the pipe is clean for the next request
+	waitIdle(t, w)
+	resp, err := s.Dispatch(&RequestPayload{ID: "next", Method: "GET", Path: "/after"})
+	if err != nil || resp.Body != "plain:/after" {
+		t.Fatalf("request after the session: %+v, %v", resp, err)
+	}
+}
+
+func TestWebSocketRefusedUpgrade(t *testing.T) {
+	w := newWSWorker(t, nil, false)
+	_, ts := newWSServer(t, w)
+
+	_, resp, err := dialWS(t, ts, "/ws/deny")
+	if !errors.Is(err, websocket.ErrBadHandshake) {
+		t.Fatalf("expected a failed handshake, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Why") != "test" || string(body) != "no entry" {
+		t.Fatalf("refusal not passed on: %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+	waitIdle(t, w)
+}
+
+func TestWebSocketDrainingWorkerClosesSession(t *testing.T) {
+	closes := make(chan StreamFrame, 1)
+	w := newWSWorker(t, closes, false)
+	s, ts := newWSServer(t, w)
+	s.ws.watch = 5 * time.Millisecond
+
+	conn, _, err := dialWS(t, ts, "/ws/chat")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	w.startDraining()
+
+	if frame := <-closes; frame.Status != websocket.CloseGoingAway {
+		t.Fatalf("worker got close %+v, want 1001", frame)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("client should be told the server is going away, got %v", err)
+	}
+	waitIdle(t, w)
+	if !w.isDead() {
+		t.Fatal("a drained worker is recycled once its session ends")
+	}
+}
+
+func TestWebSocketCloseTimeoutKillsWorker(t *testing.T) {
+	closes := make(chan StreamFrame, 1)
+	w := newWSWorker(t, closes, true)
+	s, ts := newWSServer(t, w)
+	s.ws.closeTimeout = 20 * time.Millisecond
+
+	conn, _, err := dialWS(t, ts, "/ws/chat")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	<-closes
+
+	waitIdle(t, w)
+	if !w.isDead() {
+		t.Fatal("a worker that never ends its session must be killed")
+	}
+}
+
+func TestPinnedWorkerGetsNoRequests(t *testing.T) {
+	p := newFakePool(t, 2, time.Second)
+	pinned := p.workers[0]
+	pinned.setPinned(true)
+
+	for range 4 {
+		if p.NextWorker() == pinned {
+			t.Fatal("round robin handed out a worker owned by a session")
+		}
+	}
+	if p.leastConnections() == pinned {
+		t.Fatal("least connections handed out a worker owned by a session")
+	}
+}